@@ -15,12 +15,15 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
@@ -29,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
@@ -42,10 +46,15 @@ const globalAccountName = DEFAULT_GLOBAL_ACCOUNT
 // Account are subject namespace definitions. By default no messages are shared between accounts.
 // You can share via Exports and Imports of Streams and Services.
 type Account struct {
+	// Here first because of use of atomics, and memory alignment.
+	used         int64 // unix nano of the last lookup, accessed atomically.
 	Name         string
 	Nkey         string
 	Issuer       string
+	nameTag      string
+	tags         jwt.TagList
 	claimJWT     string
+	pendingJWT   string
 	updated      time.Time
 	mu           sync.RWMutex
 	sqmu         sync.Mutex
@@ -53,25 +62,46 @@ type Account struct {
 	ic           *client
 	isid         uint64
 	etmr         *time.Timer
+	gtmr         *time.Timer
 	ctmr         *time.Timer
+	atmr         *time.Timer
 	strack       map[string]sconns
 	nrclients    int32
+	siIdle       int32 // set once service imports were torn down for being idle, accessed atomically.
+	frozen       int32 // set while clients are kept in the expiry grace period, accessed atomically.
 	sysclients   int32
 	nleafs       int32
 	nrleafs      int32
 	clients      map[*client]struct{}
+	traffic      AccountTrafficStats // of clients gone, less that of clients before they were added.
 	rm           map[string]int32
 	lqws         map[string]int32
 	usersRevoked map[string]int64
+	credsRevoked map[string][]int64
+	namespace    string
 	actsRevoked  map[string]int64
+	actsExpired  uint64
 	lleafs       []*client
+	uconns       map[string]int32
+	ctconns      map[string]int32
+	mctconns     map[string]int32
+	msublen      int32
+	userAuth     string
+	ctypes       map[string]struct{}
+	maintenance  bool
+	requireTLS   bool
 	imports      importMap
 	exports      exportMap
 	js           *jsAccount
 	jsLimits     *JetStreamAccountLimits
 	limits
 	expired      bool
+	drainUntil   time.Time
 	incomplete   bool
+	deferred     bool // imports not resolved yet, see lookupAccountWithImports
+	allowLists   bool
+	hdrFilters   bool
+	pending      []PendingImport
 	signingKeys  []string
 	srv          *Server // server this account is registered with (possibly nil)
 	lds          string  // loop detection subject for leaf nodes
@@ -80,6 +110,30 @@ type Account struct {
 	eventIds     *nuid.NUID
 	eventIdsMu   sync.Mutex
 	defaultPerms *Permissions
+	defaultResp  *ResponsePermission
+	jsAPIDeny    []string
+	mappings     []*mapping
+	depWarned    map[deprecatedImport]string // deprecation notes logged, kept when exports are rebuilt.
+}
+
+// deprecatedImport identifies an import of a deprecated export, so that
+// its deprecation note is logged once.
+type deprecatedImport struct {
+	typ      jwt.ExportType
+	export   string
+	importer string
+}
+
+// PendingImport is an import from the account claims that could not be
+// applied because the exporting account has not been loaded yet. It is
+// retried once the exporting account is fetched. While a required import
+// is pending, the account rejects new connections.
+type PendingImport struct {
+	Account  string         `json:"account"`
+	Subject  string         `json:"subject"`
+	To       string         `json:"to,omitempty"`
+	Type     jwt.ExportType `json:"type"`
+	Required bool           `json:"required,omitempty"`
 }
 
 // Account based limits.
@@ -103,10 +157,24 @@ type streamImport struct {
 	prefix  string
 	claim   *jwt.Import
 	invalid bool
+	// filter, if set, narrows the subjects received from the exporting
+	// account to those matching it. It is within from.
+	filter string
+}
+
+// subject returns the subject in the exporting account that this import
+// receives messages on.
+func (im *streamImport) subject() string {
+	if im.filter != _EMPTY_ {
+		return im.filter
+	}
+	return im.from
 }
 
 // Import service mapping struct
 type serviceImport struct {
+	// Here first because of use of atomics, and memory alignment.
+	last        int64 // unix nano of the last request, for configured imports.
 	acc         *Account
 	claim       *jwt.Import
 	se          *serviceExport
@@ -125,6 +193,7 @@ type serviceImport struct {
 	share       bool
 	tracking    bool
 	trackingHdr http.Header // header from request
+	idle        bool        // subscription torn down for lack of requests
 }
 
 // This is used to record when we create a mapping for implicit service
@@ -164,6 +233,10 @@ func (rt ServiceRespType) String() string {
 type exportAuth struct {
 	tokenReq bool
 	approved map[string]*Account
+	// hidden exports are not advertised in listings, but can be imported.
+	hidden bool
+	// deprecated is a note for importers that the export will be removed.
+	deprecated string
 }
 
 // streamExport
@@ -179,6 +252,35 @@ type serviceExport struct {
 	latency    *serviceLatency
 	rtmr       *time.Timer
 	respThresh time.Duration
+	// Accounts allowed to send requests at request time, nil allows all.
+	allowed map[string]struct{}
+	// Headers passed along with requests, nil passes all.
+	hdrs map[string]struct{}
+	// Requests awaiting a response and their maximum, zero for unlimited.
+	inFlight    int32
+	maxInFlight int32
+}
+
+// reserveInFlight counts a request awaiting a response. If enforce is true
+// and the maximum number of requests in flight is reached, the request is
+// not counted and false is returned.
+func (se *serviceExport) reserveInFlight(enforce bool) bool {
+	if se == nil {
+		return true
+	}
+	n := atomic.AddInt32(&se.inFlight, 1)
+	if max := atomic.LoadInt32(&se.maxInFlight); enforce && max > 0 && n > max {
+		atomic.AddInt32(&se.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// releaseInFlight stops counting a request reserved with reserveInFlight.
+func (se *serviceExport) releaseInFlight() {
+	if se != nil {
+		atomic.AddInt32(&se.inFlight, -1)
+	}
 }
 
 // Used to track service latency.
@@ -350,7 +452,10 @@ func (a *Account) clearEventing() {
 	a.nrclients = 0
 	// Now clear state
 	clearTimer(&a.etmr)
+	clearTimer(&a.gtmr)
 	clearTimer(&a.ctmr)
+	clearTimer(&a.atmr)
+	a.pendingJWT = _EMPTY_
 	a.clients = nil
 	a.strack = nil
 	a.mu.Unlock()
@@ -385,6 +490,40 @@ func (a *Account) NumRemoteConnections() int {
 	return nc
 }
 
+// NumExpiredActivations returns the number of imports that have been
+// invalidated because their activation token expired.
+func (a *Account) NumExpiredActivations() uint64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.actsExpired
+}
+
+// PendingImports returns the imports of this account that are waiting on
+// their exporting account to be loaded.
+func (a *Account) PendingImports() []PendingImport {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.pending) == 0 {
+		return nil
+	}
+	pending := make([]PendingImport, len(a.pending))
+	copy(pending, a.pending)
+	return pending
+}
+
+// hasPendingRequiredImports returns true if any required import of this
+// account is waiting on its exporting account.
+func (a *Account) hasPendingRequiredImports() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, pi := range a.pending {
+		if pi.Required {
+			return true
+		}
+	}
+	return false
+}
+
 // NumLocalConnections returns active number of clients for this account
 // on this server.
 func (a *Account) NumLocalConnections() int {
@@ -423,6 +562,131 @@ func (a *Account) MaxTotalConnectionsReached() bool {
 	return mtce
 }
 
+// AccountTrafficStats holds the number of messages and bytes received from
+// and sent to the clients and leafnodes of an account.
+type AccountTrafficStats struct {
+	InMsgs   int64 `json:"in_msgs"`
+	OutMsgs  int64 `json:"out_msgs"`
+	InBytes  int64 `json:"in_bytes"`
+	OutBytes int64 `json:"out_bytes"`
+}
+
+// TrafficStats returns the message and byte counters of the account since
+// the account was created or the counters were last reset.
+func (a *Account) TrafficStats() AccountTrafficStats {
+	ts, live := a.trafficStats()
+	ts.add(live)
+	return ts
+}
+
+// ResetTrafficStats resets the message and byte counters of the account and
+// returns their values prior to the reset.
+func (a *Account) ResetTrafficStats() AccountTrafficStats {
+	ts, live := a.trafficStats()
+	a.mu.Lock()
+	// Clients may have come and gone since, which updated the counters.
+	a.traffic.sub(ts)
+	a.traffic.sub(live)
+	a.mu.Unlock()
+	ts.add(live)
+	return ts
+}
+
+// trafficStats returns the counters of the clients that are gone and the sum
+// of those of the current clients. The counters of the clients are read
+// without holding the account lock, and their traffic is not counted on the
+// account itself, to keep it off the path of messages.
+func (a *Account) trafficStats() (AccountTrafficStats, AccountTrafficStats) {
+	a.mu.RLock()
+	ts := a.traffic
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == CLIENT || c.kind == LEAF {
+			clients = append(clients, c)
+		}
+	}
+	a.mu.RUnlock()
+
+	var live AccountTrafficStats
+	for _, c := range clients {
+		live.add(c.trafficStats())
+	}
+	return ts, live
+}
+
+func (ts *AccountTrafficStats) add(o AccountTrafficStats) {
+	ts.InMsgs += o.InMsgs
+	ts.OutMsgs += o.OutMsgs
+	ts.InBytes += o.InBytes
+	ts.OutBytes += o.OutBytes
+}
+
+func (ts *AccountTrafficStats) sub(o AccountTrafficStats) {
+	ts.InMsgs -= o.InMsgs
+	ts.OutMsgs -= o.OutMsgs
+	ts.InBytes -= o.InBytes
+	ts.OutBytes -= o.OutBytes
+}
+
+// maxConnectionTypeReached returns if we have reached the limit for the
+// number of local connections of the given connection type.
+func (a *Account) maxConnectionTypeReached(ct string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	max, ok := a.mctconns[ct]
+	return ok && a.ctconns[ct] >= max
+}
+
+// hasConnectionTypeLimits returns if any connection type limit is set.
+func (a *Account) hasConnectionTypeLimits() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.mctconns) > 0
+}
+
+// User authentication methods an account can restrict its users to.
+const (
+	accountUserAuthBearer = "bearer"
+	accountUserAuthNonce  = "nonce"
+)
+
+// userAuthAllowed returns if users of the account can authenticate with a
+// bearer token, or by signing the nonce if bearer is false.
+func (a *Account) userAuthAllowed(bearer bool) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	switch a.userAuth {
+	case accountUserAuthBearer:
+		return bearer
+	case accountUserAuthNonce:
+		return !bearer
+	}
+	return true
+}
+
+// maxSubjectLength returns the maximum length of the subject of
+// subscriptions, or jwt.NoLimit if there is none.
+func (a *Account) maxSubjectLength() int32 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.msublen <= 0 {
+		return jwt.NoLimit
+	}
+	return a.msublen
+}
+
+// maxUserConnectionsReached returns if the user has reached the given
+// limit of connections to this account on this server.
+func (a *Account) maxUserConnectionsReached(nkey string, max int32) bool {
+	if max == jwt.NoLimit || nkey == _EMPTY_ {
+		return false
+	}
+	a.mu.RLock()
+	mtce := a.uconns[nkey] >= max
+	a.mu.RUnlock()
+	return mtce
+}
+
 // MaxActiveConnections return the set limit for the account system
 // wide for total number of active connections.
 func (a *Account) MaxActiveConnections() int {
@@ -432,6 +696,39 @@ func (a *Account) MaxActiveConnections() int {
 	return mconns
 }
 
+// EffectiveLimits are the limits that apply to the clients of an account,
+// taking the server configured limits into account. A value of jwt.NoLimit
+// means there is no limit.
+type EffectiveLimits struct {
+	MaxSubscriptions int32 `json:"max_subscriptions"`
+	MaxPayload       int32 `json:"max_payload"`
+	MaxConnections   int32 `json:"max_connections"`
+}
+
+// EffectiveLimits returns the lower of the account limits and the limits
+// configured for the server the account is registered with.
+func (a *Account) EffectiveLimits() EffectiveLimits {
+	a.mu.RLock()
+	el := EffectiveLimits{a.msubs, a.mpay, a.mconns}
+	s := a.srv
+	a.mu.RUnlock()
+	if s == nil {
+		return el
+	}
+	// Options encode unlimited as 0.
+	serverLimit := func(v int64) int32 {
+		if v <= 0 {
+			return jwt.NoLimit
+		}
+		return int32(v)
+	}
+	opts := s.getOpts()
+	minLimit(&el.MaxSubscriptions, serverLimit(int64(opts.MaxSubs)))
+	minLimit(&el.MaxPayload, serverLimit(int64(opts.MaxPayload)))
+	minLimit(&el.MaxConnections, serverLimit(int64(opts.MaxConn)))
+	return el
+}
+
 // MaxTotalLeafNodesReached returns if we have reached our limit for number of leafnodes.
 func (a *Account) MaxTotalLeafNodesReached() bool {
 	a.mu.RLock()
@@ -490,6 +787,27 @@ func (a *Account) TotalSubs() int {
 	return int(a.sl.Count())
 }
 
+// ShadowSubCount returns the number of shadow subscriptions the clients of
+// this account have in the accounts they import streams from.
+func (a *Account) ShadowSubCount() int {
+	a.mu.RLock()
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		clients = append(clients, c)
+	}
+	a.mu.RUnlock()
+
+	var n int
+	for _, c := range clients {
+		c.mu.Lock()
+		for _, sub := range c.subs {
+			n += len(sub.shadow)
+		}
+		c.mu.Unlock()
+	}
+	return n
+}
+
 // SubscriptionInterest returns true if this account has a matching subscription
 // for the given `subject`. Works only for literal subjects.
 // TODO: Add support for wildcards
@@ -512,6 +830,10 @@ func (a *Account) Interest(subject string) int {
 // addClient keeps our accounting of local active clients or leafnodes updated.
 // Returns previous total.
 func (a *Account) addClient(c *client) int {
+	var ts AccountTrafficStats
+	if c.kind == CLIENT || c.kind == LEAF {
+		ts = c.trafficStats()
+	}
 	a.mu.Lock()
 	n := len(a.clients)
 	if a.clients != nil {
@@ -524,6 +846,19 @@ func (a *Account) addClient(c *client) int {
 		} else if c.kind == LEAF {
 			a.nleafs++
 			a.lleafs = append(a.lleafs, c)
+		} else if c.kind == CLIENT && c.pubKey != _EMPTY_ {
+			if a.uconns == nil {
+				a.uconns = make(map[string]int32)
+			}
+			a.uconns[c.pubKey]++
+		}
+		if c.kind == CLIENT || c.kind == LEAF {
+			if a.ctconns == nil {
+				a.ctconns = make(map[string]int32)
+			}
+			a.ctconns[c.connectionType()]++
+			// Only traffic from now on is for this account.
+			a.traffic.sub(ts)
 		}
 	}
 	a.mu.Unlock()
@@ -556,6 +891,10 @@ func (a *Account) removeLeafNode(c *client) {
 
 // removeClient keeps our accounting of local active clients updated.
 func (a *Account) removeClient(c *client) int {
+	var ts AccountTrafficStats
+	if c.kind == CLIENT || c.kind == LEAF {
+		ts = c.trafficStats()
+	}
 	a.mu.Lock()
 	n := len(a.clients)
 	delete(a.clients, c)
@@ -566,6 +905,21 @@ func (a *Account) removeClient(c *client) int {
 		} else if c.kind == LEAF {
 			a.nleafs--
 			a.removeLeafNode(c)
+		} else if uc, ok := a.uconns[c.pubKey]; ok {
+			if uc > 1 {
+				a.uconns[c.pubKey] = uc - 1
+			} else {
+				delete(a.uconns, c.pubKey)
+			}
+		}
+		if c.kind == CLIENT || c.kind == LEAF {
+			ct := c.connectionType()
+			if n := a.ctconns[ct]; n > 1 {
+				a.ctconns[ct] = n - 1
+			} else {
+				delete(a.ctconns, ct)
+			}
+			a.traffic.add(ts)
 		}
 	}
 	a.mu.Unlock()
@@ -592,6 +946,125 @@ func (a *Account) randomClient() *client {
 	return c
 }
 
+// mapping is a subject transform applied to messages published into an account.
+// Wildcards in the source are carried over, in order, to the destination.
+type mapping struct {
+	src  string
+	dest string
+	stok []string
+	dtok []string
+}
+
+// AddMapping will add a subject mapping for this account. Messages published
+// to a subject matching src will be delivered on dest instead. Any wildcards in
+// src need to appear, in the same order, in dest. A mapping for an existing src
+// will be replaced.
+func (a *Account) AddMapping(src, dest string) error {
+	if !IsValidSubject(src) || !IsValidSubject(dest) {
+		return ErrMalformedSubject
+	}
+	stok, dtok := strings.Split(src, tsep), strings.Split(dest, tsep)
+	var swc, dwc []string
+	for _, t := range stok {
+		if t == pwcs || t == fwcs {
+			swc = append(swc, t)
+		}
+	}
+	for _, t := range dtok {
+		if t == pwcs || t == fwcs {
+			dwc = append(dwc, t)
+		}
+	}
+	if !reflect.DeepEqual(swc, dwc) {
+		return fmt.Errorf("mapping destination %q does not match wildcards of source %q", dest, src)
+	}
+	m := &mapping{src: src, dest: dest, stok: stok, dtok: dtok}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, em := range a.mappings {
+		if em.src == src {
+			a.mappings[i] = m
+			return nil
+		}
+	}
+	a.mappings = append(a.mappings, m)
+	return nil
+}
+
+// RemoveMapping will remove the subject mapping for src.
+// Returns true if a mapping was removed.
+func (a *Account) RemoveMapping(src string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, m := range a.mappings {
+		if m.src == src {
+			a.mappings = append(a.mappings[:i], a.mappings[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hasMappings returns true if this account has any subject mappings.
+func (a *Account) hasMappings() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.RLock()
+	n := len(a.mappings)
+	a.mu.RUnlock()
+	return n > 0
+}
+
+// selectMappedSubject returns the subject a message published on subj needs
+// to be delivered on, and whether a mapping was applied.
+func (a *Account) selectMappedSubject(subj string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.mappings) == 0 {
+		return subj, false
+	}
+	tokens := strings.Split(subj, tsep)
+	for _, m := range a.mappings {
+		if dest, ok := m.transform(tokens); ok {
+			return dest, true
+		}
+	}
+	return subj, false
+}
+
+// transform will map the literal subject tokens to the destination
+// if they match the source.
+func (m *mapping) transform(tokens []string) (string, bool) {
+	var wcs []string
+	for i, t := range m.stok {
+		if t == fwcs {
+			if i >= len(tokens) {
+				return _EMPTY_, false
+			}
+			wcs = append(wcs, strings.Join(tokens[i:], tsep))
+			break
+		}
+		if i >= len(tokens) || i == len(m.stok)-1 && len(tokens) != len(m.stok) {
+			return _EMPTY_, false
+		}
+		if t == pwcs {
+			wcs = append(wcs, tokens[i])
+		} else if t != tokens[i] {
+			return _EMPTY_, false
+		}
+	}
+	dest := make([]string, 0, len(m.dtok))
+	for _, t := range m.dtok {
+		if t == pwcs || t == fwcs {
+			t, wcs = wcs[0], wcs[1:]
+		}
+		dest = append(dest, t)
+	}
+	return strings.Join(dest, tsep), true
+}
+
 // AddServiceExport will configure the account with the defined export.
 func (a *Account) AddServiceExport(subject string, accounts []*Account) error {
 	return a.AddServiceExportWithResponse(subject, Singleton, accounts)
@@ -615,9 +1088,9 @@ func (a *Account) AddServiceExportWithResponse(subject string, respType ServiceR
 		se = &serviceExport{}
 	}
 
-	if respType != Singleton {
-		se.respType = respType
-	}
+	// Always set the response type, otherwise re-adding an existing
+	// export as a singleton would keep the previous response type.
+	se.respType = respType
 
 	if accounts != nil {
 		// empty means auth required but will be import token.
@@ -642,88 +1115,358 @@ func (a *Account) AddServiceExportWithResponse(subject string, respType ServiceR
 	return nil
 }
 
-// TrackServiceExport will enable latency tracking of the named service.
-// Results will be published in this account to the given results subject.
-func (a *Account) TrackServiceExport(service, results string) error {
-	return a.TrackServiceExportWithSampling(service, results, DEFAULT_SERVICE_LATENCY_SAMPLING)
-}
-
-// TrackServiceExportWithSampling will enable latency tracking of the named service for the given
-// sampling rate (1-100). Results will be published in this account to the given results subject.
-func (a *Account) TrackServiceExportWithSampling(service, results string, sampling int) error {
+// SetServiceExportAllowedAccounts restricts which importing accounts may send
+// requests to the named service export. This is checked when a request is
+// processed, in addition to any import authorization, and requests from
+// other accounts are dropped. An empty list removes the restriction.
+func (a *Account) SetServiceExportAllowedAccounts(service string, accounts []string) error {
 	if a == nil {
 		return ErrMissingAccount
 	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	if sampling != 0 { // 0 means triggered by header
-		if sampling < 1 || sampling > 100 {
-			return ErrBadSampling
-		}
+	se := a.exports.services[service]
+	if se == nil {
+		return ErrMissingService
 	}
-	if !IsValidPublishSubject(results) {
-		return ErrBadPublishSubject
+	if len(accounts) == 0 {
+		se.allowed = nil
+		return nil
 	}
-	// Don't loop back on outselves.
-	if a.IsExportService(results) {
-		return ErrBadPublishSubject
+	se.allowed = make(map[string]struct{}, len(accounts))
+	for _, acc := range accounts {
+		se.allowed[acc] = struct{}{}
 	}
+	a.allowLists = true
+	return nil
+}
 
-	if a.srv != nil && !a.srv.EventsEnabled() {
-		return ErrNoSysAccount
+// SetServiceExportAllowedHeaders restricts which headers of requests sent to
+// the named service export from other accounts are passed along. Headers not
+// in the list are stripped, so an empty list strips all of them. A nil list
+// removes the restriction.
+func (a *Account) SetServiceExportAllowedHeaders(service string, headers []string) error {
+	if a == nil {
+		return ErrMissingAccount
 	}
-
 	a.mu.Lock()
-	if a.exports.services == nil {
-		a.mu.Unlock()
-		return ErrMissingService
-	}
-	ea, ok := a.exports.services[service]
-	if !ok {
-		a.mu.Unlock()
+	defer a.mu.Unlock()
+
+	se := a.exports.services[service]
+	if se == nil {
 		return ErrMissingService
 	}
-	if ea == nil {
-		ea = &serviceExport{}
-		a.exports.services[service] = ea
-	} else if ea.respType != Singleton {
-		a.mu.Unlock()
-		return ErrBadServiceType
+	if headers == nil {
+		se.hdrs = nil
+		return nil
 	}
-	ea.latency = &serviceLatency{
-		sampling: int8(sampling),
-		subject:  results,
+	se.hdrs = make(map[string]struct{}, len(headers))
+	for _, h := range headers {
+		se.hdrs[http.CanonicalHeaderKey(h)] = struct{}{}
 	}
-	s := a.srv
-	a.mu.Unlock()
+	a.hdrFilters = true
+	return nil
+}
 
-	if s == nil {
-		return nil
+// SetServiceExportMaxInFlight sets the maximum number of requests to the
+// service export that can await a response at the same time. Requests beyond
+// that are rejected, with a no responders status for clients that support
+// it. Zero removes the limit.
+func (a *Account) SetServiceExportMaxInFlight(service string, max int) error {
+	if a == nil {
+		return ErrMissingAccount
 	}
+	if max < 0 {
+		return fmt.Errorf("max in flight requests can not be negative")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	// Now track down the imports and add in latency as needed to enable.
-	s.accounts.Range(func(k, v interface{}) bool {
-		acc := v.(*Account)
-		acc.mu.Lock()
-		for _, im := range acc.imports.services {
-			if im != nil && im.acc.Name == a.Name && subjectIsSubsetMatch(im.to, service) {
-				im.latency = ea.latency
-			}
-		}
-		acc.mu.Unlock()
-		return true
-	})
-
+	se := a.exports.services[service]
+	if se == nil {
+		return ErrMissingService
+	}
+	atomic.StoreInt32(&se.maxInFlight, int32(max))
 	return nil
 }
 
-// UnTrackServiceExport will disable latency tracking of the named service.
-func (a *Account) UnTrackServiceExport(service string) {
-	if a == nil || (a.srv != nil && !a.srv.EventsEnabled()) {
-		return
+// SetExportAdvertised sets whether the stream and service exports of subject
+// are advertised. Exports that are not advertised are left out of listings,
+// such as account info and ExportApprovals, but can still be imported.
+// Exports are advertised by default.
+func (a *Account) SetExportAdvertised(subject string, advertise bool) error {
+	if a == nil {
+		return ErrMissingAccount
 	}
-
 	a.mu.Lock()
-	if a == nil || a.exports.services == nil {
+	defer a.mu.Unlock()
+
+	found := false
+	if se, ok := a.exports.streams[subject]; ok {
+		// Public stream exports may not have an entry.
+		if se == nil {
+			se = &streamExport{}
+			a.exports.streams[subject] = se
+		}
+		se.hidden = !advertise
+		found = true
+	}
+	if se := a.exports.services[subject]; se != nil {
+		se.hidden = !advertise
+		found = true
+	}
+	if !found {
+		return ErrMissingExport
+	}
+	return nil
+}
+
+// SetExportDeprecated sets a note telling importers that the stream and service
+// exports of subject are deprecated. It is logged once for each importing
+// account and reported with its imports, but does not affect them otherwise.
+// An empty note clears it.
+func (a *Account) SetExportDeprecated(subject, note string) error {
+	if a == nil {
+		return ErrMissingAccount
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := false
+	if se, ok := a.exports.streams[subject]; ok {
+		// Public stream exports may not have an entry.
+		if se == nil {
+			se = &streamExport{}
+			a.exports.streams[subject] = se
+		}
+		se.deprecated = note
+		found = true
+	}
+	if se := a.exports.services[subject]; se != nil {
+		se.deprecated = note
+		found = true
+	}
+	if !found {
+		return ErrMissingExport
+	}
+	return nil
+}
+
+// exportAuthFor returns the subject and the export of the given type that
+// subject is imported from. The export is nil if there is none or it is a
+// public stream export without an entry. Of overlapping stream exports the
+// most specific one is used.
+// Lock should be held.
+func (a *Account) exportAuthFor(subject string, typ jwt.ExportType) (string, *exportAuth) {
+	tokens := strings.Split(subject, tsep)
+	var match string
+	found := false
+	if typ == jwt.Service {
+		var mse *serviceExport
+		for subj, se := range a.exports.services {
+			if isSubsetMatch(tokens, subj) && (!found || moreSpecificSubject(subj, match)) {
+				match, mse, found = subj, se, true
+			}
+		}
+		if mse == nil {
+			return match, nil
+		}
+		return match, &mse.exportAuth
+	}
+	var mse *streamExport
+	for subj, se := range a.exports.streams {
+		if isSubsetMatch(tokens, subj) && (!found || moreSpecificSubject(subj, match)) {
+			match, mse, found = subj, se, true
+		}
+	}
+	if mse == nil {
+		return match, nil
+	}
+	return match, &mse.exportAuth
+}
+
+// moreSpecificSubject returns true if subject a matches fewer subjects than
+// b. That is if a is a subset of b or, when neither is, if a has more literal
+// tokens. Otherwise the subjects are compared, so that the order is stable.
+func moreSpecificSubject(a, b string) bool {
+	if aSub, bSub := subjectIsSubsetMatch(a, b), subjectIsSubsetMatch(b, a); aSub != bSub {
+		return aSub
+	}
+	if al, bl := numLiteralTokens(a), numLiteralTokens(b); al != bl {
+		return al > bl
+	}
+	return a < b
+}
+
+// numLiteralTokens returns the number of tokens of subject that are not wildcards.
+func numLiteralTokens(subject string) int {
+	n := 0
+	for _, t := range strings.Split(subject, tsep) {
+		if t != pwcs && t != fwcs {
+			n++
+		}
+	}
+	return n
+}
+
+// exportDeprecation returns the deprecation note of the export of the given
+// type that subject is imported from.
+// Lock should not be held.
+func (a *Account) exportDeprecation(subject string, typ jwt.ExportType) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ea := a.exportAuthFor(subject, typ); ea != nil {
+		return ea.deprecated
+	}
+	return _EMPTY_
+}
+
+// warnDeprecatedImport logs the deprecation note of the export of the given
+// type that importer imports subject from, once per importing account.
+// Lock should not be held.
+func (a *Account) warnDeprecatedImport(importer *Account, subject string, typ jwt.ExportType) {
+	a.mu.Lock()
+	export, ea := a.exportAuthFor(subject, typ)
+	if ea == nil || ea.deprecated == _EMPTY_ {
+		a.mu.Unlock()
+		return
+	}
+	// Warned imports are kept on the account, as exports are rebuilt
+	// whenever claims are applied. A new note is logged again.
+	di := deprecatedImport{typ, export, importer.Name}
+	if a.depWarned[di] == ea.deprecated {
+		a.mu.Unlock()
+		return
+	}
+	if a.depWarned == nil {
+		a.depWarned = make(map[deprecatedImport]string)
+	}
+	a.depWarned[di] = ea.deprecated
+	note, s := ea.deprecated, a.srv
+	a.mu.Unlock()
+
+	if s != nil {
+		s.Warnf("Account %q imports deprecated %s export %q of account %q: %s",
+			importer.Name, typ, subject, a.Name, note)
+	}
+}
+
+// Checks if the requesting account is allowed to send requests to the
+// service export matching subject.
+// Lock should not be held.
+func (a *Account) serviceRequestAllowed(subject, requester string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.allowLists {
+		return true
+	}
+	se := a.getServiceExport(subject)
+	if se == nil || se.allowed == nil {
+		return true
+	}
+	_, ok := se.allowed[requester]
+	return ok
+}
+
+// Returns the headers allowed on requests to the service export matching
+// subject, and false if all headers are allowed.
+// Lock should not be held.
+func (a *Account) serviceAllowedHeaders(subject string) (map[string]struct{}, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.hdrFilters {
+		return nil, false
+	}
+	se := a.getServiceExport(subject)
+	if se == nil || se.hdrs == nil {
+		return nil, false
+	}
+	return se.hdrs, true
+}
+
+// TrackServiceExport will enable latency tracking of the named service.
+// Results will be published in this account to the given results subject.
+func (a *Account) TrackServiceExport(service, results string) error {
+	return a.TrackServiceExportWithSampling(service, results, DEFAULT_SERVICE_LATENCY_SAMPLING)
+}
+
+// TrackServiceExportWithSampling will enable latency tracking of the named service for the given
+// sampling rate (1-100). Results will be published in this account to the given results subject.
+func (a *Account) TrackServiceExportWithSampling(service, results string, sampling int) error {
+	if a == nil {
+		return ErrMissingAccount
+	}
+
+	if sampling != 0 { // 0 means triggered by header
+		if sampling < 1 || sampling > 100 {
+			return ErrBadSampling
+		}
+	}
+	if !IsValidPublishSubject(results) {
+		return ErrBadPublishSubject
+	}
+	// Don't loop back on outselves.
+	if a.IsExportService(results) {
+		return ErrBadPublishSubject
+	}
+
+	if a.srv != nil && !a.srv.EventsEnabled() {
+		return ErrNoSysAccount
+	}
+
+	a.mu.Lock()
+	if a.exports.services == nil {
+		a.mu.Unlock()
+		return ErrMissingService
+	}
+	ea, ok := a.exports.services[service]
+	if !ok {
+		a.mu.Unlock()
+		return ErrMissingService
+	}
+	if ea == nil {
+		ea = &serviceExport{}
+		a.exports.services[service] = ea
+	} else if ea.respType != Singleton {
+		a.mu.Unlock()
+		return ErrBadServiceType
+	}
+	ea.latency = &serviceLatency{
+		sampling: int8(sampling),
+		subject:  results,
+	}
+	s := a.srv
+	a.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	// Now track down the imports and add in latency as needed to enable.
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.Lock()
+		for _, im := range acc.imports.services {
+			if im != nil && im.acc.Name == a.Name && subjectIsSubsetMatch(im.to, service) {
+				im.latency = ea.latency
+			}
+		}
+		acc.mu.Unlock()
+		return true
+	})
+
+	return nil
+}
+
+// UnTrackServiceExport will disable latency tracking of the named service.
+func (a *Account) UnTrackServiceExport(service string) {
+	if a == nil || (a.srv != nil && !a.srv.EventsEnabled()) {
+		return
+	}
+
+	a.mu.Lock()
+	if a == nil || a.exports.services == nil {
 		a.mu.Unlock()
 		return
 	}
@@ -1050,12 +1793,62 @@ func (a *Account) AddServiceImportWithClaim(destination *Account, from, to strin
 		to = from
 	}
 	// First check to see if the account has authorized us to route to the "to" subject.
-	if !destination.checkServiceImportAuthorized(a, to, imClaim) {
+	// An activation token given by URL is fetched first, so that the destination
+	// is not locked while waiting on it.
+	if !destination.checkServiceImportAuthorized(a, to, resolveActivation(imClaim)) {
 		return ErrServiceImportAuthorization
 	}
+	// Make sure following the imports of the destination does not lead back to us.
+	if a.serviceImportFormsCycle(destination, from, to) {
+		return ErrServiceImportCycle
+	}
 
-	_, err := a.addServiceImport(destination, from, to, imClaim)
-	return err
+	if _, err := a.addServiceImport(destination, from, to, imClaim); err != nil {
+		return err
+	}
+	destination.warnDeprecatedImport(a, to, jwt.Service)
+	return nil
+}
+
+// Upper bound of service imports followed when checking for a cycle.
+const maxServiceImportChain = 64
+
+// serviceImportFormsCycle will check if a service import from the subject
+// "from" to the subject "to" in destination would form a cycle. That is,
+// following the service imports of destination, and the ones they point to,
+// leads back to this account and subject.
+// Lock should not be held.
+func (a *Account) serviceImportFormsCycle(destination *Account, from, to string) bool {
+	visited := map[string]struct{}{a.Name + " " + from: {}}
+	acc, subj := destination, to
+	for i := 0; i < maxServiceImportChain; i++ {
+		if _, ok := visited[acc.Name+" "+subj]; ok {
+			return true
+		}
+		visited[acc.Name+" "+subj] = struct{}{}
+		acc.mu.RLock()
+		si := acc.imports.services[subj]
+		if si == nil {
+			for _, esi := range acc.imports.services {
+				if subjectIsSubsetMatch(subj, esi.from) {
+					si = esi
+					break
+				}
+			}
+		}
+		var next *Account
+		var nsubj string
+		if si != nil {
+			next, nsubj = si.acc, si.to
+		}
+		acc.mu.RUnlock()
+		if next == nil {
+			return false
+		}
+		acc, subj = next, nsubj
+	}
+	// Too long a chain, treat as a cycle.
+	return true
 }
 
 // SetServiceImportSharing will allow sharing of information about requests with the export account.
@@ -1142,6 +1935,7 @@ func (a *Account) removeRespServiceImport(si *serviceImport, reason rsiReason) {
 	}
 
 	a.mu.Lock()
+	_, found := a.exports.responses[si.from]
 	delete(a.exports.responses, si.from)
 	dest := si.acc
 	to := si.to
@@ -1149,6 +1943,9 @@ func (a *Account) removeRespServiceImport(si *serviceImport, reason rsiReason) {
 	rc := si.rc
 	a.mu.Unlock()
 
+	if found {
+		si.se.releaseInFlight()
+	}
 	if tracking && rc != nil {
 		a.sendBackendErrorTrackingLatency(si, reason)
 	}
@@ -1290,6 +2087,10 @@ func (a *Account) checkForReverseEntry(reply string, si *serviceImport, checkInt
 			}
 			acc.mu.Unlock()
 
+			if rsi != nil {
+				rsi.se.releaseInFlight()
+			}
+
 			if trackingCleanup {
 				acc.sendReplyInterestLostTrackLatency(rsi)
 			}
@@ -1320,6 +2121,15 @@ func (a *Account) addServiceImport(dest *Account, from, to string, claim *jwt.Im
 	}
 	dest.mu.RUnlock()
 
+	if to == "" {
+		to = from
+	}
+	hasWC := subjectHasWildcard(from)
+
+	// Build the import before taking the lock, so that only installing it
+	// and reserving its subscription id happens while holding it.
+	si := &serviceImport{time.Now().UnixNano(), dest, claim, se, nil, from, to, "", 0, rt, lat, nil, nil, hasWC, false, false, false, false, nil, false}
+
 	a.mu.Lock()
 	if a.imports.services == nil {
 		a.imports.services = make(map[string]*serviceImport)
@@ -1328,17 +2138,14 @@ func (a *Account) addServiceImport(dest *Account, from, to string, claim *jwt.Im
 		return nil, fmt.Errorf("duplicate service import subject %q, previously used in import for account %q, subject %q",
 			from, dup.acc.Name, dup.to)
 	}
-
-	if to == "" {
-		to = from
-	}
-	hasWC := subjectHasWildcard(from)
-
-	si := &serviceImport{dest, claim, se, nil, from, to, "", 0, rt, lat, nil, nil, hasWC, false, false, false, false, nil}
 	a.imports.services[from] = si
+	c, sid, err := a.reserveServiceImportSid(si)
 	a.mu.Unlock()
 
-	if err := a.addServiceImportSub(si); err != nil {
+	if err == nil && c != nil {
+		err = a.subscribeServiceImport(c, si, sid)
+	}
+	if err != nil {
 		a.removeServiceImport(si.from)
 		return nil, err
 	}
@@ -1374,29 +2181,111 @@ func (a *Account) subscribeInternal(subject string, cb msgHandler) (*subscriptio
 // This will add an account subscription that matches the "from" from a service import entry.
 func (a *Account) addServiceImportSub(si *serviceImport) error {
 	a.mu.Lock()
+	c, sid, err := a.reserveServiceImportSid(si)
+	a.mu.Unlock()
+	// No client will happen in parsing when the account has not been properly setup.
+	if err != nil || c == nil {
+		return err
+	}
+	return a.subscribeServiceImport(c, si, sid)
+}
+
+// reserveServiceImportSid assigns the subscription id of the service import
+// and returns the internal client to subscribe with, nil if there is none.
+// Lock should be held.
+func (a *Account) reserveServiceImportSid(si *serviceImport) (*client, string, error) {
 	c := a.internalClient()
-	// This will happen in parsing when the account has not been properly setup.
 	if c == nil {
-		a.mu.Unlock()
-		return nil
+		return nil, _EMPTY_, nil
 	}
 	if si.sid != nil {
-		a.mu.Unlock()
-		return fmt.Errorf("duplicate call to create subscription for service import")
+		return nil, _EMPTY_, fmt.Errorf("duplicate call to create subscription for service import")
 	}
 	a.isid++
 	sid := strconv.FormatUint(a.isid, 10)
 	si.sid = []byte(sid)
-	subject := si.from
-	a.mu.Unlock()
+	return c, sid, nil
+}
 
+// subscribeServiceImport subscribes to the "from" subject of the service import
+// with the sid reserved by reserveServiceImportSid.
+// Lock should not be held.
+func (a *Account) subscribeServiceImport(c *client, si *serviceImport, sid string) error {
 	cb := func(sub *subscription, c *client, subject, reply string, msg []byte) {
 		c.processServiceImport(si, a, msg)
 	}
-	_, err := c.processSub([]byte(subject), nil, []byte(sid), cb, true)
+	_, err := c.processSub([]byte(si.from), nil, []byte(sid), cb, true)
 	return err
 }
 
+// reclaimIdleServiceImports tears down the subscriptions of configured service
+// imports that have not seen a request for longer than timeout. They are
+// reinstated by reinstateIdleServiceImports on the next request, from a
+// client or a leafnode. Leafnodes keep their interest in the imports while
+// they are idle, so that their requests still reach us.
+// Lock should not be held.
+func (a *Account) reclaimIdleServiceImports(timeout time.Duration) {
+	mints := time.Now().UnixNano() - int64(timeout)
+	var sids [][]byte
+	a.mu.Lock()
+	c := a.ic
+	for _, si := range a.imports.services {
+		if si.response || si.idle || si.sid == nil || atomic.LoadInt64(&si.last) > mints {
+			continue
+		}
+		sids = append(sids, si.sid)
+		si.sid = nil
+		si.idle = true
+	}
+	if len(sids) > 0 {
+		atomic.StoreInt32(&a.siIdle, 1)
+	}
+	a.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+	// The subscriptions were not forwarded, so only remove them locally.
+	for _, sid := range sids {
+		c.mu.Lock()
+		sub := c.subs[string(sid)]
+		c.mu.Unlock()
+		if sub != nil {
+			c.unsubscribe(a, sub, true, true)
+		}
+	}
+}
+
+// reinstateIdleServiceImports brings back the subscriptions of idle service
+// imports that subject is published to.
+// Lock should not be held.
+func (a *Account) reinstateIdleServiceImports(subject string) {
+	var sis []*serviceImport
+	a.mu.Lock()
+	idle := false
+	for _, si := range a.imports.services {
+		if !si.idle {
+			continue
+		}
+		if si.from == subject || (si.hasWC && subjectIsSubsetMatch(subject, si.from)) {
+			si.idle = false
+			sis = append(sis, si)
+		} else {
+			idle = true
+		}
+	}
+	if !idle {
+		atomic.StoreInt32(&a.siIdle, 0)
+	}
+	a.mu.Unlock()
+
+	for _, si := range sis {
+		if err := a.addServiceImportSub(si); err != nil {
+			a.srv.Errorf("Error reinstating service import %q of account [%s]: %v", si.from, a.Name, err)
+		}
+	}
+}
+
 // Remove all the subscriptions associated with service imports.
 func (a *Account) removeAllServiceImportSubs() {
 	a.mu.RLock()
@@ -1748,7 +2637,7 @@ func (a *Account) addRespServiceImport(dest *Account, to string, osi *serviceImp
 
 	// dest is the requestor's account. a is the service responder with the export.
 	// Marked as internal here, that is how we distinguish.
-	si := &serviceImport{dest, nil, osi.se, nil, nrr, to, osi.to, 0, rt, nil, nil, nil, false, true, false, osi.share, false, nil}
+	si := &serviceImport{0, dest, nil, osi.se, nil, nrr, to, osi.to, 0, rt, nil, nil, nil, false, true, false, osi.share, false, nil, false}
 
 	if a.exports.responses == nil {
 		a.exports.responses = make(map[string]*serviceImport)
@@ -1779,9 +2668,18 @@ func (a *Account) addRespServiceImport(dest *Account, to string, osi *serviceImp
 
 // AddStreamImportWithClaim will add in the stream import from a specific account with optional token.
 func (a *Account) AddStreamImportWithClaim(account *Account, from, prefix string, imClaim *jwt.Import) error {
+	return a.addStreamImportWithClaim(account, from, prefix, _EMPTY_, imClaim)
+}
+
+// addStreamImportWithClaim is like AddStreamImportWithClaim, with the import
+// filtered from the start, see SetStreamImportFilter.
+func (a *Account) addStreamImportWithClaim(account *Account, from, prefix, filter string, imClaim *jwt.Import) error {
 	if account == nil {
 		return ErrMissingAccount
 	}
+	if filter != _EMPTY_ && !isValidStreamImportFilter(from, filter) {
+		return ErrStreamImportBadFilter
+	}
 
 	// First check to see if the account has authorized export of the subject.
 	if !account.checkStreamImportAuthorized(a, from, imClaim) {
@@ -1801,30 +2699,70 @@ func (a *Account) AddStreamImportWithClaim(account *Account, from, prefix string
 		}
 	}
 	a.mu.Lock()
-	if a.isStreamImportDuplicate(account, from) {
+	if a.isStreamImportDuplicate(account, from, prefix) {
 		a.mu.Unlock()
 		return ErrStreamImportDuplicate
 	}
-	a.imports.streams = append(a.imports.streams, &streamImport{account, from, prefix, imClaim, false})
+	a.imports.streams = append(a.imports.streams, &streamImport{acc: account, from: from, prefix: prefix, claim: imClaim, filter: filter})
 	a.mu.Unlock()
+	account.warnDeprecatedImport(a, from, jwt.Stream)
 	return nil
 }
 
-// isStreamImportDuplicate checks for duplicate.
+// isStreamImportDuplicate checks for duplicate. The same subject can be
+// imported from an account more than once under different prefixes.
 // Lock should be held.
-func (a *Account) isStreamImportDuplicate(acc *Account, from string) bool {
+func (a *Account) isStreamImportDuplicate(acc *Account, from, prefix string) bool {
 	for _, si := range a.imports.streams {
-		if si.acc == acc && si.from == from {
+		if si.acc == acc && si.from == from && si.prefix == prefix {
 			return true
 		}
 	}
 	return false
 }
 
-// AddStreamImport will add in the stream import from a specific account.
-func (a *Account) AddStreamImport(account *Account, from, prefix string) error {
-	return a.AddStreamImportWithClaim(account, from, prefix, nil)
-}
+// SetStreamImportFilter restricts the stream imports of subject from account
+// to the messages whose subject matches filter, which must be within subject.
+// Only those are then sent over from the exporting account. An empty filter
+// receives the whole stream again. Subscriptions that already exist are not
+// updated.
+func (a *Account) SetStreamImportFilter(account *Account, subject, filter string) error {
+	if a == nil || account == nil {
+		return ErrMissingAccount
+	}
+	if filter != _EMPTY_ && !isValidStreamImportFilter(subject, filter) {
+		return ErrStreamImportBadFilter
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Imports are replaced rather than updated, since they are read
+	// without the lock once collected for shadow subscriptions.
+	found := false
+	for i, si := range a.imports.streams {
+		if si.acc == account && si.from == subject {
+			nsi := *si
+			nsi.filter = filter
+			a.imports.streams[i] = &nsi
+			found = true
+		}
+	}
+	if !found {
+		return ErrMissingStreamImport
+	}
+	return nil
+}
+
+// isValidStreamImportFilter returns true if filter is a valid subject within
+// the imported subject.
+func isValidStreamImportFilter(subject, filter string) bool {
+	return IsValidSubject(filter) && subjectIsSubsetMatch(filter, subject)
+}
+
+// AddStreamImport will add in the stream import from a specific account.
+func (a *Account) AddStreamImport(account *Account, from, prefix string) error {
+	return a.AddStreamImportWithClaim(account, from, prefix, nil)
+}
 
 // IsPublicExport is a placeholder to denote a public export.
 var IsPublicExport = []*Account(nil)
@@ -1863,6 +2801,46 @@ func (a *Account) AddStreamExport(subject string, accounts []*Account) error {
 	return nil
 }
 
+// ExportApprovals returns, for each exported stream and service subject
+// that has approved importers, the sorted names of those importing accounts.
+// Exports that are not advertised are omitted.
+func (a *Account) ExportApprovals() map[string][]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// A subject may be exported both as a stream and a service.
+	approved := make(map[string]map[string]struct{})
+	add := func(subject string, ea *exportAuth) {
+		if ea.hidden {
+			return
+		}
+		for name := range ea.approved {
+			if approved[subject] == nil {
+				approved[subject] = make(map[string]struct{})
+			}
+			approved[subject][name] = struct{}{}
+		}
+	}
+	for subject, se := range a.exports.streams {
+		if se != nil {
+			add(subject, &se.exportAuth)
+		}
+	}
+	for subject, se := range a.exports.services {
+		if se != nil {
+			add(subject, &se.exportAuth)
+		}
+	}
+	approvals := make(map[string][]string, len(approved))
+	for subject, names := range approved {
+		for name := range names {
+			approvals[subject] = append(approvals[subject], name)
+		}
+		sort.Strings(approvals[subject])
+	}
+	return approvals
+}
+
 // Check if another account is authorized to import from us.
 func (a *Account) checkStreamImportAuthorized(account *Account, subject string, imClaim *jwt.Import) bool {
 	// Find the subject in the exports list.
@@ -1918,6 +2896,60 @@ func (a *Account) checkStreamExportApproved(account *Account, subject string, im
 	return false
 }
 
+// latencyStreamSubject returns the subject latency results need to be sent
+// to in order to be stored in the named stream. This is the results subject
+// if the stream captures it, otherwise the first literal stream subject.
+func (a *Account) latencyStreamSubject(stream, results string) (string, error) {
+	mset, err := a.LookupStream(stream)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	subjects := mset.Config().Subjects
+	if len(subjects) == 0 {
+		subjects = []string{stream}
+	}
+	for _, subj := range subjects {
+		if subjectIsSubsetMatch(results, subj) {
+			return results, nil
+		}
+	}
+	for _, subj := range subjects {
+		if subjectIsLiteral(subj) {
+			return subj, nil
+		}
+	}
+	return _EMPTY_, fmt.Errorf("stream has no literal subject")
+}
+
+// subjectNamespace returns the subject that all subjects used by clients
+// of the account must be within, or an empty string if there is none.
+func (a *Account) subjectNamespace() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.namespace
+}
+
+// exportCoversSubject returns true if the subject is within the subject of
+// any export of the given type, regardless of who the export is approved for.
+func (a *Account) exportCoversSubject(subject string, typ jwt.ExportType) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if typ == jwt.Stream {
+		for subj := range a.exports.streams {
+			if subjectIsSubsetMatch(subject, subj) {
+				return true
+			}
+		}
+		return false
+	}
+	for subj := range a.exports.services {
+		if subjectIsSubsetMatch(subject, subj) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *Account) checkServiceExportApproved(account *Account, subject string, imClaim *jwt.Import) bool {
 	// Check direct match of subject first
 	se, ok := a.exports.services[subject]
@@ -1995,6 +3027,22 @@ func fetchActivation(url string) string {
 	return string(body)
 }
 
+// resolveActivation returns a copy of the import claim with its activation
+// token inlined when the token is given by URL. Otherwise the claim itself
+// is returned.
+func resolveActivation(claim *jwt.Import) *jwt.Import {
+	if claim == nil || claim.Token == _EMPTY_ {
+		return claim
+	}
+	if url, err := url.Parse(claim.Token); err == nil && url.Scheme != _EMPTY_ {
+		// Create a quick clone so we can inline Token JWT.
+		clone := *claim
+		clone.Token = fetchActivation(url.String())
+		return &clone
+	}
+	return claim
+}
+
 // These are import stream specific versions for when an activation expires.
 func (a *Account) streamActivationExpired(exportAcc *Account, subject string) {
 	a.mu.RLock()
@@ -2002,35 +3050,44 @@ func (a *Account) streamActivationExpired(exportAcc *Account, subject string) {
 		a.mu.RUnlock()
 		return
 	}
-	var si *streamImport
-	for _, si = range a.imports.streams {
-		if si.acc == exportAcc && si.from == subject {
-			break
+	// The same export can be imported under multiple prefixes.
+	var sis []*streamImport
+	for _, si := range a.imports.streams {
+		if si.acc == exportAcc && si.from == subject && !si.invalid {
+			sis = append(sis, si)
 		}
 	}
-
-	if si == nil || si.invalid {
-		a.mu.RUnlock()
-		return
-	}
 	a.mu.RUnlock()
 
-	if si.acc.checkActivation(a, si.claim, false) {
-		// The token has been updated most likely and we are good to go.
+	var expired []*streamImport
+	for _, si := range sis {
+		// The token may have been updated, in which case we are good to go.
+		if !si.acc.checkActivation(a, si.claim, false) {
+			expired = append(expired, si)
+		}
+	}
+	if len(expired) == 0 {
 		return
 	}
 
 	a.mu.Lock()
-	si.invalid = true
+	for _, si := range expired {
+		si.invalid = true
+		a.actsExpired++
+	}
 	clients := make([]*client, 0, len(a.clients))
 	for c := range a.clients {
 		clients = append(clients, c)
 	}
 	awcsti := map[string]struct{}{a.Name: {}}
+	s := a.srv
 	a.mu.Unlock()
 	for _, c := range clients {
 		c.processSubsOnConfigReload(awcsti)
 	}
+	if s != nil {
+		s.sendImportExpiredEvent(a, exportAcc, subject, jwt.Stream)
+	}
 }
 
 // These are import service specific versions for when an activation expires.
@@ -2054,7 +3111,13 @@ func (a *Account) serviceActivationExpired(subject string) {
 
 	a.mu.Lock()
 	si.invalid = true
+	a.actsExpired++
+	s := a.srv
 	a.mu.Unlock()
+
+	if s != nil {
+		s.sendImportExpiredEvent(a, si.acc, subject, jwt.Service)
+	}
 }
 
 // Fires for expired activation tokens. We could track this with timers etc.
@@ -2068,18 +3131,27 @@ func (a *Account) activationExpired(exportAcc *Account, subject string, kind jwt
 	}
 }
 
+// activationTypeMismatch returns true if the inline activation token of the
+// import was issued for a different import type. Tokens given by URL are
+// checked once fetched, in checkActivation.
+func activationTypeMismatch(i *jwt.Import) bool {
+	if i.Token == _EMPTY_ {
+		return false
+	}
+	if u, err := url.Parse(i.Token); err == nil && u.Scheme != _EMPTY_ {
+		return false
+	}
+	act, err := jwt.DecodeActivationClaims(i.Token)
+	return err == nil && act.ImportType != i.Type
+}
+
 // checkActivation will check the activation token for validity.
 func (a *Account) checkActivation(importAcc *Account, claim *jwt.Import, expTimer bool) bool {
 	if claim == nil || claim.Token == "" {
 		return false
 	}
-	// Create a quick clone so we can inline Token JWT.
-	clone := *claim
-
 	// We grab the token from a URL by hand here since we need expiration etc.
-	if url, err := url.Parse(clone.Token); err == nil && url.Scheme != "" {
-		clone.Token = fetchActivation(url.String())
-	}
+	clone := *resolveActivation(claim)
 	vr := jwt.CreateValidationResults()
 	clone.Validate(a.Name, vr)
 	if vr.IsBlocking(true) {
@@ -2089,6 +3161,22 @@ func (a *Account) checkActivation(importAcc *Account, claim *jwt.Import, expTime
 	if err != nil {
 		return false
 	}
+	// The activation has to be issued for the importing account. Otherwise
+	// a token minted for one account could be reused by another.
+	if importAcc == nil || act.Subject != importAcc.Name {
+		if a.srv != nil {
+			a.srv.Errorf("Activation token subject %q does not match importing account %q (subject: %q - type: %q) for account %q",
+				act.Subject, importAcc.GetName(), act.ImportSubject, act.ImportType, a.Name)
+		}
+		return false
+	}
+	if act.ImportType != claim.Type {
+		if a.srv != nil {
+			a.srv.Errorf("Activation token for %s import %q is for a %s import for account %q: %v",
+				claim.Type, act.ImportSubject, act.ImportType, a.Name, ErrActivationTypeMismatch)
+		}
+		return false
+	}
 	if !a.isIssuerClaimTrusted(act) {
 		return false
 	}
@@ -2122,8 +3210,15 @@ func (a *Account) checkActivation(importAcc *Account, claim *jwt.Import, expTime
 // Returns true if the activation claim is trusted. That is the issuer matches
 // the account or is an entry in the signing keys.
 func (a *Account) isIssuerClaimTrusted(claims *jwt.ActivationClaims) bool {
-	// if no issuer account, issuer is the account
+	// if no issuer account, issuer has to be the account
 	if claims.IssuerAccount == "" {
+		if claims.Issuer != a.Name {
+			if a.srv != nil {
+				a.srv.Errorf("Invalid issuer %q in activation claim (subject: %q - type: %q) for account %q",
+					claims.Issuer, claims.Activation.ImportSubject, claims.Activation.ImportType, a.Name)
+			}
+			return false
+		}
 		return true
 	}
 	// If the IssuerAccount is not us, then this is considered an error.
@@ -2134,7 +3229,15 @@ func (a *Account) isIssuerClaimTrusted(claims *jwt.ActivationClaims) bool {
 		}
 		return false
 	}
-	return a.hasIssuerNoLock(claims.Issuer)
+	// The signer has to be the account or one of its current signing keys.
+	if claims.Issuer == a.Name || a.hasIssuerNoLock(claims.Issuer) {
+		return true
+	}
+	if a.srv != nil {
+		a.srv.Errorf("Activation claim (subject: %q - type: %q) for account %q is not signed by a signing key of the account",
+			claims.Activation.ImportSubject, claims.Activation.ImportType, a.Name)
+	}
+	return false
 }
 
 // Returns true if `a` and `b` stream imports are the same. Note that the
@@ -2153,7 +3256,23 @@ func (a *Account) checkStreamImportsEqual(b *Account) bool {
 		bm[bim.acc.Name+bim.from+bim.prefix] = bim
 	}
 	for _, aim := range a.imports.streams {
-		if _, ok := bm[aim.acc.Name+aim.from+aim.prefix]; !ok {
+		if bim, ok := bm[aim.acc.Name+aim.from+aim.prefix]; !ok || bim.filter != aim.filter {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if both accounts import the same services, regardless of the
+// settings of the imports.
+// Lock should be held.
+func (a *Account) checkServiceImportsEqual(b *Account) bool {
+	if len(a.imports.services) != len(b.imports.services) {
+		return false
+	}
+	for from, asi := range a.imports.services {
+		bsi, ok := b.imports.services[from]
+		if !ok || asi.acc.Name != bsi.acc.Name || asi.to != bsi.to {
 			return false
 		}
 	}
@@ -2221,9 +3340,60 @@ func (a *Account) IsExpired() bool {
 func (a *Account) expiredTimeout() {
 	// Mark expired first.
 	a.mu.Lock()
+	wasExpired := a.expired
 	a.expired = true
+	s := a.srv
+	a.mu.Unlock()
+
+	if !wasExpired && s != nil {
+		s.accountExpiryChanged(a, true)
+	}
+
+	// Keep the clients connected but frozen for a while, so that the
+	// account can still be renewed.
+	if s != nil {
+		if grace := s.getOpts().AccountExpiryGrace; grace > 0 {
+			a.mu.Lock()
+			if a.expired && a.gtmr == nil {
+				atomic.StoreInt32(&a.frozen, 1)
+				a.gtmr = time.AfterFunc(grace, a.expiryGraceTimeout)
+			}
+			a.mu.Unlock()
+			s.Noticef("Account [%s] expired, rejecting messages of its clients for %v", a.Name, grace)
+			return
+		}
+	}
+	a.expireClients()
+}
+
+// Called when the expiry grace period of an account has passed.
+func (a *Account) expiryGraceTimeout() {
+	a.mu.Lock()
+	a.gtmr = nil
+	atomic.StoreInt32(&a.frozen, 0)
+	expired := a.expired
 	a.mu.Unlock()
+	if expired {
+		a.expireClients()
+	}
+}
 
+// clearExpiryGrace ends the expiry grace period, if any, leaving the
+// clients connected.
+// Lock should be held.
+func (a *Account) clearExpiryGrace() {
+	clearTimer(&a.gtmr)
+	atomic.StoreInt32(&a.frozen, 0)
+}
+
+// isFrozen returns true if the account expired and its clients are kept
+// connected during the expiry grace period.
+func (a *Account) isFrozen() bool {
+	return atomic.LoadInt32(&a.frozen) == 1
+}
+
+// expireClients disconnects all clients of an expired account.
+func (a *Account) expireClients() {
 	// Collect the clients and expire them.
 	cs := make([]*client, 0, len(a.clients))
 	a.mu.RLock()
@@ -2237,6 +3407,342 @@ func (a *Account) expiredTimeout() {
 	}
 }
 
+// accountDrainWindow is how long new client connections to an account
+// are rejected after the account has been drained.
+const accountDrainWindow = 2 * time.Second
+
+// isDraining returns true if the account has been drained recently.
+func (a *Account) isDraining() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return time.Now().Before(a.drainUntil)
+}
+
+// requiresTLS returns true if the account claims only allow client
+// connections secured with TLS.
+func (a *Account) requiresTLS() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.requireTLS
+}
+
+// inMaintenance returns true if the account claims put it in maintenance,
+// during which new client connections are rejected.
+func (a *Account) inMaintenance() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.maintenance
+}
+
+// DrainAccount will disconnect all clients of the account with the given
+// public key, sending them the given reason first. New client connections
+// to the account are rejected for a brief period. Returns the number of
+// clients that were drained.
+func (s *Server) DrainAccount(pub string, reason string) int {
+	v, ok := s.accounts.Load(pub)
+	if !ok {
+		return 0
+	}
+	a := v.(*Account)
+
+	a.mu.Lock()
+	a.drainUntil = time.Now().Add(accountDrainWindow)
+	cs := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == CLIENT {
+			cs = append(cs, c)
+		}
+	}
+	a.mu.Unlock()
+
+	s.Noticef("Draining %d client(s) of account %s: %s", len(cs), a.Name, reason)
+	for _, c := range cs {
+		c.sendErr(reason)
+		c.closeConnection(AccountDrained)
+	}
+	return len(cs)
+}
+
+// DisconnectClient will disconnect the client connection with the given
+// connection ID from the account with the given public key, sending it the
+// given reason first. Returns true if a matching connection was found and
+// closed.
+func (s *Server) DisconnectClient(pub string, cid uint64, reason string) bool {
+	v, ok := s.accounts.Load(pub)
+	if !ok {
+		return false
+	}
+	a := v.(*Account)
+
+	var kc *client
+	a.mu.RLock()
+	for c := range a.clients {
+		if c.kind == CLIENT && c.cid == cid {
+			kc = c
+			break
+		}
+	}
+	a.mu.RUnlock()
+	if kc == nil {
+		return false
+	}
+
+	if reason == _EMPTY_ {
+		reason = Kicked.String()
+	}
+	s.Noticef("Disconnecting client %d of account %s: %s", cid, a.Name, reason)
+	kc.sendErr(reason)
+	kc.closeConnection(Kicked)
+	return true
+}
+
+// RevalidateClients checks the connected clients of the account against the
+// current state of the account, like an update of the account claims does,
+// without requiring new claims. Clients are disconnected if the account has
+// expired, if they exceed the account connection limit, or if their user or
+// signing key has been revoked or is no longer trusted. Limits are re-applied
+// to the others. Returns the number of clients that were disconnected.
+func (a *Account) RevalidateClients() int {
+	a.mu.RLock()
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == CLIENT || c.kind == LEAF {
+			clients = append(clients, c)
+		}
+	}
+	expired := a.expired
+	a.mu.RUnlock()
+
+	if expired {
+		for _, c := range clients {
+			c.accountAuthExpired()
+		}
+		return len(clients)
+	}
+
+	return a.revalidateClients(clients)
+}
+
+// revalidateClients disconnects the clients that exceed the connection limits
+// of the account, that have been revoked, or whose signing key is no longer
+// trusted. The account limits and permissions are re-applied to the others.
+// Returns the number of clients that were disconnected.
+// Lock should not be held.
+func (a *Account) revalidateClients(clients []*client) int {
+	// Sort if we are over the limit, the newest connections are disconnected first.
+	if a.MaxTotalConnectionsReached() || a.hasConnectionTypeLimits() {
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].start.After(clients[j].start)
+		})
+	}
+
+	decode := jwt.DecodeUserClaims
+	var tagPerms map[string]*Permissions
+	if s := a.srv; s != nil {
+		decode = s.verifyUserClaims
+		tagPerms = s.getOpts().UserTagPermissions
+	}
+	ns := a.subjectNamespace()
+
+	closed := 0
+	ctseen := make(map[string]int32)
+	for i, c := range clients {
+		a.mu.RLock()
+		exceeded := a.mconns != jwt.NoLimit && i >= int(a.mconns)
+		if c.kind == CLIENT || c.kind == LEAF {
+			ct := c.connectionType()
+			ctseen[ct]++
+			if max, ok := a.mctconns[ct]; ok && ctseen[ct] > max {
+				exceeded = true
+			}
+		}
+		a.mu.RUnlock()
+		if exceeded {
+			c.maxAccountConnExceeded()
+			closed++
+			continue
+		}
+		c.mu.Lock()
+		c.applyAccountLimits()
+		theJWT := c.opts.JWT
+		var sk string
+		if c.user != nil {
+			sk = c.user.SigningKey
+		}
+		c.mu.Unlock()
+		if theJWT != _EMPTY_ {
+			juc, err := decode(theJWT)
+			if err != nil {
+				c.Debugf("User JWT not valid: %v", err)
+				c.authViolation()
+				closed++
+				continue
+			} else if a.checkUserRevoked(juc.Subject, juc.IssuedAt) {
+				c.sendErrAndDebug("User Authentication Revoked")
+				c.closeConnection(Revocation)
+				closed++
+				continue
+			} else if juc.IssuerAccount != _EMPTY_ && a.checkSigningKeyRevoked(juc.Issuer, juc.IssuedAt) {
+				// The signing key that issued this user has been revoked.
+				c.sendErrAndDebug("Authorization Revoked")
+				c.closeConnection(Revocation)
+				closed++
+				continue
+			}
+			// Default permissions may have changed. Only rebuild the client's
+			// permissions if its effective permissions did.
+			perms := buildInternalNkeyUser(juc, nil, a).Permissions
+			perms = mergeTagPermissions(perms, juc.Tags, tagPerms)
+			var cns string
+			if c.kind == CLIENT {
+				cns = ns
+			}
+			c.mu.Lock()
+			if c.updatePermissions(perms, cns) {
+				c.Debugf("Permissions updated")
+			}
+			c.mu.Unlock()
+		}
+		if sk != _EMPTY_ && !a.hasIssuer(sk) {
+			c.closeConnection(AuthenticationViolation)
+			closed++
+		}
+	}
+	return closed
+}
+
+// ExportClaims reconstructs account claims from the exports, imports and
+// limits currently applied to the account. This can be used to verify what
+// the server is actually enforcing versus the claims that were pushed.
+// The returned claims are not signed.
+func (a *Account) ExportClaims() *jwt.AccountClaims {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	ac := jwt.NewAccountClaims(a.Name)
+	ac.Issuer = a.Issuer
+	ac.Name = a.nameTag
+	ac.Tags = append(ac.Tags, a.tags...)
+
+	for subj, se := range a.exports.streams {
+		e := &jwt.Export{Subject: jwt.Subject(subj), Type: jwt.Stream}
+		if se != nil {
+			e.TokenReq = se.tokenReq
+		}
+		ac.Exports = append(ac.Exports, e)
+	}
+	for subj, se := range a.exports.services {
+		e := &jwt.Export{Subject: jwt.Subject(subj), Type: jwt.Service}
+		if se != nil {
+			e.TokenReq = se.tokenReq
+			switch se.respType {
+			case Streamed:
+				e.ResponseType = jwt.ResponseTypeStream
+			case Chunked:
+				e.ResponseType = jwt.ResponseTypeChunked
+			default:
+				e.ResponseType = jwt.ResponseTypeSingleton
+			}
+			if se.respThresh != DEFAULT_SERVICE_EXPORT_RESPONSE_THRESHOLD {
+				e.ResponseThreshold = se.respThresh
+			}
+			if se.latency != nil {
+				e.Latency = &jwt.ServiceLatency{
+					Sampling: int(se.latency.sampling),
+					Results:  jwt.Subject(se.latency.subject),
+				}
+			}
+		}
+		ac.Exports = append(ac.Exports, e)
+	}
+	sort.Slice(ac.Exports, func(i, j int) bool {
+		return ac.Exports[i].Subject < ac.Exports[j].Subject
+	})
+
+	for _, si := range a.imports.streams {
+		im := &jwt.Import{
+			Subject: jwt.Subject(si.from),
+			Account: si.acc.Name,
+			To:      jwt.Subject(strings.TrimSuffix(si.prefix, tsep)),
+			Type:    jwt.Stream,
+		}
+		if si.claim != nil {
+			im.Name, im.Token = si.claim.Name, si.claim.Token
+		}
+		ac.Imports = append(ac.Imports, im)
+	}
+	for _, si := range a.imports.services {
+		// Skip the response mappings, those are not part of the claims.
+		if si.response {
+			continue
+		}
+		im := &jwt.Import{
+			Subject: jwt.Subject(si.from),
+			Account: si.acc.Name,
+			Type:    jwt.Service,
+		}
+		if si.to != si.from {
+			im.To = jwt.Subject(si.to)
+		}
+		if si.claim != nil {
+			im.Name, im.Token = si.claim.Name, si.claim.Token
+		}
+		ac.Imports = append(ac.Imports, im)
+	}
+	sort.Slice(ac.Imports, func(i, j int) bool {
+		if ac.Imports[i].Subject != ac.Imports[j].Subject {
+			return ac.Imports[i].Subject < ac.Imports[j].Subject
+		}
+		return ac.Imports[i].Account < ac.Imports[j].Account
+	})
+
+	ac.Limits.Subs = int64(a.msubs)
+	ac.Limits.Payload = int64(a.mpay)
+	ac.Limits.Conn = int64(a.mconns)
+	ac.Limits.LeafNodeConn = int64(a.mleafs)
+	// JetStream is disabled for the account unless limits were applied.
+	if a.jsLimits != nil {
+		ac.Limits.JetStreamLimits = jwt.JetStreamLimits{
+			MemoryStorage: a.jsLimits.MaxMemory,
+			DiskStorage:   a.jsLimits.MaxStore,
+			Streams:       int64(a.jsLimits.MaxStreams),
+			Consumer:      int64(a.jsLimits.MaxConsumers),
+		}
+	} else {
+		ac.Limits.JetStreamLimits = jwt.JetStreamLimits{}
+	}
+
+	ac.SigningKeys = append(ac.SigningKeys, a.signingKeys...)
+	if len(a.usersRevoked) > 0 {
+		ac.Revocations = make(jwt.RevocationList, len(a.usersRevoked))
+		for pk, t := range a.usersRevoked {
+			ac.Revocations[pk] = t
+		}
+	}
+	return ac
+}
+
+// schedulePendingClaims will apply claimJWT to the account once d has passed,
+// replacing any update already pending.
+// Lock should be held
+func (a *Account) schedulePendingClaims(s *Server, claimJWT string, d time.Duration) {
+	clearTimer(&a.atmr)
+	a.pendingJWT = claimJWT
+	a.atmr = time.AfterFunc(d, func() {
+		a.mu.Lock()
+		if a.pendingJWT != claimJWT {
+			a.mu.Unlock()
+			return
+		}
+		a.pendingJWT = _EMPTY_
+		a.atmr = nil
+		a.mu.Unlock()
+		if err := s.updateAccountWithClaimJWT(a, claimJWT); err != nil {
+			s.Errorf("Scheduled update of account [%s] resulted in error: %v", a.Name, err)
+		}
+	})
+}
+
 // Sets the expiration timer for an account JWT that has it set.
 func (a *Account) setExpirationTimer(d time.Duration) {
 	a.etmr = time.AfterFunc(d, a.expiredTimeout)
@@ -2256,6 +3762,12 @@ func (a *Account) clearExpirationTimer() bool {
 func (a *Account) checkUserRevoked(nkey string, issuedAt int64) bool {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
+	if isCredentialRevoked(a.credsRevoked, nkey, issuedAt) {
+		return true
+	}
+	if a.srv != nil && a.srv.isExternallyRevoked(nkey, issuedAt) {
+		return true
+	}
 	if a.usersRevoked == nil {
 		return false
 	}
@@ -2265,24 +3777,146 @@ func (a *Account) checkUserRevoked(nkey string, issuedAt int64) bool {
 	return true
 }
 
+// checkSigningKeyRevoked will check if the signing key that issued a user
+// has been revoked. Revocations of signing keys share the account revocation
+// list with users, so only users issued at or before the revocation are affected.
+func (a *Account) checkSigningKeyRevoked(signingKey string, issuedAt int64) bool {
+	return a.checkUserRevoked(signingKey, issuedAt)
+}
+
+// startServiceImportReclaimer periodically tears down the subscriptions of
+// service imports that have been idle for longer than timeout.
+func (s *Server) startServiceImportReclaimer(timeout time.Duration) {
+	quit := s.quitCh
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			s.accounts.Range(func(_, v interface{}) bool {
+				v.(*Account).reclaimIdleServiceImports(timeout)
+				return true
+			})
+		}
+	})
+}
+
+// isExternallyRevoked will check if a user has been revoked by the list
+// polled from the revocations URL.
+func (s *Server) isExternallyRevoked(nkey string, issuedAt int64) bool {
+	s.revMu.RLock()
+	t, ok := s.revoked[nkey]
+	s.revMu.RUnlock()
+	return ok && t >= issuedAt
+}
+
+// startRevocationsPoller periodically fetches the revocation list from revURL,
+// disconnecting users that it newly revokes.
+func (s *Server) startRevocationsPoller(revURL string, interval time.Duration) {
+	c := &http.Client{Timeout: fetchTimeout}
+	quit := s.quitCh
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := s.pollRevocations(c, revURL); err != nil {
+				s.Warnf("Error polling revocations from %q: %v", revURL, err)
+			}
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// pollRevocations fetches the revocation list from revURL and applies it.
+func (s *Server) pollRevocations(c *http.Client, revURL string) error {
+	resp, err := c.Get(revURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var revoked map[string]int64
+	if err := json.NewDecoder(resp.Body).Decode(&revoked); err != nil {
+		return err
+	}
+	s.revMu.Lock()
+	changed := !reflect.DeepEqual(s.revoked, revoked)
+	s.revoked = revoked
+	s.revMu.Unlock()
+	if !changed {
+		return nil
+	}
+	s.Debugf("Applying %d polled revocations", len(revoked))
+	s.accounts.Range(func(_, v interface{}) bool {
+		v.(*Account).closeRevokedClients()
+		return true
+	})
+	return nil
+}
+
+// closeRevokedClients will close the connections of users that are revoked.
+// Returns the number of connections closed.
+// Lock should not be held.
+func (a *Account) closeRevokedClients() int {
+	a.mu.RLock()
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		clients = append(clients, c)
+	}
+	a.mu.RUnlock()
+
+	closed := 0
+	for _, c := range clients {
+		c.mu.Lock()
+		juc := c.uclaims
+		c.mu.Unlock()
+		if juc == nil {
+			continue
+		}
+		if a.checkUserRevoked(juc.Subject, juc.IssuedAt) {
+			c.sendErrAndDebug("User Authentication Revoked")
+			c.closeConnection(Revocation)
+			closed++
+		}
+	}
+	return closed
+}
+
 // Check expiration and set the proper state as needed.
-func (a *Account) checkExpiration(claims *jwt.ClaimsData) {
+// Returns true if the expired state of the account changed.
+func (a *Account) checkExpiration(claims *jwt.ClaimsData) bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	wasExpired := a.expired
 	a.clearExpirationTimer()
 	if claims.Expires == 0 {
 		a.expired = false
-		return
+		a.clearExpiryGrace()
+		return wasExpired
 	}
 	tn := time.Now().Unix()
 	if claims.Expires <= tn {
 		a.expired = true
-		return
+		return !wasExpired
 	}
 	expiresAt := time.Duration(claims.Expires - tn)
 	a.setExpirationTimer(expiresAt * time.Second)
 	a.expired = false
+	a.clearExpiryGrace()
+	return wasExpired
 }
 
 // hasIssuer returns true if the issuer matches the account
@@ -2294,57 +3928,303 @@ func (a *Account) hasIssuer(issuer string) bool {
 	return hi
 }
 
-// hasIssuerNoLock is the unlocked version of hasIssuer
-func (a *Account) hasIssuerNoLock(issuer string) bool {
-	// same issuer
-	if a.Issuer == issuer {
-		return true
+// hasIssuerNoLock is the unlocked version of hasIssuer
+func (a *Account) hasIssuerNoLock(issuer string) bool {
+	// same issuer
+	if a.Issuer == issuer {
+		return true
+	}
+	for i := 0; i < len(a.signingKeys); i++ {
+		if a.signingKeys[i] == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the loop detection subject used for leafnodes
+func (a *Account) getLDSubject() string {
+	a.mu.RLock()
+	lds := a.lds
+	a.mu.RUnlock()
+	return lds
+}
+
+// Placeholder for signaling token auth required.
+var tokenAuthReq = []*Account{}
+
+func authAccounts(tokenReq bool) []*Account {
+	if tokenReq {
+		return tokenAuthReq
+	}
+	return nil
+}
+
+// SetAccountResolver will assign the account resolver.
+func (s *Server) SetAccountResolver(ar AccountResolver) {
+	s.mu.Lock()
+	s.accResolver = ar
+	s.mu.Unlock()
+}
+
+// AccountResolver returns the registered account resolver.
+func (s *Server) AccountResolver() AccountResolver {
+	s.mu.Lock()
+	ar := s.accResolver
+	s.mu.Unlock()
+	return ar
+}
+
+// SwapAccountResolver replaces the account resolver of a running server. If
+// migrate is true, the JWTs of the accounts currently loaded are stored with
+// the new resolver before it is put in place, so that lookups do not fail
+// during the swap. The new resolver is started if the server is running and
+// the previous one is closed.
+func (s *Server) SwapAccountResolver(ar AccountResolver, migrate bool) error {
+	if ar == nil {
+		return ErrNoAccountResolver
+	}
+	s.accResolverMu.Lock()
+	defer s.accResolverMu.Unlock()
+
+	s.mu.Lock()
+	old := s.accResolver
+	running := s.running
+	s.mu.Unlock()
+	if ar == old {
+		return nil
+	}
+
+	var migrated map[string]string
+	if migrate {
+		if ar.IsReadOnly() {
+			return fmt.Errorf("can not migrate accounts to a read only resolver")
+		}
+		migrated = s.loadedAccountJWTs()
+		for name, claimJWT := range migrated {
+			if err := ar.Store(name, claimJWT); err != nil {
+				return fmt.Errorf("migrating account %q: %v", name, err)
+			}
+		}
+	}
+	if running {
+		if err := ar.Start(s); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.accResolver = ar
+	s.mu.Unlock()
+
+	// Claims updated while migrating were stored with the previous resolver.
+	if migrate {
+		for name, claimJWT := range s.loadedAccountJWTs() {
+			if migrated[name] == claimJWT {
+				continue
+			}
+			if err := ar.Store(name, claimJWT); err != nil {
+				s.Warnf("Error migrating account %q to the new resolver: %v", name, err)
+			}
+		}
+	}
+	// Directory resolvers stop answering on the system account.
+	switch r := old.(type) {
+	case *DirAccResolver:
+		r.unsubscribe()
+	case *CacheDirAccResolver:
+		r.unsubscribe()
+	}
+	if old != nil {
+		old.Close()
+	}
+	s.Noticef("Swapped %s account resolver for %s, migrated %d account(s)",
+		accResolverType(old), accResolverType(ar), len(migrated))
+	return nil
+}
+
+// loadedAccountJWTs returns the JWTs of the accounts backed by claims,
+// keyed by account name.
+func (s *Server) loadedAccountJWTs() map[string]string {
+	jwts := make(map[string]string)
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		if acc.isClaimAccount() {
+			jwts[k.(string)] = acc.claimJWT
+		}
+		acc.mu.RUnlock()
+		return true
+	})
+	return jwts
+}
+
+// isClaimAccount returns if this account is backed by a JWT claim.
+// Lock should be held.
+func (a *Account) isClaimAccount() bool {
+	return a.claimJWT != ""
+}
+
+// AccountAdmissionHandler is invoked before account claims are applied.
+// Returning an error rejects the claims and leaves the account unchanged.
+type AccountAdmissionHandler func(*jwt.AccountClaims) error
+
+// SetAccountAdmissionHandler will assign the handler used to admit
+// account claims before they are applied. Passing nil removes it.
+func (s *Server) SetAccountAdmissionHandler(h AccountAdmissionHandler) {
+	s.mu.Lock()
+	s.accAdmission = h
+	s.mu.Unlock()
+}
+
+// admitAccountClaims runs the account admission handler, if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) admitAccountClaims(ac *jwt.AccountClaims) error {
+	s.mu.Lock()
+	h := s.accAdmission
+	s.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h(ac)
+}
+
+// checkDuplicateExports returns an error if the claims list the same subject
+// more than once for exports of the same type. Which of those would be applied
+// depends on the order they are processed in.
+func checkDuplicateExports(ac *jwt.AccountClaims) error {
+	seen := make(map[string]*jwt.Export, len(ac.Exports))
+	for _, e := range ac.Exports {
+		if e == nil {
+			continue
+		}
+		key := e.Type.String() + " " + string(e.Subject)
+		prev, ok := seen[key]
+		if !ok {
+			seen[key] = e
+			continue
+		}
+		if prev.TokenReq != e.TokenReq {
+			return fmt.Errorf("%s export %q listed more than once with conflicting token requirements", e.Type, e.Subject)
+		}
+		return fmt.Errorf("%s export %q listed more than once", e.Type, e.Subject)
+	}
+	return nil
+}
+
+// AccountUpdate describes account claims that were applied to an account.
+type AccountUpdate struct {
+	// Account is the public key of the account.
+	Account string
+	// IssuedAt is when the applied claims were issued.
+	IssuedAt time.Time
+	// ImportsChanged, ExportsChanged, LimitsChanged and SigningKeysChanged
+	// tell which parts of the account changed with the claims.
+	ImportsChanged     bool
+	ExportsChanged     bool
+	LimitsChanged      bool
+	SigningKeysChanged bool
+}
+
+// Number of account updates kept for AccountUpdateChan. Once full, the
+// oldest update is dropped to make room for a new one.
+const accountUpdateChanLen = 256
+
+// AccountUpdateChan returns a channel receiving an AccountUpdate each time
+// claims are applied to an account. Updates are dropped, oldest first, if
+// they are not received fast enough, so that updating accounts never blocks.
+// The same channel is returned on every call.
+func (s *Server) AccountUpdateChan() <-chan AccountUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accUpdates == nil {
+		s.accUpdates = make(chan AccountUpdate, accountUpdateChanLen)
+	}
+	return s.accUpdates
+}
+
+// sendAccountUpdate delivers the update to the channel returned by
+// AccountUpdateChan, if there is one, dropping the oldest update if full.
+// Lock MUST NOT be held upon entry.
+func (s *Server) sendAccountUpdate(u AccountUpdate) {
+	s.mu.Lock()
+	ch := s.accUpdates
+	s.mu.Unlock()
+	if ch == nil {
+		return
 	}
-	for i := 0; i < len(a.signingKeys); i++ {
-		if a.signingKeys[i] == issuer {
-			return true
+	for {
+		select {
+		case ch <- u:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
 		}
 	}
-	return false
-}
-
-// Returns the loop detection subject used for leafnodes
-func (a *Account) getLDSubject() string {
-	a.mu.RLock()
-	lds := a.lds
-	a.mu.RUnlock()
-	return lds
 }
 
-// Placeholder for signaling token auth required.
-var tokenAuthReq = []*Account{}
+// AccountExpiryHandler is invoked when an account expires, or when an
+// expired account is renewed by new claims.
+type AccountExpiryHandler func(acc *Account, expired bool)
 
-func authAccounts(tokenReq bool) []*Account {
-	if tokenReq {
-		return tokenAuthReq
-	}
-	return nil
+// SetAccountExpiryHandler will assign the handler invoked when the expired
+// state of an account changes. Passing nil removes it.
+func (s *Server) SetAccountExpiryHandler(h AccountExpiryHandler) {
+	s.mu.Lock()
+	s.accExpiry = h
+	s.mu.Unlock()
 }
 
-// SetAccountResolver will assign the account resolver.
-func (s *Server) SetAccountResolver(ar AccountResolver) {
+// accountExpiryChanged runs the account expiry handler, if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) accountExpiryChanged(a *Account, expired bool) {
 	s.mu.Lock()
-	s.accResolver = ar
+	h := s.accExpiry
 	s.mu.Unlock()
+	if h != nil {
+		h(a, expired)
+	}
 }
 
-// AccountResolver returns the registered account resolver.
-func (s *Server) AccountResolver() AccountResolver {
+// Sources of the account JWTs stored by an account resolver.
+const (
+	// ResolverStorePush is an account JWT pushed as an update.
+	ResolverStorePush = "push"
+	// ResolverStoreSync is an account JWT received while syncing with
+	// other servers.
+	ResolverStoreSync = "sync"
+	// ResolverStorePreload is an account JWT from the resolver preloads.
+	ResolverStorePreload = "preload"
+)
+
+// ResolverStoreHandler is invoked after the account resolver stored the
+// account JWT of the account with the given public key. The source is one
+// of ResolverStorePush, ResolverStoreSync or ResolverStorePreload.
+type ResolverStoreHandler func(pub, jwt, source string)
+
+// SetResolverStoreHandler will assign the handler invoked after the account
+// resolver stored an account JWT, for instance for audit logging. Preloads
+// are stored while the server is created, so a handler set afterwards is
+// only told about them when they are stored again on reload. Passing nil
+// removes it.
+func (s *Server) SetResolverStoreHandler(h ResolverStoreHandler) {
 	s.mu.Lock()
-	ar := s.accResolver
+	s.resolverStore = h
 	s.mu.Unlock()
-	return ar
 }
 
-// isClaimAccount returns if this account is backed by a JWT claim.
-// Lock should be held.
-func (a *Account) isClaimAccount() bool {
-	return a.claimJWT != ""
+// resolverStored runs the resolver store handler, if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) resolverStored(pub, jwt, source string) {
+	s.mu.Lock()
+	h := s.resolverStore
+	s.mu.Unlock()
+	if h != nil {
+		h(pub, jwt, source)
+	}
 }
 
 // updateAccountClaims will update an existing account with new claims.
@@ -2357,13 +4237,25 @@ func (s *Server) UpdateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 // updateAccountClaimsWithRefresh will update an existing account with new claims.
 // If refreshImportingAccounts is true it will also update incomplete dependent accounts
 // This will replace any exports or imports previously defined.
+// An error is returned, and nothing applied, if the claims are not admitted.
 // Lock MUST NOT be held upon entry.
-func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaims, refreshImportingAccounts bool) {
+func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaims, refreshImportingAccounts bool) error {
 	if a == nil {
-		return
+		return nil
+	}
+	if err := checkDuplicateExports(ac); err != nil {
+		s.Errorf("Account claims update for %s rejected: %v", a.Name, err)
+		return err
+	}
+	if err := s.admitAccountClaims(ac); err != nil {
+		s.Errorf("Account claims update for %s rejected: %v", a.Name, err)
+		return err
 	}
 	s.Debugf("Updating account claims: %s", a.Name)
-	a.checkExpiration(ac.Claims())
+	if a.checkExpiration(ac.Claims()) {
+		// Notify once the new claims have been applied.
+		defer s.accountExpiryChanged(a, a.IsExpired())
+	}
 
 	a.mu.Lock()
 	// Clone to update, only select certain fields.
@@ -2373,6 +4265,8 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 
 	// Exports is creating a whole new map.
 	a.exports = exportMap{}
+	a.allowLists = false
+	a.hdrFilters = false
 
 	// Imports are checked unlocked in processInbound, so we can't change out the struct here. Need to process inline.
 	if a.imports.streams != nil {
@@ -2390,6 +4284,17 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 	// Reset any notion of export revocations.
 	a.actsRevoked = nil
 
+	// Reset subject mappings, they are applied from the claims below.
+	a.mappings = nil
+	claimJWT := a.claimJWT
+
+	// Human friendly information, only used for monitoring.
+	a.nameTag = ac.Name
+	a.tags = nil
+	if len(ac.Tags) > 0 {
+		a.tags = append(a.tags, ac.Tags...)
+	}
+
 	// update account signing keys
 	a.signingKeys = nil
 	signersChanged := false
@@ -2430,6 +4335,15 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 		}
 	}
 
+	var ext accountClaimsExt
+	decodeClaimsExt(claimJWT, ac.ID, &ext)
+	latencyStreams := map[string]string{}
+	for _, e := range ext.Exports {
+		if e.LatencyStream != _EMPTY_ {
+			latencyStreams[string(e.Subject)] = e.LatencyStream
+		}
+	}
+
 	for _, e := range ac.Exports {
 		switch e.Type {
 		case jwt.Stream:
@@ -2467,46 +4381,136 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 			a.mu.Unlock()
 		}
 	}
+	for _, e := range ext.Exports {
+		if e.Advertise != nil && !*e.Advertise {
+			if err := a.SetExportAdvertised(string(e.Subject), false); err != nil {
+				s.Debugf("Error hiding export %q of account [%s]: %v", e.Subject, a.Name, err)
+			}
+		}
+		if e.Deprecated != _EMPTY_ {
+			if err := a.SetExportDeprecated(string(e.Subject), e.Deprecated); err != nil {
+				s.Debugf("Error deprecating export %q of account [%s]: %v", e.Subject, a.Name, err)
+			}
+		}
+		if e.MaxInFlight > 0 {
+			if err := a.SetServiceExportMaxInFlight(string(e.Subject), int(e.MaxInFlight)); err != nil {
+				s.Debugf("Error setting max in flight requests for service export %q of account [%s]: %v", e.Subject, a.Name, err)
+			}
+		}
+	}
+	for svc, accounts := range ext.ServiceAllowedAccounts {
+		if err := a.SetServiceExportAllowedAccounts(svc, accounts); err != nil {
+			s.Debugf("Error setting allowed accounts for service export %q of account [%s]: %v", svc, a.Name, err)
+		}
+	}
+	for svc, headers := range ext.ServiceAllowedHeaders {
+		if err := a.SetServiceExportAllowedHeaders(svc, headers); err != nil {
+			s.Debugf("Error setting allowed headers for service export %q of account [%s]: %v", svc, a.Name, err)
+		}
+	}
+	srcs := make([]string, 0, len(ext.Mappings))
+	for src := range ext.Mappings {
+		srcs = append(srcs, src)
+	}
+	// Apply in a stable order since sources may overlap.
+	sort.Strings(srcs)
+	for _, src := range srcs {
+		dest := ext.Mappings[src]
+		s.Debugf("Adding subject mapping %q -> %q for %s", src, dest, a.Name)
+		if err := a.AddMapping(src, dest); err != nil {
+			s.Debugf("Error adding subject mapping to account [%s]: %v", a.Name, err)
+		}
+	}
+	// Process imports in a stable order, sorted by subject then account, so that
+	// logs and failures are reproducible for the same claims.
+	imports := make([]*jwt.Import, len(ac.Imports))
+	copy(imports, ac.Imports)
+	sort.SliceStable(imports, func(i, j int) bool {
+		if imports[i].Subject != imports[j].Subject {
+			return imports[i].Subject < imports[j].Subject
+		}
+		return imports[i].Account < imports[j].Account
+	})
 	var incompleteImports []*jwt.Import
-	for _, i := range ac.Imports {
+	var pending []PendingImport
+	for _, i := range imports {
 		// check tmpAccounts with priority
 		var acc *Account
 		var err error
 		if v, ok := s.tmpAccounts.Load(i.Account); ok {
 			acc = v.(*Account)
 		} else {
-			acc, err = s.lookupAccount(i.Account)
+			// Fetch the exporting account if needed, so that the import
+			// resolves now instead of when the exporter is first used.
+			// Its own imports are left for then, to only fetch direct exporters.
+			acc, err = s.lookupAccountWithImports(i.Account, false)
 		}
 		if acc == nil || err != nil {
-			s.Errorf("Can't locate account [%s] for import of [%v] %s (err=%v)", i.Account, i.Subject, i.Type, err)
+			required := isImportRequired(ext.RequiredImports, i.Account, string(i.Subject))
+			if required {
+				s.Errorf("Can't locate account [%s] for required import of [%v] %s, rejecting connections to account [%s] (err=%v)",
+					i.Account, i.Subject, i.Type, a.Name, err)
+			} else {
+				s.Errorf("Can't locate account [%s] for import of [%v] %s (err=%v)", i.Account, i.Subject, i.Type, err)
+			}
 			incompleteImports = append(incompleteImports, i)
+			pending = append(pending, PendingImport{i.Account, string(i.Subject), string(i.To), i.Type, required})
+			continue
+		}
+		// Adding the import below will fail authorization as well, but
+		// report this explicitly since no approval can ever fix it.
+		// For service imports the exported subject is the one we route to.
+		subject := string(i.Subject)
+		if i.Type == jwt.Service && i.To != _EMPTY_ {
+			subject = string(i.To)
+		}
+		if !acc.exportCoversSubject(subject, i.Type) {
+			s.Debugf("Error adding %s import to account [%s]: %v: %s:%q", i.Type, a.Name, ErrImportSubjectNotCovered, acc.Name, subject)
+			incompleteImports = append(incompleteImports, i)
+			continue
+		}
+		// An activation issued for the other import type can never authorize
+		// this import, so reject it instead of retrying.
+		if activationTypeMismatch(i) {
+			s.Errorf("Error adding %s import %s:%q to account [%s]: %v", i.Type, acc.Name, i.Subject, a.Name, ErrActivationTypeMismatch)
 			continue
 		}
 		switch i.Type {
 		case jwt.Stream:
 			s.Debugf("Adding stream import %s:%q for %s:%q", acc.Name, i.Subject, a.Name, i.To)
-			if err := a.AddStreamImportWithClaim(acc, string(i.Subject), string(i.To), i); err != nil {
+			filter := importFilter(ext.Imports, i.Account, string(i.Subject))
+			if filter != _EMPTY_ && !isValidStreamImportFilter(string(i.Subject), filter) {
+				s.Errorf("Error filtering stream import %s:%q of account [%s]: %v", acc.Name, i.Subject, a.Name, ErrStreamImportBadFilter)
+				filter = _EMPTY_
+			}
+			if err := a.addStreamImportWithClaim(acc, string(i.Subject), string(i.To), filter, i); err != nil {
 				s.Debugf("Error adding stream import to account [%s]: %v", a.Name, err.Error())
 				incompleteImports = append(incompleteImports, i)
 			}
 		case jwt.Service:
 			// FIXME(dlc) - need to add in respThresh here eventually.
 			s.Debugf("Adding service import %s:%q for %s:%q", acc.Name, i.Subject, a.Name, i.To)
-			if err := a.AddServiceImportWithClaim(acc, string(i.Subject), string(i.To), i); err != nil {
+			if err := a.AddServiceImportWithClaim(acc, string(i.Subject), string(i.To), i); err == ErrServiceImportCycle {
+				// Retrying will not help, so drop the import.
+				s.Errorf("Error adding service import %s:%q to account [%s]: %v", acc.Name, i.Subject, a.Name, err)
+			} else if err != nil {
 				s.Debugf("Error adding service import to account [%s]: %v", a.Name, err.Error())
 				incompleteImports = append(incompleteImports, i)
 			}
 		}
 	}
 	// Now let's apply any needed changes from import/export changes.
-	if !a.checkStreamImportsEqual(old) {
+	streamImportsChanged := !a.checkStreamImportsEqual(old)
+	streamExportsChanged := !a.checkStreamExportsEqual(old)
+	serviceExportsChanged := !a.checkServiceExportsEqual(old)
+	if streamImportsChanged {
 		awcsti := map[string]struct{}{a.Name: {}}
 		for _, c := range gatherClients() {
 			c.processSubsOnConfigReload(awcsti)
 		}
 	}
 	// Now check if stream exports have changed.
-	if !a.checkStreamExportsEqual(old) || signersChanged {
+	if streamExportsChanged || signersChanged {
 		clients := map[*client]struct{}{}
 		// We need to check all accounts that have an import claim from this account.
 		awcsti := map[string]struct{}{}
@@ -2539,7 +4543,7 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 		}
 	}
 	// Now check if service exports have changed.
-	if !a.checkServiceExportsEqual(old) || signersChanged {
+	if serviceExportsChanged || signersChanged {
 		s.accounts.Range(func(k, v interface{}) bool {
 			acc := v.(*Account)
 			// Move to the next if this account is actually account "a".
@@ -2598,8 +4602,60 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 	} else {
 		a.usersRevoked = nil
 	}
+	a.credsRevoked = ext.RevokedCredentials
+	a.msublen = 0
+	if ext.MaxSubjectLength > 0 {
+		a.msublen = ext.MaxSubjectLength
+	}
+	a.ctypes = contentTypeSet(ext.AllowedContentTypes)
+	a.maintenance = ext.Maintenance
+	a.requireTLS = ext.RequireTLS
+	a.userAuth = _EMPTY_
+	switch ua := strings.ToLower(ext.UserAuth); ua {
+	case _EMPTY_:
+	case accountUserAuthBearer, accountUserAuthNonce:
+		a.userAuth = ua
+	default:
+		s.Warnf("Unknown user authentication method %q for account [%s] ignored", ext.UserAuth, a.Name)
+	}
+	var unknownOps []string
+	a.jsAPIDeny, unknownOps = jsAPIDenySubjects(ext.JetStreamAPIDeny)
+	if len(unknownOps) > 0 {
+		s.Warnf("Unknown JetStream API operations %q for account [%s] ignored", unknownOps, a.Name)
+	}
+	a.namespace = _EMPTY_
+	if ns := ext.SubjectNamespace; ns != _EMPTY_ {
+		if IsValidSubject(ns) {
+			a.namespace = ns
+		} else {
+			s.Warnf("Invalid subject namespace %q for account [%s] ignored", ns, a.Name)
+		}
+	}
+	a.mctconns = nil
+	for ct, max := range ext.ConnectionTypeLimits {
+		ct = strings.ToUpper(ct)
+		switch ct {
+		case jwt.ConnectionTypeStandard, jwt.ConnectionTypeWebsocket, jwt.ConnectionTypeLeafnode, jwt.ConnectionTypeMqtt:
+		default:
+			s.Warnf("Unknown connection type %q in connection limits for account [%s] ignored", ct, a.Name)
+			continue
+		}
+		if max == jwt.NoLimit {
+			continue
+		}
+		if a.mctconns == nil {
+			a.mctconns = make(map[string]int32)
+		}
+		a.mctconns[ct] = int32(max)
+	}
 	a.defaultPerms = buildPermissionsFromJwt(&ac.DefaultPermissions)
+	a.defaultResp = nil
+	if ext.DefaultResp != nil {
+		a.defaultResp = &ResponsePermission{MaxMsgs: ext.DefaultResp.MaxMsgs, Expires: ext.DefaultResp.Expires}
+	}
 	a.incomplete = len(incompleteImports) != 0
+	a.deferred = false
+	a.pending = pending
 	for _, i := range incompleteImports {
 		s.incompleteAccExporterMap.Store(i.Account, struct{}{})
 	}
@@ -2623,14 +4679,6 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 	a.updated = time.Now()
 	a.mu.Unlock()
 
-	clients := gatherClients()
-	// Sort if we are over the limit.
-	if a.MaxTotalConnectionsReached() {
-		sort.Slice(clients, func(i, j int) bool {
-			return clients[i].start.After(clients[j].start)
-		})
-	}
-
 	if jsEnabled {
 		if err := s.configJetStream(a); err != nil {
 			s.Errorf("Error configuring jetstream for account [%s]: %v", a.Name, err.Error())
@@ -2641,50 +4689,47 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 		}
 	}
 
-	for i, c := range clients {
-		a.mu.RLock()
-		exceeded := a.mconns != jwt.NoLimit && i >= int(a.mconns)
-		a.mu.RUnlock()
-		if exceeded {
-			c.maxAccountConnExceeded()
+	// Now that jetstream is configured, send latency results to the
+	// streams they are meant to be stored in.
+	for _, e := range ac.Exports {
+		stream, ok := latencyStreams[string(e.Subject)]
+		if !ok || e.Type != jwt.Service || e.Latency == nil {
 			continue
 		}
-		c.mu.Lock()
-		c.applyAccountLimits()
-		theJWT := c.opts.JWT
-		c.mu.Unlock()
-		// Check for being revoked here. We use ac one to avoid the account lock.
-		if ac.Revocations != nil {
-			if juc, err := jwt.DecodeUserClaims(theJWT); err != nil {
-				c.Debugf("User JWT not valid: %v", err)
-				c.authViolation()
-				continue
-			} else if ok := ac.IsClaimRevoked(juc); ok {
-				c.sendErrAndDebug("User Authentication Revoked")
-				c.closeConnection(Revocation)
-				continue
+		results := string(e.Latency.Results)
+		if subj, err := a.latencyStreamSubject(stream, results); err != nil {
+			s.Warnf("Latency results of service export %q of account [%s] not stored in stream %q: %v",
+				e.Subject, a.Name, stream, err)
+		} else if subj != results {
+			s.Debugf("Sending latency results of service export %q of account [%s] to %q for stream %q",
+				e.Subject, a.Name, subj, stream)
+			if err := a.TrackServiceExportWithSampling(string(e.Subject), subj, e.Latency.Sampling); err != nil {
+				s.Debugf("Error adding latency tracking for service export to account [%s]: %v", a.Name, err)
 			}
 		}
 	}
 
-	// Check if the signing keys changed, might have to evict
-	if signersChanged {
-		for _, c := range clients {
-			c.mu.Lock()
-			sk := c.user.SigningKey
-			c.mu.Unlock()
-			if sk != "" && !a.hasIssuer(sk) {
-				c.closeConnection(AuthenticationViolation)
-			}
-		}
+	a.revalidateClients(gatherClients())
+
+	a.mu.RLock()
+	update := AccountUpdate{
+		Account:            a.Name,
+		IssuedAt:           time.Unix(ac.IssuedAt, 0),
+		ImportsChanged:     streamImportsChanged || !a.checkServiceImportsEqual(old),
+		ExportsChanged:     streamExportsChanged || serviceExportsChanged,
+		LimitsChanged:      a.limits != old.limits,
+		SigningKeysChanged: signersChanged,
 	}
+	a.mu.RUnlock()
+	s.sendAccountUpdate(update)
 
 	if _, ok := s.incompleteAccExporterMap.Load(old.Name); ok && refreshImportingAccounts {
 		s.incompleteAccExporterMap.Delete(old.Name)
 		s.accounts.Range(func(key, value interface{}) bool {
 			acc := value.(*Account)
 			acc.mu.RLock()
-			incomplete := acc.incomplete
+			// Accounts with deferred imports resolve them when first used.
+			incomplete := acc.incomplete && !acc.deferred
 			name := acc.Name
 			// Must use jwt in account or risk failing on fetch
 			// This jwt may not be the same that caused exportingAcc to be in incompleteAccExporterMap
@@ -2708,13 +4753,15 @@ func (s *Server) updateAccountClaimsWithRefresh(a *Account, ac *jwt.AccountClaim
 			return true
 		})
 	}
+	return nil
 }
 
 // Helper to build an internal account structure from a jwt.AccountClaims.
 // Lock MUST NOT be held upon entry.
-func (s *Server) buildInternalAccount(ac *jwt.AccountClaims) *Account {
+func (s *Server) buildInternalAccount(ac *jwt.AccountClaims, claimJWT string) (*Account, error) {
 	acc := NewAccount(ac.Subject)
 	acc.Issuer = ac.Issuer
+	acc.claimJWT = claimJWT
 	// Set this here since we are placing in s.tmpAccounts below and may be
 	// referenced by an route RS+, etc.
 	s.setAccountSublist(acc)
@@ -2723,8 +4770,11 @@ func (s *Server) buildInternalAccount(ac *jwt.AccountClaims) *Account {
 	// being built, however, to solve circular import dependencies, we
 	// need to store it here.
 	s.tmpAccounts.Store(ac.Subject, acc)
-	s.UpdateAccountClaims(acc, ac)
-	return acc
+	if err := s.updateAccountClaimsWithRefresh(acc, ac, true); err != nil {
+		s.tmpAccounts.Delete(ac.Subject)
+		return nil, err
+	}
+	return acc, nil
 }
 
 // Helper to build Permissions from jwt.Permissions
@@ -2771,16 +4821,178 @@ func buildInternalNkeyUser(uc *jwt.UserClaims, acts map[string]struct{}, acc *Ac
 	}
 
 	// Now check for permissions.
+	// Users without explicit permissions inherit the account defaults,
+	// explicit permissions replace the defaults entirely.
 	var p = buildPermissionsFromJwt(&uc.Permissions)
-	if p == nil && acc.defaultPerms != nil {
+	acc.mu.RLock()
+	if p == nil {
 		p = acc.defaultPerms.clone()
 	}
+	// Responders without their own response permission get the one of the
+	// account, if set. Unlike one set on the user, it does not limit the
+	// publishing of users that are not restricted to allowed subjects.
+	if dr := acc.defaultResp; dr != nil && (p == nil || p.Response == nil) {
+		if p == nil {
+			p = &Permissions{}
+		}
+		p.Response = &ResponsePermission{MaxMsgs: dr.MaxMsgs, Expires: dr.Expires}
+		if p.Response.MaxMsgs == 0 {
+			p.Response.MaxMsgs = DEFAULT_ALLOW_RESPONSE_MAX_MSGS
+		}
+		if p.Response.Expires == 0 {
+			p.Response.Expires = DEFAULT_ALLOW_RESPONSE_EXPIRATION
+		}
+	}
+	// JetStream API operations denied to the account are denied to all users.
+	if len(acc.jsAPIDeny) > 0 {
+		if p == nil {
+			p = &Permissions{}
+		}
+		if p.Publish == nil {
+			p.Publish = &SubjectPermission{}
+		}
+		deny := make([]string, 0, len(p.Publish.Deny)+len(acc.jsAPIDeny))
+		p.Publish.Deny = append(append(deny, p.Publish.Deny...), acc.jsAPIDeny...)
+	}
+	acc.mu.RUnlock()
 	nu.Permissions = p
 	return nu
 }
 
 const fetchTimeout = 2 * time.Second
 
+// accountNotFoundErr is returned by resolvers when the account is known not
+// to exist, as opposed to a fetch that failed for other reasons.
+type accountNotFoundErr struct {
+	error
+}
+
+// fetchOriginResolver is implemented by resolvers that can report where a
+// fetched jwt came from. This is used when tracing resolver fetches.
+type fetchOriginResolver interface {
+	fetchWithOrigin(name string) (string, string, error)
+}
+
+// appliedClaimsResolver is implemented by resolvers that keep the jwt in
+// effect while the one stored only applies later.
+type appliedClaimsResolver interface {
+	fetchApplied(name string) (string, error)
+}
+
+// AccountResolverConfig describes the configuration of an account resolver.
+// Fields that do not apply to the resolver type are left empty.
+type AccountResolverConfig struct {
+	// Type is one of MEM, URL, UNIX, FULL or CACHE.
+	Type string `json:"type"`
+	// Dir is the directory used by FULL and CACHE resolvers.
+	Dir string `json:"dir,omitempty"`
+	// URL is the base url used by the URL resolver.
+	URL string `json:"url,omitempty"`
+	// Socket is the unix domain socket path used by the UNIX resolver.
+	Socket string `json:"socket,omitempty"`
+	// TTL is how long a CACHE resolver keeps account JWTs.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Limit is the maximum number of account JWTs stored in the directory.
+	Limit int64 `json:"limit,omitempty"`
+	// Interval is how often a FULL resolver syncs with its peers.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Jitter is the fraction of Interval randomly added to the wait between
+	// syncs of a FULL resolver.
+	Jitter float64 `json:"jitter,omitempty"`
+}
+
+// AccountResolverConfig returns the configuration of the account resolver,
+// or nil if there is none. The returned value is a copy.
+func (o *Options) AccountResolverConfig() *AccountResolverConfig {
+	if o.AccountResolver == nil {
+		return nil
+	}
+	cfg := &AccountResolverConfig{Type: accResolverType(o.AccountResolver)}
+	dirConfig := func(dr *DirAccResolver) {
+		store := dr.DirJWTStore
+		store.Lock()
+		cfg.Dir = store.directory
+		if store.expiration != nil {
+			cfg.Limit = store.expiration.limit
+			cfg.TTL = store.expiration.ttl
+		}
+		store.Unlock()
+	}
+	switch ar := o.AccountResolver.(type) {
+	case *URLAccResolver:
+		cfg.URL = ar.url
+	case *UnixAccResolver:
+		cfg.Socket = ar.path
+	case *CacheDirAccResolver:
+		dirConfig(&ar.DirAccResolver)
+		cfg.TTL = ar.ttl
+	case *DirAccResolver:
+		dirConfig(ar)
+		cfg.Interval = ar.syncInterval
+		cfg.Jitter = ar.syncJitter
+	}
+	return cfg
+}
+
+// ResolverStatus reports the state of a server's account resolver.
+type ResolverStatus struct {
+	// Type is one of MEM, URL, UNIX, FULL or CACHE.
+	Type string `json:"type"`
+	// JWTs is the number of account JWTs stored by the resolver.
+	JWTs int `json:"jwts"`
+	// LastSync is when a FULL resolver last completed a sync with its peers.
+	LastSync time.Time `json:"last_sync,omitempty"`
+}
+
+// resolverStatus returns the status of the account resolver.
+func (s *Server) resolverStatus() (*ResolverStatus, error) {
+	ar := s.AccountResolver()
+	if ar == nil {
+		return nil, fmt.Errorf("no account resolver configured")
+	}
+	status := &ResolverStatus{Type: accResolverType(ar)}
+	var dr *DirAccResolver
+	switch r := ar.(type) {
+	case *MemAccResolver:
+		r.sm.Range(func(_, _ interface{}) bool {
+			status.JWTs++
+			return true
+		})
+	case *CacheDirAccResolver:
+		dr = &r.DirAccResolver
+	case *DirAccResolver:
+		dr = r
+	}
+	if dr != nil {
+		keys, err := dr.keys()
+		if err != nil {
+			return nil, err
+		}
+		status.JWTs = len(keys)
+		if ls := atomic.LoadInt64(&dr.lastSync); ls != 0 {
+			status.LastSync = time.Unix(0, ls).UTC()
+		}
+	}
+	return status, nil
+}
+
+// accResolverType returns the configuration name of the resolver type.
+func accResolverType(ar AccountResolver) string {
+	switch ar.(type) {
+	case *MemAccResolver:
+		return "MEM"
+	case *URLAccResolver:
+		return "URL"
+	case *UnixAccResolver:
+		return "UNIX"
+	case *CacheDirAccResolver:
+		return "CACHE"
+	case *DirAccResolver:
+		return "FULL"
+	}
+	return fmt.Sprintf("%T", ar)
+}
+
 // AccountResolver interface. This is to fetch Account JWTs by public nkeys
 type AccountResolver interface {
 	Fetch(name string) (string, error)
@@ -2821,7 +5033,8 @@ func (*resolverDefaultsOpsImpl) Store(_, _ string) error {
 // MemAccResolver is a memory only resolver.
 // Mostly for testing.
 type MemAccResolver struct {
-	sm sync.Map
+	sm      sync.Map
+	applied sync.Map
 	resolverDefaultsOpsImpl
 }
 
@@ -2835,18 +5048,33 @@ func (m *MemAccResolver) Fetch(name string) (string, error) {
 
 // Store will store the account jwt claims in the internal sync.Map.
 func (m *MemAccResolver) Store(name, jwt string) error {
+	// Keep the claims in effect while the new ones only apply later.
+	if jwtApplyAt(jwt).IsZero() {
+		m.applied.Delete(name)
+	} else if j, ok := m.sm.Load(name); ok && jwtApplyAt(j.(string)).IsZero() {
+		m.applied.Store(name, j)
+	}
 	m.sm.Store(name, jwt)
 	return nil
 }
 
+func (m *MemAccResolver) fetchApplied(name string) (string, error) {
+	if j, ok := m.applied.Load(name); ok {
+		return j.(string), nil
+	}
+	return _EMPTY_, ErrMissingAccount
+}
+
 func (ur *MemAccResolver) IsReadOnly() bool {
 	return false
 }
 
 // URLAccResolver implements an http fetcher.
 type URLAccResolver struct {
-	url string
-	c   *http.Client
+	url  string
+	c    *http.Client
+	mu   sync.RWMutex
+	hdrs http.Header
 	resolverDefaultsOpsImpl
 }
 
@@ -2871,21 +5099,83 @@ func NewURLAccResolver(url string) (*URLAccResolver, error) {
 // Fetch will fetch the account jwt claims from the base url, appending the
 // account name onto the end.
 func (ur *URLAccResolver) Fetch(name string) (string, error) {
+	theJWT, _, err := ur.fetchWithOrigin(name)
+	return theJWT, err
+}
+
+// setHeaders sets the headers that will be attached to every fetch.
+// Header values are never logged since they usually carry credentials.
+func (ur *URLAccResolver) setHeaders(hdrs map[string]string) {
+	var h http.Header
+	if len(hdrs) > 0 {
+		h = make(http.Header, len(hdrs))
+		for k, v := range hdrs {
+			h.Set(k, v)
+		}
+	}
+	ur.mu.Lock()
+	ur.hdrs = h
+	ur.mu.Unlock()
+}
+
+// fetchWithOrigin is like Fetch but also returns the HTTP status of the response.
+func (ur *URLAccResolver) fetchWithOrigin(name string) (string, string, error) {
 	url := ur.url + name
-	resp, err := ur.c.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return _EMPTY_, _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, err)
+	}
+	ur.mu.RLock()
+	for k, v := range ur.hdrs {
+		req.Header[k] = v
+	}
+	ur.mu.RUnlock()
+	resp, err := ur.c.Do(req)
 	if err != nil {
-		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, err)
+		return _EMPTY_, _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, err)
 	} else if resp == nil {
-		return _EMPTY_, fmt.Errorf("could not fetch <%q>: no response", url)
-	} else if resp.StatusCode != http.StatusOK {
-		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, resp.Status)
+		return _EMPTY_, _EMPTY_, fmt.Errorf("could not fetch <%q>: no response", url)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return _EMPTY_, resp.Status, &accountNotFoundErr{fmt.Errorf("could not fetch <%q>: %v", url, resp.Status)}
+	} else if resp.StatusCode != http.StatusOK {
+		return _EMPTY_, resp.Status, fmt.Errorf("could not fetch <%q>: %v", url, resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return _EMPTY_, err
+		return _EMPTY_, resp.Status, err
 	}
-	return string(body), nil
+	return string(body), resp.Status, nil
+}
+
+// UnixAccResolver implements an http fetcher over a unix domain socket.
+type UnixAccResolver struct {
+	*URLAccResolver
+	path string
+}
+
+// NewUnixAccResolver returns a new resolver that fetches account JWTs with
+// HTTP requests sent over the unix domain socket at path. The account name is
+// requested as the path of the URL, e.g. GET /<account public key>.
+func NewUnixAccResolver(path string) (*UnixAccResolver, error) {
+	if path == _EMPTY_ {
+		return nil, fmt.Errorf("unix account resolver requires a socket path")
+	}
+	tr := &http.Transport{
+		MaxIdleConns:    10,
+		IdleConnTimeout: 30 * time.Second,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	ur := &URLAccResolver{
+		// The host is ignored since we always dial the socket.
+		url: "http://unix/",
+		c:   &http.Client{Timeout: fetchTimeout, Transport: tr},
+	}
+	return &UnixAccResolver{URLAccResolver: ur, path: path}, nil
 }
 
 // Resolver based on nats for synchronization and backing directory for storage.
@@ -2893,6 +5183,20 @@ type DirAccResolver struct {
 	*DirJWTStore
 	*Server
 	syncInterval time.Duration
+	lastSync     int64           // unix nano of the last completed sync, accessed atomically.
+	syncJitter   float64         // fraction of syncInterval randomly added to each wait between syncs
+	subs         []*subscription // system account subscriptions made on start
+	quit         chan struct{}   // closed to stop the goroutines started on start
+}
+
+// nextSyncInterval returns how long to wait until the next sync, which
+// is the sync interval plus up to syncJitter of it. The jitter keeps the
+// servers of a cluster from all syncing at once.
+func (dr *DirAccResolver) nextSyncInterval() time.Duration {
+	if dr.syncJitter <= 0 {
+		return dr.syncInterval
+	}
+	return dr.syncInterval + time.Duration(rand.Float64()*dr.syncJitter*float64(dr.syncInterval))
 }
 
 func (dr *DirAccResolver) IsTrackingUpdate() bool {
@@ -2935,6 +5239,7 @@ func (dr *DirAccResolver) Start(s *Server) error {
 	defer dr.Unlock()
 	dr.Server = s
 	dr.DirJWTStore.changed = func(pubKey string) {
+		s.clearNegativeLookup(pubKey)
 		if v, ok := s.accounts.Load(pubKey); !ok {
 		} else if jwt, err := dr.LoadAcc(pubKey); err != nil {
 			s.Errorf("update got error on load: %v", err)
@@ -2942,21 +5247,17 @@ func (dr *DirAccResolver) Start(s *Server) error {
 			s.Errorf("update resulted in error %v", err)
 		}
 	}
+	dr.quit = make(chan struct{})
 	packRespIb := s.newRespInbox()
-	for _, reqSub := range []string{accUpdateEventSubjOld, accUpdateEventSubjNew} {
+	for _, reqSub := range s.accountUpdateSubjects() {
 		// subscribe to account jwt update requests
-		if _, err := s.sysSubscribe(fmt.Sprintf(reqSub, "*"), func(_ *subscription, _ *client, subj, resp string, msg []byte) {
-			pubKey := ""
-			tk := strings.Split(subj, tsep)
-			if len(tk) == accUpdateTokensNew {
-				pubKey = tk[accReqAccIndex]
-			} else if len(tk) == accUpdateTokensOld {
-				pubKey = tk[accUpdateAccIdxOld]
-			} else {
+		if sub, err := s.sysSubscribe(reqSub, func(_ *subscription, _ *client, subj, resp string, msg []byte) {
+			pubKey := s.accountFromUpdateSubject(subj)
+			if pubKey == _EMPTY_ {
 				s.Debugf("jwt update skipped due to bad subject %q", subj)
 				return
 			}
-			if claim, err := jwt.DecodeAccountClaims(string(msg)); err != nil {
+			if claim, err := s.decodeAccountClaims(string(msg)); err != nil {
 				respondToUpdate(s, resp, pubKey, "jwt update resulted in error", err)
 			} else if claim.Subject != pubKey {
 				err := errors.New("subject does not match jwt content")
@@ -2964,13 +5265,16 @@ func (dr *DirAccResolver) Start(s *Server) error {
 			} else if err := dr.save(pubKey, string(msg)); err != nil {
 				respondToUpdate(s, resp, pubKey, "jwt update resulted in error", err)
 			} else {
+				s.resolverStored(pubKey, string(msg), ResolverStorePush)
 				respondToUpdate(s, resp, pubKey, "jwt updated", nil)
 			}
 		}); err != nil {
 			return fmt.Errorf("error setting up update handling: %v", err)
+		} else {
+			dr.subs = append(dr.subs, sub)
 		}
 	}
-	if _, err := s.sysSubscribe(fmt.Sprintf(accLookupReqSubj, "*"), func(_ *subscription, _ *client, subj, reply string, msg []byte) {
+	if sub, err := s.sysSubscribe(fmt.Sprintf(accLookupReqSubj, "*"), func(_ *subscription, _ *client, subj, reply string, msg []byte) {
 		// respond to lookups with our version
 		if reply == "" {
 			return
@@ -2986,7 +5290,10 @@ func (dr *DirAccResolver) Start(s *Server) error {
 		}
 	}); err != nil {
 		return fmt.Errorf("error setting up lookup request handling: %v", err)
-	} else if _, err = s.sysSubscribeQ(accPackReqSubj, "responder",
+	} else {
+		dr.subs = append(dr.subs, sub)
+	}
+	if sub, err := s.sysSubscribeQ(accPackReqSubj, "responder",
 		// respond to pack requests with one or more pack messages
 		// an empty message signifies the end of the response responder
 		func(_ *subscription, _ *client, _, reply string, theirHash []byte) {
@@ -3008,50 +5315,115 @@ func (dr *DirAccResolver) Start(s *Server) error {
 			}
 		}); err != nil {
 		return fmt.Errorf("error setting up pack request handling: %v", err)
-	} else if _, err = s.sysSubscribe(packRespIb, func(_ *subscription, _ *client, _, _ string, msg []byte) {
+	} else {
+		dr.subs = append(dr.subs, sub)
+	}
+	if sub, err := s.sysSubscribe(packRespIb, func(_ *subscription, _ *client, _, _ string, msg []byte) {
 		// embed pack responses into store
 		hash := dr.DirJWTStore.Hash()
 		if len(msg) == 0 { // end of response stream
 			s.Debugf("Merging Finished and resulting in: %x", dr.DirJWTStore.Hash())
+			atomic.StoreInt64(&dr.lastSync, time.Now().UnixNano())
 			return
-		} else if err := dr.DirJWTStore.Merge(string(msg)); err != nil {
+		} else if err := dr.DirJWTStore.merge(string(msg), func(pubKey, theJWT string) {
+			s.resolverStored(pubKey, theJWT, ResolverStoreSync)
+		}); err != nil {
 			s.Errorf("Merging resulted in error: %v", err)
 		} else {
 			s.Debugf("Merging succeeded and changed %x to %x", hash, dr.DirJWTStore.Hash())
 		}
 	}); err != nil {
 		return fmt.Errorf("error setting up pack response handling: %v", err)
+	} else {
+		dr.subs = append(dr.subs, sub)
+	}
+	if sub, err := s.sysSubscribeQ(accActiveReqSubj, "responder",
+		// respond to warm up requests with the jwt of the accounts in use here,
+		// one per message. an empty message signifies the end of the response
+		func(_ *subscription, _ *client, _, reply string, _ []byte) {
+			if reply == "" {
+				return
+			}
+			s.accounts.Range(func(k, _ interface{}) bool {
+				pubKey := k.(string)
+				if theJWT, err := dr.DirJWTStore.LoadAcc(pubKey); err == nil && theJWT != _EMPTY_ {
+					s.sendInternalMsgLocked(reply, "", nil, []byte(fmt.Sprintf("%s|%s", pubKey, theJWT)))
+				}
+				return true
+			})
+			s.sendInternalMsgLocked(reply, "", nil, []byte{})
+		}); err != nil {
+		return fmt.Errorf("error setting up warm up request handling: %v", err)
+	} else {
+		dr.subs = append(dr.subs, sub)
 	}
 	// periodically send out pack message
-	quit := s.quitCh
+	quit, stop := s.quitCh, dr.quit
 	s.startGoRoutine(func() {
 		defer s.grWG.Done()
-		ticker := time.NewTicker(dr.syncInterval)
+		timer := time.NewTimer(dr.nextSyncInterval())
 		for {
 			select {
 			case <-quit:
-				ticker.Stop()
+				timer.Stop()
 				return
-			case <-ticker.C:
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
 			ourHash := dr.DirJWTStore.Hash()
 			s.Debugf("Checking store state: %x", ourHash)
 			s.sendInternalMsgLocked(accPackReqSubj, packRespIb, nil, ourHash[:])
+			timer.Reset(dr.nextSyncInterval())
 		}
 	})
 	s.Noticef("Managing all jwt in exclusive directory %s", dr.directory)
 	return nil
 }
 
+// Close stops the goroutines started on start and closes the directory store.
+// It is called with the server lock held on shutdown and must not take it.
+func (dr *DirAccResolver) Close() {
+	dr.Lock()
+	stop := dr.quit
+	dr.quit = nil
+	dr.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	dr.DirJWTStore.Close()
+}
+
+// unsubscribe removes the system account subscriptions made on start along
+// with the interest they propagated to routes, gateways and leafnodes.
+// Server lock should not be held.
+func (dr *DirAccResolver) unsubscribe() {
+	dr.Lock()
+	subs := dr.subs
+	dr.subs = nil
+	dr.Unlock()
+	for _, sub := range subs {
+		sub.client.processUnsub(sub.sid)
+	}
+}
+
 func (dr *DirAccResolver) Fetch(name string) (string, error) {
+	theJWT, _, err := dr.fetchWithOrigin(name)
+	return theJWT, err
+}
+
+// fetchWithOrigin is like Fetch but also returns where the jwt came from,
+// either the local directory or the peer that responded to the lookup.
+func (dr *DirAccResolver) fetchWithOrigin(name string) (string, string, error) {
 	if theJWT, err := dr.LoadAcc(name); theJWT != "" {
-		return theJWT, nil
+		return theJWT, "local", nil
 	} else {
 		dr.Lock()
 		srv := dr.Server
 		dr.Unlock()
 		if srv == nil {
-			return "", err
+			return "", "", err
 		}
 		return srv.fetch(dr, name) // lookup from other server
 	}
@@ -3061,6 +5433,10 @@ func (dr *DirAccResolver) Store(name, jwt string) error {
 	return dr.saveIfNewer(name, jwt)
 }
 
+func (dr *DirAccResolver) fetchApplied(name string) (string, error) {
+	return dr.loadApplied(name)
+}
+
 func NewDirAccResolver(path string, limit int64, syncInterval time.Duration) (*DirAccResolver, error) {
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -3072,36 +5448,57 @@ func NewDirAccResolver(path string, limit int64, syncInterval time.Duration) (*D
 	if err != nil {
 		return nil, err
 	}
-	return &DirAccResolver{store, nil, syncInterval}, nil
+	return &DirAccResolver{store, nil, syncInterval, 0, 0, nil, nil}, nil
 }
 
 // Caching resolver using nats for lookups and making use of a directory for storage
 type CacheDirAccResolver struct {
 	DirAccResolver
-	ttl time.Duration
+	ttl  time.Duration
+	warm bool // request the accounts in use by a full resolver peer on start
 }
 
-func (s *Server) fetch(res AccountResolver, name string) (string, error) {
+const (
+	// Interval and number of attempts at requesting the accounts in use
+	// from a peer when warming a cache resolver. Peers are usually not
+	// connected yet when the resolver starts.
+	cacheWarmInterval = 500 * time.Millisecond
+	cacheWarmAttempts = 20
+)
+
+// Holds a lookup response and the connection it was received from.
+type fetchResponse struct {
+	msg  []byte
+	peer string
+}
+
+// fetch will request the account jwt from other servers. It returns the jwt
+// as well as a description of the peer connection the response arrived on.
+func (s *Server) fetch(res AccountResolver, name string) (string, string, error) {
 	if s == nil {
-		return "", ErrNoAccountResolver
+		return "", "", ErrNoAccountResolver
 	}
-	respC := make(chan []byte, 1)
+	respC := make(chan fetchResponse, 1)
 	accountLookupRequest := fmt.Sprintf(accLookupReqSubj, name)
 	s.mu.Lock()
 	if s.sys == nil || s.sys.replies == nil {
 		s.mu.Unlock()
-		return "", fmt.Errorf("eventing shut down")
+		return "", "", fmt.Errorf("eventing shut down")
 	}
 	replySubj := s.newRespInbox()
 	replies := s.sys.replies
 	// Store our handler.
-	replies[replySubj] = func(sub *subscription, _ *client, subject, _ string, msg []byte) {
+	replies[replySubj] = func(sub *subscription, c *client, subject, _ string, msg []byte) {
 		clone := make([]byte, len(msg))
 		copy(clone, msg)
+		peer := "local"
+		if c != nil && c.kind != SYSTEM {
+			peer = c.String()
+		}
 		s.mu.Lock()
 		if _, ok := replies[replySubj]; ok {
 			select {
-			case respC <- clone: // only use first response and only if there is still interest
+			case respC <- fetchResponse{clone, peer}: // only use first response and only if there is still interest
 			default:
 			}
 		}
@@ -3111,22 +5508,24 @@ func (s *Server) fetch(res AccountResolver, name string) (string, error) {
 	quit := s.quitCh
 	s.mu.Unlock()
 	var err error
-	var theJWT string
+	var theJWT, peer string
 	select {
 	case <-quit:
 		err = errors.New("fetching jwt failed due to shutdown")
 	case <-time.After(fetchTimeout):
-		err = errors.New("fetching jwt timed out")
+		// No server responded, so none of them has the account.
+		err = &accountNotFoundErr{errors.New("fetching jwt timed out")}
 	case m := <-respC:
-		if err = res.Store(name, string(m)); err == nil {
-			theJWT = string(m)
+		peer = m.peer
+		if err = res.Store(name, string(m.msg)); err == nil {
+			theJWT = string(m.msg)
 		}
 	}
 	s.mu.Lock()
 	delete(replies, replySubj)
 	s.mu.Unlock()
 	close(respC)
-	return theJWT, err
+	return theJWT, peer, err
 }
 
 func NewCacheDirAccResolver(path string, limit int64, ttl time.Duration) (*CacheDirAccResolver, error) {
@@ -3137,7 +5536,7 @@ func NewCacheDirAccResolver(path string, limit int64, ttl time.Duration) (*Cache
 	if err != nil {
 		return nil, err
 	}
-	return &CacheDirAccResolver{DirAccResolver{store, nil, 0}, ttl}, nil
+	return &CacheDirAccResolver{DirAccResolver{store, nil, 0, 0, 0, nil, nil}, ttl, false}, nil
 }
 
 func (dr *CacheDirAccResolver) Start(s *Server) error {
@@ -3145,6 +5544,7 @@ func (dr *CacheDirAccResolver) Start(s *Server) error {
 	defer dr.Unlock()
 	dr.Server = s
 	dr.DirJWTStore.changed = func(pubKey string) {
+		s.clearNegativeLookup(pubKey)
 		if v, ok := s.accounts.Load(pubKey); !ok {
 		} else if jwt, err := dr.LoadAcc(pubKey); err != nil {
 			s.Errorf("update got error on load: %v", err)
@@ -3152,20 +5552,16 @@ func (dr *CacheDirAccResolver) Start(s *Server) error {
 			s.Errorf("update resulted in error %v", err)
 		}
 	}
-	for _, reqSub := range []string{accUpdateEventSubjOld, accUpdateEventSubjNew} {
+	dr.quit = make(chan struct{})
+	for _, reqSub := range s.accountUpdateSubjects() {
 		// subscribe to account jwt update requests
-		if _, err := s.sysSubscribe(fmt.Sprintf(reqSub, "*"), func(_ *subscription, _ *client, subj, resp string, msg []byte) {
-			pubKey := ""
-			tk := strings.Split(subj, tsep)
-			if len(tk) == accUpdateTokensNew {
-				pubKey = tk[accReqAccIndex]
-			} else if len(tk) == accUpdateTokensOld {
-				pubKey = tk[accUpdateAccIdxOld]
-			} else {
+		if sub, err := s.sysSubscribe(reqSub, func(_ *subscription, _ *client, subj, resp string, msg []byte) {
+			pubKey := s.accountFromUpdateSubject(subj)
+			if pubKey == _EMPTY_ {
 				s.Debugf("jwt update cache skipped due to bad subject %q", subj)
 				return
 			}
-			if claim, err := jwt.DecodeAccountClaims(string(msg)); err != nil {
+			if claim, err := s.decodeAccountClaims(string(msg)); err != nil {
 				respondToUpdate(s, resp, pubKey, "jwt update cache resulted in error", err)
 			} else if claim.Subject != pubKey {
 				err := errors.New("subject does not match jwt content")
@@ -3175,12 +5571,63 @@ func (dr *CacheDirAccResolver) Start(s *Server) error {
 			} else if err := dr.save(pubKey, string(msg)); err != nil {
 				respondToUpdate(s, resp, pubKey, "jwt update cache resulted in error", err)
 			} else {
+				s.resolverStored(pubKey, string(msg), ResolverStorePush)
 				respondToUpdate(s, resp, pubKey, "jwt updated cache", nil)
 			}
 		}); err != nil {
 			return fmt.Errorf("error setting up update handling: %v", err)
+		} else {
+			dr.subs = append(dr.subs, sub)
+		}
+	}
+	if dr.warm {
+		if err := dr.warmUp(s); err != nil {
+			return err
 		}
 	}
 	s.Noticef("Managing some jwt in exclusive directory %s", dr.directory)
 	return nil
 }
+
+// warmUp requests the jwt of the accounts in use by a full resolver peer
+// and stores them, so that first connections to them need no lookup.
+// Requests are repeated until a peer responds.
+func (dr *CacheDirAccResolver) warmUp(s *Server) error {
+	var done int32
+	respIb := s.newRespInbox()
+	sub, err := s.sysSubscribe(respIb, func(_ *subscription, _ *client, _, _ string, msg []byte) {
+		if len(msg) == 0 { // end of response stream
+			if atomic.CompareAndSwapInt32(&done, 0, 1) {
+				s.Noticef("Warmed up jwt cache from peer")
+			}
+			return
+		} else if err := dr.DirJWTStore.merge(string(msg), func(pubKey, theJWT string) {
+			s.resolverStored(pubKey, theJWT, ResolverStoreSync)
+		}); err != nil {
+			s.Errorf("Warming up cache resulted in error: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error setting up warm up response handling: %v", err)
+	}
+	dr.subs = append(dr.subs, sub)
+	quit, stop := s.quitCh, dr.quit
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		for i := 0; i < cacheWarmAttempts && atomic.LoadInt32(&done) == 0; i++ {
+			s.sendInternalMsgLocked(accActiveReqSubj, respIb, nil, []byte{})
+			select {
+			case <-quit:
+				return
+			case <-stop:
+				return
+			case <-time.After(cacheWarmInterval):
+			}
+		}
+		if atomic.LoadInt32(&done) == 0 {
+			s.Warnf("No peer responded to warm up the jwt cache")
+		}
+		s.sysUnsubscribe(sub)
+	})
+	return nil
+}
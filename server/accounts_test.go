@@ -19,12 +19,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
@@ -614,6 +616,87 @@ func TestImportAuthorized(t *testing.T) {
 	checkBool(foo.checkStreamImportAuthorized(bz, "foo.bar.baz.1", nil), false, t)
 }
 
+func TestAccountExportApprovals(t *testing.T) {
+	_, foo, bar := simpleAccountServer(t)
+
+	if approvals := foo.ExportApprovals(); len(approvals) != 0 {
+		t.Fatalf("Expected no approvals, got %+v", approvals)
+	}
+	// Public exports and token required exports have no approved importers.
+	foo.AddStreamExport("public", IsPublicExport)
+	foo.AddServiceExport("token.req", []*Account{})
+
+	foo.AddStreamExport("foo", []*Account{bar})
+	foo.AddServiceExport("req", []*Account{bar})
+	foo.AddServiceExport("foo", []*Account{bar})
+
+	expected := map[string][]string{
+		"foo": {bar.Name},
+		"req": {bar.Name},
+	}
+	if approvals := foo.ExportApprovals(); !reflect.DeepEqual(approvals, expected) {
+		t.Fatalf("Expected approvals %+v, got %+v", expected, approvals)
+	}
+	if approvals := bar.ExportApprovals(); len(approvals) != 0 {
+		t.Fatalf("Expected no approvals, got %+v", approvals)
+	}
+
+	// Exports that are not advertised are omitted.
+	if err := foo.SetExportAdvertised("req", false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(expected, "req")
+	if approvals := foo.ExportApprovals(); !reflect.DeepEqual(approvals, expected) {
+		t.Fatalf("Expected approvals %+v, got %+v", expected, approvals)
+	}
+}
+
+func TestAccountShadowSubCount(t *testing.T) {
+	s, fooAcc, barAcc := simpleAccountServer(t)
+	defer s.Shutdown()
+
+	for _, subj := range []string{"foo", "baz"} {
+		if err := fooAcc.AddStreamExport(subj, nil); err != nil {
+			t.Fatalf("Error adding account export: %v", err)
+		}
+		if err := barAcc.AddStreamImport(fooAcc, subj, "import"); err != nil {
+			t.Fatalf("Error adding account import: %v", err)
+		}
+	}
+
+	c1, _, _ := newClientForServer(s)
+	defer c1.close()
+	if err := c1.registerWithAccount(barAcc); err != nil {
+		t.Fatalf("Error registering client with 'bar' account: %v", err)
+	}
+	c2, _, _ := newClientForServer(s)
+	defer c2.close()
+	if err := c2.registerWithAccount(barAcc); err != nil {
+		t.Fatalf("Error registering client with 'bar' account: %v", err)
+	}
+
+	// The wildcard subscription covers both imports.
+	if err := c1.parse([]byte("SUB import.foo 1\r\nSUB import.> 2\r\n")); err != nil {
+		t.Fatalf("Error for client: %v", err)
+	}
+	if err := c2.parse([]byte("SUB import.baz 1\r\nSUB other 2\r\n")); err != nil {
+		t.Fatalf("Error for client: %v", err)
+	}
+	if n := barAcc.ShadowSubCount(); n != 4 {
+		t.Fatalf("Expected 4 shadow subscriptions, got %d", n)
+	}
+	if n := fooAcc.ShadowSubCount(); n != 0 {
+		t.Fatalf("Expected no shadow subscriptions for the exporter, got %d", n)
+	}
+
+	if err := c1.parse([]byte("UNSUB 2\r\n")); err != nil {
+		t.Fatalf("Error for client: %v", err)
+	}
+	if n := barAcc.ShadowSubCount(); n != 2 {
+		t.Fatalf("Expected 2 shadow subscriptions, got %d", n)
+	}
+}
+
 func TestSimpleMapping(t *testing.T) {
 	s, fooAcc, barAcc := simpleAccountServer(t)
 	defer s.Shutdown()
@@ -2344,6 +2427,59 @@ func BenchmarkNewRouteReply(b *testing.B) {
 	}
 }
 
+func BenchmarkAccountAddServiceImports(b *testing.B) {
+	opts := defaultServerOptions
+	s := New(&opts)
+	dest, err := s.RegisterAccount("$dest")
+	if err != nil {
+		b.Fatalf("Error creating account: %v", err)
+	}
+	if err := dest.AddServiceExport("svc.>", nil); err != nil {
+		b.Fatalf("Error adding service export: %v", err)
+	}
+	subjects := make([]string, 1000)
+	for i := range subjects {
+		subjects[i] = fmt.Sprintf("svc.%d", i)
+	}
+
+	var waited time.Duration
+	var reads int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acc, err := s.RegisterAccount(fmt.Sprintf("$imp%d", i))
+		if err != nil {
+			b.Fatalf("Error creating account: %v", err)
+		}
+		// Readers contend for the account lock while the imports are added.
+		done := make(chan struct{})
+		wait := make(chan time.Duration)
+		go func() {
+			var total time.Duration
+			for n := 1; ; n++ {
+				select {
+				case <-done:
+					wait <- total / time.Duration(n)
+					return
+				default:
+				}
+				start := time.Now()
+				acc.mu.RLock()
+				acc.mu.RUnlock()
+				total += time.Since(start)
+			}
+		}()
+		for _, subj := range subjects {
+			if err := acc.AddServiceImport(dest, subj, _EMPTY_); err != nil {
+				b.Fatalf("Error adding service import: %v", err)
+			}
+		}
+		close(done)
+		waited += <-wait
+		reads++
+	}
+	b.ReportMetric(float64(waited.Nanoseconds())/float64(reads), "rlock-wait-ns")
+}
+
 func TestSamplingHeader(t *testing.T) {
 	test := func(expectSampling bool, h http.Header) {
 		t.Helper()
@@ -2403,3 +2539,369 @@ func TestSamplingHeader(t *testing.T) {
 	test(true, http.Header{"traceparent": []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
 	test(false, http.Header{"traceparent": []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}})
 }
+
+func TestAccountSubjectMapping(t *testing.T) {
+	acc := NewAccount("$foo")
+	for _, bad := range [][]string{
+		{"foo.*", "bar"},
+		{"foo.>", "bar.*"},
+		{"foo.*.>", "bar.>.*"},
+		{"foo..bar", "bar"},
+	} {
+		if err := acc.AddMapping(bad[0], bad[1]); err == nil {
+			t.Fatalf("Expected an error for mapping %q -> %q", bad[0], bad[1])
+		}
+	}
+	for _, m := range [][]string{
+		{"foo", "bar"},
+		{"orders.*", "orders.v2.*"},
+		{"a.*.b.>", "c.*.>"},
+	} {
+		if err := acc.AddMapping(m[0], m[1]); err != nil {
+			t.Fatalf("Error adding mapping %q -> %q: %v", m[0], m[1], err)
+		}
+	}
+	for _, test := range []struct {
+		subj   string
+		mapped string
+	}{
+		{"foo", "bar"},
+		{"foo.bar", ""},
+		{"orders.22", "orders.v2.22"},
+		{"orders.22.33", ""},
+		{"orders", ""},
+		{"a.1.b.2.3", "c.1.2.3"},
+		{"a.1.b", ""},
+	} {
+		subj, ok := acc.selectMappedSubject(test.subj)
+		if test.mapped == "" {
+			if ok || subj != test.subj {
+				t.Fatalf("Expected %q to not be mapped, got %q", test.subj, subj)
+			}
+		} else if !ok || subj != test.mapped {
+			t.Fatalf("Expected %q to be mapped to %q, got %q", test.subj, test.mapped, subj)
+		}
+	}
+	if !acc.RemoveMapping("orders.*") || acc.RemoveMapping("orders.*") {
+		t.Fatalf("Expected mapping to be removed once")
+	}
+	if _, ok := acc.selectMappedSubject("orders.22"); ok {
+		t.Fatalf("Expected mapping to be gone")
+	}
+}
+
+func TestAccountTrafficStats(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{NewAccount("foo"), NewAccount("bar")}
+	opts.Users = []*User{
+		{Username: "foo", Password: "pwd", Account: opts.Accounts[0]},
+		{Username: "bar", Password: "pwd", Account: opts.Accounts[1]},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://foo:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+
+	ncb := natsConnect(t, fmt.Sprintf("nats://bar:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+
+	const n = 10
+	payload := []byte("hello world")
+	for i := 0; i < n; i++ {
+		natsPub(t, nc, "foo", payload)
+	}
+	for i := 0; i < n; i++ {
+		natsNexMsg(t, sub, time.Second)
+	}
+
+	fooAcc, err := s.LookupAccount("foo")
+	require_NoError(t, err)
+	expected := AccountTrafficStats{
+		InMsgs:   n,
+		OutMsgs:  n,
+		InBytes:  int64(n * len(payload)),
+		OutBytes: int64(n * len(payload)),
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if ts := fooAcc.TrafficStats(); ts != expected {
+			return fmt.Errorf("Expected %+v, got %+v", expected, ts)
+		}
+		return nil
+	})
+
+	barAcc, err := s.LookupAccount("bar")
+	require_NoError(t, err)
+	if ts := barAcc.TrafficStats(); ts != (AccountTrafficStats{}) {
+		t.Fatalf("Expected no traffic for bar, got %+v", ts)
+	}
+
+	if ts := fooAcc.ResetTrafficStats(); ts != expected {
+		t.Fatalf("Expected reset to return %+v, got %+v", expected, ts)
+	}
+	if ts := fooAcc.TrafficStats(); ts != (AccountTrafficStats{}) {
+		t.Fatalf("Expected stats to be reset, got %+v", ts)
+	}
+}
+
+func TestAccountServiceImportIdleTimeout(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		service_import_idle_timeout: "100ms"
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				exports: [{service: "svc"}]
+			}
+			B {
+				users: [{user: b, password: b}]
+				imports: [{service: {account: A, subject: "svc"}}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:a@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	natsSub(t, nca, "svc", func(m *nats.Msg) {
+		m.Respond([]byte("ok"))
+	})
+	natsFlush(t, nca)
+
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:b@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+	if _, err := ncb.Request("svc", nil, time.Second); err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+
+	accB, err := s.LookupAccount("B")
+	require_NoError(t, err)
+	hasSub := func() bool {
+		accB.mu.RLock()
+		defer accB.mu.RUnlock()
+		return accB.imports.services["svc"].sid != nil
+	}
+	require_True(t, hasSub())
+
+	// Once idle the subscription of the import is torn down.
+	checkFor(t, time.Second, 20*time.Millisecond, func() error {
+		if hasSub() {
+			return fmt.Errorf("Service import subscription still present")
+		}
+		return nil
+	})
+	if r := accB.sl.Match("svc"); len(r.psubs) != 0 {
+		t.Fatalf("Expected no subscription on %q, got %d", "svc", len(r.psubs))
+	}
+
+	// The next request sets it up again.
+	if _, err := ncb.Request("svc", nil, time.Second); err != nil {
+		t.Fatalf("Error on request after idle: %v", err)
+	}
+	require_True(t, hasSub())
+}
+
+func TestAccountServiceExportMaxInFlight(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				exports: [{service: "svc"}]
+			}
+			B {
+				users: [{user: b, password: b}]
+				imports: [{service: {account: A, subject: "svc"}}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	accA, err := s.LookupAccount("A")
+	require_NoError(t, err)
+	if err := accA.SetServiceExportMaxInFlight("nope", 1); err != ErrMissingService {
+		t.Fatalf("Expected %v, got %v", ErrMissingService, err)
+	}
+	require_NoError(t, accA.SetServiceExportMaxInFlight("svc", 1))
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:a@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	sub := natsSubSync(t, nca, "svc")
+	natsFlush(t, nca)
+
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"user\":\"b\",\"pass\":\"b\",\"headers\":true,\"no_responders\":true}\r\n" +
+		"SUB reply.> 1\r\nPUB svc reply.1 0\r\n\r\nPUB svc reply.2 0\r\n\r\n")
+
+	// The first request is pending, so the second one is rejected.
+	l, err := cr.ReadString('\n')
+	require_NoError(t, err)
+	if am := hmsgPat.FindAllStringSubmatch(l, -1); len(am) == 0 || am[0][SUB_INDEX] != "reply.2" {
+		t.Fatalf("Expected a no responders status for the second request, got %q", l)
+	}
+	checkPayload(cr, []byte("NATS/1.0 503\r\n\r\n\r\n"), t)
+
+	m := natsNexMsg(t, sub, time.Second)
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected only one request to reach the service, got %v", err)
+	}
+
+	// Once answered, there is room for another request.
+	require_NoError(t, m.Respond([]byte("ok")))
+	l, err = cr.ReadString('\n')
+	require_NoError(t, err)
+	if am := msgPat.FindAllStringSubmatch(l, -1); len(am) == 0 || am[0][SUB_INDEX] != "reply.1" {
+		t.Fatalf("Expected the response to the first request, got %q", l)
+	}
+	checkPayload(cr, []byte("ok\r\n"), t)
+
+	c.parseAsync("PUB svc reply.3 0\r\n\r\n")
+	m = natsNexMsg(t, sub, time.Second)
+	if m.Subject != "svc" {
+		t.Fatalf("Unexpected request subject %q", m.Subject)
+	}
+}
+
+func TestAccountExportDeprecation(t *testing.T) {
+	s, fooAcc, barAcc := simpleAccountServer(t)
+	defer s.Shutdown()
+	l := &captureWarnLogger{warn: make(chan string, 10)}
+	s.SetLogger(l, false, false)
+
+	require_NoError(t, fooAcc.AddServiceExport("svc", nil))
+	require_NoError(t, fooAcc.AddStreamExport("news.>", nil))
+	if err := fooAcc.SetExportDeprecated("nope", "gone"); err != ErrMissingExport {
+		t.Fatalf("Expected %v, got %v", ErrMissingExport, err)
+	}
+	require_NoError(t, fooAcc.SetExportDeprecated("svc", "use svc.v2"))
+	require_NoError(t, fooAcc.SetExportDeprecated("news.>", "use events.>"))
+
+	expectWarnings := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case w := <-l.warn:
+				if !strings.Contains(w, "deprecated") {
+					t.Fatalf("Unexpected warning: %q", w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %d warnings, got %d", n, i)
+			}
+		}
+		select {
+		case w := <-l.warn:
+			t.Fatalf("Unexpected warning: %q", w)
+		default:
+		}
+	}
+
+	require_NoError(t, barAcc.AddServiceImport(fooAcc, "svc", ""))
+	require_NoError(t, barAcc.AddStreamImport(fooAcc, "news.sports", ""))
+	expectWarnings(2)
+
+	// The note is logged once per importing account.
+	require_NoError(t, barAcc.AddServiceImport(fooAcc, "other", "svc"))
+	require_NoError(t, barAcc.AddStreamImport(fooAcc, "news.sports", "local"))
+	expectWarnings(0)
+	bazAcc, err := s.RegisterAccount("$baz")
+	require_NoError(t, err)
+	require_NoError(t, bazAcc.AddServiceImport(fooAcc, "svc", ""))
+	expectWarnings(1)
+
+	info, err := s.accountInfo(barAcc.Name)
+	require_NoError(t, err)
+	if len(info.Imports) != 4 {
+		t.Fatalf("Expected 4 imports, got %d", len(info.Imports))
+	}
+	for _, im := range info.Imports {
+		expected := "use svc.v2"
+		if strings.HasPrefix(string(im.Subject), "news.") {
+			expected = "use events.>"
+		}
+		if im.Deprecated != expected {
+			t.Fatalf("Expected import of %q to have note %q, got %q", im.Subject, expected, im.Deprecated)
+		}
+	}
+	info, err = s.accountInfo(fooAcc.Name)
+	require_NoError(t, err)
+	for _, e := range info.Exports {
+		if e.Deprecated == _EMPTY_ {
+			t.Fatalf("Expected export %q to be deprecated", e.Subject)
+		}
+	}
+
+	// Exports are rebuilt when claims are applied, this does not log the
+	// note again. A new note is logged.
+	fooAcc.mu.Lock()
+	fooAcc.exports = exportMap{}
+	fooAcc.mu.Unlock()
+	require_NoError(t, fooAcc.AddServiceExport("svc", nil))
+	require_NoError(t, fooAcc.SetExportDeprecated("svc", "use svc.v2"))
+	require_NoError(t, barAcc.AddServiceImport(fooAcc, "other.2", "svc"))
+	expectWarnings(0)
+	require_NoError(t, fooAcc.SetExportDeprecated("svc", "use svc.v3"))
+	require_NoError(t, barAcc.AddServiceImport(fooAcc, "other.3", "svc"))
+	expectWarnings(1)
+
+	// Of overlapping exports, the note of the most specific one is used.
+	require_NoError(t, fooAcc.AddStreamExport("news.>", nil))
+	require_NoError(t, fooAcc.AddStreamExport("news.sports.*", nil))
+	require_NoError(t, fooAcc.SetExportDeprecated("news.>", "use events.>"))
+	require_NoError(t, fooAcc.SetExportDeprecated("news.sports.*", "use sports.*"))
+	for i := 0; i < 10; i++ {
+		if note := fooAcc.exportDeprecation("news.sports.today", jwt.Stream); note != "use sports.*" {
+			t.Fatalf("Expected the note of the most specific export, got %q", note)
+		}
+	}
+}
+
+func TestAccountStreamImportFilterConcurrentSubs(t *testing.T) {
+	s, fooAcc, barAcc := simpleAccountServer(t)
+	defer s.Shutdown()
+
+	require_NoError(t, fooAcc.AddStreamExport("foo.>", nil))
+	require_NoError(t, barAcc.AddStreamImport(fooAcc, "foo.>", "import"))
+
+	c, _, _ := newClientForServer(s)
+	defer c.close()
+	require_NoError(t, c.registerWithAccount(barAcc))
+
+	// Changing the filter while subscriptions are shadowed is safe.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			filter := "foo.bar.>"
+			if i%2 == 0 {
+				filter = _EMPTY_
+			}
+			if err := barAcc.SetStreamImportFilter(fooAcc, "foo.>", filter); err != nil {
+				t.Errorf("Error setting filter: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if err := c.parse([]byte("SUB import.*.> 1\r\nUNSUB 1\r\n")); err != nil {
+			t.Fatalf("Error for client: %v", err)
+		}
+	}
+	<-done
+
+	// Subscriptions made after the filter is set use it.
+	require_NoError(t, barAcc.SetStreamImportFilter(fooAcc, "foo.>", "foo.bar.>"))
+	require_NoError(t, c.parse([]byte("SUB import.*.> 2\r\n")))
+	c.mu.Lock()
+	shadow := c.subs["2"].shadow
+	c.mu.Unlock()
+	if len(shadow) != 1 || string(shadow[0].subject) != "foo.bar.>" {
+		t.Fatalf("Expected a shadow subscription on %q, got %+v", "foo.bar.>", shadow)
+	}
+}
@@ -200,6 +200,50 @@ func (s *Server) assignGlobalAccountToOrphanUsers(nkeys map[string]*NkeyUser, us
 	}
 }
 
+// mergeTagPermissions returns the permissions p merged with the publish and
+// subscribe permissions configured for any of the given user tags. Allowed
+// subjects extend an explicit allow list, they never restrict a user that is
+// allowed everything. Denied subjects are always added.
+func mergeTagPermissions(p *Permissions, tags jwt.TagList, policy map[string]*Permissions) *Permissions {
+	if len(tags) == 0 || len(policy) == 0 {
+		return p
+	}
+	merged := p.clone()
+	for _, tag := range tags {
+		tp := policy[strings.ToLower(tag)]
+		if tp == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &Permissions{}
+		}
+		merged.Publish = mergeSubjectPermission(merged.Publish, tp.Publish)
+		merged.Subscribe = mergeSubjectPermission(merged.Subscribe, tp.Subscribe)
+	}
+	if merged != nil && merged.Publish == nil && merged.Subscribe == nil && merged.Response == nil {
+		return p
+	}
+	return merged
+}
+
+// Merges the subject permission src into dst, see mergeTagPermissions.
+func mergeSubjectPermission(dst, src *SubjectPermission) *SubjectPermission {
+	if src == nil {
+		return dst
+	}
+	if dst == nil {
+		if len(src.Deny) == 0 {
+			return nil
+		}
+		dst = &SubjectPermission{}
+	}
+	if dst.Allow != nil {
+		dst.Allow = append(dst.Allow, src.Allow...)
+	}
+	dst.Deny = append(dst.Deny, src.Deny...)
+	return dst
+}
+
 // If the given permissions has a ResponsePermission
 // set, ensure that defaults are set (if values are 0)
 // and that a Publish permission is set, and Allow
@@ -388,22 +432,47 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		if c.opts.JWT == "" {
 			s.mu.Unlock()
 			c.Debugf("Authentication requires a user JWT")
+			c.authErr = ErrJWTRequired
 			return false
 		}
 		// So we have a valid user jwt here.
-		juc, err = jwt.DecodeUserClaims(c.opts.JWT)
+		// Credentials for another kind of nkey get a more specific error.
+		if err := checkUserCredentialType(c.opts.JWT); err != nil {
+			s.mu.Unlock()
+			c.Debugf("User JWT not valid: %v", err)
+			c.authErr = err
+			return false
+		}
+		juc, err = s.decodeUserClaims(c.opts.JWT)
 		if err != nil {
 			s.mu.Unlock()
 			c.Debugf("User JWT not valid: %v", err)
+			c.authErr = ErrJWTInvalid
 			return false
 		}
+		c.mu.Lock()
+		c.uclaims = juc
+		c.mu.Unlock()
 		vr := jwt.CreateValidationResults()
 		juc.Validate(vr)
 		if vr.IsBlocking(true) {
 			s.mu.Unlock()
 			c.Debugf("User JWT no longer valid: %+v", vr)
+			if juc.Expires > 0 && juc.Expires <= time.Now().Unix() {
+				c.authErr = ErrJWTExpired
+			} else {
+				c.authErr = ErrJWTInvalid
+			}
 			return false
 		}
+		if opts.RejectUnknownClaimFields {
+			if unknown := unknownClaimFields(c.opts.JWT, userClaimFields); len(unknown) > 0 {
+				s.mu.Unlock()
+				c.Warnf("User JWT rejected, unknown claim fields %v", unknown)
+				c.authErr = ErrClaimsUnknownFields
+				return false
+			}
+		}
 	}
 
 	// Check if we have nkeys or users for client.
@@ -504,12 +573,14 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 			// user only as an MQTT client.
 			c.Debugf("%v", err)
 			if len(allowedConnTypes) == 0 {
+				c.authErr = ErrJWTUserPermissions
 				return false
 			}
 			err = nil
 		}
 		if !c.connectionTypeAllowed(allowedConnTypes) {
 			c.Debugf("Connection type not allowed")
+			c.authErr = ErrJWTUserPermissions
 			return false
 		}
 		issuer := juc.Issuer
@@ -518,6 +589,11 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		if acc, err = s.LookupAccount(issuer); acc == nil {
 			c.Debugf("Account JWT lookup error: %v", err)
+			if err == ErrAccountExpired {
+				c.authErr = ErrJWTAccountExpired
+			} else {
+				c.authErr = ErrMissingAccount
+			}
 			return false
 		}
 		if !s.isTrustedIssuer(acc.Issuer) {
@@ -530,6 +606,17 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		if acc.IsExpired() {
 			c.Debugf("Account JWT has expired")
+			c.authErr = ErrJWTAccountExpired
+			return false
+		}
+		if acc.hasPendingRequiredImports() {
+			c.Debugf("Account has required imports that are not resolved")
+			c.authErr = ErrAccountRequiredImportsPending
+			return false
+		}
+		if !acc.userAuthAllowed(juc.BearerToken) {
+			c.Debugf("User authentication method not allowed by account")
+			c.authErr = ErrJWTUserAuthMethod
 			return false
 		}
 		// skip validation of nonce when presented with a bearer token
@@ -561,30 +648,53 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		if acc.checkUserRevoked(juc.Subject, juc.IssuedAt) {
 			c.Debugf("User authentication revoked")
+			c.authErr = ErrJWTRevoked
+			return false
+		}
+		if juc.IssuerAccount != "" && acc.checkSigningKeyRevoked(juc.Issuer, juc.IssuedAt) {
+			c.Debugf("User signing key revoked")
+			c.authErr = ErrJWTRevoked
+			return false
+		}
+		if cutoff := opts.RejectUsersIssuedBefore; !cutoff.IsZero() && juc.IssuedAt < cutoff.Unix() {
+			c.Debugf("User JWT issued before %v", cutoff)
+			c.authErr = ErrJWTRevoked
 			return false
 		}
 		if !validateSrc(juc, c.host) {
 			c.Errorf("Bad src Ip %s", c.host)
+			c.authErr = ErrJWTUserPermissions
+			return false
+		}
+		if max := opts.MaxUserTimeRanges; max > 0 && len(juc.Times) > max {
+			c.Debugf("User JWT has %d time ranges, exceeding the maximum of %d", len(juc.Times), max)
+			c.authErr = ErrJWTUserPermissions
 			return false
 		}
 		allowNow, validFor := validateTimes(juc)
 		if !allowNow {
 			c.Errorf("Outside connect times")
+			c.authErr = ErrJWTUserPermissions
 			return false
 		}
 
+		// Hold onto the user's public key. This is set before registering
+		// with the account so that connections can be tracked per user.
+		c.pubKey = juc.Subject
 		nkey = buildInternalNkeyUser(juc, allowedConnTypes, acc)
+		nkey.Permissions = mergeTagPermissions(nkey.Permissions, juc.Tags, opts.UserTagPermissions)
 		if err := c.RegisterNkeyUser(nkey); err != nil {
 			return false
 		}
-		// Hold onto the user's public key.
-		c.pubKey = juc.Subject
 
 		// Generate an event if we have a system account.
 		s.accountConnectEvent(c)
 
-		// Check if we need to set an auth timer if the user jwt expires.
-		c.setExpiration(juc.Claims(), validFor)
+		// Check if we need to set an auth timer if the user jwt expires,
+		// unless this type of connection is exempt.
+		if _, exempt := opts.AuthExpirationExemptConnectionTypes[c.connectionType()]; !exempt {
+			c.setExpiration(juc.Claims(), validFor)
+		}
 		return true
 	}
 
@@ -921,6 +1031,15 @@ func comparePasswords(serverPassword, clientPassword string) bool {
 	return true
 }
 
+// validateAuthErrorTemplate checks that the auth error template fits on a
+// single protocol line.
+func validateAuthErrorTemplate(o *Options) error {
+	if strings.ContainsAny(o.AuthErrorTemplate, "\r\n") {
+		return fmt.Errorf("auth error template can not contain line breaks")
+	}
+	return nil
+}
+
 func validateAuth(o *Options) error {
 	for _, u := range o.Users {
 		if err := validateAllowedConnectionTypes(u.AllowedConnectionTypes); err != nil {
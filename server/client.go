@@ -15,6 +15,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -114,6 +115,8 @@ const (
 	writeLoopStarted                         // Marks that the writeLoop has been started.
 	skipFlushOnClose                         // Marks that flushOutbound() should not be called on connection close.
 	expectConnect                            // Marks if this connection is expected to send a CONNECT
+	subsLimitLowered                         // Marks that the subscription limit was lowered below current usage.
+	subsLimitRejected                        // Marks that a subscription was rejected after the limit was lowered.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -177,6 +180,12 @@ const (
 	MsgHeaderViolation
 	NoRespondersRequiresHeaders
 	ClusterNameConflict
+	MaxUserConnectionsExceeded
+	AccountDrained
+	AccountAuthenticationExpired
+	Kicked
+	AccountInMaintenance
+	AccountRequiresTLS
 )
 
 // Some flags passed to processMsgResultsEx
@@ -205,22 +214,29 @@ type client struct {
 	rrTracking *rrTracking
 	mpay       int32
 	msubs      int32
+	msublen    int32
+	muconns    int32
+	ctypes     atomic.Value // map[string]struct{} of allowed content types, nil if any.
 	mcl        int32
 	mu         sync.Mutex
 	cid        uint64
 	start      time.Time
 	nonce      []byte
 	pubKey     string
+	authErr    error
 	nc         net.Conn
 	ncs        atomic.Value
 	out        outbound
 	user       *NkeyUser
+	uclaims    *jwt.UserClaims // user JWT claims as verified on authentication.
 	host       string
 	port       uint16
 	subs       map[string]*subscription
 	replies    map[string]*resp
 	mperms     *msgDeny
 	darray     []string
+	permsHash  string // hash of the permissions applied to this client.
+	permsBuild int    // number of times permissions were built for this client.
 	pcd        map[*client]struct{}
 	atmr       *time.Timer
 	ping       pinfo
@@ -287,6 +303,8 @@ type permissions struct {
 	pub    perm
 	resp   *ResponsePermission
 	pcache map[string]bool
+	// Subject namespace of the account, subjects outside of it are denied.
+	namespace string
 }
 
 // This is used to dynamically track responses and reply subjects
@@ -548,6 +566,21 @@ func (c *client) reportErrRegisterAccount(acc *Account, err error) {
 	if err == ErrTooManyAccountConnections {
 		c.maxAccountConnExceeded()
 		return
+	} else if err == ErrTooManyUserConnections {
+		c.maxUserConnExceeded()
+		return
+	} else if err == ErrAccountDraining {
+		c.sendErrAndDebug(ErrAccountDraining.Error())
+		c.closeConnection(AccountDrained)
+		return
+	} else if err == ErrAccountInMaintenance {
+		c.sendErrAndDebug(AccountInMaintenance.String())
+		c.closeConnection(AccountInMaintenance)
+		return
+	} else if err == ErrAccountRequiresTLS {
+		c.sendErrAndDebug(AccountRequiresTLS.String())
+		c.closeConnection(AccountRequiresTLS)
+		return
 	}
 	c.Errorf("Problem registering with account [%s]", acc.Name)
 	c.sendErr("Failed Account Registration")
@@ -559,6 +592,9 @@ func (c *client) registerWithAccount(acc *Account) error {
 	if acc == nil || acc.sl == nil {
 		return ErrBadAccount
 	}
+	// Clients are registered again with their account on reload, which must
+	// not reject connections that are already established.
+	reregister := c.acc == acc
 	// If we were previously registered, usually to $G, do accounting here to remove.
 	if c.acc != nil {
 		if prev := c.acc.removeClient(c); prev == 1 && c.srv != nil {
@@ -571,13 +607,30 @@ func (c *client) registerWithAccount(acc *Account) error {
 	srv := c.srv
 	c.acc = acc
 	c.applyAccountLimits()
+	muconns := c.muconns
+	_, isTLS := c.nc.(*tls.Conn)
 	c.mu.Unlock()
 
+	// Draining, maintenance and TLS requirements only apply to new connections.
+	if kind == CLIENT && !reregister {
+		if acc.isDraining() {
+			return ErrAccountDraining
+		} else if acc.inMaintenance() {
+			return ErrAccountInMaintenance
+		} else if !isTLS && acc.requiresTLS() {
+			return ErrAccountRequiresTLS
+		}
+	}
+
 	// Check if we have a max connections violation
 	if kind == CLIENT && acc.MaxTotalConnectionsReached() {
 		return ErrTooManyAccountConnections
 	} else if kind == LEAF && acc.MaxTotalLeafNodesReached() {
 		return ErrTooManyAccountConnections
+	} else if kind == CLIENT && acc.maxUserConnectionsReached(c.pubKey, muconns) {
+		return ErrTooManyUserConnections
+	} else if (kind == CLIENT || kind == LEAF) && acc.maxConnectionTypeReached(c.connectionType()) {
+		return ErrTooManyAccountConnections
 	}
 
 	// Add in new one.
@@ -617,16 +670,33 @@ func (c *client) applyAccountLimits() {
 	}
 	c.mpay = jwt.NoLimit
 	c.msubs = jwt.NoLimit
+	c.msublen = jwt.NoLimit
+	c.muconns = jwt.NoLimit
+	var uctypes map[string]struct{}
 	if c.opts.JWT != "" { // user jwt implies account
-		if uc, _ := jwt.DecodeUserClaims(c.opts.JWT); uc != nil {
+		if uc := c.uclaims; uc != nil {
 			c.mpay = int32(uc.Limits.Payload)
 			c.msubs = int32(uc.Limits.Subs)
+			var ext userClaimsExt
+			if decodeClaimsExt(c.opts.JWT, uc.ID, &ext) {
+				if ext.MaxConnections > 0 {
+					c.muconns = int32(ext.MaxConnections)
+				}
+				uctypes = contentTypeSet(ext.AllowedContentTypes)
+			}
 		}
 	}
+	c.ctypes.Store(intersectContentTypes(c.acc.ctypes, uctypes))
 	minLimit(&c.mpay, c.acc.mpay)
 	minLimit(&c.msubs, c.acc.msubs)
+	if c.acc.msublen > 0 {
+		c.msublen = c.acc.msublen
+	}
 	s := c.srv
 	opts := s.getOpts()
+	if opts.MaxSubjectLength > 0 {
+		minLimit(&c.msublen, int32(opts.MaxSubjectLength))
+	}
 	mPay := opts.MaxPayload
 	// options encode unlimited differently
 	if mPay == 0 {
@@ -645,6 +715,11 @@ func (c *client) applyAccountLimits() {
 		c.Errorf("Max Subscriptions set to %d from server overrides account or user config", opts.MaxSubs)
 	}
 	if c.subsAtLimit() {
+		if opts.LenientSubscriptionLimits {
+			// Keep existing subscriptions, new ones will be rejected.
+			c.flags.set(subsLimitLowered)
+			return
+		}
 		go func() {
 			c.maxSubsExceeded()
 			time.Sleep(20 * time.Millisecond)
@@ -690,18 +765,60 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 		}
 	}
 
+	var ns string
+	if user.Account != nil && c.kind == CLIENT {
+		ns = user.Account.subjectNamespace()
+	}
+
 	c.mu.Lock()
 	c.user = user
 	// Assign permissions.
-	if user.Permissions == nil {
+	c.setPermissionsInNamespace(user.Permissions, ns)
+	c.permsHash = permissionsHash(user.Permissions, ns)
+	c.mu.Unlock()
+	return nil
+}
+
+// permissionsHash returns a hash of perms, used to detect that the
+// permissions of a client did not change.
+func permissionsHash(perms *Permissions, namespace string) string {
+	if perms == nil && namespace == _EMPTY_ {
+		return _EMPTY_
+	}
+	b, _ := json.Marshal(perms)
+	b = append(b, namespace...)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// updatePermissions replaces the permissions of the client, unless they are
+// the same as the ones already applied. Rebuilding permissions would reset
+// state such as the tracked replies. Returns true if permissions were rebuilt.
+// Lock is held on entry.
+func (c *client) updatePermissions(perms *Permissions, namespace string) bool {
+	hash := permissionsHash(perms, namespace)
+	if hash == c.permsHash {
+		return false
+	}
+	c.setPermissionsInNamespace(perms, namespace)
+	c.permsHash = hash
+	return true
+}
+
+// setPermissionsInNamespace sets the permissions of the client, further
+// restricted to the subject namespace of its account, if any.
+// Lock is held on entry.
+func (c *client) setPermissionsInNamespace(perms *Permissions, namespace string) {
+	if perms == nil && namespace == _EMPTY_ {
 		// Reset perms to nil in case client previously had them.
 		c.perms = nil
 		c.mperms = nil
-	} else {
-		c.setPermissions(user.Permissions)
+		return
 	}
-	c.mu.Unlock()
-	return nil
+	if perms == nil {
+		perms = &Permissions{}
+	}
+	c.setPermissions(perms)
+	c.perms.namespace = namespace
 }
 
 func splitSubjectQueue(sq string) ([]byte, []byte, error) {
@@ -724,6 +841,7 @@ func (c *client) setPermissions(perms *Permissions) {
 	}
 	c.perms = &permissions{}
 	c.perms.pcache = make(map[string]bool)
+	c.permsBuild++
 
 	// Loop over publish permissions
 	if perms.Publish != nil {
@@ -746,6 +864,13 @@ func (c *client) setPermissions(perms *Permissions) {
 	// Check if we are allowed to send responses.
 	if perms.Response != nil {
 		rp := *perms.Response
+		// Cap the expiration if the server has a maximum. A negative
+		// value would mean no expiration at all, so cap that as well.
+		if c.srv != nil {
+			if max := c.srv.getOpts().MaxResponsePermissionExpiration; max > 0 && (rp.Expires <= 0 || rp.Expires > max) {
+				rp.Expires = max
+			}
+		}
 		c.perms.resp = &rp
 		c.replies = make(map[string]*resp)
 	}
@@ -1690,19 +1815,84 @@ func (c *client) sendErrAndDebug(err string) {
 	c.Debugf(err)
 }
 
+// authAccountName returns the name of the account the client authenticates
+// with, if it can be determined.
+// Lock should be held.
+func (c *client) authAccountName() string {
+	if c.opts.JWT != _EMPTY_ {
+		// The client may not be registered yet, so use the account of the
+		// user JWT if it was verified.
+		juc := c.uclaims
+		if juc == nil {
+			return _EMPTY_
+		}
+		if juc.IssuerAccount != _EMPTY_ {
+			return juc.IssuerAccount
+		}
+		return juc.Issuer
+	} else if c.acc != nil && c.acc.Name != globalAccountName {
+		// Clients are in the global account until they authenticate.
+		return c.acc.Name
+	}
+	return _EMPTY_
+}
+
+// authErrMsg returns the error sent to a client disconnected for an
+// authentication failure, formatted with the auth error template if set.
+func (c *client) authErrMsg(msg string, reason ClosedState) string {
+	if c.srv == nil {
+		return msg
+	}
+	tmpl := c.srv.getOpts().AuthErrorTemplate
+	if tmpl == _EMPTY_ {
+		return msg
+	}
+	c.mu.Lock()
+	account := c.authAccountName()
+	cid := c.cid
+	c.mu.Unlock()
+	return strings.NewReplacer(
+		"{message}", msg,
+		"{reason}", reason.String(),
+		"{account}", account,
+		"{cid}", strconv.FormatUint(cid, 10),
+	).Replace(tmpl)
+}
+
 func (c *client) authTimeout() {
-	c.sendErrAndDebug("Authentication Timeout")
+	c.sendErrAndDebug(c.authErrMsg("Authentication Timeout", AuthenticationTimeout))
 	c.closeConnection(AuthenticationTimeout)
 }
 
 func (c *client) authExpired() {
-	c.sendErrAndDebug("User Authentication Expired")
+	c.countAuthExpiration()
+	c.sendErrAndDebug(c.authErrMsg("User Authentication Expired", AuthenticationExpired))
 	c.closeConnection(AuthenticationExpired)
 }
 
 func (c *client) accountAuthExpired() {
-	c.sendErrAndDebug("Account Authentication Expired")
-	c.closeConnection(AuthenticationExpired)
+	c.countAuthExpiration()
+	c.sendErrAndDebug(c.authErrMsg("Account Authentication Expired", AccountAuthenticationExpired))
+	c.closeConnection(AccountAuthenticationExpired)
+}
+
+// trafficStats returns the messages and bytes received from and sent to
+// the client.
+// Lock MUST NOT be held upon entry.
+func (c *client) trafficStats() AccountTrafficStats {
+	c.mu.Lock()
+	ts := AccountTrafficStats{OutMsgs: c.outMsgs, OutBytes: c.outBytes}
+	c.mu.Unlock()
+	ts.InMsgs = atomic.LoadInt64(&c.inMsgs)
+	ts.InBytes = atomic.LoadInt64(&c.inBytes)
+	return ts
+}
+
+// countAuthExpiration counts a disconnect because authentication expired.
+func (c *client) countAuthExpiration() {
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.authExpirations, 1)
+	}
 }
 
 func (c *client) authViolation() {
@@ -1715,6 +1905,7 @@ func (c *client) authViolation() {
 		hasUsers = s.users != nil
 		s.mu.Unlock()
 		defer s.sendAuthErrorEvent(c)
+		defer s.sendAuthRejectedEvent(c)
 
 	}
 	if hasTrustedNkeys {
@@ -1730,7 +1921,11 @@ func (c *client) authViolation() {
 	} else {
 		c.Errorf(ErrAuthentication.Error())
 	}
-	c.sendErr("Authorization Violation")
+	if ce, ok := c.authErr.(*credentialTypeErr); ok {
+		c.sendErr(c.authErrMsg(ce.Error(), AuthenticationViolation))
+	} else {
+		c.sendErr(c.authErrMsg("Authorization Violation", AuthenticationViolation))
+	}
 	c.closeConnection(AuthenticationViolation)
 }
 
@@ -1739,6 +1934,11 @@ func (c *client) maxAccountConnExceeded() {
 	c.closeConnection(MaxAccountConnectionsExceeded)
 }
 
+func (c *client) maxUserConnExceeded() {
+	c.sendErrAndErr(ErrTooManyUserConnections.Error())
+	c.closeConnection(MaxUserConnectionsExceeded)
+}
+
 func (c *client) maxConnExceeded() {
 	c.sendErrAndErr(ErrTooManyConnections.Error())
 	c.closeConnection(MaxConnectionsExceeded)
@@ -2219,6 +2419,11 @@ func (c *client) processSub(subject, queue, bsid []byte, cb msgHandler, noForwar
 
 	// Check permissions if applicable.
 	if kind == CLIENT {
+		if acc != nil && acc.isFrozen() {
+			c.mu.Unlock()
+			c.accountExpiredViolation("Subscription to", sub.subject)
+			return nil, ErrAccountExpired
+		}
 		// First do a pass whether queue subscription is valid. This does not necessarily
 		// mean that it will not be able to plain subscribe.
 		//
@@ -2237,14 +2442,30 @@ func (c *client) processSub(subject, queue, bsid []byte, cb msgHandler, noForwar
 			c.subPermissionViolation(sub)
 			return nil, ErrSubscribePermissionViolation
 		}
+		// Reject subjects that are longer than allowed.
+		if c.msublen > 0 && len(sub.subject) > int(c.msublen) {
+			c.mu.Unlock()
+			c.subPermissionViolation(sub)
+			return nil, ErrSubscribePermissionViolation
+		}
 	}
 
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
+		// If the limit was lowered below what the client had, it is
+		// disconnected only if it keeps subscribing after a rejection.
+		closeConn := c.flags.isSet(subsLimitRejected)
+		if c.flags.isSet(subsLimitLowered) {
+			c.flags.set(subsLimitRejected)
+		}
 		c.mu.Unlock()
 		c.maxSubsExceeded()
+		if closeConn {
+			c.closeConnection(MaxSubscriptionsExceeded)
+		}
 		return nil, ErrTooManySubs
 	}
+	c.flags.clear(subsLimitLowered | subsLimitRejected)
 
 	var updateGWs bool
 	var err error
@@ -2332,7 +2553,8 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 			continue
 		}
 		subj := string(sub.subject)
-		if subj == im.prefix+im.from {
+		from := im.subject()
+		if subj == im.prefix+from {
 			ims = append(ims, im)
 			continue
 		}
@@ -2352,10 +2574,10 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 			}
 			tokens = append(tokens, subj[start:])
 		}
-		if isSubsetMatch(tokens, im.prefix+im.from) {
+		if isSubsetMatch(tokens, im.prefix+from) {
 			ims = append(ims, im)
 		} else if hasWC {
-			if subjectIsSubsetMatch(im.prefix+im.from, subj) {
+			if subjectIsSubsetMatch(im.prefix+from, subj) {
 				froms = append(froms, im)
 			}
 		}
@@ -2397,25 +2619,77 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 	return nil
 }
 
+// ShadowSubscriptionEvent describes a shadow subscription, which mirrors a
+// subscription in the account exporting a stream the subscriber imports,
+// being created or removed.
+type ShadowSubscriptionEvent struct {
+	Created  bool   `json:"created"`
+	Account  string `json:"account"`
+	Importer string `json:"importer"`
+	Subject  string `json:"subject"`
+	Client   uint64 `json:"client_id"`
+}
+
+// ShadowSubscriptionHandler is invoked when shadow subscriptions are created
+// or removed, for instance when stream imports change or their activation
+// expires. It must not block.
+type ShadowSubscriptionHandler func(ShadowSubscriptionEvent)
+
+// SetShadowSubscriptionHandler will assign the handler invoked on shadow
+// subscription changes. Passing nil removes it.
+func (s *Server) SetShadowSubscriptionHandler(h ShadowSubscriptionHandler) {
+	s.shadowHandler.Store(h)
+}
+
+// shadowSubChanged logs and reports a shadow subscription being created or
+// removed.
+// Lock MUST NOT be held upon entry.
+func (c *client) shadowSubChanged(nsub *subscription, created bool) {
+	if created {
+		c.Debugf("Creating import subscription on %q from account %q", nsub.subject, nsub.im.acc.Name)
+	} else {
+		c.Debugf("Removing import subscription on %q from account %q", nsub.subject, nsub.im.acc.Name)
+	}
+	if c.srv == nil {
+		return
+	}
+	h, _ := c.srv.shadowHandler.Load().(ShadowSubscriptionHandler)
+	if h == nil {
+		return
+	}
+	c.mu.Lock()
+	var importer string
+	if c.acc != nil {
+		importer = c.acc.Name
+	}
+	c.mu.Unlock()
+	h(ShadowSubscriptionEvent{
+		Created:  created,
+		Account:  nsub.im.acc.Name,
+		Importer: importer,
+		Subject:  string(nsub.subject),
+		Client:   c.cid,
+	})
+}
+
 // Add in the shadow subscription.
 func (c *client) addShadowSub(sub *subscription, im *streamImport, useFrom bool) (*subscription, error) {
 	nsub := *sub // copy
 	nsub.im = im
 	if useFrom {
-		nsub.subject = []byte(im.from)
+		nsub.subject = []byte(im.subject())
 	} else if im.prefix != "" {
 		// redo subject here to match subject in the publisher account space.
 		// Just remove prefix from what they gave us. That maps into other space.
 		nsub.subject = sub.subject[len(im.prefix):]
 	}
 
-	c.Debugf("Creating import subscription on %q from account %q", nsub.subject, im.acc.Name)
-
 	if err := im.acc.sl.Insert(&nsub); err != nil {
 		errs := fmt.Sprintf("Could not add shadow import subscription for account %q", im.acc.Name)
 		c.Debugf(errs)
 		return nil, fmt.Errorf(errs)
 	}
+	c.shadowSubChanged(&nsub, true)
 
 	// Update our route map here.
 	c.srv.updateRouteSubscriptionMap(im.acc, &nsub, 1)
@@ -2431,6 +2705,11 @@ func (c *client) canSubscribe(subject string) bool {
 		return true
 	}
 
+	// Nothing outside of the account namespace is allowed.
+	if c.perms.namespace != _EMPTY_ && !subjectIsSubsetMatch(subject, c.perms.namespace) {
+		return false
+	}
+
 	allowed := true
 
 	// Check allow list. If no allow list that means all are allowed. Deny can overrule.
@@ -2484,6 +2763,10 @@ func (c *client) canQueueSubscribe(subject, queue string) bool {
 		return true
 	}
 
+	if c.perms.namespace != _EMPTY_ && !subjectIsSubsetMatch(subject, c.perms.namespace) {
+		return false
+	}
+
 	allowed := true
 
 	if c.perms.sub.allow != nil {
@@ -2557,8 +2840,11 @@ func (c *client) unsubscribe(acc *Account, sub *subscription, force, remove bool
 	for _, nsub := range shadowSubs {
 		if err := nsub.im.acc.sl.Remove(nsub); err != nil {
 			c.Debugf("Could not remove shadow import subscription for account %q", nsub.im.acc.Name)
-		} else if updateRoute {
-			c.srv.updateRouteSubscriptionMap(nsub.im.acc, nsub, -1)
+		} else {
+			c.shadowSubChanged(nsub, false)
+			if updateRoute {
+				c.srv.updateRouteSubscriptionMap(nsub.im.acc, nsub, -1)
+			}
 		}
 		// Now check on leafnode updates.
 		c.srv.updateLeafNodes(nsub.im.acc, nsub, -1)
@@ -3121,7 +3407,7 @@ func (c *client) pubAllowed(subject string) bool {
 // pubAllowedFullCheck checks on all publish permissioning depending
 // on the flag for dynamic reply permissions.
 func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
-	if c.perms == nil || (c.perms.pub.allow == nil && c.perms.pub.deny == nil) {
+	if c.perms == nil || (c.perms.pub.allow == nil && c.perms.pub.deny == nil && c.perms.namespace == _EMPTY_) {
 		return true
 	}
 	// Check if published subject is allowed if we have permissions in place.
@@ -3143,10 +3429,16 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 		allowed = len(r.psubs) == 0
 	}
 
+	// Nothing outside of the account namespace is allowed, including replies.
+	inNamespace := c.perms.namespace == _EMPTY_ || subjectIsSubsetMatch(subject, c.perms.namespace)
+	if !inNamespace {
+		allowed = false
+	}
+
 	// If we are currently not allowed but we are tracking reply subjects
 	// dynamically, check to see if we are allowed here but avoid pcache.
 	// We need to acquire the lock though.
-	if !allowed && fullCheck && c.perms.resp != nil {
+	if !allowed && inNamespace && fullCheck && c.perms.resp != nil {
 		c.mu.Lock()
 		if resp := c.replies[subject]; resp != nil {
 			resp.n++
@@ -3217,8 +3509,15 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		return false
 	}
 
+	// Reject publishes while the account is expired but its clients are
+	// kept connected.
+	if c.kind == CLIENT && c.acc != nil && c.acc.isFrozen() {
+		c.accountExpiredViolation("Publish to", c.pa.subject)
+		return false
+	}
+
 	// Check pub permissions
-	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(string(c.pa.subject)) {
+	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil || c.perms.namespace != _EMPTY_) && !c.pubAllowed(string(c.pa.subject)) {
 		c.pubPermissionViolation(c.pa.subject)
 		return false
 	}
@@ -3229,6 +3528,18 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		return false
 	}
 
+	// Check the content type of messages with headers, if restricted.
+	if c.pa.hdr > 0 {
+		if ctypes, _ := c.ctypes.Load().(map[string]struct{}); ctypes != nil {
+			if ct := mediaType(c.getHeader().Get("Content-Type")); ct != _EMPTY_ {
+				if _, ok := ctypes[ct]; !ok {
+					c.contentTypeViolation(c.pa.subject, ct)
+					return false
+				}
+			}
+		}
+	}
+
 	if c.opts.Verbose {
 		c.sendOK()
 	}
@@ -3238,6 +3549,13 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		return false
 	}
 
+	// Check if the account maps the published subject to another one.
+	if c.kind == CLIENT && c.acc.hasMappings() {
+		if subj, ok := c.acc.selectMappedSubject(string(c.pa.subject)); ok {
+			c.pa.subject = []byte(subj)
+		}
+	}
+
 	// Check if this client's gateway replies map is not empty
 	if atomic.LoadInt32(&c.cgwrt) > 0 && c.handleGWReplyMap(msg) {
 		return true
@@ -3266,6 +3584,11 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		}
 	}
 
+	// Bring back service imports torn down for being idle that this message is for.
+	if atomic.LoadInt32(&c.acc.siIdle) > 0 {
+		c.acc.reinstateIdleServiceImports(string(c.pa.subject))
+	}
+
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
 	var r *SublistResult
@@ -3325,19 +3648,27 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 	// and wants notification of no_responders.
 	if !didDeliver && len(c.pa.reply) > 0 {
 		c.mu.Lock()
-		if c.opts.NoResponders {
-			if sub := c.subForReply(c.pa.reply); sub != nil {
-				proto := fmt.Sprintf("HMSG %s %s 16 16\r\nNATS/1.0 503\r\n\r\n\r\n", c.pa.reply, sub.sid)
-				c.queueOutbound([]byte(proto))
-				c.addToPCD(c)
-			}
-		}
+		c.sendNoResponders(c.pa.reply)
 		c.mu.Unlock()
 	}
 
 	return didDeliver
 }
 
+// sendNoResponders sends a no responders status to the reply subject, if
+// the client asked for those.
+// Lock should be held.
+func (c *client) sendNoResponders(reply []byte) {
+	if !c.opts.NoResponders {
+		return
+	}
+	if sub := c.subForReply(reply); sub != nil {
+		proto := fmt.Sprintf("HMSG %s %s 16 16\r\nNATS/1.0 503\r\n\r\n\r\n", reply, sub.sid)
+		c.queueOutbound([]byte(proto))
+		c.addToPCD(c)
+	}
+}
+
 // Return the subscription for this reply subject. Only look at normal subs for this client.
 func (c *client) subForReply(reply []byte) *subscription {
 	r := c.acc.sl.Match(string(reply))
@@ -3429,6 +3760,16 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 		return
 	}
 
+	if !si.response {
+		atomic.StoreInt64(&si.last, time.Now().UnixNano())
+	}
+
+	// The exporter may restrict which accounts can send requests.
+	if !si.response && !si.acc.serviceRequestAllowed(si.to, acc.Name) {
+		c.Debugf("Dropping request on %q from account %q, not allowed by service export", si.to, acc.Name)
+		return
+	}
+
 	var nrr []byte
 	var rsi *serviceImport
 
@@ -3436,6 +3777,15 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 	// TODO(dlc) - restrict to configured service imports and not responses?
 	tracking, headers := shouldSample(si.latency, c)
 	if len(c.pa.reply) > 0 {
+		// Responses count towards the requests in flight too, but only
+		// requests are limited.
+		if !si.se.reserveInFlight(!si.response) {
+			c.Debugf("Dropping request on %q from account %q, too many requests in flight", si.to, acc.Name)
+			c.mu.Lock()
+			c.sendNoResponders(c.pa.reply)
+			c.mu.Unlock()
+			return
+		}
 		rsi = c.setupResponseServiceImport(acc, si, tracking, headers)
 		if rsi != nil {
 			nrr = []byte(rsi.from)
@@ -3460,6 +3810,14 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 		to = string(c.pa.subject)
 	}
 
+	// The exporter may restrict which headers are passed along with requests.
+	ohdr, osize, ohdb, oszb := c.pa.hdr, c.pa.size, c.pa.hdb, c.pa.szb
+	if !si.response && c.pa.hdr > 0 {
+		if allowed, ok := si.acc.serviceAllowedHeaders(si.to); ok {
+			msg = c.filterHeaders(msg, allowed)
+		}
+	}
+
 	// FIXME(dlc) - Do L1 cache trick like normal client?
 	rr := si.acc.sl.Match(to)
 
@@ -3494,6 +3852,7 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 
 	// Put what was there back now.
 	c.in.rts = orts
+	c.pa.hdr, c.pa.size, c.pa.hdb, c.pa.szb = ohdr, osize, ohdb, oszb
 
 	// Determine if we should remove this service import. This is for response service imports.
 	// We will remove if we did not deliver, or if we are a response service import and we are
@@ -3526,6 +3885,43 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 	}
 }
 
+// filterHeaders returns a copy of msg with only the allowed headers left and
+// updates the parse state to match. The header is dropped altogether if none
+// of its headers are allowed.
+func (c *client) filterHeaders(msg []byte, allowed map[string]struct{}) []byte {
+	hdr, payload := msg[:c.pa.hdr], msg[c.pa.hdr:]
+	lines := bytes.Split(hdr, []byte(_CRLF_))
+	nmsg := make([]byte, 0, len(msg))
+	// The first line holds the version.
+	nmsg = append(nmsg, lines[0]...)
+	nmsg = append(nmsg, _CRLF_...)
+	kept := false
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		if _, ok := allowed[http.CanonicalHeaderKey(string(bytes.TrimSpace(line[:i])))]; !ok {
+			continue
+		}
+		nmsg = append(nmsg, line...)
+		nmsg = append(nmsg, _CRLF_...)
+		kept = true
+	}
+	if !kept {
+		c.pa.hdr, c.pa.hdb = -1, nil
+		nmsg = append(nmsg[:0], payload...)
+	} else {
+		nmsg = append(nmsg, _CRLF_...)
+		c.pa.hdr = len(nmsg)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+		nmsg = append(nmsg, payload...)
+	}
+	c.pa.size = len(nmsg) - LEN_CR_LF
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	return nmsg
+}
+
 func (c *client) addSubToRouteTargets(sub *subscription) {
 	if c.in.rts == nil {
 		c.in.rts = make([]routeTarget, 0, routeTargetInit)
@@ -3826,6 +4222,18 @@ func (c *client) pubPermissionViolation(subject []byte) {
 	c.Errorf("Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
 }
 
+// accountExpiredViolation rejects an operation, such as "Publish to" a subject,
+// of a client whose account expired but that is kept connected for now.
+func (c *client) accountExpiredViolation(op string, subject []byte) {
+	c.sendErr(fmt.Sprintf("Account Expired, %s %q Rejected", op, subject))
+	c.Debugf("Account Expired - %s, %s %q rejected", c.getAuthUser(), op, subject)
+}
+
+func (c *client) contentTypeViolation(subject []byte, ct string) {
+	c.sendErr(fmt.Sprintf("Permissions Violation for Publish with Content-Type %q to %q", ct, subject))
+	c.Errorf("Publish Violation - %s, Subject %q, Content-Type %q", c.getAuthUser(), subject, ct)
+}
+
 func (c *client) subPermissionViolation(sub *subscription) {
 	errTxt := fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject)
 	logTxt := fmt.Sprintf("Subscription Violation - %s, Subject %q, SID %s",
@@ -3906,7 +4314,9 @@ func (c *client) clearPingTimer() {
 
 // Lock should be held
 func (c *client) setAuthTimer(d time.Duration) {
+	c.clearAuthTimer()
 	c.atmr = time.AfterFunc(d, c.authTimeout)
+	c.addAuthTimers(1)
 }
 
 // Lock should be held
@@ -3916,9 +4326,17 @@ func (c *client) clearAuthTimer() bool {
 	}
 	stopped := c.atmr.Stop()
 	c.atmr = nil
+	c.addAuthTimers(-1)
 	return stopped
 }
 
+// addAuthTimers updates the number of auth timers the server has set.
+func (c *client) addAuthTimers(delta int64) {
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.authTimers, delta)
+	}
+}
+
 // We may reuse atmr for expiring user jwts,
 // so check connectReceived.
 // Lock assume held on entry.
@@ -3930,7 +4348,9 @@ func (c *client) awaitingAuth() bool {
 // We will lock on entry.
 func (c *client) setExpirationTimer(d time.Duration) {
 	c.mu.Lock()
+	c.clearAuthTimer()
 	c.atmr = time.AfterFunc(d, c.authExpired)
+	c.addAuthTimers(1)
 	c.mu.Unlock()
 }
 
@@ -4044,7 +4464,9 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 		c.mu.Unlock()
 		c.addShadowSubscriptions(acc, sub)
 		for _, nsub := range oldShadows {
-			nsub.im.acc.sl.Remove(nsub)
+			if nsub.im.acc.sl.Remove(nsub) == nil {
+				c.shadowSubChanged(nsub, false)
+			}
 		}
 	}
 
@@ -4460,17 +4882,22 @@ func (c *client) connectionTypeAllowed(acts map[string]struct{}) bool {
 	if len(acts) == 0 {
 		return true
 	}
+	_, ok := acts[c.connectionType()]
+	return ok
+}
+
+// connectionType returns the jwt connection type of this client.
+func (c *client) connectionType() string {
 	// Assume standard client, then update based on presence of websocket
 	// or other type.
-	want := jwt.ConnectionTypeStandard
+	ct := jwt.ConnectionTypeStandard
 	if c.kind == LEAF {
-		want = jwt.ConnectionTypeLeafnode
+		ct = jwt.ConnectionTypeLeafnode
 	}
 	if c.ws != nil {
-		want = jwt.ConnectionTypeWebsocket
+		ct = jwt.ConnectionTypeWebsocket
 	}
-	_, ok := acts[want]
-	return ok
+	return ct
 }
 
 // isClosed returns true if either closeConnection or connMarkedClosed
@@ -2455,6 +2455,7 @@ func TestClientLimits(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Error encoding jwt: %v", err)
 			}
+			c.uclaims = uc
 			c.applyAccountLimits()
 			if c.mpay != test.expect {
 				t.Fatalf("payload %d not as ecpected %d", c.mpay, test.expect)
@@ -191,6 +191,18 @@ const (
 	// latency metrics
 	DEFAULT_SERVICE_LATENCY_SAMPLING = 100
 
+	// DEFAULT_RESOLVER_NEGATIVE_CACHE_TTL is the default time a failed account
+	// lookup is remembered before the resolver is asked again.
+	DEFAULT_RESOLVER_NEGATIVE_CACHE_TTL = time.Second
+
+	// DEFAULT_ACCOUNT_UPDATE_MIN_INTERVAL is the default minimum time between
+	// two resolver fetches of the same account's claims.
+	DEFAULT_ACCOUNT_UPDATE_MIN_INTERVAL = time.Second
+
+	// DEFAULT_REVOCATIONS_POLL_INTERVAL is the default time between two
+	// polls of the external revocation list.
+	DEFAULT_REVOCATIONS_POLL_INTERVAL = time.Minute
+
 	// DEFAULT_SYSTEM_ACCOUNT
 	DEFAULT_SYSTEM_ACCOUNT = "$SYS"
 
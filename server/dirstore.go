@@ -36,6 +36,9 @@ import (
 
 const (
 	fileExtension = ".jwt"
+	// Next to a JWT that applies later, the one in effect until then.
+	// Not picked up by pack, sync or the hash, which only use fileExtension.
+	appliedExtension = ".applied"
 )
 
 // validatePathExists checks that the provided path exists and is a dir if requested
@@ -295,10 +298,41 @@ func (store *DirJWTStore) PackWalk(maxJWTs int, cb func(partialPackMsg string))
 	return err
 }
 
+// keys returns the public keys of all JWTs in the store.
+func (store *DirJWTStore) keys() ([]string, error) {
+	var keys []string
+	store.Lock()
+	dir := store.directory
+	exp := store.expiration
+	store.Unlock()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if info != nil && !info.IsDir() && strings.HasSuffix(path, fileExtension) { // this is a JWT
+			pubKey := strings.TrimSuffix(filepath.Base(path), fileExtension)
+			store.Lock()
+			if exp != nil {
+				if _, ok := exp.idx[pubKey]; !ok {
+					store.Unlock()
+					return nil // only include indexed files
+				}
+			}
+			store.Unlock()
+			keys = append(keys, pubKey)
+		}
+		return nil
+	})
+	return keys, err
+}
+
 // Merge takes the JWTs from package and adds them to the store
 // Merge is destructive in the sense that it doesn't check if the JWT
 // is newer or anything like that.
 func (store *DirJWTStore) Merge(pack string) error {
+	return store.merge(pack, nil)
+}
+
+// merge is like Merge, but calls stored, if not nil, for every jwt of the
+// pack that changed the store.
+func (store *DirJWTStore) merge(pack string, stored func(pubKey, theJWT string)) error {
 	newJWTs := strings.Split(pack, "\n")
 	for _, line := range newJWTs {
 		if line == "" { // ignore blank lines
@@ -309,8 +343,10 @@ func (store *DirJWTStore) Merge(pack string) error {
 			return fmt.Errorf("line in package didn't contain 2 entries: %q", line)
 		}
 		pubKey := split[0]
-		if err := store.saveIfNewer(pubKey, split[1]); err != nil {
+		if changed, err := store.storeIfNewer(pubKey, split[1]); err != nil {
 			return err
+		} else if changed && stored != nil {
+			stored(pubKey, split[1])
 		}
 	}
 	return nil
@@ -384,6 +420,39 @@ func (store *DirJWTStore) load(publicKey string) (string, error) {
 	}
 }
 
+// loadApplied returns the JWT kept in effect while the one stored for
+// publicKey only applies later.
+// Assumes lock is NOT held
+func (store *DirJWTStore) loadApplied(publicKey string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+	if path := store.pathForKey(publicKey); path == "" {
+		return "", fmt.Errorf("invalid public key")
+	} else if data, err := ioutil.ReadFile(path + appliedExtension); err != nil {
+		return "", err
+	} else {
+		return string(data), nil
+	}
+}
+
+// keepApplied keeps the JWT at path around while theJWT, which is about to
+// replace it, only applies later. Once a JWT applies right away there is
+// nothing to keep.
+// Assumes the lock is held.
+func keepApplied(path string, theJWT string) error {
+	if jwtApplyAt(theJWT).IsZero() {
+		if err := os.Remove(path + appliedExtension); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	// A JWT that has not applied yet is not kept, the one kept before stays.
+	if data, err := ioutil.ReadFile(path); err == nil && jwtApplyAt(string(data)).IsZero() {
+		return ioutil.WriteFile(path+appliedExtension, data, 0644)
+	}
+	return nil
+}
+
 // write that keeps hash of all jwt in sync
 // Assumes the lock is held. Does return true or an error never both.
 func (store *DirJWTStore) write(path string, publicKey string, theJWT string) (bool, error) {
@@ -408,10 +477,14 @@ func (store *DirJWTStore) write(path string, publicKey string, theJWT string) (b
 			if err := os.Remove(store.pathForKey(i.publicKey)); err != nil {
 				return false, err
 			} else {
+				os.Remove(store.pathForKey(i.publicKey) + appliedExtension)
 				store.expiration.unTrack(i.publicKey)
 			}
 		}
 	}
+	if err := keepApplied(path, theJWT); err != nil {
+		return false, err
+	}
 	if err := ioutil.WriteFile(path, []byte(theJWT), 0644); err != nil {
 		return false, err
 	} else if store.expiration != nil {
@@ -449,32 +522,37 @@ func (store *DirJWTStore) save(publicKey string, theJWT string) error {
 }
 
 // Assumes the lock is NOT held, and only updates if the jwt is new, or the one on disk is older
-// returns true when the jwt changed
 func (store *DirJWTStore) saveIfNewer(publicKey string, theJWT string) error {
+	_, err := store.storeIfNewer(publicKey, theJWT)
+	return err
+}
+
+// Like saveIfNewer, but returns true when the jwt changed
+func (store *DirJWTStore) storeIfNewer(publicKey string, theJWT string) (bool, error) {
 	if store.readonly {
-		return fmt.Errorf("store is read-only")
+		return false, fmt.Errorf("store is read-only")
 	}
 	path := store.pathForKey(publicKey)
 	if path == "" {
-		return fmt.Errorf("invalid public key")
+		return false, fmt.Errorf("invalid public key")
 	}
 	dirPath := filepath.Dir(path)
 	if _, err := validateDirPath(dirPath); err != nil {
 		if err := os.MkdirAll(dirPath, 0755); err != nil {
-			return err
+			return false, err
 		}
 	}
 	if _, err := os.Stat(path); err == nil {
 		if newJWT, err := jwt.DecodeGeneric(theJWT); err != nil {
 			// skip if it can't be decoded
 		} else if existing, err := ioutil.ReadFile(path); err != nil {
-			return err
+			return false, err
 		} else if existingJWT, err := jwt.DecodeGeneric(string(existing)); err != nil {
 			// skip if it can't be decoded
 		} else if existingJWT.ID == newJWT.ID {
-			return nil
+			return false, nil
 		} else if existingJWT.IssuedAt > newJWT.IssuedAt {
-			return nil
+			return false, nil
 		}
 	}
 	store.Lock()
@@ -482,11 +560,11 @@ func (store *DirJWTStore) saveIfNewer(publicKey string, theJWT string) error {
 	changed, err := store.write(path, publicKey, theJWT)
 	store.Unlock()
 	if err != nil {
-		return err
+		return false, err
 	} else if changed && cb != nil {
 		cb(publicKey)
 	}
-	return nil
+	return changed, nil
 }
 
 func xorAssign(lVal *[sha256.Size]byte, rVal [sha256.Size]byte) {
@@ -650,6 +728,7 @@ func (store *DirJWTStore) startExpiring(reCheck time.Duration, limit int64, evic
 					if err := os.Remove(path); err != nil {
 						heap.Push(pq, it) // retry later
 					} else {
+						os.Remove(path + appliedExtension)
 						pq.unTrack(it.publicKey)
 						xorAssign(&pq.hash, it.hash)
 						store.Unlock()
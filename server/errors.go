@@ -54,6 +54,22 @@ var (
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
 
+	// ErrTooManyUserConnections signals that a user has reached the maximum number of connections
+	// allowed by the user JWT.
+	ErrTooManyUserConnections = errors.New("maximum connections exceeded for user")
+
+	// ErrAccountDraining signals that an account is being drained and new
+	// connections are temporarily rejected.
+	ErrAccountDraining = errors.New("account is being drained")
+
+	// ErrAccountInMaintenance signals that an account is in maintenance and
+	// new connections are rejected.
+	ErrAccountInMaintenance = errors.New("account is in maintenance")
+
+	// ErrAccountRequiresTLS signals that an account only accepts client
+	// connections secured with TLS.
+	ErrAccountRequiresTLS = errors.New("account requires TLS")
+
 	// ErrTooManySubs signals a client that the maximum number of subscriptions per connection
 	// has been reached.
 	ErrTooManySubs = errors.New("maximum subscriptions exceeded")
@@ -86,6 +102,9 @@ var (
 	// ErrMissingService is returned when an account does not have an exported service.
 	ErrMissingService = errors.New("service missing")
 
+	// ErrMissingExport is returned when an export does not exist.
+	ErrMissingExport = errors.New("export missing")
+
 	// ErrBadServiceType is returned when latency tracking is being applied to non-singleton response types.
 	ErrBadServiceType = errors.New("bad service response type")
 
@@ -104,9 +123,37 @@ var (
 	// ErrAccountResolverUpdateTooSoon is returned when we attempt an update too soon to last request.
 	ErrAccountResolverUpdateTooSoon = errors.New("account resolver update too soon")
 
+	// ErrAccountJetStreamLimitsRequired is returned when an account JWT does not
+	// declare JetStream limits and the server requires them.
+	ErrAccountJetStreamLimitsRequired = errors.New("account jwt does not declare jetstream limits")
+
+	// ErrAccountRequiredImportsPending is returned when an account has required
+	// imports whose exporting account could not be resolved yet.
+	ErrAccountRequiredImportsPending = errors.New("account required imports not resolved")
+
+	// ErrClaimsUnknownFields is returned when a JWT has fields this server does
+	// not understand and the server rejects those.
+	ErrClaimsUnknownFields = errors.New("jwt has unknown claim fields")
+
+	// ErrJWTUserAuthMethod is returned when a user authenticates with a user JWT
+	// using a method, bearer token or signed nonce, that its account does not allow.
+	ErrJWTUserAuthMethod = errors.New("user authentication method not allowed by account")
+
+	// ErrAccountClaimsSubjectMismatch is returned when an account JWT is for
+	// a different account than the one it was fetched or applied for.
+	ErrAccountClaimsSubjectMismatch = errors.New("account jwt subject does not match account")
+
+	// ErrAccountClaimsNotApplied is returned when the claims of an account that
+	// has none in place yet only take effect in the future.
+	ErrAccountClaimsNotApplied = errors.New("account claims do not apply yet")
+
 	// ErrAccountResolverSameClaims is returned when same claims have been fetched.
 	ErrAccountResolverSameClaims = errors.New("account resolver no new claims")
 
+	// ErrTooManyResolverFetches is returned when an account fetch could not start in time
+	// because of the limit on resolver fetches in flight.
+	ErrTooManyResolverFetches = errors.New("too many account resolver fetches in flight")
+
 	// ErrStreamImportAuthorization is returned when a stream import is not authorized.
 	ErrStreamImportAuthorization = errors.New("stream import not authorized")
 
@@ -116,9 +163,26 @@ var (
 	// ErrStreamImportDuplicate is returned when a stream import is a duplicate of one that already exists.
 	ErrStreamImportDuplicate = errors.New("stream import already exists")
 
+	// ErrStreamImportBadFilter is returned when a stream import filter is not within the imported subject.
+	ErrStreamImportBadFilter = errors.New("stream import filter must be a subset of the imported subject")
+
+	// ErrMissingStreamImport is returned when a stream import does not exist.
+	ErrMissingStreamImport = errors.New("stream import missing")
+
 	// ErrServiceImportAuthorization is returned when a service import is not authorized.
 	ErrServiceImportAuthorization = errors.New("service import not authorized")
 
+	// ErrImportSubjectNotCovered is returned when an import subject is not within any
+	// subject exported by the referenced account.
+	ErrImportSubjectNotCovered = errors.New("subject not covered by export")
+
+	// ErrActivationTypeMismatch is returned when the activation token of an import
+	// was issued for a different import type, e.g. a service for a stream import.
+	ErrActivationTypeMismatch = errors.New("activation type mismatch")
+
+	// ErrServiceImportCycle is returned when a service import would form a cycle of service imports.
+	ErrServiceImportCycle = errors.New("service import cycle detected")
+
 	// ErrClientOrRouteConnectedToGatewayPort represents an error condition when
 	// a client or route attempted to connect to the Gateway port.
 	ErrClientOrRouteConnectedToGatewayPort = errors.New("attempted to connect to gateway port")
@@ -132,6 +196,26 @@ var (
 	// when there is no internal system account defined.
 	ErrNoSysAccount = errors.New("system account not setup")
 
+	// ErrJWTRequired is returned when a user connects without a user JWT to a
+	// server that requires one.
+	ErrJWTRequired = errors.New("user jwt required")
+
+	// ErrJWTInvalid is returned when a user JWT can not be decoded or validated.
+	ErrJWTInvalid = errors.New("user jwt not valid")
+
+	// ErrJWTExpired is returned when a user JWT has expired.
+	ErrJWTExpired = errors.New("user jwt expired")
+
+	// ErrJWTRevoked is returned when a user JWT, or the key that signed it, has been revoked.
+	ErrJWTRevoked = errors.New("user jwt revoked")
+
+	// ErrJWTAccountExpired is returned when the account JWT of a user has expired.
+	ErrJWTAccountExpired = errors.New("account jwt expired")
+
+	// ErrJWTUserPermissions is returned when a user JWT does not permit the connection,
+	// because of its connection types, source networks or connect times.
+	ErrJWTUserPermissions = errors.New("user jwt does not permit connection")
+
 	// ErrRevocation is returned when a credential has been revoked.
 	ErrRevocation = errors.New("credentials have been revoked")
 
@@ -306,3 +390,14 @@ func ErrorIs(err, target error) bool {
 		}
 	}
 }
+
+// credentialTypeErr is the authentication error of a JWT presented as user
+// credentials whose subject is another kind of nkey, such as an account.
+type credentialTypeErr struct {
+	kind string
+}
+
+// Error reports the kind of credential that was presented.
+func (e *credentialTypeErr) Error() string {
+	return fmt.Sprintf("expected user credential, got %s", e.kind)
+}
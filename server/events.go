@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -36,6 +37,7 @@ const (
 	accLookupReqTokens = 6
 	accLookupReqSubj   = "$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP"
 	accPackReqSubj     = "$SYS.REQ.CLAIMS.PACK"
+	accActiveReqSubj   = "$SYS.REQ.CLAIMS.ACTIVE"
 
 	connectEventSubj    = "$SYS.ACCOUNT.%s.CONNECT"
 	disconnectEventSubj = "$SYS.ACCOUNT.%s.DISCONNECT"
@@ -49,11 +51,14 @@ const (
 	accConnsEventSubjOld     = "$SYS.SERVER.ACCOUNT.%s.CONNS" // kept for backward compatibility
 	shutdownEventSubj        = "$SYS.SERVER.%s.SHUTDOWN"
 	authErrorEventSubj       = "$SYS.SERVER.%s.CLIENT.AUTH.ERR"
+	authRejectedEventSubj    = "$SYS.SERVER.%s.CLIENT.AUTH.REJECTED"
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverDirectReqSubj      = "$SYS.REQ.SERVER.%s.%s"
 	serverPingReqSubj        = "$SYS.REQ.SERVER.PING.%s"
 	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING" // use $SYS.REQ.SERVER.PING.STATSZ instead
+	serverNegCacheReqSubj    = "$SYS.REQ.SERVER.RESOLVER.NEGCACHE"
 	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
+	importExpiredEventSubj   = "$SYS.ACCOUNT.%s.IMPORT.EXPIRED"
 	remoteLatencyEventSubj   = "$SYS.LATENCY.M2.%s"
 	inboxRespSubj            = "$SYS._INBOX.%s.%s"
 
@@ -127,6 +132,81 @@ type DisconnectEventMsg struct {
 // DisconnectEventMsgType is the schema type for DisconnectEventMsg
 const DisconnectEventMsgType = "io.nats.server.advisory.v1.client_disconnect"
 
+// ImportExpiredEventMsg is sent when an import is removed from an account
+// because its activation token expired.
+type ImportExpiredEventMsg struct {
+	TypedEvent
+	Server   ServerInfo `json:"server"`
+	Account  string     `json:"acc"`
+	Subject  string     `json:"subject"`
+	Exporter string     `json:"exporter"`
+	Kind     string     `json:"kind"`
+}
+
+// ImportExpiredEventMsgType is the schema type for ImportExpiredEventMsg
+const ImportExpiredEventMsgType = "io.nats.server.advisory.v1.import_expired"
+
+// AuthRejectedEventMsg is sent when a client connection is rejected because
+// it failed to authenticate, if enabled with the auth_rejection_events option.
+type AuthRejectedEventMsg struct {
+	TypedEvent
+	Server  ServerInfo `json:"server"`
+	Reason  string     `json:"reason"`
+	Error   string     `json:"error,omitempty"`
+	Account string     `json:"account,omitempty"`
+	Remote  string     `json:"remote"`
+	CID     uint64     `json:"cid"`
+}
+
+// AuthRejectedEventMsgType is the schema type for AuthRejectedEventMsg
+const AuthRejectedEventMsgType = "io.nats.server.advisory.v1.client_auth_rejected"
+
+// Reason codes of AuthRejectedEventMsg.
+const (
+	AuthRejectedJWTRequired        = "jwt_required"
+	AuthRejectedJWTInvalid         = "jwt_invalid"
+	AuthRejectedJWTExpired         = "jwt_expired"
+	AuthRejectedJWTRevoked         = "jwt_revoked"
+	AuthRejectedUserPermissions    = "user_permissions"
+	AuthRejectedAuthMethod         = "auth_method"
+	AuthRejectedCredentialType     = "credential_type"
+	AuthRejectedUnknownClaimFields = "unknown_claim_fields"
+	AuthRejectedAccountExpired     = "account_expired"
+	AuthRejectedAccountMissing     = "account_missing"
+	AuthRejectedAccountImports     = "account_imports_pending"
+	AuthRejectedInvalidCredentials = "invalid_credentials"
+)
+
+// authRejectedReason returns the reason code for an authentication error.
+func authRejectedReason(err error) string {
+	if _, ok := err.(*credentialTypeErr); ok {
+		return AuthRejectedCredentialType
+	}
+	switch err {
+	case ErrJWTRequired:
+		return AuthRejectedJWTRequired
+	case ErrJWTInvalid:
+		return AuthRejectedJWTInvalid
+	case ErrJWTExpired:
+		return AuthRejectedJWTExpired
+	case ErrJWTRevoked:
+		return AuthRejectedJWTRevoked
+	case ErrJWTUserPermissions:
+		return AuthRejectedUserPermissions
+	case ErrJWTUserAuthMethod:
+		return AuthRejectedAuthMethod
+	case ErrClaimsUnknownFields:
+		return AuthRejectedUnknownClaimFields
+	case ErrJWTAccountExpired:
+		return AuthRejectedAccountExpired
+	case ErrMissingAccount:
+		return AuthRejectedAccountMissing
+	case ErrAccountRequiredImportsPending:
+		return AuthRejectedAccountImports
+	}
+	return AuthRejectedInvalidCredentials
+}
+
 // AccountNumConns is an event that will be sent from a server that is tracking
 // a given account when the number of connections changes. It will also HB
 // updates in the absence of any changes.
@@ -599,8 +679,8 @@ func (s *Server) initEventTracking() {
 		subscribeToUpdate = !s.accResolver.IsTrackingUpdate()
 	}
 	if subscribeToUpdate {
-		for _, sub := range []string{accUpdateEventSubjOld, accUpdateEventSubjNew} {
-			if _, err := s.sysSubscribe(fmt.Sprintf(sub, "*"), s.accountClaimUpdate); err != nil {
+		for _, sub := range s.accountUpdateSubjects() {
+			if _, err := s.sysSubscribe(sub, s.accountClaimUpdate); err != nil {
 				s.Errorf("Error setting up internal tracking: %v", err)
 			}
 		}
@@ -640,6 +720,10 @@ func (s *Server) initEventTracking() {
 			optz := &AccountzEventOptions{}
 			s.zReq(reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) { return s.Accountz(&optz.AccountzOptions) })
 		},
+		"RESOLVER": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &ResolverEventOptions{}
+			s.zReq(reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) { return s.resolverStatus() })
+		},
 	}
 	for name, req := range monSrvc {
 		subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, name)
@@ -651,6 +735,22 @@ func (s *Server) initEventTracking() {
 			s.Errorf("Error setting up internal tracking: %v", err)
 		}
 	}
+	// Lists or clears the accounts whose lookup failed recently.
+	if _, err := s.sysSubscribe(serverNegCacheReqSubj, func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+		optz := &NegativeCacheEventOptions{}
+		s.zReq(reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) {
+			switch optz.Op {
+			case _EMPTY_, "list":
+				return &NegativeCacheResponse{Entries: s.negativeLookups(false)}, nil
+			case "clear":
+				return &NegativeCacheResponse{Entries: s.negativeLookups(true), Cleared: true}, nil
+			default:
+				return nil, fmt.Errorf("unknown operation %q", optz.Op)
+			}
+		})
+	}); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	extractAccount := func(subject string) (string, error) {
 		if tk := strings.Split(subject, tsep); len(tk) != accReqTokens {
 			return "", fmt.Errorf("subject %q is malformed", subject)
@@ -704,6 +804,23 @@ func (s *Server) initEventTracking() {
 			})
 		},
 		"CONNS": s.connsRequest,
+		"DISCONNECT": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &DisconnectEventOptions{}
+			s.zReq(reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) {
+				acc, err := extractAccount(subject)
+				if err != nil {
+					return nil, err
+				}
+				if optz.CID == 0 {
+					return nil, fmt.Errorf("client id is required")
+				}
+				return &AccountDisconnectResponse{
+					Account:      acc,
+					CID:          optz.CID,
+					Disconnected: s.DisconnectClient(acc, optz.CID, optz.Reason),
+				}, nil
+			})
+		},
 	}
 	for name, req := range monAccSrvc {
 		if _, err := s.sysSubscribe(fmt.Sprintf(accReqSubj, "*", name), req); err != nil {
@@ -743,22 +860,19 @@ func (s *Server) accountClaimUpdate(sub *subscription, _ *client, subject, resp
 	if !s.EventsEnabled() {
 		return
 	}
-	pubKey := ""
-	toks := strings.Split(subject, tsep)
-	if len(toks) == accUpdateTokensNew {
-		pubKey = toks[accReqAccIndex]
-	} else if len(toks) == accUpdateTokensOld {
-		pubKey = toks[accUpdateAccIdxOld]
-	} else {
+	pubKey := s.accountFromUpdateSubject(subject)
+	if pubKey == _EMPTY_ {
 		s.Debugf("Received account claims update on bad subject %q", subject)
 		return
 	}
-	if claim, err := jwt.DecodeAccountClaims(string(msg)); err != nil {
+	if claim, err := s.decodeAccountClaims(string(msg)); err != nil {
 		respondToUpdate(s, resp, pubKey, "jwt update resulted in error", err)
 	} else if claim.Subject != pubKey {
 		err := errors.New("subject does not match jwt content")
 		respondToUpdate(s, resp, pubKey, "jwt update resulted in error", err)
 	} else if v, ok := s.accounts.Load(pubKey); !ok {
+		// A lookup of this account may be able to succeed now.
+		s.clearNegativeLookup(pubKey)
 		respondToUpdate(s, resp, pubKey, "jwt update skipped", nil)
 	} else if err := s.updateAccountWithClaimJWT(v.(*Account), string(msg)); err != nil {
 		respondToUpdate(s, resp, pubKey, "jwt update resulted in error", err)
@@ -767,6 +881,66 @@ func (s *Server) accountClaimUpdate(sub *subscription, _ *client, subject, resp
 	}
 }
 
+// accountUpdateSubjects returns the subjects on which account claim updates
+// are accepted, with a wildcard in place of the account public key.
+func (s *Server) accountUpdateSubjects() []string {
+	subjs := []string{fmt.Sprintf(accUpdateEventSubjOld, pwcs), fmt.Sprintf(accUpdateEventSubjNew, pwcs)}
+	return append(subjs, s.getOpts().AccountUpdateSubjects...)
+}
+
+// accountFromUpdateSubject returns the account public key an account claim
+// update was sent for, or an empty string if the subject is not recognized.
+func (s *Server) accountFromUpdateSubject(subject string) string {
+	toks := strings.Split(subject, tsep)
+	for _, custom := range s.getOpts().AccountUpdateSubjects {
+		ctoks := strings.Split(custom, tsep)
+		if len(ctoks) != len(toks) {
+			continue
+		}
+		idx := -1
+		for i, ctok := range ctoks {
+			if ctok == pwcs {
+				idx = i
+			} else if ctok != toks[i] {
+				idx = -1
+				break
+			}
+		}
+		if idx >= 0 {
+			return toks[idx]
+		}
+	}
+	if len(toks) == accUpdateTokensNew {
+		return toks[accReqAccIndex]
+	} else if len(toks) == accUpdateTokensOld {
+		return toks[accUpdateAccIdxOld]
+	}
+	return _EMPTY_
+}
+
+// validateAccountUpdateSubjects checks that each additional account update
+// subject is valid and has exactly one wildcard token for the account.
+func validateAccountUpdateSubjects(o *Options) error {
+	for _, subj := range o.AccountUpdateSubjects {
+		if !IsValidSubject(subj) {
+			return fmt.Errorf("account update subject %q is not a valid subject", subj)
+		}
+		wc := 0
+		for _, tok := range strings.Split(subj, tsep) {
+			if tok == fwcs {
+				wc = -1
+				break
+			} else if tok == pwcs {
+				wc++
+			}
+		}
+		if wc != 1 {
+			return fmt.Errorf("account update subject %q must have a single %q token for the account", subj, pwcs)
+		}
+	}
+	return nil
+}
+
 // processRemoteServerShutdown will update any affected accounts.
 // Will update the remote count for clients.
 // Lock assume held.
@@ -930,6 +1104,20 @@ func (s *Server) leafNodeConnected(sub *subscription, _ *client, subject, reply
 	}
 }
 
+// DisconnectEventOptions are options passed to an account DISCONNECT request.
+type DisconnectEventOptions struct {
+	CID    uint64 `json:"cid"`
+	Reason string `json:"reason,omitempty"`
+	EventFilterOptions
+}
+
+// AccountDisconnectResponse is the response to an account DISCONNECT request.
+type AccountDisconnectResponse struct {
+	Account      string `json:"account"`
+	CID          uint64 `json:"cid"`
+	Disconnected bool   `json:"disconnected"`
+}
+
 // Common filter options for system requests STATSZ VARZ SUBSZ CONNZ ROUTEZ GATEWAYZ LEAFZ
 type EventFilterOptions struct {
 	Name    string `json:"server_name,omitempty"` // filter by server name
@@ -991,6 +1179,32 @@ type AccountzEventOptions struct {
 	EventFilterOptions
 }
 
+// In the context of system events, ResolverEventOptions are options passed to the resolver status request
+type ResolverEventOptions struct {
+	EventFilterOptions
+}
+
+// In the context of system events, NegativeCacheEventOptions are options passed
+// to the request listing or clearing the negative account lookup cache.
+type NegativeCacheEventOptions struct {
+	// Op is either "list", the default, or "clear".
+	Op string `json:"op,omitempty"`
+	EventFilterOptions
+}
+
+// NegativeCacheEntry is an account whose lookup failed recently.
+type NegativeCacheEntry struct {
+	Account string    `json:"account"`
+	Expires time.Time `json:"expires"`
+}
+
+// NegativeCacheResponse is the response to a negative cache request. On clear,
+// Entries holds the accounts that were removed from the cache.
+type NegativeCacheResponse struct {
+	Entries []NegativeCacheEntry `json:"entries"`
+	Cleared bool                 `json:"cleared,omitempty"`
+}
+
 // returns true if the request does NOT apply to this server and can be ignored.
 // DO NOT hold the server lock when
 func (s *Server) filterRequest(fOpts *EventFilterOptions) bool {
@@ -1149,6 +1363,29 @@ func (s *Server) sendLeafNodeConnectMsg(accName string) {
 	s.sendInternalMsg(subj, "", &m.Server, &m)
 }
 
+// sendImportExpiredEvent will send an event when an import of the given
+// account has been removed because its activation expired.
+// Lock should NOT be held on entry.
+func (s *Server) sendImportExpiredEvent(a, exporter *Account, subject string, kind jwt.ExportType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := ImportExpiredEventMsg{
+		TypedEvent: TypedEvent{
+			Type: ImportExpiredEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		},
+		Account:  a.Name,
+		Subject:  subject,
+		Exporter: exporter.Name,
+		Kind:     kind.String(),
+	}
+	s.sendInternalMsg(fmt.Sprintf(importExpiredEventSubj, a.Name), "", &m.Server, &m)
+}
+
 // sendAccConnsUpdate is called to send out our information on the
 // account's local connections.
 // Lock should be held on entry.
@@ -1354,6 +1591,42 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 	s.mu.Unlock()
 }
 
+// sendAuthRejectedEvent will send an event describing why the client failed
+// to authenticate, if enabled.
+func (s *Server) sendAuthRejectedEvent(c *client) {
+	if !s.getOpts().AuthRejectionEvents {
+		return
+	}
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	eid := s.nextEventID()
+	s.mu.Unlock()
+	c.mu.Lock()
+	m := AuthRejectedEventMsg{
+		TypedEvent: TypedEvent{
+			Type: AuthRejectedEventMsgType,
+			ID:   eid,
+			Time: time.Now().UTC(),
+		},
+		Reason:  authRejectedReason(c.authErr),
+		Account: c.authAccountName(),
+		Remote:  net.JoinHostPort(c.host, strconv.Itoa(int(c.port))),
+		CID:     c.cid,
+	}
+	if c.authErr != nil {
+		m.Error = c.authErr.Error()
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	subj := fmt.Sprintf(authRejectedEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
 // Internal message callback. If the msg is needed past the callback it is
 // required to be copied.
 type msgHandler func(sub *subscription, client *client, subject, reply string, msg []byte)
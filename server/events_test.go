@@ -1203,6 +1203,79 @@ func TestAccountClaimsUpdates(t *testing.T) {
 	})
 }
 
+func TestAccountClaimsUpdatesCustomSubject(t *testing.T) {
+	opts := DefaultOptions()
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	opts.AccountResolver = &MemAccResolver{}
+	opts.AccountUpdateSubjects = []string{"ctrl.account.*.update"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	sacc, sakp := createAccount(s)
+	s.setSystemAccount(sacc)
+
+	akp, _ := nkeys.CreateAccount()
+	pub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(pub)
+	nac.Limits.Conn = 4
+	ajwt, _ := nac.Encode(okp)
+	addAccountToMemResolver(s, pub, ajwt)
+
+	acc, _ := s.LookupAccount(pub)
+	if acc.MaxActiveConnections() != 4 {
+		t.Fatalf("Expected to see a limit of 4 connections")
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc, err := nats.Connect(url, createUserCreds(t, s, sakp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	update := func(subj string, conns int64) {
+		t.Helper()
+		nac := jwt.NewAccountClaims(pub)
+		nac.Limits.Conn = conns
+		ajwt, _ := nac.Encode(okp)
+		resp, err := nc.Request(subj, []byte(ajwt), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		if !strings.Contains(string(resp.Data), "jwt updated") {
+			t.Fatalf("Unexpected response: %s", resp.Data)
+		}
+		if n := acc.MaxActiveConnections(); n != int(conns) {
+			t.Fatalf("Expected a limit of %d connections, got %d", conns, n)
+		}
+	}
+	// The custom subject and the standard ones are all accepted.
+	update(fmt.Sprintf("ctrl.account.%s.update", pub), 8)
+	update(fmt.Sprintf(accUpdateEventSubjOld, pub), 12)
+	update(fmt.Sprintf(accUpdateEventSubjNew, pub), 16)
+
+	conf := createConfFile(t, []byte(`account_update_subjects: ["ctrl.account.*.update", "legacy.*"]`))
+	defer os.Remove(conf)
+	copts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config file: %v", err)
+	}
+	if subjs := copts.AccountUpdateSubjects; len(subjs) != 2 || subjs[0] != "ctrl.account.*.update" || subjs[1] != "legacy.*" {
+		t.Fatalf("Unexpected account update subjects: %v", copts.AccountUpdateSubjects)
+	}
+
+	// Subjects without a single wildcard for the account are rejected.
+	for _, subj := range []string{"ctrl.account.update", "ctrl.*.*.update", "ctrl.account.>", "ctrl..*"} {
+		opts := DefaultOptions()
+		opts.AccountUpdateSubjects = []string{subj}
+		if err := validateOptions(opts); err == nil {
+			t.Fatalf("Expected error for account update subject %q", subj)
+		}
+	}
+}
+
 func TestAccountReqMonitoring(t *testing.T) {
 	s, opts := runTrustedServer(t)
 	defer s.Shutdown()
@@ -1258,6 +1331,99 @@ func TestAccountReqMonitoring(t *testing.T) {
 	}
 }
 
+func TestAccountReqDisconnect(t *testing.T) {
+	s, opts := runTrustedServer(t)
+	defer s.Shutdown()
+	sacc, sakp := createAccount(s)
+	s.setSystemAccount(sacc)
+	acc, akp := createAccount(s)
+	if acc == nil {
+		t.Fatalf("did not create account")
+	}
+	disconnect := fmt.Sprintf(accReqSubj, acc.Name, "DISCONNECT")
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	ncSys, err := nats.Connect(url, createUserCreds(t, s, sakp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncSys.Close()
+
+	errCh := make(chan error, 1)
+	nc1, err := nats.Connect(url, createUserCreds(t, s, akp),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			errCh <- nc.LastError()
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc1.Close()
+	nc2, err := nats.Connect(url, createUserCreds(t, s, akp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+
+	// Users of the account can not send the request.
+	if _, err := nc2.Request(disconnect, []byte(`{"cid":1}`), 250*time.Millisecond); err == nil {
+		t.Fatalf("Expected request from a non system account to fail")
+	}
+
+	request := func(cid uint64) *AccountDisconnectResponse {
+		t.Helper()
+		req := fmt.Sprintf(`{"cid":%d,"reason":"incident 42"}`, cid)
+		msg, err := ncSys.Request(disconnect, []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp struct {
+			Data  *AccountDisconnectResponse `json:"data"`
+			Error *ApiError                  `json:"error"`
+		}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		if resp.Error != nil || resp.Data == nil {
+			t.Fatalf("Unexpected response: %s", msg.Data)
+		}
+		return resp.Data
+	}
+
+	cid, err := nc1.GetClientID()
+	if err != nil {
+		t.Fatalf("Error getting client id: %v", err)
+	}
+	if resp := request(cid); !resp.Disconnected || resp.CID != cid || resp.Account != acc.Name {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "incident 42") {
+			t.Fatalf("Expected reason to be sent, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not get the disconnect reason")
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := acc.NumLocalConnections(); n != 1 {
+			return fmt.Errorf("expected 1 connection, got %d", n)
+		}
+		return nil
+	})
+	if err := nc2.Flush(); err != nil || !nc2.IsConnected() {
+		t.Fatalf("Expected other connection to remain connected: %v", err)
+	}
+
+	// A connection that does not exist, or belongs to another account,
+	// is not disconnected.
+	if resp := request(cid + 100); resp.Disconnected {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	scid, _ := ncSys.GetClientID()
+	if resp := request(scid); resp.Disconnected {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
+
 func TestAccountReqInfo(t *testing.T) {
 	s, opts := runTrustedServer(t)
 	defer s.Shutdown()
@@ -1559,7 +1725,7 @@ func TestSystemAccountWithGateways(t *testing.T) {
 
 	// If this tests fails with wrong number after 10 seconds we may have
 	// added a new inititial subscription for the eventing system.
-	checkExpectedSubs(t, 33, sa)
+	checkExpectedSubs(t, 37, sa)
 
 	// Create a client on B and see if we receive the event
 	urlb := fmt.Sprintf("nats://%s:%d", ob.Host, ob.Port)
@@ -2154,3 +2320,70 @@ func TestServerEventsReceivedByQSubs(t *testing.T) {
 		t.Fatalf("Expected auth error, got %q", dem.Reason)
 	}
 }
+
+func TestAuthRejectedEvents(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	sysPub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(sysPub).Encode(oKp)
+	require_NoError(t, err)
+	akp, _ := nkeys.CreateAccount()
+	aPub, _ := akp.PublicKey()
+	aJwt, err := jwt.NewAccountClaims(aPub).Encode(oKp)
+	require_NoError(t, err)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		system_account: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+		}
+		auth_rejection_events: true
+	`, ojwt, sysPub, sysPub, sysJwt, aPub, aJwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, sysKp))
+	defer ncs.Close()
+	sub := natsSubSync(t, ncs, fmt.Sprintf(authRejectedEventSubj, "*"))
+	require_NoError(t, ncs.Flush())
+
+	nextEvent := func() *AuthRejectedEventMsg {
+		t.Helper()
+		msg := natsNexMsg(t, sub, time.Second)
+		var ev AuthRejectedEventMsg
+		require_NoError(t, json.Unmarshal(msg.Data, &ev))
+		if ev.Type != AuthRejectedEventMsgType || ev.Remote == _EMPTY_ || ev.Server.ID != s.ID() {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+		return &ev
+	}
+
+	// No user JWT at all.
+	if _, err := nats.Connect(s.ClientURL()); err == nil {
+		t.Fatal("Expected the connection to fail")
+	}
+	if ev := nextEvent(); ev.Reason != AuthRejectedJWTRequired || ev.Account != _EMPTY_ {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+
+	// An expired user JWT.
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	upub, _ := ukp.PublicKey()
+	uc := jwt.NewUserClaims(upub)
+	uc.Expires = time.Now().Add(-time.Minute).Unix()
+	ujwt, err := uc.Encode(akp)
+	require_NoError(t, err)
+	creds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(creds)
+	if _, err := nats.Connect(s.ClientURL(), nats.UserCredentials(creds)); err == nil {
+		t.Fatal("Expected the connection to fail")
+	}
+	if ev := nextEvent(); ev.Reason != AuthRejectedJWTExpired || ev.Account != aPub {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+}
@@ -709,6 +709,22 @@ func (a *Account) JetStreamUsage() JetStreamAccountStats {
 	return stats
 }
 
+// JetStreamLimits returns the JetStream limits in effect for this account and
+// whether JetStream is enabled for it. Limits that could not be applied, for
+// instance because they exceed the server's resources, are not reported.
+func (a *Account) JetStreamLimits() (JetStreamAccountLimits, bool) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return JetStreamAccountLimits{}, false
+	}
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.limits, true
+}
+
 // DisableJetStream will disable JetStream for this account.
 func (a *Account) DisableJetStream() error {
 	a.mu.Lock()
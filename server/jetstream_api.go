@@ -203,6 +203,35 @@ const (
 // Maximum name lengths for streams, consumers and templates.
 const JSMaxNameLen = 256
 
+// jsAPIOperations maps the JetStream API operations an account claim can
+// deny to the API subjects they are requested on.
+var jsAPIOperations = map[string][]string{
+	"stream_create":   {JSApiStreamCreate},
+	"stream_update":   {JSApiStreamUpdate},
+	"stream_delete":   {JSApiStreamDelete},
+	"stream_purge":    {JSApiStreamPurge},
+	"stream_snapshot": {JSApiStreamSnapshot},
+	"stream_restore":  {JSApiStreamRestore},
+	"msg_delete":      {JSApiMsgDelete},
+	"consumer_create": {JSApiConsumerCreate, JSApiDurableCreate},
+	"consumer_delete": {JSApiConsumerDelete},
+	"template_create": {JSApiTemplateCreate},
+	"template_delete": {JSApiTemplateDelete},
+}
+
+// jsAPIDenySubjects returns the API subjects of the given JetStream API
+// operations, as well as the operations that are not known.
+func jsAPIDenySubjects(ops []string) (subjects []string, unknown []string) {
+	for _, op := range ops {
+		if subjs, ok := jsAPIOperations[strings.ToLower(op)]; ok {
+			subjects = append(subjects, subjs...)
+		} else {
+			unknown = append(unknown, op)
+		}
+	}
+	return subjects, unknown
+}
+
 // Responses for API calls.
 
 // ApiError is included in all responses if there was an error.
@@ -14,10 +14,14 @@
 package server
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -62,6 +66,383 @@ func ReadOperatorJWT(jwtfile string) (*jwt.OperatorClaims, error) {
 	return opc, nil
 }
 
+// accountClaimsExt holds account claim fields the server understands but
+// that are not part of the jwt library. They live in the "nats" section of
+// the account JWT, next to the regular account fields.
+type accountClaimsExt struct {
+	Mappings map[string]string `json:"mappings,omitempty"`
+	// ServiceAllowedAccounts maps a service export subject to the accounts
+	// allowed to send requests to it.
+	ServiceAllowedAccounts map[string][]string `json:"service_allowed_accounts,omitempty"`
+	// ServiceAllowedHeaders maps a service export subject to the headers
+	// passed along with requests from other accounts. Other headers are
+	// stripped, all of them if the list is empty.
+	ServiceAllowedHeaders map[string][]string `json:"service_allowed_headers,omitempty"`
+	// RevokedCredentials maps a user public key to the issued at times of
+	// its individual JWTs that are revoked. Unlike revocations, JWTs issued
+	// for the user before or after those are not affected.
+	RevokedCredentials map[string][]int64 `json:"revoked_credentials,omitempty"`
+	// RequiredImports maps an exporting account to the subjects of the imports
+	// from it that are required. While a required import can not be resolved
+	// the account rejects new connections.
+	RequiredImports map[string][]string `json:"required_imports,omitempty"`
+	// SubjectNamespace, if set, is a subject that all subjects the users
+	// of the account publish or subscribe to must be within, regardless
+	// of their permissions.
+	SubjectNamespace string `json:"subject_namespace,omitempty"`
+	// ConnectionTypeLimits caps the number of connections of the account
+	// per connection type, such as STANDARD, WEBSOCKET or LEAFNODE. Each
+	// type is enforced independently of the others and of Limits.Conn.
+	ConnectionTypeLimits map[string]int64 `json:"conn_type_limits,omitempty"`
+	// MaxSubjectLength is the maximum length of the subject of subscriptions
+	// of the users of the account. Zero means unlimited.
+	MaxSubjectLength int32 `json:"max_subject_length,omitempty"`
+	// UserAuth restricts how users of the account authenticate, either
+	// only with bearer tokens ("bearer") or only by signing the nonce
+	// ("nonce"). Both are allowed if empty.
+	UserAuth string `json:"user_auth,omitempty"`
+	// AllowedContentTypes, if set, lists the media types users of the
+	// account may publish messages with, as given by the Content-Type
+	// header. Messages without that header are not affected.
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+	// Maintenance, when true, rejects new connections of users of the account
+	// while keeping the existing ones.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// RequireTLS, when true, rejects client connections of users of the
+	// account that are not secured with TLS.
+	RequireTLS bool `json:"require_tls,omitempty"`
+	// JetStreamAPIDeny lists JetStream API operations, such as "stream_delete"
+	// or "consumer_create", that users of the account are not permitted,
+	// regardless of their permissions.
+	JetStreamAPIDeny []string `json:"js_api_deny,omitempty"`
+	// DefaultResp is the response permission of users of the account that
+	// do not have one of their own. As for those set on users, publishing is
+	// then limited to the allowed subjects and replies to received requests.
+	DefaultResp *jwt.ResponsePermission `json:"default_resp,omitempty"`
+	// ApplyAt, if set, is the unix time in seconds at which an update to
+	// these claims takes effect. Until then the claims already in place
+	// for the account are kept. An account without claims in place is not
+	// loaded before then, since there is nothing to keep.
+	ApplyAt int64 `json:"apply_at,omitempty"`
+	// Exports holds the fields of the account's exports that are not part
+	// of jwt.Export.
+	Exports []exportClaimExt `json:"exports,omitempty"`
+	// Imports holds the fields of the account's imports that are not part
+	// of jwt.Import.
+	Imports []importClaimExt `json:"imports,omitempty"`
+}
+
+// exportClaimExt holds export fields the server understands but that are not
+// part of the jwt library. Exports are advertised unless Advertise is false.
+type exportClaimExt struct {
+	Subject   jwt.Subject `json:"subject,omitempty"`
+	Advertise *bool       `json:"advertise,omitempty"`
+	// LatencyStream is the name of a JetStream stream of the exporting
+	// account that latency results of this service export are stored in.
+	LatencyStream string `json:"latency_stream,omitempty"`
+	// MaxInFlight is the maximum number of requests to this service export
+	// that can await a response at the same time. Zero means unlimited.
+	MaxInFlight int32 `json:"max_in_flight,omitempty"`
+	// Deprecated is a note telling importers that this export will be removed.
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// importClaimExt holds import fields the server understands but that are not
+// part of the jwt library. The import is identified by the exporting account
+// and the imported subject.
+type importClaimExt struct {
+	Account string      `json:"account,omitempty"`
+	Subject jwt.Subject `json:"subject,omitempty"`
+	// Filter restricts a stream import to the subjects matching it, so that
+	// only those are sent over from the exporting account.
+	Filter jwt.Subject `json:"filter,omitempty"`
+}
+
+// AddUserFromCreds parses user credentials, as generated by
+// jwt.FormatUserConfig, and checks that the user JWT and seed match and
+// that the user's account can be resolved and trusts the user's issuer.
+// The account is loaded as a result, so that connections of that user
+// do not have to wait for it.
+func (s *Server) AddUserFromCreds(creds []byte) error {
+	ujwt, err := jwt.ParseDecoratedJWT(creds)
+	if err != nil {
+		return err
+	}
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return err
+	}
+	vr := jwt.CreateValidationResults()
+	uc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return ErrJWTInvalid
+	}
+	kp, err := jwt.ParseDecoratedUserNKey(creds)
+	if err != nil {
+		return err
+	}
+	defer kp.Wipe()
+	if pub, err := kp.PublicKey(); err != nil {
+		return err
+	} else if pub != uc.Subject {
+		return fmt.Errorf("user seed does not match user jwt subject %q", uc.Subject)
+	}
+	issuer := uc.Issuer
+	if uc.IssuerAccount != "" {
+		issuer = uc.IssuerAccount
+	}
+	acc, err := s.LookupAccount(issuer)
+	if err != nil {
+		return err
+	}
+	if uc.IssuerAccount != "" && !acc.hasIssuer(uc.Issuer) {
+		return fmt.Errorf("user jwt issuer %q not known to account %q", uc.Issuer, acc.Name)
+	}
+	return nil
+}
+
+// isImportRequired returns true if the import of subject from account is
+// listed in required.
+func isImportRequired(required map[string][]string, account, subject string) bool {
+	for _, subj := range required[account] {
+		if subj == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// importFilter returns the filter of the stream import of subject from account
+// listed in imports, if any.
+func importFilter(imports []importClaimExt, account, subject string) string {
+	for _, im := range imports {
+		if im.Account == account && string(im.Subject) == subject {
+			return string(im.Filter)
+		}
+	}
+	return _EMPTY_
+}
+
+// isCredentialRevoked returns true if the JWT issued at issuedAt for nkey
+// is listed in revoked.
+func isCredentialRevoked(revoked map[string][]int64, nkey string, issuedAt int64) bool {
+	for _, t := range revoked[nkey] {
+		if t == issuedAt {
+			return true
+		}
+	}
+	return false
+}
+
+// userClaimsExt holds user claim fields the server understands but that are
+// not part of the jwt library. They live in the "nats" section of the user JWT.
+type userClaimsExt struct {
+	MaxConnections int64 `json:"max_connections,omitempty"`
+	// AllowedContentTypes further restricts the media types the user may
+	// publish messages with, on top of those allowed by the account.
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+}
+
+// contentTypeSet returns the media types of list for lookups, or nil if list
+// is empty, which means all content types are allowed.
+func contentTypeSet(list []string) map[string]struct{} {
+	if len(list) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(list))
+	for _, ct := range list {
+		set[mediaType(ct)] = struct{}{}
+	}
+	return set
+}
+
+// intersectContentTypes returns the content types allowed by both a and b.
+func intersectContentTypes(a, b map[string]struct{}) map[string]struct{} {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	set := make(map[string]struct{})
+	for ct := range a {
+		if _, ok := b[ct]; ok {
+			set[ct] = struct{}{}
+		}
+	}
+	return set
+}
+
+// mediaType returns the media type of a Content-Type header value, in lower
+// case and without parameters.
+func mediaType(ct string) string {
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ct))
+}
+
+// accountLimitsRaw is used to find out which limits are present in the
+// "nats" section of an account JWT, since zero values are omitted once decoded.
+type accountLimitsRaw struct {
+	Limits map[string]json.RawMessage `json:"limits"`
+}
+
+// declaresJetStreamLimits returns true if the account JWT explicitly sets
+// any of the JetStream limits, including to zero.
+func declaresJetStreamLimits(claimJWT, id string) bool {
+	var raw accountLimitsRaw
+	if !decodeClaimsExt(claimJWT, id, &raw) {
+		return false
+	}
+	for _, k := range []string{"mem_storage", "disk_storage", "streams", "consumer"} {
+		if _, ok := raw.Limits[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Claim fields this server understands, at the top level of a JWT and in the
+// "nats" section of account and user JWTs.
+var (
+	topClaimFields     = claimFields(jwt.AccountClaims{})
+	accountClaimFields = claimFields(jwt.Account{}, accountClaimsExt{})
+	userClaimFields    = claimFields(jwt.User{}, userClaimsExt{})
+)
+
+// claimFields returns the JSON field names of the given structs, including
+// the fields of embedded structs.
+func claimFields(vs ...interface{}) map[string]struct{} {
+	fields := make(map[string]struct{})
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if f.Anonymous && tag == _EMPTY_ && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if name == "-" {
+				continue
+			} else if name == _EMPTY_ {
+				name = f.Name
+			}
+			fields[name] = struct{}{}
+		}
+	}
+	for _, v := range vs {
+		add(reflect.TypeOf(v))
+	}
+	return fields
+}
+
+// unknownClaimFields returns the sorted fields of an already verified JWT,
+// at the top level or in its "nats" section, that are not known.
+func unknownClaimFields(claimJWT string, known map[string]struct{}) []string {
+	chunks := strings.Split(claimJWT, ".")
+	if len(chunks) != 3 {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(chunks[1])
+	if err != nil {
+		return nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+	var nats map[string]json.RawMessage
+	json.Unmarshal(raw["nats"], &nats)
+	var unknown []string
+	for k := range raw {
+		if _, ok := topClaimFields[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	for k := range nats {
+		if _, ok := known[k]; !ok {
+			unknown = append(unknown, "nats."+k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// nkeyKind returns the kind of entity a public nkey belongs to, such as
+// "user" or "account".
+func nkeyKind(pub string) string {
+	switch nkeys.Prefix(pub) {
+	case nkeys.PrefixByteUser:
+		return "user"
+	case nkeys.PrefixByteAccount:
+		return "account"
+	case nkeys.PrefixByteOperator:
+		return "operator"
+	case nkeys.PrefixByteServer:
+		return "server"
+	case nkeys.PrefixByteCluster:
+		return "cluster"
+	}
+	return "unknown"
+}
+
+// checkUserCredentialType returns an error naming the kind of nkey the
+// subject of the JWT is for, unless it is a user nkey or the JWT can not
+// be decoded at all.
+func checkUserCredentialType(theJWT string) error {
+	gc, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return nil
+	}
+	if kind := nkeyKind(gc.Subject); kind != "user" {
+		return &credentialTypeErr{kind: kind}
+	}
+	return nil
+}
+
+// claimsApplyAt returns the time at which the account claims take effect,
+// or the zero time if they do right away.
+func claimsApplyAt(claimJWT, id string) time.Time {
+	var ext accountClaimsExt
+	if !decodeClaimsExt(claimJWT, id, &ext) || ext.ApplyAt <= time.Now().Unix() {
+		return time.Time{}
+	}
+	return time.Unix(ext.ApplyAt, 0)
+}
+
+// jwtApplyAt is like claimsApplyAt for a JWT stored after it was verified.
+func jwtApplyAt(theJWT string) time.Time {
+	gc, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return time.Time{}
+	}
+	return claimsApplyAt(theJWT, gc.ID)
+}
+
+// decodeClaimsExt will decode the "nats" section of an already verified JWT
+// into ext. Nothing is decoded unless the JWT ID matches id, which makes sure
+// the JWT is the one the decoded claims came from.
+func decodeClaimsExt(claimJWT, id string, ext interface{}) bool {
+	chunks := strings.Split(claimJWT, ".")
+	if id == _EMPTY_ || len(chunks) != 3 {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(chunks[1])
+	if err != nil {
+		return false
+	}
+	var raw struct {
+		ID   string          `json:"jti"`
+		Nats json.RawMessage `json:"nats"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || raw.ID != id || len(raw.Nats) == 0 {
+		return false
+	}
+	return json.Unmarshal(raw.Nats, ext) == nil
+}
+
 // Just wipe slice with 'x', for clearing contents of nkey seed file.
 func wipeSlice(buf []byte) {
 	for i := range buf {
@@ -107,6 +488,13 @@ func validateTrustedOperators(o *Options) error {
 			return fmt.Errorf("system_account in config and operator JWT must be identical")
 		}
 	}
+	if o.RejectExpiredOperators {
+		for _, opc := range o.TrustedOperators {
+			if operatorExpired(opc) {
+				return fmt.Errorf("operator %s JWT expired on %v", opc.Subject, time.Unix(opc.Expires, 0))
+			}
+		}
+	}
 	srvMajor, srvMinor, srvUpdate, _ := jwt.ParseServerVersion(strings.Split(VERSION, "-")[0])
 	for _, opc := range o.TrustedOperators {
 		if major, minor, update, err := jwt.ParseServerVersion(opc.AssertServerVersion); err != nil {
@@ -143,6 +531,12 @@ func validateTrustedOperators(o *Options) error {
 	return nil
 }
 
+// operatorExpired returns true if the operator JWT has an expiration that
+// has passed.
+func operatorExpired(opc *jwt.OperatorClaims) bool {
+	return opc.Expires != 0 && opc.Expires <= time.Now().Unix()
+}
+
 func validateSrc(claims *jwt.UserClaims, host string) bool {
 	if claims == nil {
 		return false
@@ -207,3 +601,69 @@ func validateTimes(claims *jwt.UserClaims) (bool, time.Duration) {
 	}
 	return false, time.Duration(0)
 }
+
+// JWTVerifier decodes a JWT and verifies its signature, for instance through
+// a FIPS validated crypto module, in place of the built-in nkeys verification.
+// trustedKeys are the operator keys the server trusts. The server still checks
+// the issuer of the returned claims as it does for the built-in verification.
+type JWTVerifier func(token string, trustedKeys []string) (jwt.Claims, error)
+
+// SetJWTVerifier will assign the verifier used for account and user JWTs.
+// Passing nil restores the built-in verification.
+func (s *Server) SetJWTVerifier(v JWTVerifier) {
+	s.mu.Lock()
+	s.jwtVerifier = v
+	s.mu.Unlock()
+}
+
+// decodeAccountClaims decodes and verifies an account JWT with the JWT
+// verifier, if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) decodeAccountClaims(token string) (*jwt.AccountClaims, error) {
+	s.mu.Lock()
+	v, keys := s.jwtVerifier, append([]string(nil), s.trustedKeys...)
+	s.mu.Unlock()
+	if v == nil {
+		return jwt.DecodeAccountClaims(token)
+	}
+	claims, err := v(token, keys)
+	if err != nil {
+		return nil, err
+	}
+	ac, ok := claims.(*jwt.AccountClaims)
+	if !ok {
+		return nil, fmt.Errorf("jwt verifier returned %T, expected account claims", claims)
+	}
+	return ac, nil
+}
+
+// verifyUserClaims decodes and verifies a user JWT with the JWT verifier,
+// if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) verifyUserClaims(token string) (*jwt.UserClaims, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.decodeUserClaims(token)
+}
+
+// decodeUserClaims decodes and verifies a user JWT with the JWT verifier,
+// if any.
+// Lock should be held, it is released while the verifier is called.
+func (s *Server) decodeUserClaims(token string) (*jwt.UserClaims, error) {
+	v := s.jwtVerifier
+	if v == nil {
+		return jwt.DecodeUserClaims(token)
+	}
+	keys := append([]string(nil), s.trustedKeys...)
+	s.mu.Unlock()
+	claims, err := v(token, keys)
+	s.mu.Lock()
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := claims.(*jwt.UserClaims)
+	if !ok {
+		return nil, fmt.Errorf("jwt verifier returned %T, expected user claims", claims)
+	}
+	return uc, nil
+}
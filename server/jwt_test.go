@@ -15,16 +15,27 @@ package server
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -80,6 +91,70 @@ func addAccountToMemResolver(s *Server, pub, jwtclaim string) {
 	s.AccountResolver().Store(pub, jwtclaim)
 }
 
+// RecordingResolver wraps an AccountResolver and records the Fetch and
+// Store calls made to it, so tests can assert on how the server uses the
+// resolver without having to instrument it themselves.
+type RecordingResolver struct {
+	AccountResolver
+	mu    sync.Mutex
+	calls []ResolverCall
+}
+
+// ResolverCall is a single call recorded by RecordingResolver.
+type ResolverCall struct {
+	Op   string // "fetch" or "store"
+	Name string
+	Time time.Time
+}
+
+func newRecordingResolver(r AccountResolver) *RecordingResolver {
+	return &RecordingResolver{AccountResolver: r}
+}
+
+func (r *RecordingResolver) record(op, name string) {
+	r.mu.Lock()
+	r.calls = append(r.calls, ResolverCall{op, name, time.Now()})
+	r.mu.Unlock()
+}
+
+// Fetch records the call and fetches from the wrapped resolver.
+func (r *RecordingResolver) Fetch(name string) (string, error) {
+	r.record("fetch", name)
+	return r.AccountResolver.Fetch(name)
+}
+
+// Store records the call and stores in the wrapped resolver.
+func (r *RecordingResolver) Store(name, jwt string) error {
+	r.record("store", name)
+	return r.AccountResolver.Store(name, jwt)
+}
+
+// Calls returns a copy of the calls recorded so far.
+func (r *RecordingResolver) Calls() []ResolverCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]ResolverCall, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+// Ops returns the recorded calls as "op:name" strings, in order.
+func (r *RecordingResolver) Ops() []string {
+	calls := r.Calls()
+	ops := make([]string, 0, len(calls))
+	for _, c := range calls {
+		ops = append(ops, c.Op+":"+c.Name)
+	}
+	return ops
+}
+
+// Reset discards the calls recorded so far.
+func (r *RecordingResolver) Reset() {
+	r.mu.Lock()
+	r.calls = nil
+	r.mu.Unlock()
+}
+
 func createClient(t *testing.T, s *Server, akp nkeys.KeyPair) (*testAsyncClient, *bufio.Reader, string) {
 	return createClientWithIssuer(t, s, akp, "")
 }
@@ -288,6 +363,24 @@ func TestJWTUserBadTrusted(t *testing.T) {
 	}
 }
 
+func TestJWTTrustedKeys(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+
+	keys := s.TrustedKeys()
+	if len(keys) != 1 || keys[0] != opub {
+		t.Fatalf("Expected trusted keys to be [%s], got %v", opub, keys)
+	}
+	// Make sure we got a copy.
+	keys[0] = "bad"
+	if keys := s.TrustedKeys(); len(keys) != 1 || keys[0] != opub {
+		t.Fatalf("Expected trusted keys to be [%s], got %v", opub, keys)
+	}
+}
+
 // Test that if a user tries to connect with an expired user JWT we do the right thing.
 func TestJWTUserExpired(t *testing.T) {
 	nuc := newJWTTestUserClaims()
@@ -328,6 +421,46 @@ func TestJWTUserExpiresAfterConnect(t *testing.T) {
 	}
 }
 
+func TestJWTUserExpirationAuthTimerCounts(t *testing.T) {
+	nuc := newJWTTestUserClaims()
+	nuc.IssuedAt = time.Now().Unix()
+	nuc.Expires = time.Now().Add(time.Second).Unix()
+	s, c, cr := setupJWTTestWithUserClaims(t, nuc, "+OK")
+	defer s.Shutdown()
+	defer c.close()
+	expectPong(t, cr)
+
+	// The auth timeout timer was replaced by the expiration timer.
+	if n := s.NumAuthTimers(); n != 1 {
+		t.Fatalf("Expected 1 auth timer, got %d", n)
+	}
+	v, err := s.Varz(nil)
+	require_NoError(t, err)
+	if v.AuthTimers != 1 || v.AuthExpirations != 0 {
+		t.Fatalf("Unexpected varz auth timers %d and expirations %d", v.AuthTimers, v.AuthExpirations)
+	}
+
+	l, err := cr.ReadString('\n')
+	require_NoError(t, err)
+	if !strings.Contains(l, "Expired") {
+		t.Fatalf("Expected the user to expire, got %q", l)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumAuthTimers(); n != 0 {
+			return fmt.Errorf("Expected no auth timers, got %d", n)
+		}
+		return nil
+	})
+	if n := s.NumAuthExpirations(); n != 1 {
+		t.Fatalf("Expected 1 auth expiration, got %d", n)
+	}
+	v, err = s.Varz(nil)
+	require_NoError(t, err)
+	if v.AuthTimers != 0 || v.AuthExpirations != 1 {
+		t.Fatalf("Unexpected varz auth timers %d and expirations %d", v.AuthTimers, v.AuthExpirations)
+	}
+}
+
 func TestJWTUserPermissionClaims(t *testing.T) {
 	nuc := newJWTTestUserClaims()
 	nuc.Permissions.Pub.Allow.Add("foo")
@@ -363,6 +496,67 @@ func TestJWTUserPermissionClaims(t *testing.T) {
 	}
 }
 
+func TestJWTAccountSubjectNamespace(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt := encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp, map[string]interface{}{
+		"subject_namespace": "tenant.acme.>",
+	})
+	addAccountToMemResolver(s, apub, ajwt)
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := jwt.NewUserClaims(pub)
+	nuc.Permissions.Pub.Allow.Add("foo", "tenant.acme.>")
+	nuc.Permissions.Sub.Allow.Add("foo", "tenant.acme.>")
+	ujwt, err := nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	sigraw, _ := nkp.Sign([]byte(info.Nonce))
+	sig := base64.RawURLEncoding.EncodeToString(sigraw)
+	c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", ujwt, sig))
+	expectPong(t, cr)
+
+	// "foo" is allowed by the user permissions, but outside of the namespace.
+	c.parseAsync("PUB foo 2\r\nok\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Publish") {
+		t.Fatalf("Expected a publish permissions violation, got %q", l)
+	}
+	c.parseAsync("SUB foo 1\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Subscription") {
+		t.Fatalf("Expected a subscription permissions violation, got %q", l)
+	}
+	c.parseAsync("SUB tenant.acme.* 2\r\nPUB tenant.acme.bar 2\r\nok\r\nPING\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "MSG tenant.acme.bar 2 2") {
+		t.Fatalf("Expected a message, got %q", l)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for subj, expected := range map[string]bool{
+		"foo":              false,
+		">":                false,
+		"tenant.>":         false,
+		"tenant.acme.>":    true,
+		"tenant.acme.bar":  true,
+		"tenant.other.bar": false,
+	} {
+		if ok := c.canSubscribe(subj); ok != expected {
+			t.Fatalf("Expected subscribing to %q allowed to be %v, got %v", subj, expected, ok)
+		}
+	}
+}
+
 func TestJWTUserResponsePermissionClaims(t *testing.T) {
 	nuc := newJWTTestUserClaims()
 	nuc.Permissions.Resp = &jwt.ResponsePermission{
@@ -470,6 +664,61 @@ func TestJWTUserResponsePermissionClaimsNegativeValues(t *testing.T) {
 	}
 }
 
+func TestJWTUserResponsePermissionExpiresClamped(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expires  time.Duration
+		expected time.Duration
+	}{
+		{"over max", time.Hour, time.Minute},
+		{"negative", -1 * time.Second, time.Minute},
+		{"below max", 10 * time.Second, 10 * time.Second},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := opTrustBasicSetup()
+			defer s.Shutdown()
+			s.getOpts().MaxResponsePermissionExpiration = time.Minute
+			buildMemAccResolver(s)
+
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+			if err != nil {
+				t.Fatalf("Error generating account JWT: %v", err)
+			}
+			addAccountToMemResolver(s, apub, ajwt)
+
+			nkp, _ := nkeys.CreateUser()
+			pub, _ := nkp.PublicKey()
+			nuc := jwt.NewUserClaims(pub)
+			nuc.Permissions.Resp = &jwt.ResponsePermission{MaxMsgs: 1, Expires: test.expires}
+			ujwt, err := nuc.Encode(akp)
+			if err != nil {
+				t.Fatalf("Error generating user JWT: %v", err)
+			}
+
+			c, cr, l := newClientForServer(s)
+			defer c.close()
+			var info nonceInfo
+			json.Unmarshal([]byte(l[5:]), &info)
+			sigraw, _ := nkp.Sign([]byte(info.Nonce))
+			sig := base64.RawURLEncoding.EncodeToString(sigraw)
+			c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", ujwt, sig))
+			expectPong(t, cr)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.perms == nil || c.perms.resp == nil {
+				t.Fatalf("Expected client perms for response permissions to be non-nil")
+			}
+			if c.perms.resp.Expires != test.expected {
+				t.Fatalf("Expected client perms for response permissions Expires to be %v, got %v",
+					test.expected, c.perms.resp.Expires)
+			}
+		})
+	}
+}
+
 func TestJWTAccountExpired(t *testing.T) {
 	nac := newJWTTestAccountClaims()
 	nac.IssuedAt = time.Now().Add(-10 * time.Second).Unix()
@@ -562,6 +811,105 @@ func TestJWTAccountRenew(t *testing.T) {
 	}
 }
 
+func TestJWTAccountExpiryGrace(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	s.opts.AccountExpiryGrace = 10 * time.Second
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.IssuedAt = time.Now().Add(-10 * time.Second).Unix()
+	nac.Expires = time.Now().Add(time.Second).Unix()
+	ajwt, err := nac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+	c.parseAsync("SUB foo 1\r\nPING\r\n")
+	expectPong(t, cr)
+
+	checkFor(t, 3*time.Second, 100*time.Millisecond, func() error {
+		if acc.IsExpired() {
+			return nil
+		}
+		return fmt.Errorf("Account not expired yet")
+	})
+
+	// The client stays connected, but can neither publish nor subscribe.
+	c.parseAsync("PUB foo 2\r\nok\r\nSUB bar 2\r\nPING\r\n")
+	for _, op := range []string{"Publish to \"foo\"", "Subscription to \"bar\""} {
+		l, err := cr.ReadString('\n')
+		require_NoError(t, err)
+		if !strings.HasPrefix(l, "-ERR ") || !strings.Contains(l, "Account Expired, "+op) {
+			t.Fatalf("Expected the %s to be rejected, got %q", op, l)
+		}
+	}
+	expectPong(t, cr)
+	c.mu.Lock()
+	_, subscribed := c.subs["2"]
+	c.mu.Unlock()
+	if subscribed {
+		t.Fatalf("Expected the subscription to be rejected")
+	}
+	// New connections are rejected still.
+	nc, ncr, ncs := createClient(t, s, akp)
+	defer nc.close()
+	nc.parseAsync(ncs)
+	if l, _ := ncr.ReadString('\n'); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+
+	// Renewing the account restores the client.
+	nac.IssuedAt = time.Now().Unix()
+	nac.Expires = time.Now().Add(2 * time.Second).Unix()
+	ajwt, err = nac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+	require_NoError(t, s.updateAccountWithClaimJWT(acc, ajwt))
+	c.parseAsync("PUB foo 2\r\nok\r\nPING\r\n")
+	l, err := cr.ReadString('\n')
+	require_NoError(t, err)
+	if !strings.HasPrefix(l, "MSG foo 1 2") {
+		t.Fatalf("Expected the message, got %q", l)
+	}
+
+	// Once the grace period has passed without a renewal, the client is
+	// disconnected.
+	s.optsMu.Lock()
+	s.opts.AccountExpiryGrace = 250 * time.Millisecond
+	s.optsMu.Unlock()
+	start := time.Now()
+	for {
+		l, err := cr.ReadString('\n')
+		require_NoError(t, err)
+		if strings.HasPrefix(l, "-ERR ") {
+			if !strings.Contains(l, "Account Authentication Expired") {
+				t.Fatalf("Expected the account expiration error, got %q", l)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Expected the client to be disconnected")
+		}
+	}
+	// The close reason tells the account expiration apart from the user's.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		for _, cc := range s.closed.closedClients() {
+			if cc.Reason == AccountAuthenticationExpired.String() {
+				return nil
+			}
+		}
+		return fmt.Errorf("Expected a connection closed for %v", AccountAuthenticationExpired)
+	})
+}
+
 func TestJWTAccountRenewFromResolver(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
@@ -901,6 +1249,72 @@ func TestJWTAccountExportWithResponseType(t *testing.T) {
 	}
 }
 
+func TestJWTAccountExportsKeepDistinctResponseTypes(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	expected := map[string]ServiceRespType{
+		"test.stream":        Streamed,
+		"test.chunk":         Chunked,
+		"test.single":        Singleton,
+		"test.def":           Singleton,
+		"test.old":           Singleton,
+		"test.stream.single": Singleton,
+	}
+	fooAC.Exports.Add(
+		&jwt.Export{Subject: "test.stream", Type: jwt.Service, ResponseType: jwt.ResponseTypeStream},
+		&jwt.Export{Subject: "test.chunk", Type: jwt.Service, ResponseType: jwt.ResponseTypeChunked},
+		&jwt.Export{Subject: "test.single", Type: jwt.Service, ResponseType: jwt.ResponseTypeSingleton, TokenReq: true},
+		&jwt.Export{Subject: "test.def", Type: jwt.Service, TokenReq: true},
+		&jwt.Export{Subject: "test.old", Type: jwt.Service},
+		&jwt.Export{Subject: "test.stream.single", Type: jwt.Service, ResponseType: jwt.ResponseTypeSingleton},
+	)
+	fooJWT, err := fooAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	fooAcc, err := s.LookupAccount(fooPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	checkRespTypes := func(t *testing.T) {
+		t.Helper()
+		fooAcc.mu.RLock()
+		defer fooAcc.mu.RUnlock()
+		if len(fooAcc.exports.services) != len(expected) {
+			t.Fatalf("Expected %d services, got %d", len(expected), len(fooAcc.exports.services))
+		}
+		for subj, rt := range expected {
+			se := fooAcc.exports.services[subj]
+			if se == nil {
+				t.Fatalf("Expected service export for %q", subj)
+			}
+			if se.respType != rt {
+				t.Fatalf("Expected service export %q to have response type %v, got %v", subj, rt, se.respType)
+			}
+		}
+	}
+	checkRespTypes(t)
+
+	// Re-adding an existing export must replace its response type.
+	if err := fooAcc.AddServiceExportWithResponse("test.stream", Singleton, nil); err != nil {
+		t.Fatalf("Error adding service export: %v", err)
+	}
+	expected["test.stream"] = Singleton
+	checkRespTypes(t)
+	if err := fooAcc.AddServiceExportWithResponse("test.stream", Chunked, nil); err != nil {
+		t.Fatalf("Error adding service export: %v", err)
+	}
+	expected["test.stream"] = Chunked
+	checkRespTypes(t)
+}
+
 func expectPong(t *testing.T, cr *bufio.Reader) {
 	t.Helper()
 	l, _ := cr.ReadString('\n')
@@ -1024,6 +1438,98 @@ func TestJWTAccountImportExportUpdates(t *testing.T) {
 	checkShadow(1)
 }
 
+// Helper to encode claims along with fields in the "nats" section
+// that are understood by the server but not by the jwt library.
+func encodeClaimsWithExt(t *testing.T, c jwt.Claims, kp nkeys.KeyPair, ext map[string]interface{}) string {
+	t.Helper()
+	token, err := c.Encode(kp)
+	if err != nil {
+		t.Fatalf("Error generating JWT: %v", err)
+	}
+	chunks := strings.Split(token, ".")
+	data, err := base64.RawURLEncoding.DecodeString(chunks[1])
+	if err != nil {
+		t.Fatalf("Error decoding JWT: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatalf("Error decoding JWT: %v", err)
+	}
+	nats := payload["nats"].(map[string]interface{})
+	for k, v := range ext {
+		nats[k] = v
+	}
+	if data, err = json.Marshal(payload); err != nil {
+		t.Fatalf("Error encoding JWT: %v", err)
+	}
+	signed := chunks[0] + "." + base64.RawURLEncoding.EncodeToString(data)
+	sig, err := kp.Sign([]byte(signed))
+	if err != nil {
+		t.Fatalf("Error signing JWT: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAccountSubjectMappingUpdates(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	c, cr, cs := createClient(t, s, fooKP)
+	defer c.close()
+
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	c.parseAsync("SUB orders.v2.* 1\r\nPING\r\n")
+	expectPong(t, cr)
+
+	acc, _ := s.LookupAccount(fooPub)
+	if acc.hasMappings() {
+		t.Fatalf("Expected no mappings")
+	}
+
+	// Now add a mapping to the account claims.
+	fooJWT = encodeClaimsWithExt(t, fooAC, okp, map[string]interface{}{
+		"mappings": map[string]string{"orders.*": "orders.v2.*"},
+	})
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	if err := s.updateAccountWithClaimJWT(acc, fooJWT); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	if !acc.hasMappings() {
+		t.Fatalf("Expected mappings")
+	}
+
+	c.parseAsync("PUB orders.22 2\r\nok\r\nPING\r\n")
+	expectMsg(t, cr, "orders.v2.22", "ok")
+
+	// Remove the mapping again.
+	fooAC = jwt.NewAccountClaims(fooPub)
+	fooJWT, _ = fooAC.Encode(okp)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	if err := s.updateAccountWithClaimJWT(acc, fooJWT); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	if acc.hasMappings() {
+		t.Fatalf("Expected mappings to be removed")
+	}
+
+	c.parseAsync("PUB orders.22 2\r\nok\r\nPING\r\n")
+	expectPong(t, cr)
+}
+
 func TestJWTAccountImportActivationExpires(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
@@ -1108,15 +1614,102 @@ func TestJWTAccountImportActivationExpires(t *testing.T) {
 	checkShadow(t, 0)
 }
 
-func TestJWTAccountLimitsSubs(t *testing.T) {
-	fooAC := newJWTTestAccountClaims()
-	fooAC.Limits.Subs = 10
-	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
-	defer s.Shutdown()
-	defer c.close()
-
+func TestJWTAccountImportActivationExpiresEvent(t *testing.T) {
 	okp, _ := nkeys.FromSeed(oSeed)
-	fooPub, _ := fooKP.PublicKey()
+	encode := func(ac *jwt.AccountClaims) string {
+		t.Helper()
+		theJWT, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		return theJWT
+	}
+
+	sysKp, _ := nkeys.CreateAccount()
+	syspub, _ := sysKp.PublicKey()
+	sysJwt := encode(jwt.NewAccountClaims(syspub))
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+	fooJWT := encode(fooAC)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "foo"
+	activation.ImportType = jwt.Service
+	now := time.Now()
+	activation.IssuedAt = now.Add(-10 * time.Second).Unix()
+	// These are second resolution. So round up before adding a second.
+	activation.Expires = now.Round(time.Second).Add(time.Second).Unix()
+	actJWT, err := activation.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating activation token: %v", err)
+	}
+	barAC := jwt.NewAccountClaims(barPub)
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service, Token: actJWT})
+	barJWT := encode(barAC)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		system_account: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+			%s: %s
+		}
+	`, ojwt, syspub, syspub, sysJwt, fooPub, fooJWT, barPub, barJWT)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sysc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, sysKp))
+	defer sysc.Close()
+	sub := natsSubSync(t, sysc, fmt.Sprintf(importExpiredEventSubj, "*"))
+	natsFlush(t, sysc)
+
+	acc, err := s.LookupAccount(barPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if n := acc.NumExpiredActivations(); n != 0 {
+		t.Fatalf("Expected no expired activations, got %d", n)
+	}
+
+	msg := natsNexMsg(t, sub, 3*time.Second)
+	if msg.Subject != fmt.Sprintf(importExpiredEventSubj, barPub) {
+		t.Fatalf("Unexpected event subject: %q", msg.Subject)
+	}
+	var em ImportExpiredEventMsg
+	if err := json.Unmarshal(msg.Data, &em); err != nil {
+		t.Fatalf("Error unmarshaling event: %v", err)
+	}
+	if em.Type != ImportExpiredEventMsgType || em.Account != barPub ||
+		em.Subject != "foo" || em.Exporter != fooPub || em.Kind != jwt.Service.String() {
+		t.Fatalf("Unexpected event: %+v", em)
+	}
+	if n := acc.NumExpiredActivations(); n != 1 {
+		t.Fatalf("Expected 1 expired activation, got %d", n)
+	}
+	// There should be a single event per expiry.
+	if msg, err := sub.NextMsg(250 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no more events, got %v - %v", msg, err)
+	}
+}
+
+func TestJWTAccountLimitsSubs(t *testing.T) {
+	fooAC := newJWTTestAccountClaims()
+	fooAC.Limits.Subs = 10
+	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
+	defer s.Shutdown()
+	defer c.close()
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	fooPub, _ := fooKP.PublicKey()
 
 	// Create a client.
 	c, cr, cs := createClient(t, s, fooKP)
@@ -1176,2443 +1769,7135 @@ func TestJWTAccountLimitsSubs(t *testing.T) {
 	}
 }
 
-func TestJWTAccountLimitsSubsButServerOverrides(t *testing.T) {
-	s := opTrustBasicSetup()
+func TestJWTAccountLimitsSubjectLength(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	opts.MaxSubjectLength = 32
+	s, c, _, _ := rawSetup(opts)
+	c.close()
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 
-	// override with server setting of 2.
-	opts := s.getOpts()
-	opts.MaxSubs = 2
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	addAccountToMemResolver(s, apub, encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp,
+		map[string]interface{}{"max_subject_length": 16}))
 
-	okp, _ := nkeys.FromSeed(oSeed)
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
 
-	// Create accounts and imports/exports.
-	fooKP, _ := nkeys.CreateAccount()
-	fooPub, _ := fooKP.PublicKey()
-	fooAC := jwt.NewAccountClaims(fooPub)
-	fooAC.Limits.Subs = 10
-	fooJWT, err := fooAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
-	}
-	addAccountToMemResolver(s, fooPub, fooJWT)
-	fooAcc, _ := s.LookupAccount(fooPub)
-	fooAcc.mu.RLock()
-	if fooAcc.msubs != 10 {
-		fooAcc.mu.RUnlock()
-		t.Fatalf("Expected account to have msubs of 10, got %d", fooAcc.msubs)
+	// The account limit is lower than the server one.
+	c.mu.Lock()
+	msublen := c.msublen
+	c.mu.Unlock()
+	if msublen != 16 {
+		t.Fatalf("Expected client msublen to be 16, got %d", msublen)
 	}
-	fooAcc.mu.RUnlock()
-
-	// Create a client.
-	c, cr, cs := createClient(t, s, fooKP)
-	defer c.close()
 
-	c.parseAsync(cs)
+	subj := strings.Repeat("a", 16)
+	c.parseAsync(fmt.Sprintf("SUB %s 1\r\nPING\r\n", subj))
 	expectPong(t, cr)
 
-	c.parseAsync("SUB foo 1\r\nSUB bar 2\r\nSUB baz 3\r\nPING\r\n")
+	c.parseAsync(fmt.Sprintf("SUB %s.b 2\r\nPING\r\n", subj[:15]))
 	l, _ := cr.ReadString('\n')
-
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
+	if !strings.HasPrefix(l, "-ERR 'Permissions Violation for Subscription") {
+		t.Fatalf("Expected a permissions violation, got: %v", l)
 	}
-	if !strings.Contains(l, "maximum subscriptions exceeded") {
-		t.Fatalf("Expected an ERR for max subscriptions exceeded, got: %v", l)
+	expectPong(t, cr)
+
+	c.mu.Lock()
+	nsubs := len(c.subs)
+	c.mu.Unlock()
+	if nsubs != 1 {
+		t.Fatalf("Expected 1 subscription, got %d", nsubs)
 	}
-	// Read last PONG so does not hold up test.
-	cr.ReadString('\n')
 }
 
-func TestJWTAccountLimitsMaxPayload(t *testing.T) {
-	fooAC := newJWTTestAccountClaims()
-	fooAC.Limits.Payload = 8
-	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
+func TestJWTAccountLimitsSubsLenient(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	opts.LenientSubscriptionLimits = true
+	s, c, _, _ := rawSetup(opts)
+	c.close()
 	defer s.Shutdown()
-	defer c.close()
+	buildMemAccResolver(s)
 
+	fooKP, _ := nkeys.CreateAccount()
 	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Limits.Subs = 10
+	fooJWT, err := fooAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	fooAcc, _ := s.LookupAccount(fooPub)
 
-	// Create a client.
 	c, cr, cs := createClient(t, s, fooKP)
 	defer c.close()
-
 	c.parseAsync(cs)
 	expectPong(t, cr)
+	for i := 0; i < 10; i++ {
+		c.parseAsync(fmt.Sprintf("SUB foo %d\r\nPING\r\n", i))
+		expectPong(t, cr)
+	}
 
-	// Check to make sure we have the limit set.
-	// Account first
-	fooAcc, _ := s.LookupAccount(fooPub)
-	fooAcc.mu.RLock()
-	if fooAcc.mpay != 8 {
-		fooAcc.mu.RUnlock()
-		t.Fatalf("Expected account to have mpay of 8, got %d", fooAcc.mpay)
+	expectMaxSubsErr := func() {
+		t.Helper()
+		l, _ := cr.ReadString('\n')
+		if !strings.HasPrefix(l, "-ERR") || !strings.Contains(l, "maximum subscriptions exceeded") {
+			t.Fatalf("Expected an ERR for max subscriptions exceeded, got: %v", l)
+		}
 	}
-	fooAcc.mu.RUnlock()
-	// Now test that the client has limits too.
+
+	// Lowering the limit keeps the client and its subscriptions.
+	fooAC.Limits.Subs = 5
+	s.UpdateAccountClaims(fooAcc, fooAC)
+	c.parseAsync("PING\r\n")
+	expectPong(t, cr)
 	c.mu.Lock()
-	if c.mpay != 8 {
-		c.mu.Unlock()
-		t.Fatalf("Expected client to have mpay of 10, got %d", c.mpay)
-	}
+	n := len(c.subs)
 	c.mu.Unlock()
+	if n != 10 {
+		t.Fatalf("Expected 10 subscriptions, got %d", n)
+	}
 
-	c.parseAsync("PUB foo 4\r\nXXXX\r\nPING\r\n")
+	// New subscriptions are rejected.
+	c.parseAsync("SUB bar 11\r\nPING\r\n")
+	expectMaxSubsErr()
 	expectPong(t, cr)
 
-	c.parseAsync("PUB foo 10\r\nXXXXXXXXXX\r\nPING\r\n")
-	l, _ := cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
-	}
-	if !strings.Contains(l, "Maximum Payload") {
-		t.Fatalf("Expected an ERR for max payload violation, got: %v", l)
+	// Keeping on subscribing gets the client disconnected.
+	c.parseAsync("SUB bar 12\r\n")
+	expectMaxSubsErr()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		c.mu.Lock()
+		closed := c.isClosed()
+		c.mu.Unlock()
+		if !closed {
+			return fmt.Errorf("Expected client to be disconnected")
+		}
+		return nil
+	})
+}
+
+func TestJWTAccountEffectiveLimits(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		claim    int64
+		server   int
+		expected int32
+	}{
+		{"server overrides", 10, 2, 2},
+		{"claim overrides", 2, 10, 2},
+		{"no server limit", 10, 0, 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := opTrustBasicSetup()
+			defer s.Shutdown()
+			buildMemAccResolver(s)
+
+			opts := s.getOpts()
+			opts.MaxSubs = test.server
+			opts.MaxPayload = int32(test.server)
+			opts.MaxConn = test.server
+
+			fooKP, _ := nkeys.CreateAccount()
+			fooPub, _ := fooKP.PublicKey()
+			fooAC := jwt.NewAccountClaims(fooPub)
+			fooAC.Limits.Subs = test.claim
+			fooAC.Limits.Payload = test.claim
+			fooAC.Limits.Conn = test.claim
+			fooJWT, err := fooAC.Encode(oKp)
+			if err != nil {
+				t.Fatalf("Error generating account JWT: %v", err)
+			}
+			addAccountToMemResolver(s, fooPub, fooJWT)
+			fooAcc, _ := s.LookupAccount(fooPub)
+
+			expected := EffectiveLimits{test.expected, test.expected, test.expected}
+			if el := fooAcc.EffectiveLimits(); el != expected {
+				t.Fatalf("Expected effective limits %+v, got %+v", expected, el)
+			}
+		})
 	}
 }
 
-func TestJWTAccountLimitsMaxPayloadButServerOverrides(t *testing.T) {
+func TestJWTAccountAdmissionHandler(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 
-	// override with server setting of 4.
-	opts := s.getOpts()
-	opts.MaxPayload = 4
-
-	okp, _ := nkeys.FromSeed(oSeed)
+	errTooManyExports := errors.New("too many exports")
+	s.SetAccountAdmissionHandler(func(ac *jwt.AccountClaims) error {
+		if len(ac.Exports) > 1 {
+			return errTooManyExports
+		}
+		return nil
+	})
 
-	// Create accounts and imports/exports.
 	fooKP, _ := nkeys.CreateAccount()
 	fooPub, _ := fooKP.PublicKey()
 	fooAC := jwt.NewAccountClaims(fooPub)
-	fooAC.Limits.Payload = 8
-	fooJWT, err := fooAC.Encode(okp)
+	fooAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	fooJWT, err := fooAC.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
 	addAccountToMemResolver(s, fooPub, fooJWT)
+	fooAcc, err := s.LookupAccount(fooPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
 
-	// Create a client.
 	c, cr, cs := createClient(t, s, fooKP)
 	defer c.close()
-
 	c.parseAsync(cs)
 	expectPong(t, cr)
 
-	c.parseAsync("PUB foo 6\r\nXXXXXX\r\nPING\r\n")
-	l, _ := cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
+	// Update that is rejected by the handler.
+	fooAC.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream})
+	fooJWT2, err := fooAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	if !strings.Contains(l, "Maximum Payload") {
-		t.Fatalf("Expected an ERR for max payload violation, got: %v", l)
+	if err := s.updateAccountWithClaimJWT(fooAcc, fooJWT2); err != errTooManyExports {
+		t.Fatalf("Expected error %v, got %v", errTooManyExports, err)
+	}
+	fooAcc.mu.RLock()
+	_, hasFoo := fooAcc.exports.streams["foo"]
+	_, hasBar := fooAcc.exports.streams["bar"]
+	claimJWT := fooAcc.claimJWT
+	fooAcc.mu.RUnlock()
+	if !hasFoo || hasBar {
+		t.Fatalf("Expected previous exports to remain, got foo=%v bar=%v", hasFoo, hasBar)
+	}
+	if claimJWT != fooJWT {
+		t.Fatalf("Expected previous claims to remain")
+	}
+	c.mu.Lock()
+	closed := c.isClosed()
+	c.mu.Unlock()
+	if closed {
+		t.Fatalf("Expected client to remain connected")
+	}
+	c.parseAsync("PING\r\n")
+	expectPong(t, cr)
+
+	// A new account that is rejected can not be looked up.
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	barAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	barAC.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream})
+	barJWT, err := barAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, barPub, barJWT)
+	if acc, err := s.LookupAccount(barPub); acc != nil || err != errTooManyExports {
+		t.Fatalf("Expected account to be rejected, got %v - %v", acc, err)
 	}
 }
 
-func TestJWTAccountLimitsMaxConns(t *testing.T) {
-	fooAC := newJWTTestAccountClaims()
-	fooAC.Limits.Conn = 8
-	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
+func TestJWTAccountUpdateChan(t *testing.T) {
+	s := opTrustBasicSetup()
 	defer s.Shutdown()
-	defer c.close()
+	buildMemAccResolver(s)
+	ch := s.AccountUpdateChan()
+	if s.AccountUpdateChan() != ch {
+		t.Fatal("Expected the same channel to be returned")
+	}
 
-	newClient := func(expPre string) *testAsyncClient {
+	expectUpdate := func() AccountUpdate {
 		t.Helper()
-		// Create a client.
-		c, cr, cs := createClient(t, s, fooKP)
-		c.parseAsync(cs)
-		l, _ := cr.ReadString('\n')
-		if !strings.HasPrefix(l, expPre) {
-			t.Fatalf("Expected a response starting with %q, got %q", expPre, l)
+		select {
+		case u := <-ch:
+			return u
+		case <-time.After(time.Second):
+			t.Fatal("Expected an account update")
 		}
-		return c
+		return AccountUpdate{}
 	}
 
-	// A connection is created in setupJWTTestWitAccountClaims(), so limit
-	// to 7 here (8 total).
-	for i := 0; i < 7; i++ {
-		c := newClient("PONG")
-		defer c.close()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ajwt, err := ac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	if u := expectUpdate(); u.Account != apub || u.ExportsChanged {
+		t.Fatalf("Unexpected update %+v", u)
 	}
-	// Now this one should fail.
-	c = newClient("-ERR ")
-	c.close()
-}
 
-// This will test that we can switch from a public export to a private
-// one and back with export claims to make sure the claim update mechanism
-// is working properly.
-func TestJWTAccountServiceImportAuthSwitch(t *testing.T) {
+	ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service})
+	ajwt, err = ac.Encode(oKp)
+	require_NoError(t, err)
+	require_NoError(t, s.updateAccountWithClaimJWT(acc, ajwt))
+	u := expectUpdate()
+	if u.Account != apub || !u.ExportsChanged || u.ImportsChanged || u.LimitsChanged || u.SigningKeysChanged {
+		t.Fatalf("Unexpected update %+v", u)
+	}
+	if u.IssuedAt.Unix() != ac.IssuedAt {
+		t.Fatalf("Expected issued at %v, got %v", time.Unix(ac.IssuedAt, 0), u.IssuedAt)
+	}
+
+	// Updates that are not received in time do not block, the oldest are dropped.
+	for i := 0; i < accountUpdateChanLen+10; i++ {
+		s.sendAccountUpdate(AccountUpdate{Account: fmt.Sprint(i)})
+	}
+	if u := expectUpdate(); u.Account != "10" {
+		t.Fatalf("Expected the oldest updates to be dropped, got %q first", u.Account)
+	}
+	if n := len(ch); n != accountUpdateChanLen-1 {
+		t.Fatalf("Expected %d pending updates, got %d", accountUpdateChanLen-1, n)
+	}
+}
+
+func TestJWTAccountDuplicateExports(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 
-	okp, _ := nkeys.FromSeed(oSeed)
-
-	// Create accounts and imports/exports.
 	fooKP, _ := nkeys.CreateAccount()
 	fooPub, _ := fooKP.PublicKey()
 	fooAC := jwt.NewAccountClaims(fooPub)
-	serviceExport := &jwt.Export{Subject: "ngs.usage.*", Type: jwt.Service}
-	fooAC.Exports.Add(serviceExport)
-	fooJWT, err := fooAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
-	}
+	fooAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service})
+	fooJWT, err := fooAC.Encode(oKp)
+	require_NoError(t, err)
 	addAccountToMemResolver(s, fooPub, fooJWT)
+	fooAcc, err := s.LookupAccount(fooPub)
+	require_NoError(t, err)
+
+	// The same subject twice with different token requirements is rejected.
+	fooAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+	fooJWT2, err := fooAC.Encode(oKp)
+	require_NoError(t, err)
+	err = s.updateAccountWithClaimJWT(fooAcc, fooJWT2)
+	if err == nil || !strings.Contains(err.Error(), "conflicting token requirements") {
+		t.Fatalf("Expected the duplicate export to be rejected, got %v", err)
+	}
+	fooAcc.mu.RLock()
+	se := fooAcc.exports.services["foo"]
+	claimJWT := fooAcc.claimJWT
+	fooAcc.mu.RUnlock()
+	if se == nil || se.tokenReq || claimJWT != fooJWT {
+		t.Fatalf("Expected previous claims to remain")
+	}
+	// Claims applied directly are checked as well.
+	dupAC, err := jwt.DecodeAccountClaims(fooJWT2)
+	require_NoError(t, err)
+	s.UpdateAccountClaims(fooAcc, dupAC)
+	fooAcc.mu.RLock()
+	se = fooAcc.exports.services["foo"]
+	fooAcc.mu.RUnlock()
+	if se == nil || se.tokenReq {
+		t.Fatalf("Expected previous exports to remain")
+	}
+
+	// The same subject for a stream and a service export is fine.
+	fooAC.Exports = jwt.Exports{
+		&jwt.Export{Subject: "foo", Type: jwt.Service},
+		&jwt.Export{Subject: "foo", Type: jwt.Stream},
+	}
+	fooJWT3, err := fooAC.Encode(oKp)
+	require_NoError(t, err)
+	require_NoError(t, s.updateAccountWithClaimJWT(fooAcc, fooJWT3))
 
+	// A new account with duplicate exports can not be looked up.
 	barKP, _ := nkeys.CreateAccount()
 	barPub, _ := barKP.PublicKey()
 	barAC := jwt.NewAccountClaims(barPub)
-	serviceImport := &jwt.Import{Account: fooPub, Subject: "ngs.usage", To: "ngs.usage.DEREK", Type: jwt.Service}
-	barAC.Imports.Add(serviceImport)
-	barJWT, err := barAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
-	}
+	barAC.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream}, &jwt.Export{Subject: "bar", Type: jwt.Stream})
+	barJWT, err := barAC.Encode(oKp)
+	require_NoError(t, err)
 	addAccountToMemResolver(s, barPub, barJWT)
+	if _, err := s.LookupAccount(barPub); err == nil || !strings.Contains(err.Error(), "listed more than once") {
+		t.Fatalf("Expected lookup to fail, got %v", err)
+	}
+}
+func TestJWTAccountExpiryHandler(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
 
-	// Create a client that will send the request
-	ca, cra, csa := createClient(t, s, barKP)
-	defer ca.close()
-	ca.parseAsync(csa)
-	expectPong(t, cra)
-
-	// Create the client that will respond to the requests.
-	cb, crb, csb := createClient(t, s, fooKP)
-	defer cb.close()
-	cb.parseAsync(csb)
-	expectPong(t, crb)
-
-	// Create Subscriber.
-	cb.parseAsync("SUB ngs.usage.* 1\r\nPING\r\n")
-	expectPong(t, crb)
-
-	// Send Request
-	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
-	expectPong(t, cra)
-
-	// We should receive the request mapped into our account. PING needed to flush.
-	cb.parseAsync("PING\r\n")
-	expectMsg(t, crb, "ngs.usage.DEREK", "hi")
+	type expiryEvent struct {
+		name    string
+		expired bool
+	}
+	ch := make(chan expiryEvent, 10)
+	s.SetAccountExpiryHandler(func(acc *Account, expired bool) {
+		ch <- expiryEvent{acc.Name, expired}
+	})
+	expectEvent := func(name string, expired bool) {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			if ev.name != name || ev.expired != expired {
+				t.Fatalf("Expected event for %q expired=%v, got %+v", name, expired, ev)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected expiry handler to be invoked")
+		}
+	}
+	expectNoEvent := func() {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			t.Fatalf("Unexpected expiry event: %+v", ev)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
 
-	// Now update to make the export private.
-	fooACPrivate := jwt.NewAccountClaims(fooPub)
-	serviceExport = &jwt.Export{Subject: "ngs.usage.*", Type: jwt.Service, TokenReq: true}
-	fooACPrivate.Exports.Add(serviceExport)
-	fooJWTPrivate, err := fooACPrivate.Encode(okp)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.Expires = time.Now().Add(time.Second).Unix()
+	ajwt, err := nac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	addAccountToMemResolver(s, fooPub, fooJWTPrivate)
-	acc, _ := s.LookupAccount(fooPub)
-	s.UpdateAccountClaims(acc, fooACPrivate)
-
-	// Send Another Request
-	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
-	expectPong(t, cra)
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, _ := s.LookupAccount(apub)
+	if acc == nil {
+		t.Fatalf("Could not retrieve account for %q", apub)
+	}
+	// Loading an active account is not a transition.
+	expectNoEvent()
 
-	// We should not receive the request this time.
-	cb.parseAsync("PING\r\n")
-	expectPong(t, crb)
+	// Wait for the expiration timer.
+	expectEvent(apub, true)
+	if !acc.IsExpired() {
+		t.Fatalf("Expected account to be expired")
+	}
 
-	// Now put it back again to public and make sure it works again.
-	addAccountToMemResolver(s, fooPub, fooJWT)
-	s.UpdateAccountClaims(acc, fooAC)
+	// Renew the account.
+	nac.Expires = time.Now().Add(time.Hour).Unix()
+	s.UpdateAccountClaims(acc, nac)
+	expectEvent(apub, false)
+	if acc.IsExpired() {
+		t.Fatalf("Expected account to be active")
+	}
 
-	// Send Request
-	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
-	expectPong(t, cra)
+	// An update that does not change the expired state is not reported.
+	nac.Expires = time.Now().Add(2 * time.Hour).Unix()
+	s.UpdateAccountClaims(acc, nac)
+	expectNoEvent()
 
-	// We should receive the request mapped into our account. PING needed to flush.
-	cb.parseAsync("PING\r\n")
-	expectMsg(t, crb, "ngs.usage.DEREK", "hi")
+	// Nor once the handler is removed.
+	s.SetAccountExpiryHandler(nil)
+	nac.Expires = time.Now().Add(-time.Second).Unix()
+	s.UpdateAccountClaims(acc, nac)
+	expectNoEvent()
+	if !acc.IsExpired() {
+		t.Fatalf("Expected account to be expired")
+	}
 }
 
-func TestJWTAccountServiceImportExpires(t *testing.T) {
+func TestJWTAccountLimitsSubsButServerOverrides(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 
+	// override with server setting of 2.
+	opts := s.getOpts()
+	opts.MaxSubs = 2
+
 	okp, _ := nkeys.FromSeed(oSeed)
 
 	// Create accounts and imports/exports.
 	fooKP, _ := nkeys.CreateAccount()
 	fooPub, _ := fooKP.PublicKey()
 	fooAC := jwt.NewAccountClaims(fooPub)
-	serviceExport := &jwt.Export{Subject: "foo", Type: jwt.Service}
-
-	fooAC.Exports.Add(serviceExport)
+	fooAC.Limits.Subs = 10
 	fooJWT, err := fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
 	addAccountToMemResolver(s, fooPub, fooJWT)
+	fooAcc, _ := s.LookupAccount(fooPub)
+	fooAcc.mu.RLock()
+	if fooAcc.msubs != 10 {
+		fooAcc.mu.RUnlock()
+		t.Fatalf("Expected account to have msubs of 10, got %d", fooAcc.msubs)
+	}
+	fooAcc.mu.RUnlock()
 
-	barKP, _ := nkeys.CreateAccount()
-	barPub, _ := barKP.PublicKey()
-	barAC := jwt.NewAccountClaims(barPub)
-	serviceImport := &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
+	// Create a client.
+	c, cr, cs := createClient(t, s, fooKP)
+	defer c.close()
 
-	barAC.Imports.Add(serviceImport)
-	barJWT, err := barAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	c.parseAsync("SUB foo 1\r\nSUB bar 2\r\nSUB baz 3\r\nPING\r\n")
+	l, _ := cr.ReadString('\n')
+
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
 	}
-	addAccountToMemResolver(s, barPub, barJWT)
+	if !strings.Contains(l, "maximum subscriptions exceeded") {
+		t.Fatalf("Expected an ERR for max subscriptions exceeded, got: %v", l)
+	}
+	// Read last PONG so does not hold up test.
+	cr.ReadString('\n')
+}
 
-	// Create a client that will send the request
-	ca, cra, csa := createClient(t, s, barKP)
-	defer ca.close()
-	ca.parseAsync(csa)
-	expectPong(t, cra)
+func TestJWTAccountLimitsMaxPayload(t *testing.T) {
+	fooAC := newJWTTestAccountClaims()
+	fooAC.Limits.Payload = 8
+	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
+	defer s.Shutdown()
+	defer c.close()
 
-	// Create the client that will respond to the requests.
-	cb, crb, csb := createClient(t, s, fooKP)
-	defer cb.close()
-	cb.parseAsync(csb)
-	expectPong(t, crb)
+	fooPub, _ := fooKP.PublicKey()
 
-	// Create Subscriber.
-	cb.parseAsync("SUB foo 1\r\nPING\r\n")
-	expectPong(t, crb)
+	// Create a client.
+	c, cr, cs := createClient(t, s, fooKP)
+	defer c.close()
 
-	// Send Request
-	ca.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
-	expectPong(t, cra)
+	c.parseAsync(cs)
+	expectPong(t, cr)
 
-	// We should receive the request. PING needed to flush.
-	cb.parseAsync("PING\r\n")
-	expectMsg(t, crb, "foo", "hi")
+	// Check to make sure we have the limit set.
+	// Account first
+	fooAcc, _ := s.LookupAccount(fooPub)
+	fooAcc.mu.RLock()
+	if fooAcc.mpay != 8 {
+		fooAcc.mu.RUnlock()
+		t.Fatalf("Expected account to have mpay of 8, got %d", fooAcc.mpay)
+	}
+	fooAcc.mu.RUnlock()
+	// Now test that the client has limits too.
+	c.mu.Lock()
+	if c.mpay != 8 {
+		c.mu.Unlock()
+		t.Fatalf("Expected client to have mpay of 10, got %d", c.mpay)
+	}
+	c.mu.Unlock()
 
-	// Now update the exported service to require auth.
-	fooAC = jwt.NewAccountClaims(fooPub)
-	serviceExport = &jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true}
+	c.parseAsync("PUB foo 4\r\nXXXX\r\nPING\r\n")
+	expectPong(t, cr)
 
-	fooAC.Exports.Add(serviceExport)
-	fooJWT, err = fooAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+	c.parseAsync("PUB foo 10\r\nXXXXXXXXXX\r\nPING\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
 	}
-	addAccountToMemResolver(s, fooPub, fooJWT)
-	acc, _ := s.LookupAccount(fooPub)
-	s.UpdateAccountClaims(acc, fooAC)
+	if !strings.Contains(l, "Maximum Payload") {
+		t.Fatalf("Expected an ERR for max payload violation, got: %v", l)
+	}
+}
 
-	// Send Another Request
-	ca.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
-	expectPong(t, cra)
+func TestJWTUserLimitsMaxPayloadBelowAccount(t *testing.T) {
+	fooAC := newJWTTestAccountClaims()
+	fooAC.Limits.Payload = 8
+	nuc := newJWTTestUserClaims()
+	nuc.Limits.Payload = 4
+	s, _, c, cr := setupJWTTestWithClaims(t, fooAC, nuc, "+OK")
+	defer s.Shutdown()
+	defer c.close()
 
-	// We should not receive the request this time.
-	cb.parseAsync("PING\r\n")
-	expectPong(t, crb)
+	// The lower limit of the user applies to its connection only.
+	c.mu.Lock()
+	mpay := c.mpay
+	c.mu.Unlock()
+	if mpay != 4 {
+		t.Fatalf("Expected client to have mpay of 4, got %d", mpay)
+	}
+	expectPong(t, cr)
 
-	// Now get an activation token such that it will work, but will expire.
-	barAC = jwt.NewAccountClaims(barPub)
-	serviceImport = &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
+	c.parseAsync("PUB foo 4\r\nXXXX\r\nPING\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected +OK, got %q", l)
+	}
+	expectPong(t, cr)
 
-	now := time.Now()
-	activation := jwt.NewActivationClaims(barPub)
-	activation.ImportSubject = "foo"
-	activation.ImportType = jwt.Service
-	activation.IssuedAt = now.Add(-10 * time.Second).Unix()
-	activation.Expires = now.Add(time.Second).Round(time.Second).Unix()
-	actJWT, err := activation.Encode(fooKP)
-	if err != nil {
-		t.Fatalf("Error generating activation token: %v", err)
+	c.parseAsync("PUB foo 6\r\nXXXXXX\r\nPING\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") || !strings.Contains(l, "Maximum Payload") {
+		t.Fatalf("Expected an ERR for max payload violation, got: %v", l)
 	}
-	serviceImport.Token = actJWT
+}
 
-	barAC.Imports.Add(serviceImport)
-	barJWT, err = barAC.Encode(okp)
+func TestJWTAccountLimitsMaxPayloadButServerOverrides(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	// override with server setting of 4.
+	opts := s.getOpts()
+	opts.MaxPayload = 4
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Limits.Payload = 8
+	fooJWT, err := fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	addAccountToMemResolver(s, barPub, barJWT)
-	acc, _ = s.LookupAccount(barPub)
-	s.UpdateAccountClaims(acc, barAC)
-
-	// Now it should work again.
-	// Send Another Request
-	ca.parseAsync("PUB foo 3\r\nhi2\r\nPING\r\n")
-	expectPong(t, cra)
-
-	// We should receive the request. PING needed to flush.
-	cb.parseAsync("PING\r\n")
-	expectMsg(t, crb, "foo", "hi2")
+	addAccountToMemResolver(s, fooPub, fooJWT)
 
-	// Now wait for it to expire, then retry.
-	waitTime := time.Duration(activation.Expires-time.Now().Unix()) * time.Second
-	time.Sleep(waitTime + 250*time.Millisecond)
+	// Create a client.
+	c, cr, cs := createClient(t, s, fooKP)
+	defer c.close()
 
-	// Send Another Request
-	ca.parseAsync("PUB foo 3\r\nhi3\r\nPING\r\n")
-	expectPong(t, cra)
+	c.parseAsync(cs)
+	expectPong(t, cr)
 
-	// We should NOT receive the request. PING needed to flush.
-	cb.parseAsync("PING\r\n")
-	expectPong(t, crb)
+	c.parseAsync("PUB foo 6\r\nXXXXXX\r\nPING\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
+	}
+	if !strings.Contains(l, "Maximum Payload") {
+		t.Fatalf("Expected an ERR for max payload violation, got: %v", l)
+	}
 }
 
-func TestAccountURLResolver(t *testing.T) {
-	for _, test := range []struct {
-		name   string
-		useTLS bool
-	}{
-		{"plain", false},
-		{"tls", true},
-	} {
-		t.Run(test.name, func(t *testing.T) {
-			kp, _ := nkeys.FromSeed(oSeed)
-			akp, _ := nkeys.CreateAccount()
-			apub, _ := akp.PublicKey()
-			nac := jwt.NewAccountClaims(apub)
-			ajwt, err := nac.Encode(kp)
-			if err != nil {
-				t.Fatalf("Error generating account JWT: %v", err)
-			}
-
-			hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.Write([]byte(ajwt))
-			})
-			var ts *httptest.Server
-			if test.useTLS {
-				ts = httptest.NewTLSServer(hf)
-			} else {
-				ts = httptest.NewServer(hf)
-			}
-			defer ts.Close()
-
-			confTemplate := `
-				operator: %s
-				listen: -1
-				resolver: URL("%s/ngs/v1/accounts/jwt/")
-				resolver_tls {
-					insecure: true
-				}
-			`
-			conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
-			defer os.Remove(conf)
+func TestJWTAccountLimitsMaxConns(t *testing.T) {
+	fooAC := newJWTTestAccountClaims()
+	fooAC.Limits.Conn = 8
+	s, fooKP, c, _ := setupJWTTestWitAccountClaims(t, fooAC, "+OK")
+	defer s.Shutdown()
+	defer c.close()
 
-			s, opts := RunServerWithConfig(conf)
-			pub, _ := kp.PublicKey()
-			opts.TrustedKeys = []string{pub}
-			defer s.Shutdown()
+	newClient := func(expPre string) *testAsyncClient {
+		t.Helper()
+		// Create a client.
+		c, cr, cs := createClient(t, s, fooKP)
+		c.parseAsync(cs)
+		l, _ := cr.ReadString('\n')
+		if !strings.HasPrefix(l, expPre) {
+			t.Fatalf("Expected a response starting with %q, got %q", expPre, l)
+		}
+		return c
+	}
 
-			acc, _ := s.LookupAccount(apub)
-			if acc == nil {
-				t.Fatalf("Expected to receive an account")
-			}
-			if acc.Name != apub {
-				t.Fatalf("Account name did not match claim key")
-			}
-		})
+	// A connection is created in setupJWTTestWitAccountClaims(), so limit
+	// to 7 here (8 total).
+	for i := 0; i < 7; i++ {
+		c := newClient("PONG")
+		defer c.close()
 	}
+	// Now this one should fail.
+	c = newClient("-ERR ")
+	c.close()
 }
 
-func TestAccountURLResolverTimeout(t *testing.T) {
-	kp, _ := nkeys.FromSeed(oSeed)
+func TestJWTUserLimitsMaxConns(t *testing.T) {
 	akp, _ := nkeys.CreateAccount()
 	apub, _ := akp.PublicKey()
-	nac := jwt.NewAccountClaims(apub)
-	ajwt, err := nac.Encode(kp)
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	basePath := "/ngs/v1/accounts/jwt/"
-
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == basePath {
-			w.Write([]byte("ok"))
-			return
-		}
-		// Purposely be slow on account lookup.
-		time.Sleep(200 * time.Millisecond)
-		w.Write([]byte(ajwt))
-	}))
-	defer ts.Close()
-
-	confTemplate := `
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		resolver: URL("%s%s")
-    `
-	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ts.URL, basePath)))
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
 	defer os.Remove(conf)
-
-	s, opts := RunServerWithConfig(conf)
-	pub, _ := kp.PublicKey()
-	opts.TrustedKeys = []string{pub}
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
-	// Lower default timeout to speed-up test
-	s.AccountResolver().(*URLAccResolver).c.Timeout = 50 * time.Millisecond
+	createUser := func(maxConns int) nats.Option {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		ujwt := encodeClaimsWithExt(t, jwt.NewUserClaims(upub), akp, map[string]interface{}{
+			"max_connections": maxConns,
+		})
+		return nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) })
+	}
+	user := createUser(2)
 
-	acc, _ := s.LookupAccount(apub)
-	if acc != nil {
-		t.Fatalf("Expected to not receive an account due to timeout")
+	nc1 := natsConnect(t, s.ClientURL(), user)
+	defer nc1.Close()
+	nc2 := natsConnect(t, s.ClientURL(), user)
+	defer nc2.Close()
+	if _, err := nats.Connect(s.ClientURL(), user); err == nil ||
+		!strings.Contains(err.Error(), ErrTooManyUserConnections.Error()) {
+		t.Fatalf("Expected error %q, got %v", ErrTooManyUserConnections, err)
 	}
+
+	// Other users of the account are not affected.
+	nc := natsConnect(t, s.ClientURL(), createUser(1))
+	defer nc.Close()
+
+	// Once a connection is closed, the user can connect again.
+	nc1.Close()
+	acc, _ := s.LookupAccount(apub)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := acc.NumLocalConnections(); n != 2 {
+			return fmt.Errorf("Expected 2 connections, got %d", n)
+		}
+		return nil
+	})
+	nc1 = natsConnect(t, s.ClientURL(), user)
+	nc1.Close()
 }
 
-func TestAccountURLResolverNoFetchOnReload(t *testing.T) {
-	kp, _ := nkeys.FromSeed(oSeed)
+func TestJWTUserMaxTimeRanges(t *testing.T) {
 	akp, _ := nkeys.CreateAccount()
 	apub, _ := akp.PublicKey()
-	nac := jwt.NewAccountClaims(apub)
-	ajwt, err := nac.Encode(kp)
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(ajwt))
-	}))
-	defer ts.Close()
-
-	confTemplate := `
-		operator: %s
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		resolver: URL("%s/ngs/v1/accounts/jwt/")
-    `
-	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+		max_user_time_ranges: 2
+	`, ojwt, apub, ajwt)))
 	defer os.Remove(conf)
-
 	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
-	acc, _ := s.LookupAccount(apub)
-	if acc == nil {
-		t.Fatalf("Expected to receive an account")
+	createUser := func(ranges int) nats.Option {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		now := time.Now()
+		for i := 0; i < ranges; i++ {
+			// Overlapping ranges that all include now.
+			uc.Times = append(uc.Times, jwt.TimeRange{
+				Start: now.Add(-time.Duration(i+1) * time.Minute).Format("15:04:05"),
+				End:   now.Add(time.Duration(i+1) * time.Hour).Format("15:04:05"),
+			})
+		}
+		ujwt, err := uc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) })
 	}
 
-	// Reload would produce a DATA race during the DeepEqual check for the account resolver,
-	// so close the current one and we will create a new one that keeps track of fetch calls.
-	ts.Close()
-
-	fetch := int32(0)
-	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		atomic.AddInt32(&fetch, 1)
-		w.Write([]byte(ajwt))
-	}))
-	defer ts.Close()
-
-	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
-
-	if err := s.Reload(); err != nil {
-		t.Fatalf("Error on reload: %v", err)
-	}
-	if atomic.LoadInt32(&fetch) != 0 {
-		t.Fatalf("Fetch invoked during reload")
+	nc := natsConnect(t, s.ClientURL(), createUser(2))
+	nc.Close()
+	if _, err := nats.Connect(s.ClientURL(), createUser(3)); err == nil ||
+		!strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("Expected authorization violation, got %v", err)
 	}
+}
 
-	// Now stop the resolver and make sure that on startup, we report URL resolver failure
-	s.Shutdown()
-	s = nil
-	ts.Close()
+// proxyProtoDialer connects as a proxy would, sending a PROXY protocol
+// header with the given source address first.
+type proxyProtoDialer struct {
+	src string
+}
 
-	opts := LoadConfig(conf)
-	if s, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "could not fetch") {
-		if s != nil {
-			s.Shutdown()
-		}
-		t.Fatalf("Expected error regarding account resolver, got %v", err)
+func (d *proxyProtoDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 56324 4222\r\n", d.src); err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return conn, nil
 }
 
-func TestAccountURLResolverFetchFailureInServer1(t *testing.T) {
-	const subj = "test"
-	const crossAccSubj = "test"
-	// Create Exporting Account
-	expkp, _ := nkeys.CreateAccount()
-	exppub, _ := expkp.PublicKey()
-	expac := jwt.NewAccountClaims(exppub)
-	expac.Exports.Add(&jwt.Export{
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	expjwt, err := expac.Encode(oKp)
+func TestJWTUserSrcWithProxyProtocol(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create importing Account
-	impkp, _ := nkeys.CreateAccount()
-	imppub, _ := impkp.PublicKey()
-	impac := jwt.NewAccountClaims(imppub)
-	impac.Imports.Add(&jwt.Import{
-		Account: exppub,
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	impjwt, err := impac.Encode(oKp)
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	uc := jwt.NewUserClaims(upub)
+	// Allows the client, but not the proxy (127.0.0.1).
+	uc.Src.Set("192.0.2.0/24")
+	ujwt, err := uc.Encode(akp)
 	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+		t.Fatalf("Error generating user JWT: %v", err)
 	}
-	// Simulate an account server that drops the first request to exppub
-	chanImpA := make(chan struct{}, 10)
-	defer close(chanImpA)
-	chanExpS := make(chan struct{}, 10)
-	defer close(chanExpS)
-	chanExpF := make(chan struct{}, 1)
-	defer close(chanExpF)
-	failureCnt := int32(0)
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/A/" {
-			// Server startup
-			w.Write(nil)
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/A/"+imppub {
-			w.Write([]byte(impjwt))
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/A/"+exppub {
-			if atomic.AddInt32(&failureCnt, 1) <= 1 {
-				// skip the write to simulate the failure
-				chanExpF <- struct{}{}
-			} else {
-				w.Write([]byte(expjwt))
-				chanExpS <- struct{}{}
+	user := nats.UserJWT(
+		func() (string, error) { return ujwt, nil },
+		func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) })
+
+	for _, test := range []struct {
+		name     string
+		proxy    bool
+		src      string
+		accepted bool
+	}{
+		{"proxy protocol client allowed", true, "192.0.2.1", true},
+		{"proxy protocol client rejected", true, "198.51.100.1", false},
+		{"no proxy protocol", false, "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: 127.0.0.1:-1
+				operator: %s
+				resolver: MEM
+				resolver_preload: {
+					%s: %s
+				}
+				proxy_protocol: %v
+			`, ojwt, apub, ajwt, test.proxy)))
+			defer os.Remove(conf)
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			opts := []nats.Option{user}
+			if test.proxy {
+				opts = append(opts, nats.SetCustomDialer(&proxyProtoDialer{test.src}))
 			}
-		} else {
-			t.Fatal("not expected")
-		}
-	}))
-	defer ts.Close()
-	// Create server
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
-		operator: %s
-		resolver: URL("%s/A/")
-    `, ojwt, ts.URL)))
-	defer os.Remove(confA)
-	sA := RunServer(LoadConfig(confA))
-	defer sA.Shutdown()
-	// server observed one fetch on startup
-	chanRecv(t, chanImpA, 10*time.Second)
-	// Create first client
-	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
-	defer ncA.Close()
-	// create a test subscription
-	subA, err := ncA.SubscribeSync(subj)
-	if err != nil {
-		t.Fatalf("Expected no error during subscribe: %v", err)
+			nc, err := nats.Connect(s.ClientURL(), opts...)
+			if test.accepted {
+				if err != nil {
+					t.Fatalf("Expected to connect, got %v", err)
+				}
+				defer nc.Close()
+				connz, _ := s.Connz(nil)
+				if len(connz.Conns) != 1 || connz.Conns[0].IP != test.src {
+					t.Fatalf("Expected client address %q, got %+v", test.src, connz.Conns)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+				if nc != nil {
+					nc.Close()
+				}
+				t.Fatalf("Expected authorization violation, got %v", err)
+			}
+		})
 	}
-	defer subA.Unsubscribe()
-	// Connect of client triggered a fetch of both accounts
-	// the fetch for the imported account will fail
-	chanRecv(t, chanImpA, 10*time.Second)
-	chanRecv(t, chanExpF, 10*time.Second)
-	// create second client for user exporting
-	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
-	defer ncB.Close()
-	chanRecv(t, chanExpS, 10*time.Second)
-	// Connect of client triggered another fetch, this time passing
-	checkSubInterest(t, sA, imppub, subj, 10*time.Second)
-	checkSubInterest(t, sA, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
 }
 
-func TestAccountURLResolverFetchFailurePushReorder(t *testing.T) {
-	const subj = "test"
-	const crossAccSubj = "test"
-	// Create System Account
-	syskp, _ := nkeys.CreateAccount()
-	syspub, _ := syskp.PublicKey()
-	sysAc := jwt.NewAccountClaims(syspub)
-	sysjwt, err := sysAc.Encode(oKp)
+// This will test that we can switch from a public export to a private
+// one and back with export claims to make sure the claim update mechanism
+// is working properly.
+func TestJWTAccountServiceImportAuthSwitch(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	serviceExport := &jwt.Export{Subject: "ngs.usage.*", Type: jwt.Service}
+	fooAC.Exports.Add(serviceExport)
+	fooJWT, err := fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create Exporting Account
-	expkp, _ := nkeys.CreateAccount()
-	exppub, _ := expkp.PublicKey()
-	expac := jwt.NewAccountClaims(exppub)
-	expjwt1, err := expac.Encode(oKp)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	serviceImport := &jwt.Import{Account: fooPub, Subject: "ngs.usage", To: "ngs.usage.DEREK", Type: jwt.Service}
+	barAC.Imports.Add(serviceImport)
+	barJWT, err := barAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	expac.Exports.Add(&jwt.Export{
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	expjwt2, err := expac.Encode(oKp)
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	// Create a client that will send the request
+	ca, cra, csa := createClient(t, s, barKP)
+	defer ca.close()
+	ca.parseAsync(csa)
+	expectPong(t, cra)
+
+	// Create the client that will respond to the requests.
+	cb, crb, csb := createClient(t, s, fooKP)
+	defer cb.close()
+	cb.parseAsync(csb)
+	expectPong(t, crb)
+
+	// Create Subscriber.
+	cb.parseAsync("SUB ngs.usage.* 1\r\nPING\r\n")
+	expectPong(t, crb)
+
+	// Send Request
+	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should receive the request mapped into our account. PING needed to flush.
+	cb.parseAsync("PING\r\n")
+	expectMsg(t, crb, "ngs.usage.DEREK", "hi")
+
+	// Now update to make the export private.
+	fooACPrivate := jwt.NewAccountClaims(fooPub)
+	serviceExport = &jwt.Export{Subject: "ngs.usage.*", Type: jwt.Service, TokenReq: true}
+	fooACPrivate.Exports.Add(serviceExport)
+	fooJWTPrivate, err := fooACPrivate.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create importing Account
-	impkp, _ := nkeys.CreateAccount()
-	imppub, _ := impkp.PublicKey()
-	impac := jwt.NewAccountClaims(imppub)
-	impac.Imports.Add(&jwt.Import{
-		Account: exppub,
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	impjwt, err := impac.Encode(oKp)
+	addAccountToMemResolver(s, fooPub, fooJWTPrivate)
+	acc, _ := s.LookupAccount(fooPub)
+	s.UpdateAccountClaims(acc, fooACPrivate)
+
+	// Send Another Request
+	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should not receive the request this time.
+	cb.parseAsync("PING\r\n")
+	expectPong(t, crb)
+
+	// Now put it back again to public and make sure it works again.
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	s.UpdateAccountClaims(acc, fooAC)
+
+	// Send Request
+	ca.parseAsync("PUB ngs.usage 2\r\nhi\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should receive the request mapped into our account. PING needed to flush.
+	cb.parseAsync("PING\r\n")
+	expectMsg(t, crb, "ngs.usage.DEREK", "hi")
+}
+
+// captureImportErrorLogger captures import failures, which are logged at debug level.
+type captureImportErrorLogger struct {
+	captureErrorLogger
+}
+
+func (l *captureImportErrorLogger) Debugf(format string, v ...interface{}) {
+	if strings.HasPrefix(format, "Error adding") {
+		l.Errorf(format, v...)
+	}
+}
+
+func TestJWTAccountImportSubjectNotCoveredByExport(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	// The import is not attempted, so it fails only once.
+	l := &captureImportErrorLogger{captureErrorLogger{errCh: make(chan string, 10)}}
+	s.SetLogger(l, true, false)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Exports.Add(&jwt.Export{Subject: "ngs.usage.*", Type: jwt.Service})
+	fooAC.Exports.Add(&jwt.Export{Subject: "ngs.events.>", Type: jwt.Stream})
+	fooJWT, err := fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Simulate an account server that does not serve the updated jwt for exppub
-	chanImpA := make(chan struct{}, 10)
-	defer close(chanImpA)
-	chanExpS := make(chan struct{}, 10)
-	defer close(chanExpS)
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/A/" {
-			// Server startup
-			w.Write(nil)
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/A/"+imppub {
-			w.Write([]byte(impjwt))
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/A/"+exppub {
-			// respond with jwt that does not have the export
-			// this simulates an ordering issue
-			w.Write([]byte(expjwt1))
-			chanExpS <- struct{}{}
-		} else if r.URL.Path == "/A/"+syspub {
-			w.Write([]byte(sysjwt))
-		} else {
-			t.Fatal("not expected")
-		}
-	}))
-	defer ts.Close()
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
-		operator: %s
-		resolver: URL("%s/A/")
-		system_account: %s
-    `, ojwt, ts.URL, syspub)))
-	defer os.Remove(confA)
-	sA := RunServer(LoadConfig(confA))
-	defer sA.Shutdown()
-	// server observed one fetch on startup
-	chanRecv(t, chanImpA, 10*time.Second)
-	// Create first client
-	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
-	defer ncA.Close()
-	// create a test subscription
-	subA, err := ncA.SubscribeSync(subj)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	// The service export has a single token wildcard, so this can never match.
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "ngs.usage", To: "ngs.usage.DEREK.total", Type: jwt.Service})
+	// This one is fine.
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "ngs.events.foo", Type: jwt.Stream})
+	barJWT, err := barAC.Encode(okp)
 	if err != nil {
-		t.Fatalf("Expected no error during subscribe: %v", err)
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	defer subA.Unsubscribe()
-	// Connect of client triggered a fetch of both accounts
-	// the fetch for the imported account will fail
-	chanRecv(t, chanImpA, 10*time.Second)
-	chanRecv(t, chanExpS, 10*time.Second)
-	// create second client for user exporting
-	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
-	defer ncB.Close()
-	// update expjwt2, this will correct the import issue
-	sysc := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, syskp))
-	defer sysc.Close()
-	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, exppub), []byte(expjwt2))
-	sysc.Flush()
-	// updating expjwt should cause this to pass
-	checkSubInterest(t, sA, imppub, subj, 10*time.Second)
-	checkSubInterest(t, sA, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
-}
-
-type captureDebugLogger struct {
-	DummyLogger
-	dbgCh chan string
-}
+	addAccountToMemResolver(s, barPub, barJWT)
 
-func (l *captureDebugLogger) Debugf(format string, v ...interface{}) {
+	acc, err := s.LookupAccount(barPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
 	select {
-	case l.dbgCh <- fmt.Sprintf(format, v...):
+	case e := <-l.errCh:
+		if !strings.Contains(e, `"ngs.usage.DEREK.total"`) || !strings.Contains(e, "subject not covered by export") {
+			t.Fatalf("Unexpected error: %q", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an import failure to be logged")
+	}
+	select {
+	case e := <-l.errCh:
+		t.Fatalf("Unexpected error: %q", e)
 	default:
 	}
+	if n := acc.NumServiceImports(); n != 0 {
+		t.Fatalf("Expected no service import, got %d", n)
+	}
+	acc.mu.RLock()
+	n := len(acc.imports.streams)
+	acc.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("Expected 1 stream import, got %d", n)
+	}
 }
 
-func TestAccountURLResolverPermanentFetchFailure(t *testing.T) {
-	const crossAccSubj = "test"
-	expkp, _ := nkeys.CreateAccount()
-	exppub, _ := expkp.PublicKey()
-	impkp, _ := nkeys.CreateAccount()
-	imppub, _ := impkp.PublicKey()
-	// Create System Account
-	syskp, _ := nkeys.CreateAccount()
-	syspub, _ := syskp.PublicKey()
-	sysAc := jwt.NewAccountClaims(syspub)
-	sysjwt, err := sysAc.Encode(oKp)
+func TestJWTAccountServiceImportExpires(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	serviceExport := &jwt.Export{Subject: "foo", Type: jwt.Service}
+
+	fooAC.Exports.Add(serviceExport)
+	fooJWT, err := fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create 2 Accounts. Each importing from the other, but NO matching export
-	expac := jwt.NewAccountClaims(exppub)
-	expac.Imports.Add(&jwt.Import{
-		Account: imppub,
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	expjwt, err := expac.Encode(oKp)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	serviceImport := &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
+
+	barAC.Imports.Add(serviceImport)
+	barJWT, err := barAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create importing Account
-	impac := jwt.NewAccountClaims(imppub)
-	impac.Imports.Add(&jwt.Import{
-		Account: exppub,
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	impjwt, err := impac.Encode(oKp)
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	// Create a client that will send the request
+	ca, cra, csa := createClient(t, s, barKP)
+	defer ca.close()
+	ca.parseAsync(csa)
+	expectPong(t, cra)
+
+	// Create the client that will respond to the requests.
+	cb, crb, csb := createClient(t, s, fooKP)
+	defer cb.close()
+	cb.parseAsync(csb)
+	expectPong(t, crb)
+
+	// Create Subscriber.
+	cb.parseAsync("SUB foo 1\r\nPING\r\n")
+	expectPong(t, crb)
+
+	// Send Request
+	ca.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should receive the request. PING needed to flush.
+	cb.parseAsync("PING\r\n")
+	expectMsg(t, crb, "foo", "hi")
+
+	// Now update the exported service to require auth.
+	fooAC = jwt.NewAccountClaims(fooPub)
+	serviceExport = &jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true}
+
+	fooAC.Exports.Add(serviceExport)
+	fooJWT, err = fooAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Simulate an account server that does not serve the updated jwt for exppub
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/A/" {
-			// Server startup
-			w.Write(nil)
-		} else if r.URL.Path == "/A/"+imppub {
-			w.Write([]byte(impjwt))
-		} else if r.URL.Path == "/A/"+exppub {
-			w.Write([]byte(expjwt))
-		} else if r.URL.Path == "/A/"+syspub {
-			w.Write([]byte(sysjwt))
-		} else {
-			t.Fatal("not expected")
-		}
-	}))
-	defer ts.Close()
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
-		operator: %s
-		resolver: URL("%s/A/")
-		system_account: %s
-    `, ojwt, ts.URL, syspub)))
-	defer os.Remove(confA)
-	o := LoadConfig(confA)
-	sA := RunServer(o)
-	defer sA.Shutdown()
-	l := &captureDebugLogger{dbgCh: make(chan string, 100)} // has enough space to not block
-	sA.SetLogger(l, true, false)
-	// Create clients
-	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
-	defer ncA.Close()
-	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
-	defer ncB.Close()
-	sysc := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, syskp))
-	defer sysc.Close()
-	// push accounts
-	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, imppub), []byte(impjwt))
-	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, exppub), []byte(expjwt))
-	sysc.Flush()
-	importErrCnt := 0
-	tmr := time.NewTimer(500 * time.Millisecond)
-	defer tmr.Stop()
-	for {
-		select {
-		case line := <-l.dbgCh:
-			if strings.HasPrefix(line, "Error adding stream import to account") {
-				importErrCnt++
-			}
-		case <-tmr.C:
-			// connecting and updating, each cause 3 traces (2 + 1 on iteration)
-			if importErrCnt != 6 {
-				t.Fatalf("Expected 6 debug traces, got %d", importErrCnt)
-			}
-			return
-		}
-	}
-}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+	acc, _ := s.LookupAccount(fooPub)
+	s.UpdateAccountClaims(acc, fooAC)
 
-func TestAccountURLResolverFetchFailureInCluster(t *testing.T) {
-	assertChanLen := func(x int, chans ...chan struct{}) {
-		t.Helper()
-		for _, c := range chans {
-			if len(c) != x {
-				t.Fatalf("length of channel is not %d", x)
-			}
-		}
-	}
-	const subj = ">"
-	const crossAccSubj = "test"
-	// Create Exporting Account
-	expkp, _ := nkeys.CreateAccount()
-	exppub, _ := expkp.PublicKey()
-	expac := jwt.NewAccountClaims(exppub)
-	expac.Exports.Add(&jwt.Export{
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	expjwt, err := expac.Encode(oKp)
+	// Send Another Request
+	ca.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should not receive the request this time.
+	cb.parseAsync("PING\r\n")
+	expectPong(t, crb)
+
+	// Now get an activation token such that it will work, but will expire.
+	barAC = jwt.NewAccountClaims(barPub)
+	serviceImport = &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
+
+	now := time.Now()
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "foo"
+	activation.ImportType = jwt.Service
+	activation.IssuedAt = now.Add(-10 * time.Second).Unix()
+	activation.Expires = now.Add(time.Second).Round(time.Second).Unix()
+	actJWT, err := activation.Encode(fooKP)
 	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+		t.Fatalf("Error generating activation token: %v", err)
 	}
-	// Create importing Account
-	impkp, _ := nkeys.CreateAccount()
-	imppub, _ := impkp.PublicKey()
-	impac := jwt.NewAccountClaims(imppub)
-	impac.Imports.Add(&jwt.Import{
-		Account: exppub,
-		Subject: crossAccSubj,
-		Type:    jwt.Stream,
-	})
-	impac.Exports.Add(&jwt.Export{
-		Subject: "srvc",
-		Type:    jwt.Service,
-	})
-	impjwt, err := impac.Encode(oKp)
+	serviceImport.Token = actJWT
+
+	barAC.Imports.Add(serviceImport)
+	barJWT, err = barAC.Encode(okp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create User
-	nkp, _ := nkeys.CreateUser()
-	uSeed, _ := nkp.Seed()
-	upub, _ := nkp.PublicKey()
-	nuc := newJWTTestUserClaims()
-	nuc.Subject = upub
-	uJwt, err := nuc.Encode(impkp)
+	addAccountToMemResolver(s, barPub, barJWT)
+	acc, _ = s.LookupAccount(barPub)
+	s.UpdateAccountClaims(acc, barAC)
+
+	// Now it should work again.
+	// Send Another Request
+	ca.parseAsync("PUB foo 3\r\nhi2\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should receive the request. PING needed to flush.
+	cb.parseAsync("PING\r\n")
+	expectMsg(t, crb, "foo", "hi2")
+
+	// Now wait for it to expire, then retry.
+	waitTime := time.Duration(activation.Expires-time.Now().Unix()) * time.Second
+	time.Sleep(waitTime + 250*time.Millisecond)
+
+	// Send Another Request
+	ca.parseAsync("PUB foo 3\r\nhi3\r\nPING\r\n")
+	expectPong(t, cra)
+
+	// We should NOT receive the request. PING needed to flush.
+	cb.parseAsync("PING\r\n")
+	expectPong(t, crb)
+}
+
+func TestAccountURLResolver(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		useTLS bool
+	}{
+		{"plain", false},
+		{"tls", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kp, _ := nkeys.FromSeed(oSeed)
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			nac := jwt.NewAccountClaims(apub)
+			ajwt, err := nac.Encode(kp)
+			if err != nil {
+				t.Fatalf("Error generating account JWT: %v", err)
+			}
+
+			hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(ajwt))
+			})
+			var ts *httptest.Server
+			if test.useTLS {
+				ts = httptest.NewTLSServer(hf)
+			} else {
+				ts = httptest.NewServer(hf)
+			}
+			defer ts.Close()
+
+			confTemplate := `
+				operator: %s
+				listen: -1
+				resolver: URL("%s/ngs/v1/accounts/jwt/")
+				resolver_tls {
+					insecure: true
+				}
+			`
+			conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
+			defer os.Remove(conf)
+
+			s, opts := RunServerWithConfig(conf)
+			pub, _ := kp.PublicKey()
+			opts.TrustedKeys = []string{pub}
+			defer s.Shutdown()
+
+			acc, _ := s.LookupAccount(apub)
+			if acc == nil {
+				t.Fatalf("Expected to receive an account")
+			}
+			if acc.Name != apub {
+				t.Fatalf("Account name did not match claim key")
+			}
+		})
+	}
+}
+
+func TestAccountUnixResolver(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	if err != nil {
-		t.Fatalf("Error generating user JWT: %v", err)
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	creds := genCredsFile(t, uJwt, uSeed)
-	defer os.Remove(creds)
-	// Simulate an account server that drops the first request to /B/acc
-	chanImpA := make(chan struct{}, 4)
-	defer close(chanImpA)
-	chanImpB := make(chan struct{}, 4)
-	defer close(chanImpB)
-	chanExpA := make(chan struct{}, 4)
-	defer close(chanExpA)
-	chanExpB := make(chan struct{}, 4)
-	defer close(chanExpB)
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/A/" {
-			// Server A startup
-			w.Write(nil)
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/B/" {
-			// Server B startup
-			w.Write(nil)
-			chanImpB <- struct{}{}
-		} else if r.URL.Path == "/A/"+imppub {
-			// First Client connecting to Server A
-			w.Write([]byte(impjwt))
-			chanImpA <- struct{}{}
-		} else if r.URL.Path == "/B/"+imppub {
-			// Second Client connecting to Server B
-			w.Write([]byte(impjwt))
-			chanImpB <- struct{}{}
-		} else if r.URL.Path == "/A/"+exppub {
-			// First Client connecting to Server A
-			w.Write([]byte(expjwt))
-			chanExpA <- struct{}{}
-		} else if r.URL.Path == "/B/"+exppub {
-			// Second Client connecting to Server B
-			w.Write([]byte(expjwt))
-			chanExpB <- struct{}{}
-		} else {
-			t.Fatal("not expected")
+
+	dir, err := ioutil.TempDir("", "unix-resolver")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "accounts.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening on unix socket: %v", err)
+	}
+	defer l.Close()
+	var requests []string
+	var mu sync.Mutex
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+		case "/" + apub:
+			w.Write([]byte(ajwt))
+		default:
+			w.WriteHeader(http.StatusNotFound)
 		}
 	}))
-	defer ts.Close()
-	// Create seed server A
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		operator: %s
-		resolver: URL("%s/A/")
-		cluster {
-			name: clust
-			no_advertise: true
-			listen: -1
-		}
-    `, ojwt, ts.URL)))
-	defer os.Remove(confA)
-	sA := RunServer(LoadConfig(confA))
-	defer sA.Shutdown()
-	// Create Server B (using no_advertise to prevent failover)
-	confB := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		operator: %s
-		resolver: URL("%s/B/")
-		cluster {
-			name: clust
-			no_advertise: true
-			listen: -1 
-			routes [
-				nats-route://localhost:%d
-			]
+		resolver: UNIX("%s")
+	`, ojwt, sock)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ur, ok := opts.AccountResolver.(*UnixAccResolver)
+	if !ok {
+		t.Fatalf("Expected a unix resolver, got %T", opts.AccountResolver)
+	}
+	if cfg := opts.AccountResolverConfig(); cfg.Type != "UNIX" || cfg.Socket != sock {
+		t.Fatalf("Unexpected resolver config: %+v", cfg)
+	}
+	acc, _ := s.LookupAccount(apub)
+	if acc == nil || acc.Name != apub {
+		t.Fatalf("Expected to retrieve account %q, got %v", apub, acc)
+	}
+	if _, err := ur.Fetch("unknown"); err == nil {
+		t.Fatalf("Expected error fetching an unknown account")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) < 2 || requests[0] != "/" || requests[len(requests)-1] != "/unknown" {
+		t.Fatalf("Unexpected requests %v", requests)
+	}
+}
+
+// Generates a CA and a certificate signed by it, writing the PEM encoded
+// files to dir. Returns the CA, certificate and key file names.
+func genTestCertAndCA(t *testing.T, dir, prefix string, server bool) (string, string, string) {
+	t.Helper()
+	writePEM := func(name, typ string, b []byte) string {
+		t.Helper()
+		fn := filepath.Join(dir, prefix+name)
+		if err := ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatalf("Error writing %q: %v", fn, err)
 		}
-    `, ojwt, ts.URL, sA.opts.Cluster.Port)))
-	defer os.Remove(confB)
-	sB := RunServer(LoadConfig(confB))
-	defer sB.Shutdown()
-	// startup cluster
-	checkClusterFormed(t, sA, sB)
-	// Both server observed one fetch on startup
-	chanRecv(t, chanImpA, 10*time.Second)
-	chanRecv(t, chanImpB, 10*time.Second)
-	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
-	// Create first client, directly connects to A
-	urlA := fmt.Sprintf("nats://%s:%d", sA.opts.Host, sA.opts.Port)
-	ncA, err := nats.Connect(urlA, nats.UserCredentials(creds),
-		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
-			if err != nil {
-				t.Fatal("error not expected in this test", err)
-			}
-		}),
-		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
-			t.Fatal("error not expected in this test", err)
-		}),
-	)
-	if err != nil {
-		t.Fatalf("Expected to connect, got %v %s", err, urlA)
+		return fn
 	}
-	defer ncA.Close()
-	// create a test subscription
-	subA, err := ncA.SubscribeSync(subj)
-	if err != nil {
-		t.Fatalf("Expected no error during subscribe: %v", err)
+	genKey := func() *ecdsa.PrivateKey {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatalf("Error generating key: %v", err)
+		}
+		return key
 	}
-	defer subA.Unsubscribe()
-	// Connect of client triggered a fetch by Server A
-	chanRecv(t, chanImpA, 10*time.Second)
-	chanRecv(t, chanExpA, 10*time.Second)
-	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
-	//time.Sleep(10 * time.Second)
-	// create second client, directly connect to B
-	urlB := fmt.Sprintf("nats://%s:%d", sB.opts.Host, sB.opts.Port)
-	ncB, err := nats.Connect(urlB, nats.UserCredentials(creds), nats.NoReconnect())
+	now := time.Now()
+	caKey := genKey()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: prefix + "ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
 	if err != nil {
-		t.Fatalf("Expected to connect, got %v %s", err, urlB)
+		t.Fatalf("Error creating CA certificate: %v", err)
 	}
-	defer ncB.Close()
-	// Connect of client triggered a fetch by Server B
-	chanRecv(t, chanImpB, 10*time.Second)
-	chanRecv(t, chanExpB, 10*time.Second)
-	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
-	checkClusterFormed(t, sA, sB)
-	// the route subscription was lost due to the failed fetch
-	// Now we test if some recover mechanism is in play
-	checkSubInterest(t, sB, imppub, subj, 10*time.Second)         // Will fail as a result of this issue
-	checkSubInterest(t, sB, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
-	if err := ncB.Publish(subj, []byte("msg")); err != nil {
-		t.Fatalf("Expected to publish %v", err)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key := genKey()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
-	// expect the message from B to flow to A
-	if m, err := subA.NextMsg(10 * time.Second); err != nil {
-		t.Fatalf("Expected to receive a message %v", err)
-	} else if string(m.Data) != "msg" {
-		t.Fatalf("Expected to receive 'msg', got: %s", string(m.Data))
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
 	}
-	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key: %v", err)
+	}
+	return writePEM("ca.pem", "CERTIFICATE", caDER),
+		writePEM("cert.pem", "CERTIFICATE", der),
+		writePEM("key.pem", "EC PRIVATE KEY", keyDER)
 }
 
-func TestAccountURLResolverReturnDifferentOperator(t *testing.T) {
-	// Create a valid chain of op/acc/usr using a different operator
-	// This is so we can test if the server rejects this chain.
-	// Create Operator
-	op, _ := nkeys.CreateOperator()
-	// Create Account, this account is the one returned by the resolver
+func TestAccountURLResolverClientCert(t *testing.T) {
+	kp, _ := nkeys.FromSeed(oSeed)
 	akp, _ := nkeys.CreateAccount()
 	apub, _ := akp.PublicKey()
 	nac := jwt.NewAccountClaims(apub)
-	ajwt, err := nac.Encode(op)
+	ajwt, err := nac.Encode(kp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// Create User
-	nkp, _ := nkeys.CreateUser()
-	uSeed, _ := nkp.Seed()
-	upub, _ := nkp.PublicKey()
-	nuc := newJWTTestUserClaims()
-	nuc.Subject = upub
-	uJwt, err := nuc.Encode(akp)
+
+	dir, err := ioutil.TempDir("", "resolver_tls")
 	if err != nil {
-		t.Fatalf("Error generating user JWT: %v", err)
+		t.Fatalf("Error creating dir: %v", err)
 	}
-	creds := genCredsFile(t, uJwt, uSeed)
-	defer os.Remove(creds)
-	// Simulate an account server that was hijacked/mis configured
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	defer os.RemoveAll(dir)
+	srvCA, srvCert, srvKey := genTestCertAndCA(t, dir, "srv-", true)
+	cliCA, cliCert, cliKey := genTestCertAndCA(t, dir, "cli-", false)
+	_, badCert, badKey := genTestCertAndCA(t, dir, "bad-", false)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(ajwt))
 	}))
+	tlsConfig, err := GenTLSConfig(&TLSConfigOpts{
+		CertFile: srvCert,
+		KeyFile:  srvKey,
+		CaFile:   cliCA,
+		Verify:   true,
+	})
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	ts.TLS = tlsConfig
+	ts.StartTLS()
 	defer ts.Close()
-	// Create Server
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
-		operator: %s
-		resolver: URL("%s/A/")
-    `, ojwt, ts.URL)))
-	defer os.Remove(confA)
-	sA, _ := RunServerWithConfig(confA)
-	defer sA.Shutdown()
-	// Create first client, directly connects to A
-	urlA := fmt.Sprintf("nats://%s:%d", sA.opts.Host, sA.opts.Port)
-	if _, err := nats.Connect(urlA, nats.UserCredentials(creds),
-		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+
+	for _, test := range []struct {
+		name  string
+		certs string
+		ok    bool
+	}{
+		{"no client cert", "", false},
+		{"mis-signed client cert", fmt.Sprintf("cert_file: %q\nkey_file: %q", badCert, badKey), false},
+		{"client cert", fmt.Sprintf("cert_file: %q\nkey_file: %q", cliCert, cliKey), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				operator: %s
+				listen: -1
+				resolver: URL("%s/ngs/v1/accounts/jwt/")
+				resolver_tls {
+					ca_file: %q
+					%s
+				}
+			`, ojwt, ts.URL, srvCA, test.certs)))
+			defer os.Remove(conf)
+
+			s, err := NewServer(LoadConfig(conf))
+			if !test.ok {
+				if err == nil || !strings.Contains(err.Error(), "could not fetch") {
+					s.Shutdown()
+					t.Fatalf("Expected fetch to fail, got %v", err)
+				}
+				return
+			}
 			if err != nil {
-				t.Fatal("error not expected in this test", err)
+				t.Fatalf("Error creating server: %v", err)
 			}
-		}),
-		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
-			t.Fatal("error not expected in this test", err)
-		}),
-	); err == nil {
-		t.Fatal("Expected connect to fail")
-	}
-	// Test if the server has the account in memory. (shouldn't)
-	if v, ok := sA.accounts.Load(apub); ok {
-		t.Fatalf("Expected account to NOT be in memory: %v", v.(*Account))
+			defer s.Shutdown()
+			if acc, _ := s.LookupAccount(apub); acc == nil {
+				t.Fatalf("Expected to receive an account")
+			}
+		})
 	}
 }
 
-func TestJWTUserSigningKey(t *testing.T) {
-	s := opTrustBasicSetup()
-	defer s.Shutdown()
-
-	// Check to make sure we would have an authTimer
-	if !s.info.AuthRequired {
-		t.Fatalf("Expect the server to require auth")
+func TestAccountURLResolverHeaders(t *testing.T) {
+	kp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(kp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
 
-	c, cr, _ := newClientForServer(s)
-	defer c.close()
-	// Don't send jwt field, should fail.
-	c.parseAsync("CONNECT {\"verbose\":true,\"pedantic\":true}\r\nPING\r\n")
-	l, _ := cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
+	basePath := "/ngs/v1/accounts/jwt/"
+	token := "Bearer s3cr3t"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			w.Write([]byte("ok"))
+			return
+		}
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		name    string
+		headers string
+		ok      bool
+	}{
+		{"no headers", "", false},
+		{"wrong header", `resolver_headers { Authorization: "Bearer wrong" }`, false},
+		{"header", fmt.Sprintf(`resolver_headers { Authorization: %q }`, token), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				operator: %s
+				listen: -1
+				resolver: URL("%s%s")
+				%s
+			`, ojwt, ts.URL, basePath, test.headers)))
+			defer os.Remove(conf)
+
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			acc, _ := s.LookupAccount(apub)
+			if test.ok && acc == nil {
+				t.Fatalf("Expected to receive an account")
+			} else if !test.ok && acc != nil {
+				t.Fatalf("Expected to not receive an account")
+			}
+		})
 	}
+}
 
-	okp, _ := nkeys.FromSeed(oSeed)
+func TestAccountResolverHeadersRequireURLResolver(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		operator: %s
+		listen: -1
+		resolver: MEM
+		resolver_headers { Authorization: "Bearer s3cr3t" }
+	`, ojwt)))
+	defer os.Remove(conf)
 
-	// Create an account
+	opts := LoadConfig(conf)
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "resolver headers") {
+		t.Fatalf("Expected error about resolver headers, got %v", err)
+	}
+}
+
+func TestAccountURLResolverTimeout(t *testing.T) {
+	kp, _ := nkeys.FromSeed(oSeed)
 	akp, _ := nkeys.CreateAccount()
 	apub, _ := akp.PublicKey()
-
-	// Create a signing key for the account
-	askp, _ := nkeys.CreateAccount()
-	aspub, _ := askp.PublicKey()
-
 	nac := jwt.NewAccountClaims(apub)
-	ajwt, err := nac.Encode(okp)
+	ajwt, err := nac.Encode(kp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
 
-	// Create a client with the account signing key
-	c, cr, cs := createClientWithIssuer(t, s, askp, apub)
-	defer c.close()
-
-	// PING needed to flush the +OK/-ERR to us.
-	// This should fail too since no account resolver is defined.
-	c.parseAsync(cs)
-	l, _ = cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
-	}
+	basePath := "/ngs/v1/accounts/jwt/"
 
-	// Ok now let's walk through and make sure all is good.
-	// We will set the account resolver by hand to a memory resolver.
-	buildMemAccResolver(s)
-	addAccountToMemResolver(s, apub, ajwt)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			w.Write([]byte("ok"))
+			return
+		}
+		// Purposely be slow on account lookup.
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
 
-	// Create a client with a signing key
-	c, cr, cs = createClientWithIssuer(t, s, askp, apub)
-	defer c.close()
-	// should fail because the signing key is not known
-	c.parseAsync(cs)
-	l, _ = cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error: %v", l)
-	}
+	confTemplate := `
+		listen: -1
+		resolver: URL("%s%s")
+    `
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ts.URL, basePath)))
+	defer os.Remove(conf)
 
-	// add a signing key
-	nac.SigningKeys.Add(aspub)
-	// update the memory resolver
-	acc, _ := s.LookupAccount(apub)
-	s.UpdateAccountClaims(acc, nac)
+	s, opts := RunServerWithConfig(conf)
+	pub, _ := kp.PublicKey()
+	opts.TrustedKeys = []string{pub}
+	defer s.Shutdown()
 
-	// Create a client with a signing key
-	c, cr, cs = createClientWithIssuer(t, s, askp, apub)
-	defer c.close()
+	// Lower default timeout to speed-up test
+	s.AccountResolver().(*URLAccResolver).c.Timeout = 50 * time.Millisecond
 
-	// expect this to work
-	c.parseAsync(cs)
-	l, _ = cr.ReadString('\n')
-	if !strings.HasPrefix(l, "PONG") {
-		t.Fatalf("Expected a PONG, got %q", l)
+	acc, _ := s.LookupAccount(apub)
+	if acc != nil {
+		t.Fatalf("Expected to not receive an account due to timeout")
 	}
+}
 
-	isClosed := func() bool {
-		c.mu.Lock()
-		defer c.mu.Unlock()
-		return c.isClosed()
+func TestAccountURLResolverNoFetchOnReload(t *testing.T) {
+	kp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(kp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
 
-	if isClosed() {
-		t.Fatal("expected client to be alive")
-	}
-	// remove the signing key should bounce client
-	nac.SigningKeys = nil
-	acc, _ = s.LookupAccount(apub)
-	s.UpdateAccountClaims(acc, nac)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
 
-	if !isClosed() {
-		t.Fatal("expected client to be gone")
-	}
-}
+	confTemplate := `
+		operator: %s
+		listen: -1
+		resolver: URL("%s/ngs/v1/accounts/jwt/")
+    `
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
+	defer os.Remove(conf)
 
-func TestJWTAccountImportSignerRemoved(t *testing.T) {
-	s := opTrustBasicSetup()
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	buildMemAccResolver(s)
 
-	okp, _ := nkeys.FromSeed(oSeed)
+	acc, _ := s.LookupAccount(apub)
+	if acc == nil {
+		t.Fatalf("Expected to receive an account")
+	}
 
-	// Exporter keys
-	srvKP, _ := nkeys.CreateAccount()
-	srvPK, _ := srvKP.PublicKey()
-	srvSignerKP, _ := nkeys.CreateAccount()
-	srvSignerPK, _ := srvSignerKP.PublicKey()
+	// Reload would produce a DATA race during the DeepEqual check for the account resolver,
+	// so close the current one and we will create a new one that keeps track of fetch calls.
+	ts.Close()
 
-	// Importer keys
-	clientKP, _ := nkeys.CreateAccount()
-	clientPK, _ := clientKP.PublicKey()
+	fetch := int32(0)
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetch, 1)
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
 
-	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
-		ac := jwt.NewAccountClaims(srvPK)
-		ac.SigningKeys.Add(signingKeys...)
-		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
-		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating exporter JWT: %v", err)
-		}
-		return token, ac
-	}
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(confTemplate, ojwt, ts.URL)))
 
-	createImportToken := func(sub string, kind jwt.ExportType) string {
-		actC := jwt.NewActivationClaims(clientPK)
-		actC.IssuerAccount = srvPK
-		actC.ImportType = kind
-		actC.ImportSubject = jwt.Subject(sub)
-		token, err := actC.Encode(srvSignerKP)
-		if err != nil {
-			t.Fatal(err)
-		}
-		return token
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
 	}
-
-	createClientJwt := func() string {
-		ac := jwt.NewAccountClaims(clientPK)
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating importer JWT: %v", err)
-		}
-		return token
+	if atomic.LoadInt32(&fetch) != 0 {
+		t.Fatalf("Fetch invoked during reload")
 	}
 
-	srvJWT, _ := createSrvJwt(srvSignerPK)
-	addAccountToMemResolver(s, srvPK, srvJWT)
-
-	clientJWT := createClientJwt()
-	addAccountToMemResolver(s, clientPK, clientJWT)
-
-	// Create a client that will send the request
-	client, clientReader, clientCS := createClient(t, s, clientKP)
-	defer client.close()
-	client.parseAsync(clientCS)
-	expectPong(t, clientReader)
+	// Now stop the resolver and make sure that on startup, we report URL resolver failure
+	s.Shutdown()
+	s = nil
+	ts.Close()
 
-	checkShadow := func(expected int) {
-		t.Helper()
-		client.mu.Lock()
-		defer client.mu.Unlock()
-		sub := client.subs["1"]
-		count := 0
-		if sub != nil {
-			count = len(sub.shadow)
-		}
-		if count != expected {
-			t.Fatalf("Expected shadows to be %d, got %d", expected, count)
+	opts := LoadConfig(conf)
+	if s, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "could not fetch") {
+		if s != nil {
+			s.Shutdown()
 		}
+		t.Fatalf("Expected error regarding account resolver, got %v", err)
 	}
+}
 
-	checkShadow(0)
-	// Create the client that will respond to the requests.
-	srv, srvReader, srvCS := createClient(t, s, srvKP)
-	defer srv.close()
-	srv.parseAsync(srvCS)
-	expectPong(t, srvReader)
-
-	// Create Subscriber.
-	srv.parseAsync("SUB foo 1\r\nPING\r\n")
-	expectPong(t, srvReader)
-
-	// Send Request
-	client.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
-	expectPong(t, clientReader)
-
-	// We should receive the request. PING needed to flush.
-	srv.parseAsync("PING\r\n")
-	expectMsg(t, srvReader, "foo", "hi")
-
-	client.parseAsync("SUB bar 1\r\nPING\r\n")
-	expectPong(t, clientReader)
-	checkShadow(1)
-
-	srv.parseAsync("PUB bar 2\r\nhi\r\nPING\r\n")
-	expectPong(t, srvReader)
-
-	// We should receive from stream. PING needed to flush.
-	client.parseAsync("PING\r\n")
-	expectMsg(t, clientReader, "bar", "hi")
-
-	// Now update the exported service no signer
-	srvJWT, srvAC := createSrvJwt()
-	addAccountToMemResolver(s, srvPK, srvJWT)
-	acc, _ := s.LookupAccount(srvPK)
-	s.UpdateAccountClaims(acc, srvAC)
-
-	// Send Another Request
-	client.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
-	expectPong(t, clientReader)
-
-	// We should not receive the request this time.
-	srv.parseAsync("PING\r\n")
-	expectPong(t, srvReader)
+func TestAccountURLResolverTraceFetches(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
 
-	// Publish on the stream
-	srv.parseAsync("PUB bar 2\r\nhi\r\nPING\r\n")
-	expectPong(t, srvReader)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
 
-	// We should not receive from the stream this time
-	client.parseAsync("PING\r\n")
-	expectPong(t, clientReader)
-	checkShadow(0)
-}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		operator: %s
+		listen: -1
+		resolver: URL("%s/ngs/v1/accounts/jwt/")
+		resolver_trace_fetches: true
+    `, ojwt, ts.URL)))
+	defer os.Remove(conf)
 
-func TestJWTAccountImportSignerDeadlock(t *testing.T) {
-	s := opTrustBasicSetup()
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	buildMemAccResolver(s)
-
-	okp, _ := nkeys.FromSeed(oSeed)
-
-	// Exporter keys
-	srvKP, _ := nkeys.CreateAccount()
-	srvPK, _ := srvKP.PublicKey()
-	srvSignerKP, _ := nkeys.CreateAccount()
-	srvSignerPK, _ := srvSignerKP.PublicKey()
 
-	// Importer keys
-	clientKP, _ := nkeys.CreateAccount()
-	clientPK, _ := clientKP.PublicKey()
+	l := &captureDebugLogger{dbgCh: make(chan string, 100)}
+	s.SetLogger(l, true, false)
 
-	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
-		ac := jwt.NewAccountClaims(srvPK)
-		ac.SigningKeys.Add(signingKeys...)
-		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
-		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating exporter JWT: %v", err)
+	for i := 0; i < 3; i++ {
+		if _, err := s.fetchRawAccountClaims(apub); err != nil {
+			t.Fatalf("Error fetching account: %v", err)
 		}
-		return token, ac
 	}
 
-	createImportToken := func(sub string, kind jwt.ExportType) string {
-		actC := jwt.NewActivationClaims(clientPK)
-		actC.IssuerAccount = srvPK
-		actC.ImportType = kind
-		actC.ImportSubject = jwt.Subject(sub)
-		token, err := actC.Encode(srvSignerKP)
-		if err != nil {
-			t.Fatal(err)
+	expected := fmt.Sprintf("Account [%s] fetch from URL resolver (200 OK) took ", apub)
+	traces := 0
+	for done := false; !done; {
+		select {
+		case line := <-l.dbgCh:
+			if strings.HasPrefix(line, expected) {
+				traces++
+			} else if strings.HasPrefix(line, fmt.Sprintf("Account [%s] fetch", apub)) {
+				t.Fatalf("Unexpected fetch trace: %q", line)
+			}
+		default:
+			done = true
 		}
-		return token
 	}
-
-	createClientJwt := func() string {
-		ac := jwt.NewAccountClaims(clientPK)
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating importer JWT: %v", err)
-		}
-		return token
+	if traces != 3 {
+		t.Fatalf("Expected 3 fetch traces, got %d", traces)
 	}
-
-	srvJWT, _ := createSrvJwt(srvSignerPK)
-	addAccountToMemResolver(s, srvPK, srvJWT)
-
-	clientJWT := createClientJwt()
-	addAccountToMemResolver(s, clientPK, clientJWT)
-
-	acc, _ := s.LookupAccount(srvPK)
-	// Have a go routine that constantly gets/releases the acc's write lock.
-	// There was a bug that could cause AddServiceImportWithClaim to deadlock.
-	ch := make(chan bool, 1)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-ch:
-				return
-			default:
-				acc.mu.Lock()
-				acc.mu.Unlock()
-				time.Sleep(time.Millisecond)
-			}
-		}
-	}()
-
-	// Create a client that will send the request
-	client, clientReader, clientCS := createClient(t, s, clientKP)
-	defer client.close()
-	client.parseAsync(clientCS)
-	expectPong(t, clientReader)
-
-	close(ch)
-	wg.Wait()
 }
 
-func TestJWTAccountImportWrongIssuerAccount(t *testing.T) {
-	s := opTrustBasicSetup()
-	defer s.Shutdown()
-	buildMemAccResolver(s)
-
-	l := &captureErrorLogger{errCh: make(chan string, 2)}
-	s.SetLogger(l, false, false)
-
-	okp, _ := nkeys.FromSeed(oSeed)
-
-	// Exporter keys
-	srvKP, _ := nkeys.CreateAccount()
-	srvPK, _ := srvKP.PublicKey()
-	srvSignerKP, _ := nkeys.CreateAccount()
-	srvSignerPK, _ := srvSignerKP.PublicKey()
-
-	// Importer keys
-	clientKP, _ := nkeys.CreateAccount()
-	clientPK, _ := clientKP.PublicKey()
-
-	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
-		ac := jwt.NewAccountClaims(srvPK)
-		ac.SigningKeys.Add(signingKeys...)
-		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
-		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating exporter JWT: %v", err)
-		}
-		return token, ac
+func TestAccountURLResolverFetchFailureInServer1(t *testing.T) {
+	const subj = "test"
+	const crossAccSubj = "test"
+	// Create Exporting Account
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	expjwt, err := expac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	createImportToken := func(sub string, kind jwt.ExportType) string {
-		actC := jwt.NewActivationClaims(clientPK)
-		// Reference ourselves, which is wrong.
-		actC.IssuerAccount = clientPK
-		actC.ImportType = kind
-		actC.ImportSubject = jwt.Subject(sub)
-		token, err := actC.Encode(srvSignerKP)
-		if err != nil {
-			t.Fatal(err)
-		}
-		return token
-	}
-
-	createClientJwt := func() string {
-		ac := jwt.NewAccountClaims(clientPK)
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
-		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
-		token, err := ac.Encode(okp)
-		if err != nil {
-			t.Fatalf("Error generating importer JWT: %v", err)
-		}
-		return token
+	// Create importing Account
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{
+		Account: exppub,
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	impjwt, err := impac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	srvJWT, _ := createSrvJwt(srvSignerPK)
-	addAccountToMemResolver(s, srvPK, srvJWT)
-
-	clientJWT := createClientJwt()
-	addAccountToMemResolver(s, clientPK, clientJWT)
-
-	// Create a client that will send the request
-	client, clientReader, clientCS := createClient(t, s, clientKP)
-	defer client.close()
-	client.parseAsync(clientCS)
-	expectPong(t, clientReader)
-
-	for i := 0; i < 2; i++ {
-		select {
-		case e := <-l.errCh:
-			if !strings.HasPrefix(e, fmt.Sprintf("Invalid issuer account %q in activation claim", clientPK)) {
-				t.Fatalf("Unexpected error: %v", e)
+	// Simulate an account server that drops the first request to exppub
+	chanImpA := make(chan struct{}, 10)
+	defer close(chanImpA)
+	chanExpS := make(chan struct{}, 10)
+	defer close(chanExpS)
+	chanExpF := make(chan struct{}, 1)
+	defer close(chanExpF)
+	failureCnt := int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server startup
+			w.Write(nil)
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/A/"+imppub {
+			w.Write([]byte(impjwt))
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/A/"+exppub {
+			if atomic.AddInt32(&failureCnt, 1) <= 1 {
+				// skip the write to simulate the failure
+				chanExpF <- struct{}{}
+			} else {
+				w.Write([]byte(expjwt))
+				chanExpS <- struct{}{}
 			}
-		case <-time.After(2 * time.Second):
-			t.Fatalf("Did not get error regarding issuer account")
+		} else {
+			t.Fatal("not expected")
 		}
+	}))
+	defer ts.Close()
+	// Create server
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+    `, ojwt, ts.URL)))
+	defer os.Remove(confA)
+	sA := RunServer(LoadConfig(confA))
+	defer sA.Shutdown()
+	// server observed one fetch on startup
+	chanRecv(t, chanImpA, 10*time.Second)
+	// Create first client
+	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
+	defer ncA.Close()
+	// create a test subscription
+	subA, err := ncA.SubscribeSync(subj)
+	if err != nil {
+		t.Fatalf("Expected no error during subscribe: %v", err)
 	}
+	defer subA.Unsubscribe()
+	// Connect of client triggered a fetch of both accounts
+	// the fetch for the imported account will fail
+	chanRecv(t, chanImpA, 10*time.Second)
+	chanRecv(t, chanExpF, 10*time.Second)
+	// create second client for user exporting
+	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncB.Close()
+	chanRecv(t, chanExpS, 10*time.Second)
+	// Connect of client triggered another fetch, this time passing
+	checkSubInterest(t, sA, imppub, subj, 10*time.Second)
+	checkSubInterest(t, sA, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
 }
 
-func TestJWTUserRevokedOnAccountUpdate(t *testing.T) {
-	nac := newJWTTestAccountClaims()
-	s, akp, c, cr := setupJWTTestWitAccountClaims(t, nac, "+OK")
-	defer s.Shutdown()
-	defer c.close()
-
-	expectPong(t, cr)
-
-	okp, _ := nkeys.FromSeed(oSeed)
-	apub, _ := akp.PublicKey()
-
-	c.mu.Lock()
-	pub := c.user.Nkey
-	c.mu.Unlock()
-
-	// Now revoke the user.
-	nac.Revoke(pub)
-
-	ajwt, err := nac.Encode(okp)
+func TestAccountURLResolverImportResolvesOnFirstConnect(t *testing.T) {
+	const subj = "test"
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: subj, Type: jwt.Stream})
+	expjwt, err := expac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	// Update the account on the server.
-	addAccountToMemResolver(s, apub, ajwt)
-	acc, err := s.LookupAccount(apub)
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: subj, Type: jwt.Stream})
+	impjwt, err := impac.Encode(oKp)
 	if err != nil {
-		t.Fatalf("Error looking up the account: %v", err)
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
 
-	// This is simulating a system update for the account claims.
-	go s.updateAccountWithClaimJWT(acc, ajwt)
+	var expFetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/A/":
+			w.Write(nil)
+		case "/A/" + imppub:
+			w.Write([]byte(impjwt))
+		case "/A/" + exppub:
+			atomic.AddInt32(&expFetches, 1)
+			w.Write([]byte(expjwt))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+	`, ojwt, ts.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
 
-	l, _ := cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
+	// Only the importer connects, its exporter is fetched along with it.
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, impkp))
+	defer nc.Close()
+	natsSubSync(t, nc, subj)
+	natsFlush(t, nc)
+
+	if n := atomic.LoadInt32(&expFetches); n != 1 {
+		t.Fatalf("Expected exporter to be fetched once, got %d", n)
 	}
-	if !strings.Contains(l, "Revoked") {
-		t.Fatalf("Expected 'Revoked' to be in the error")
+	acc, err := s.LookupAccount(imppub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
 	}
+	if pending := acc.PendingImports(); len(pending) != 0 {
+		t.Fatalf("Expected no pending imports, got %+v", pending)
+	}
+	checkSubInterest(t, s, exppub, subj, 2*time.Second)
 }
 
-func TestJWTUserRevoked(t *testing.T) {
-	okp, _ := nkeys.FromSeed(oSeed)
+func TestAccountURLResolverImportFetchesDirectExportersOnly(t *testing.T) {
+	// Account A imports a stream from B, which imports a service from C.
+	ckp, _ := nkeys.CreateAccount()
+	cpub, _ := ckp.PublicKey()
+	cac := jwt.NewAccountClaims(cpub)
+	cac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	cjwt, err := cac.Encode(oKp)
+	require_NoError(t, err)
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	bac := jwt.NewAccountClaims(bpub)
+	bac.Exports.Add(&jwt.Export{Subject: "events", Type: jwt.Stream})
+	bac.Imports.Add(&jwt.Import{Account: cpub, Subject: "svc", Type: jwt.Service})
+	bjwt, err := bac.Encode(oKp)
+	require_NoError(t, err)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	aac := jwt.NewAccountClaims(apub)
+	aac.Imports.Add(&jwt.Import{Account: bpub, Subject: "events", Type: jwt.Stream})
+	ajwt, err := aac.Encode(oKp)
+	require_NoError(t, err)
 
-	// Create a new user that we will make sure has been revoked.
-	nkp, _ := nkeys.CreateUser()
-	pub, _ := nkp.PublicKey()
-	nuc := jwt.NewUserClaims(pub)
+	var bFetches, cFetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/A/":
+			w.Write(nil)
+		case "/A/" + apub:
+			w.Write([]byte(ajwt))
+		case "/A/" + bpub:
+			atomic.AddInt32(&bFetches, 1)
+			w.Write([]byte(bjwt))
+		case "/A/" + cpub:
+			atomic.AddInt32(&cFetches, 1)
+			w.Write([]byte(cjwt))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+	`, ojwt, ts.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Connecting to A fetches its exporter B, but not B's exporter C.
+	nca := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp))
+	defer nca.Close()
+	suba := natsSubSync(t, nca, "events")
+	natsFlush(t, nca)
+	if n := atomic.LoadInt32(&bFetches); n != 1 {
+		t.Fatalf("Expected B to be fetched once, got %d", n)
+	}
+	if n := atomic.LoadInt32(&cFetches); n != 0 {
+		t.Fatalf("Expected C not to be fetched, got %d", n)
+	}
+	checkSubInterest(t, s, bpub, "events", 2*time.Second)
+
+	// Connecting to B resolves its imports, fetching C.
+	ncb := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, bkp))
+	defer ncb.Close()
+	if n := atomic.LoadInt32(&cFetches); n != 1 {
+		t.Fatalf("Expected C to be fetched once, got %d", n)
+	}
+	ncc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, ckp))
+	defer ncc.Close()
+	natsSub(t, ncc, "svc", func(m *nats.Msg) {
+		m.Respond([]byte("ok"))
+	})
+	natsFlush(t, ncc)
+	resp, err := ncb.Request("svc", nil, time.Second)
+	require_NoError(t, err)
+	if string(resp.Data) != "ok" {
+		t.Fatalf("Unexpected response %q", resp.Data)
+	}
+	natsPub(t, ncb, "events", []byte("hello"))
+	natsNexMsg(t, suba, time.Second)
+
+	acc, err := s.LookupAccount(bpub)
+	require_NoError(t, err)
+	acc.mu.RLock()
+	incomplete := acc.incomplete
+	acc.mu.RUnlock()
+	if incomplete {
+		t.Fatal("Expected the imports of B to be resolved")
+	}
+}
 
+func TestAccountURLResolverNegativeCache(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
 	akp, _ := nkeys.CreateAccount()
 	apub, _ := akp.PublicKey()
-	nac := jwt.NewAccountClaims(apub)
-	// Revoke the user right away.
-	nac.Revoke(pub)
-	ajwt, err := nac.Encode(okp)
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
 
-	// Sign for the user.
-	jwt, err := nuc.Encode(akp)
-	if err != nil {
-		t.Fatalf("Error generating user JWT: %v", err)
-	}
+	var fetches int32
+	var published int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/A/":
+			w.Write(nil)
+		case "/A/" + syspub:
+			w.Write([]byte(sysjwt))
+		case "/A/" + apub:
+			atomic.AddInt32(&fetches, 1)
+			if atomic.LoadInt32(&published) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(ajwt))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
 
-	s := opTrustBasicSetup()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		system_account: %s
+		resolver_negative_cache_ttl: "1m"
+	`, ojwt, ts.URL, syspub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	buildMemAccResolver(s)
-	addAccountToMemResolver(s, apub, ajwt)
-
-	c, cr, l := newClientForServer(s)
-	defer c.close()
-
-	// Sign Nonce
-	var info nonceInfo
-	json.Unmarshal([]byte(l[5:]), &info)
-	sigraw, _ := nkp.Sign([]byte(info.Nonce))
-	sig := base64.RawURLEncoding.EncodeToString(sigraw)
-
-	// PING needed to flush the +OK/-ERR to us.
-	cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", jwt, sig)
 
-	c.parseAsync(cs)
+	if _, err := s.LookupAccount(apub); err == nil {
+		t.Fatalf("Expected lookup to fail")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Expected 1 fetch, got %d", n)
+	}
+	// The account was not found, so it should not be fetched again.
+	if _, err := s.LookupAccount(apub); err == nil {
+		t.Fatalf("Expected lookup to fail")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Expected 1 fetch, got %d", n)
+	}
 
-	l, _ = cr.ReadString('\n')
-	if !strings.HasPrefix(l, "-ERR ") {
-		t.Fatalf("Expected an error")
+	// Push the account, which clears the negative cache.
+	atomic.StoreInt32(&published, 1)
+	sysc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+	resp, err := sysc.Request(fmt.Sprintf(accUpdateEventSubjNew, apub), []byte(ajwt), time.Second)
+	if err != nil {
+		t.Fatalf("Error on push: %v", err)
 	}
-	if !strings.Contains(l, "Authorization") {
-		t.Fatalf("Expected 'Revoked' to be in the error")
+	if !strings.Contains(string(resp.Data), "jwt update skipped") {
+		t.Fatalf("Unexpected push response: %s", resp.Data)
+	}
+	if acc, err := s.LookupAccount(apub); err != nil || acc == nil {
+		t.Fatalf("Expected lookup to succeed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("Expected 2 fetches, got %d", n)
 	}
 }
 
-// Test that an account update that revokes an import authorization cancels the import.
-func TestJWTImportTokenRevokedAfter(t *testing.T) {
-	s := opTrustBasicSetup()
+func TestAccountResolverNegativeCacheRequest(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+
+	var fetches int32
+	var published int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/A/":
+			w.Write(nil)
+		case "/A/" + syspub:
+			w.Write([]byte(sysjwt))
+		case "/A/" + apub:
+			atomic.AddInt32(&fetches, 1)
+			if atomic.LoadInt32(&published) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(ajwt))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		system_account: %s
+		resolver_negative_cache_ttl: "1m"
+	`, ojwt, ts.URL, syspub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	buildMemAccResolver(s)
 
-	okp, _ := nkeys.FromSeed(oSeed)
+	if _, err := s.LookupAccount(apub); err == nil {
+		t.Fatalf("Expected lookup to fail")
+	}
 
-	// Create accounts and imports/exports.
-	fooKP, _ := nkeys.CreateAccount()
-	fooPub, _ := fooKP.PublicKey()
-	fooAC := jwt.NewAccountClaims(fooPub)
+	sysc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+	request := func(op string) *NegativeCacheResponse {
+		t.Helper()
+		msg, err := sysc.Request(serverNegCacheReqSubj, []byte(fmt.Sprintf(`{"op":%q}`, op)), time.Second)
+		require_NoError(t, err)
+		var resp struct {
+			Data  *NegativeCacheResponse `json:"data"`
+			Error *ApiError              `json:"error"`
+		}
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		return resp.Data
+	}
 
-	// Now create Exports.
-	export := &jwt.Export{Subject: "foo.private", Type: jwt.Stream, TokenReq: true}
+	resp := request("list")
+	if len(resp.Entries) != 1 || resp.Entries[0].Account != apub || resp.Cleared {
+		t.Fatalf("Expected %q to be listed, got %+v", apub, resp)
+	}
+	if time.Until(resp.Entries[0].Expires) <= 0 {
+		t.Fatalf("Expected the entry to expire in the future, got %v", resp.Entries[0].Expires)
+	}
+	// Listing leaves the entry in place.
+	if !s.isNegativelyCached(apub) {
+		t.Fatalf("Expected %q to still be cached", apub)
+	}
 
-	fooAC.Exports.Add(export)
-	fooJWT, err := fooAC.Encode(okp)
-	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+	resp = request("clear")
+	if len(resp.Entries) != 1 || resp.Entries[0].Account != apub || !resp.Cleared {
+		t.Fatalf("Expected %q to be cleared, got %+v", apub, resp)
+	}
+	if resp = request("list"); len(resp.Entries) != 0 {
+		t.Fatalf("Expected no entries, got %+v", resp.Entries)
 	}
 
-	addAccountToMemResolver(s, fooPub, fooJWT)
+	// The account is now provisioned and is fetched again without waiting for the TTL.
+	atomic.StoreInt32(&published, 1)
+	if acc, err := s.LookupAccount(apub); err != nil || acc == nil {
+		t.Fatalf("Expected lookup to succeed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("Expected 2 fetches, got %d", n)
+	}
 
-	barKP, _ := nkeys.CreateAccount()
-	barPub, _ := barKP.PublicKey()
-	barAC := jwt.NewAccountClaims(barPub)
-	simport := &jwt.Import{Account: fooPub, Subject: "foo.private", Type: jwt.Stream}
+	msg, err := sysc.Request(serverNegCacheReqSubj, []byte(`{"op":"bad"}`), time.Second)
+	require_NoError(t, err)
+	if !strings.Contains(string(msg.Data), "unknown operation") {
+		t.Fatalf("Expected an error for an unknown operation, got %s", msg.Data)
+	}
+}
 
-	activation := jwt.NewActivationClaims(barPub)
-	activation.ImportSubject = "foo.private"
-	activation.ImportType = jwt.Stream
-	actJWT, err := activation.Encode(fooKP)
+func TestAccountURLResolverFetchFailurePushReorder(t *testing.T) {
+	const subj = "test"
+	const crossAccSubj = "test"
+	// Create System Account
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysAc := jwt.NewAccountClaims(syspub)
+	sysjwt, err := sysAc.Encode(oKp)
 	if err != nil {
-		t.Fatalf("Error generating activation token: %v", err)
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	simport.Token = actJWT
-	barAC.Imports.Add(simport)
-	barJWT, err := barAC.Encode(okp)
+	// Create Exporting Account
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expjwt1, err := expac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	addAccountToMemResolver(s, barPub, barJWT)
-
-	// Now revoke the export.
-	decoded, _ := jwt.DecodeActivationClaims(actJWT)
-	export.Revoke(decoded.Subject)
-
-	fooJWT, err = fooAC.Encode(okp)
+	expac.Exports.Add(&jwt.Export{
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	expjwt2, err := expac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	addAccountToMemResolver(s, fooPub, fooJWT)
-
-	fooAcc, _ := s.LookupAccount(fooPub)
-	if fooAcc == nil {
-		t.Fatalf("Expected to retrieve the account")
+	// Create importing Account
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{
+		Account: exppub,
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	impjwt, err := impac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	// Now lookup bar account and make sure it was revoked.
-	acc, _ := s.LookupAccount(barPub)
-	if acc == nil {
-		t.Fatalf("Expected to retrieve the account")
+	// Simulate an account server that does not serve the updated jwt for exppub
+	chanImpA := make(chan struct{}, 10)
+	defer close(chanImpA)
+	chanExpS := make(chan struct{}, 10)
+	defer close(chanExpS)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server startup
+			w.Write(nil)
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/A/"+imppub {
+			w.Write([]byte(impjwt))
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/A/"+exppub {
+			// respond with jwt that does not have the export
+			// this simulates an ordering issue
+			w.Write([]byte(expjwt1))
+			chanExpS <- struct{}{}
+		} else if r.URL.Path == "/A/"+syspub {
+			w.Write([]byte(sysjwt))
+		} else {
+			t.Fatal("not expected")
+		}
+	}))
+	defer ts.Close()
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		system_account: %s
+    `, ojwt, ts.URL, syspub)))
+	defer os.Remove(confA)
+	sA := RunServer(LoadConfig(confA))
+	defer sA.Shutdown()
+	// server observed one fetch on startup
+	chanRecv(t, chanImpA, 10*time.Second)
+	// Create first client
+	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
+	defer ncA.Close()
+	// create a test subscription
+	subA, err := ncA.SubscribeSync(subj)
+	if err != nil {
+		t.Fatalf("Expected no error during subscribe: %v", err)
 	}
-	if les := len(acc.imports.streams); les != 0 {
-		t.Fatalf("Expected imports streams len of 0, got %d", les)
+	defer subA.Unsubscribe()
+	// Connect of client triggered a fetch of both accounts
+	// the fetch for the imported account will fail
+	chanRecv(t, chanImpA, 10*time.Second)
+	chanRecv(t, chanExpS, 10*time.Second)
+	// create second client for user exporting
+	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncB.Close()
+	// update expjwt2, this will correct the import issue
+	sysc := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, exppub), []byte(expjwt2))
+	sysc.Flush()
+	// updating expjwt should cause this to pass
+	checkSubInterest(t, sA, imppub, subj, 10*time.Second)
+	checkSubInterest(t, sA, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
+}
+
+type captureDebugLogger struct {
+	DummyLogger
+	dbgCh chan string
+}
+
+func (l *captureDebugLogger) Debugf(format string, v ...interface{}) {
+	select {
+	case l.dbgCh <- fmt.Sprintf(format, v...):
+	default:
 	}
 }
 
-// Test that an account update that revokes an import authorization cancels the import.
-func TestJWTImportTokenRevokedBefore(t *testing.T) {
+func TestJWTAccountImportsAppliedInStableOrder(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 
-	okp, _ := nkeys.FromSeed(oSeed)
+	var exporters []string
+	for i := 0; i < 3; i++ {
+		kp, _ := nkeys.CreateAccount()
+		pub, _ := kp.PublicKey()
+		ac := jwt.NewAccountClaims(pub)
+		ac.Exports.Add(&jwt.Export{Subject: "a", Type: jwt.Stream})
+		// Service imports of "b" are routed to the subject they map to.
+		ac.Exports.Add(&jwt.Export{Subject: "*", Type: jwt.Service})
+		ac.Exports.Add(&jwt.Export{Subject: "c", Type: jwt.Stream})
+		theJWT, err := ac.Encode(oKp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		addAccountToMemResolver(s, pub, theJWT)
+		exporters = append(exporters, pub)
+	}
 
-	// Create accounts and imports/exports.
 	fooKP, _ := nkeys.CreateAccount()
 	fooPub, _ := fooKP.PublicKey()
 	fooAC := jwt.NewAccountClaims(fooPub)
-
-	// Now create Exports.
-	export := &jwt.Export{Subject: "foo.private", Type: jwt.Stream, TokenReq: true}
-
-	fooAC.Exports.Add(export)
-
-	// Import account
-	barKP, _ := nkeys.CreateAccount()
-	barPub, _ := barKP.PublicKey()
-	barAC := jwt.NewAccountClaims(barPub)
-	simport := &jwt.Import{Account: fooPub, Subject: "foo.private", Type: jwt.Stream}
-
-	activation := jwt.NewActivationClaims(barPub)
-	activation.ImportSubject = "foo.private"
-	activation.ImportType = jwt.Stream
-	actJWT, err := activation.Encode(fooKP)
-	if err != nil {
-		t.Fatalf("Error generating activation token: %v", err)
+	// Add imports out of order.
+	for _, subj := range []string{"c", "a", "b"} {
+		for i := len(exporters) - 1; i >= 0; i-- {
+			typ := jwt.Stream
+			if subj == "b" {
+				typ = jwt.Service
+			}
+			fooAC.Imports.Add(&jwt.Import{
+				Account: exporters[i],
+				Subject: jwt.Subject(subj),
+				To:      jwt.Subject(fmt.Sprintf("%d", i)),
+				Type:    typ,
+			})
+		}
 	}
-
-	simport.Token = actJWT
-	barAC.Imports.Add(simport)
-
-	// Now revoke the export.
-	decoded, _ := jwt.DecodeActivationClaims(actJWT)
-	export.Revoke(decoded.Subject)
-
-	fooJWT, err := fooAC.Encode(okp)
+	fooJWT, err := fooAC.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
 	addAccountToMemResolver(s, fooPub, fooJWT)
-
-	barJWT, err := barAC.Encode(okp)
+	fooAcc, err := s.LookupAccount(fooPub)
 	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+		t.Fatalf("Error looking up account: %v", err)
 	}
-	addAccountToMemResolver(s, barPub, barJWT)
 
-	fooAcc, _ := s.LookupAccount(fooPub)
-	if fooAcc == nil {
-		t.Fatalf("Expected to retrieve the account")
+	l := &captureDebugLogger{dbgCh: make(chan string, 100)}
+	s.SetLogger(l, true, false)
+
+	applyAndCollect := func() []string {
+		t.Helper()
+		s.UpdateAccountClaims(fooAcc, fooAC)
+		var lines []string
+		for {
+			select {
+			case line := <-l.dbgCh:
+				if strings.HasPrefix(line, "Adding stream import") || strings.HasPrefix(line, "Adding service import") {
+					lines = append(lines, line)
+				}
+			default:
+				return lines
+			}
+		}
 	}
 
-	// Now lookup bar account and make sure it was revoked.
-	acc, _ := s.LookupAccount(barPub)
-	if acc == nil {
-		t.Fatalf("Expected to retrieve the account")
+	var expected []string
+	for _, subj := range []string{"a", "b", "c"} {
+		kind := "stream"
+		if subj == "b" {
+			kind = "service"
+		}
+		sorted := append([]string(nil), exporters...)
+		sort.Strings(sorted)
+		for _, exp := range sorted {
+			expected = append(expected, fmt.Sprintf("Adding %s import %s:%q", kind, exp, subj))
+		}
 	}
-	if les := len(acc.imports.streams); les != 0 {
-		t.Fatalf("Expected imports streams len of 0, got %d", les)
+	for i := 0; i < 3; i++ {
+		lines := applyAndCollect()
+		if len(lines) != len(expected) {
+			t.Fatalf("Expected %d import traces, got %d: %q", len(expected), len(lines), lines)
+		}
+		for j, line := range lines {
+			if !strings.HasPrefix(line, expected[j]) {
+				t.Fatalf("Expected trace %d to start with %q, got %q", j, expected[j], line)
+			}
+		}
 	}
 }
 
-func TestJWTCircularAccountServiceImport(t *testing.T) {
-	s := opTrustBasicSetup()
-	defer s.Shutdown()
-	buildMemAccResolver(s)
-
-	okp, _ := nkeys.FromSeed(oSeed)
-
-	// Create accounts
-	fooKP, _ := nkeys.CreateAccount()
-	fooPub, _ := fooKP.PublicKey()
-	fooAC := jwt.NewAccountClaims(fooPub)
-
-	barKP, _ := nkeys.CreateAccount()
-	barPub, _ := barKP.PublicKey()
-	barAC := jwt.NewAccountClaims(barPub)
-
-	// Create service export/import for account foo
-	serviceExport := &jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true}
-	serviceImport := &jwt.Import{Account: barPub, Subject: "bar", Type: jwt.Service}
-
-	fooAC.Exports.Add(serviceExport)
-	fooAC.Imports.Add(serviceImport)
-	fooJWT, err := fooAC.Encode(okp)
+func TestAccountURLResolverPermanentFetchFailure(t *testing.T) {
+	const crossAccSubj = "test"
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	// Create System Account
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysAc := jwt.NewAccountClaims(syspub)
+	sysjwt, err := sysAc.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	addAccountToMemResolver(s, fooPub, fooJWT)
-
-	// Create service export/import for account bar
-	serviceExport = &jwt.Export{Subject: "bar", Type: jwt.Service, TokenReq: true}
-	serviceImport = &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
-
-	barAC.Exports.Add(serviceExport)
-	barAC.Imports.Add(serviceImport)
-	barJWT, err := barAC.Encode(okp)
+	// Create 2 Accounts. Each importing from the other, but NO matching export
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Imports.Add(&jwt.Import{
+		Account: imppub,
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	expjwt, err := expac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
-	addAccountToMemResolver(s, barPub, barJWT)
-
-	c, cr, cs := createClient(t, s, fooKP)
-	defer c.close()
-
-	c.parseAsync(cs)
-	expectPong(t, cr)
-
-	c.parseAsync("SUB foo 1\r\nPING\r\n")
-	expectPong(t, cr)
-}
-
-// This test ensures that connected clients are properly evicted
-// (no deadlock) if the max conns of an account has been lowered
-// and the account is being updated (following expiration during
-// a lookup).
-func TestJWTAccountLimitsMaxConnsAfterExpired(t *testing.T) {
-	s := opTrustBasicSetup()
-	defer s.Shutdown()
-	buildMemAccResolver(s)
-
-	okp, _ := nkeys.FromSeed(oSeed)
-
-	// Create accounts and imports/exports.
-	fooKP, _ := nkeys.CreateAccount()
-	fooPub, _ := fooKP.PublicKey()
-	fooAC := jwt.NewAccountClaims(fooPub)
-	fooAC.Limits.Conn = 10
-	fooJWT, err := fooAC.Encode(okp)
+	// Create importing Account
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{
+		Account: exppub,
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	impjwt, err := impac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	addAccountToMemResolver(s, fooPub, fooJWT)
-
-	newClient := func(expPre string) *testAsyncClient {
-		t.Helper()
-		// Create a client.
-		c, cr, cs := createClient(t, s, fooKP)
-		c.parseAsync(cs)
-		l, _ := cr.ReadString('\n')
-		if !strings.HasPrefix(l, expPre) {
-			t.Fatalf("Expected a response starting with %q, got %q", expPre, l)
+	// Simulate an account server that does not serve the updated jwt for exppub
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server startup
+			w.Write(nil)
+		} else if r.URL.Path == "/A/"+imppub {
+			w.Write([]byte(impjwt))
+		} else if r.URL.Path == "/A/"+exppub {
+			w.Write([]byte(expjwt))
+		} else if r.URL.Path == "/A/"+syspub {
+			w.Write([]byte(sysjwt))
+		} else {
+			t.Fatal("not expected")
 		}
-		go func() {
-			for {
-				if _, _, err := cr.ReadLine(); err != nil {
-					return
-				}
+	}))
+	defer ts.Close()
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		system_account: %s
+    `, ojwt, ts.URL, syspub)))
+	defer os.Remove(confA)
+	o := LoadConfig(confA)
+	sA := RunServer(o)
+	defer sA.Shutdown()
+	l := &captureDebugLogger{dbgCh: make(chan string, 100)} // has enough space to not block
+	sA.SetLogger(l, true, false)
+	// Create clients
+	ncA := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, impkp))
+	defer ncA.Close()
+	ncB := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncB.Close()
+	sysc := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+	// push accounts
+	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, imppub), []byte(impjwt))
+	natsPub(t, sysc, fmt.Sprintf(accUpdateEventSubjNew, exppub), []byte(expjwt))
+	sysc.Flush()
+	importErrCnt := 0
+	tmr := time.NewTimer(500 * time.Millisecond)
+	defer tmr.Stop()
+	for {
+		select {
+		case line := <-l.dbgCh:
+			if strings.HasPrefix(line, "Error adding stream import to account") {
+				importErrCnt++
 			}
-		}()
-		return c
+		case <-tmr.C:
+			// connecting and updating, each cause 3 traces (2 + 1 on iteration)
+			if importErrCnt != 6 {
+				t.Fatalf("Expected 6 debug traces, got %d", importErrCnt)
+			}
+			return
+		}
 	}
+}
 
-	for i := 0; i < 4; i++ {
-		c := newClient("PONG")
-		defer c.close()
+func TestAccountURLResolverFetchFailureInCluster(t *testing.T) {
+	assertChanLen := func(x int, chans ...chan struct{}) {
+		t.Helper()
+		for _, c := range chans {
+			if len(c) != x {
+				t.Fatalf("length of channel is not %d", x)
+			}
+		}
 	}
-
-	// We will simulate that the account has expired. When
-	// a new client will connect, the server will do a lookup
-	// and find the account expired, which then will cause
-	// a fetch and a rebuild of the account. Since max conns
-	// is now lower, some clients should have been removed.
-	acc, _ := s.LookupAccount(fooPub)
-	acc.mu.Lock()
-	acc.expired = true
-	acc.updated = time.Now().Add(-2 * time.Second) // work around updating to quickly
-	acc.mu.Unlock()
-
-	// Now update with new expiration and max connections lowered to 2
-	fooAC.Limits.Conn = 2
-	fooJWT, err = fooAC.Encode(okp)
+	const subj = ">"
+	const crossAccSubj = "test"
+	// Create Exporting Account
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
+	})
+	expjwt, err := expac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	addAccountToMemResolver(s, fooPub, fooJWT)
-
-	// Cause the lookup that will detect that account was expired
-	// and rebuild it, and kick clients out.
-	c := newClient("-ERR ")
-	defer c.close()
-
-	acc, _ = s.LookupAccount(fooPub)
-	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
-		acc.mu.RLock()
-		numClients := len(acc.clients)
-		acc.mu.RUnlock()
-		if numClients != 2 {
-			return fmt.Errorf("Should have 2 clients, got %v", numClients)
-		}
-		return nil
+	// Create importing Account
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{
+		Account: exppub,
+		Subject: crossAccSubj,
+		Type:    jwt.Stream,
 	})
-}
-
-func TestBearerToken(t *testing.T) {
-	okp, _ := nkeys.FromSeed(oSeed)
-	akp, _ := nkeys.CreateAccount()
-	apub, _ := akp.PublicKey()
-	nac := jwt.NewAccountClaims(apub)
-	ajwt, err := nac.Encode(okp)
+	impac.Exports.Add(&jwt.Export{
+		Subject: "srvc",
+		Type:    jwt.Service,
+	})
+	impjwt, err := impac.Encode(oKp)
 	if err != nil {
 		t.Fatalf("Error generating account JWT: %v", err)
 	}
-
+	// Create User
 	nkp, _ := nkeys.CreateUser()
-	pub, _ := nkp.PublicKey()
+	uSeed, _ := nkp.Seed()
+	upub, _ := nkp.PublicKey()
 	nuc := newJWTTestUserClaims()
-	nuc.Subject = pub
-	// Set bearer token.
-	nuc.BearerToken = true
-	jwt, err := nuc.Encode(akp)
+	nuc.Subject = upub
+	uJwt, err := nuc.Encode(impkp)
 	if err != nil {
 		t.Fatalf("Error generating user JWT: %v", err)
 	}
-
-	s := opTrustBasicSetup()
-	defer s.Shutdown()
-	buildMemAccResolver(s)
-	addAccountToMemResolver(s, apub, ajwt)
-
-	c, cr, _ := newClientForServer(s)
-	defer c.close()
-
-	// Skip nonce signature...
-
-	// PING needed to flush the +OK/-ERR to us.
-	cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", jwt)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		c.parse([]byte(cs))
-		wg.Done()
-	}()
-	l, _ := cr.ReadString('\n')
-	if !strings.HasPrefix(l, "+OK") {
-		t.Fatalf("Expected +OK, got %s", l)
-	}
-	wg.Wait()
-}
-
-func TestExpiredUserCredentialsRenewal(t *testing.T) {
-	createTmpFile := func(t *testing.T, content []byte) string {
-		t.Helper()
-		conf, err := ioutil.TempFile("", "")
-		if err != nil {
-			t.Fatalf("Error creating conf file: %v", err)
+	creds := genCredsFile(t, uJwt, uSeed)
+	defer os.Remove(creds)
+	// Simulate an account server that drops the first request to /B/acc
+	chanImpA := make(chan struct{}, 4)
+	defer close(chanImpA)
+	chanImpB := make(chan struct{}, 4)
+	defer close(chanImpB)
+	chanExpA := make(chan struct{}, 4)
+	defer close(chanExpA)
+	chanExpB := make(chan struct{}, 4)
+	defer close(chanExpB)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server A startup
+			w.Write(nil)
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/B/" {
+			// Server B startup
+			w.Write(nil)
+			chanImpB <- struct{}{}
+		} else if r.URL.Path == "/A/"+imppub {
+			// First Client connecting to Server A
+			w.Write([]byte(impjwt))
+			chanImpA <- struct{}{}
+		} else if r.URL.Path == "/B/"+imppub {
+			// Second Client connecting to Server B
+			w.Write([]byte(impjwt))
+			chanImpB <- struct{}{}
+		} else if r.URL.Path == "/A/"+exppub {
+			// First Client connecting to Server A
+			w.Write([]byte(expjwt))
+			chanExpA <- struct{}{}
+		} else if r.URL.Path == "/B/"+exppub {
+			// Second Client connecting to Server B
+			w.Write([]byte(expjwt))
+			chanExpB <- struct{}{}
+		} else {
+			t.Fatal("not expected")
 		}
-		fName := conf.Name()
-		conf.Close()
-		if err := ioutil.WriteFile(fName, content, 0666); err != nil {
-			os.Remove(fName)
-			t.Fatalf("Error writing conf file: %v", err)
+	}))
+	defer ts.Close()
+	// Create seed server A
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		cluster {
+			name: clust
+			no_advertise: true
+			listen: -1
 		}
-		return fName
-	}
-	waitTime := func(ch chan bool, timeout time.Duration) error {
-		select {
-		case <-ch:
-			return nil
-		case <-time.After(timeout):
+    `, ojwt, ts.URL)))
+	defer os.Remove(confA)
+	sA := RunServer(LoadConfig(confA))
+	defer sA.Shutdown()
+	// Create Server B (using no_advertise to prevent failover)
+	confB := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/B/")
+		cluster {
+			name: clust
+			no_advertise: true
+			listen: -1 
+			routes [
+				nats-route://localhost:%d
+			]
 		}
-		return errors.New("timeout")
+    `, ojwt, ts.URL, sA.opts.Cluster.Port)))
+	defer os.Remove(confB)
+	sB := RunServer(LoadConfig(confB))
+	defer sB.Shutdown()
+	// startup cluster
+	checkClusterFormed(t, sA, sB)
+	// Both server observed one fetch on startup
+	chanRecv(t, chanImpA, 10*time.Second)
+	chanRecv(t, chanImpB, 10*time.Second)
+	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
+	// Create first client, directly connects to A
+	urlA := fmt.Sprintf("nats://%s:%d", sA.opts.Host, sA.opts.Port)
+	ncA, err := nats.Connect(urlA, nats.UserCredentials(creds),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				t.Fatal("error not expected in this test", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			t.Fatal("error not expected in this test", err)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Expected to connect, got %v %s", err, urlA)
 	}
-
-	okp, _ := nkeys.FromSeed(oSeed)
-	akp, err := nkeys.CreateAccount()
+	defer ncA.Close()
+	// create a test subscription
+	subA, err := ncA.SubscribeSync(subj)
 	if err != nil {
-		t.Fatalf("Error generating account")
+		t.Fatalf("Expected no error during subscribe: %v", err)
 	}
-	aPub, _ := akp.PublicKey()
-	nac := jwt.NewAccountClaims(aPub)
-	aJwt, err := nac.Encode(okp)
+	defer subA.Unsubscribe()
+	// Connect of client triggered a fetch by Server A
+	chanRecv(t, chanImpA, 10*time.Second)
+	chanRecv(t, chanExpA, 10*time.Second)
+	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
+	//time.Sleep(10 * time.Second)
+	// create second client, directly connect to B
+	urlB := fmt.Sprintf("nats://%s:%d", sB.opts.Host, sB.opts.Port)
+	ncB, err := nats.Connect(urlB, nats.UserCredentials(creds), nats.NoReconnect())
 	if err != nil {
-		t.Fatalf("Error generating account JWT: %v", err)
+		t.Fatalf("Expected to connect, got %v %s", err, urlB)
 	}
-
-	kp, _ := nkeys.FromSeed(oSeed)
-	oPub, _ := kp.PublicKey()
-	opts := defaultServerOptions
-	opts.TrustedKeys = []string{oPub}
-	s := RunServer(&opts)
-	if s == nil {
-		t.Fatal("Server did not start")
+	defer ncB.Close()
+	// Connect of client triggered a fetch by Server B
+	chanRecv(t, chanImpB, 10*time.Second)
+	chanRecv(t, chanExpB, 10*time.Second)
+	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
+	checkClusterFormed(t, sA, sB)
+	// the route subscription was lost due to the failed fetch
+	// Now we test if some recover mechanism is in play
+	checkSubInterest(t, sB, imppub, subj, 10*time.Second)         // Will fail as a result of this issue
+	checkSubInterest(t, sB, exppub, crossAccSubj, 10*time.Second) // Will fail as a result of this issue
+	if err := ncB.Publish(subj, []byte("msg")); err != nil {
+		t.Fatalf("Expected to publish %v", err)
 	}
-	defer s.Shutdown()
-	buildMemAccResolver(s)
-	addAccountToMemResolver(s, aPub, aJwt)
+	// expect the message from B to flow to A
+	if m, err := subA.NextMsg(10 * time.Second); err != nil {
+		t.Fatalf("Expected to receive a message %v", err)
+	} else if string(m.Data) != "msg" {
+		t.Fatalf("Expected to receive 'msg', got: %s", string(m.Data))
+	}
+	assertChanLen(0, chanImpA, chanImpB, chanExpA, chanExpB)
+}
 
+func TestAccountURLResolverReturnDifferentOperator(t *testing.T) {
+	// Create a valid chain of op/acc/usr using a different operator
+	// This is so we can test if the server rejects this chain.
+	// Create Operator
+	op, _ := nkeys.CreateOperator()
+	// Create Account, this account is the one returned by the resolver
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(op)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	// Create User
 	nkp, _ := nkeys.CreateUser()
-	pub, _ := nkp.PublicKey()
 	uSeed, _ := nkp.Seed()
+	upub, _ := nkp.PublicKey()
 	nuc := newJWTTestUserClaims()
-	nuc.Subject = pub
-	nuc.Expires = time.Now().Add(time.Second).Unix()
+	nuc.Subject = upub
 	uJwt, err := nuc.Encode(akp)
 	if err != nil {
 		t.Fatalf("Error generating user JWT: %v", err)
 	}
-
-	creds, err := jwt.FormatUserConfig(uJwt, uSeed)
-	if err != nil {
-		t.Fatalf("Error encoding credentials: %v", err)
-	}
-	chainedFile := createTmpFile(t, creds)
-	defer os.Remove(chainedFile)
-
-	rch := make(chan bool)
-
-	url := fmt.Sprintf("nats://%s:%d", s.opts.Host, s.opts.Port)
-	nc, err := nats.Connect(url,
-		nats.UserCredentials(chainedFile),
-		nats.ReconnectWait(25*time.Millisecond),
-		nats.ReconnectJitter(0, 0),
-		nats.MaxReconnects(2),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			rch <- true
+	creds := genCredsFile(t, uJwt, uSeed)
+	defer os.Remove(creds)
+	// Simulate an account server that was hijacked/mis configured
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
+	// Create Server
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+    `, ojwt, ts.URL)))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+	// Create first client, directly connects to A
+	urlA := fmt.Sprintf("nats://%s:%d", sA.opts.Host, sA.opts.Port)
+	if _, err := nats.Connect(urlA, nats.UserCredentials(creds),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				t.Fatal("error not expected in this test", err)
+			}
 		}),
-	)
-	if err != nil {
-		t.Fatalf("Expected to connect, got %v %s", err, url)
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			t.Fatal("error not expected in this test", err)
+		}),
+	); err == nil {
+		t.Fatal("Expected connect to fail")
 	}
-	defer nc.Close()
-
-	// Place new credentials underneath.
-	nuc.Expires = time.Now().Add(30 * time.Second).Unix()
-	uJwt, err = nuc.Encode(akp)
-	if err != nil {
-		t.Fatalf("Error encoding user jwt: %v", err)
+	// Test if the server has the account in memory. (shouldn't)
+	if v, ok := sA.accounts.Load(apub); ok {
+		t.Fatalf("Expected account to NOT be in memory: %v", v.(*Account))
 	}
-	creds, err = jwt.FormatUserConfig(uJwt, uSeed)
-	if err != nil {
-		t.Fatalf("Error encoding credentials: %v", err)
+}
+
+func TestAccountURLResolverReturnDifferentAccount(t *testing.T) {
+	// The account that was asked for.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	// The account whose validly signed JWT the resolver returns instead.
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	bjwt, err := jwt.NewAccountClaims(bpub).Encode(oKp)
+	require_NoError(t, err)
+	// Simulate a cache in front of the account server mixing up entries.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(bjwt))
+	}))
+	defer ts.Close()
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+    `, ojwt, ts.URL)))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+
+	if _, err := sA.LookupAccount(apub); err != ErrAccountClaimsSubjectMismatch {
+		t.Fatalf("Expected %v, got %v", ErrAccountClaimsSubjectMismatch, err)
 	}
-	if err := ioutil.WriteFile(chainedFile, creds, 0666); err != nil {
-		t.Fatalf("Error writing conf file: %v", err)
+	// Neither account was loaded.
+	for _, pub := range []string{apub, bpub} {
+		if v, ok := sA.accounts.Load(pub); ok {
+			t.Fatalf("Expected account to NOT be in memory: %v", v.(*Account))
+		}
 	}
+	// Applying the JWT to the wrong account is rejected as well.
+	acc := NewAccount(apub)
+	if err := sA.updateAccountWithClaimJWT(acc, bjwt); err != ErrAccountClaimsSubjectMismatch {
+		t.Fatalf("Expected %v, got %v", ErrAccountClaimsSubjectMismatch, err)
+	}
+}
 
-	// Make sure we get disconnected and reconnected first.
-	if err := waitTime(rch, 2*time.Second); err != nil {
-		t.Fatal("Should have reconnected.")
+func TestJWTUserSigningKey(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+
+	// Check to make sure we would have an authTimer
+	if !s.info.AuthRequired {
+		t.Fatalf("Expect the server to require auth")
 	}
 
-	// We should not have been closed.
-	if nc.IsClosed() {
-		t.Fatal("Got disconnected when we should have reconnected.")
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	// Don't send jwt field, should fail.
+	c.parseAsync("CONNECT {\"verbose\":true,\"pedantic\":true}\r\nPING\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
 	}
 
-	// Check that we clear the lastErr that can cause the disconnect.
-	// Our reconnect CB will happen before the clear. So check after a bit.
-	time.Sleep(50 * time.Millisecond)
-	if nc.LastError() != nil {
-		t.Fatalf("Expected lastErr to be cleared, got %q", nc.LastError())
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create an account
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+
+	// Create a signing key for the account
+	askp, _ := nkeys.CreateAccount()
+	aspub, _ := askp.PublicKey()
+
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-}
 
-func updateJwt(t *testing.T, url string, creds string, pubKey string, jwt string, respCnt int) int {
-	t.Helper()
-	require_NextMsg := func(sub *nats.Subscription) bool {
-		t.Helper()
-		msg := natsNexMsg(t, sub, time.Second)
-		content := make(map[string]interface{})
-		json.Unmarshal(msg.Data, &content)
-		if _, ok := content["data"]; ok {
-			return true
-		}
-		return false
+	// Create a client with the account signing key
+	c, cr, cs := createClientWithIssuer(t, s, askp, apub)
+	defer c.close()
+
+	// PING needed to flush the +OK/-ERR to us.
+	// This should fail too since no account resolver is defined.
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
 	}
-	c := natsConnect(t, url, nats.UserCredentials(creds),
-		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
-			if err != nil {
-				t.Fatal("error not expected in this test", err)
-			}
-		}),
-		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
-			t.Fatal("error not expected in this test", err)
-		}),
-	)
-	defer c.Close()
-	resp := c.NewRespInbox()
-	sub := natsSubSync(t, c, resp)
-	err := sub.AutoUnsubscribe(respCnt)
-	require_NoError(t, err)
-	require_NoError(t, c.PublishRequest(fmt.Sprintf(accUpdateEventSubjNew, pubKey), resp, []byte(jwt)))
-	passCnt := 0
-	for i := 0; i < respCnt; i++ {
-		if require_NextMsg(sub) {
-			passCnt++
-		}
+
+	// Ok now let's walk through and make sure all is good.
+	// We will set the account resolver by hand to a memory resolver.
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	// Create a client with a signing key
+	c, cr, cs = createClientWithIssuer(t, s, askp, apub)
+	defer c.close()
+	// should fail because the signing key is not known
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error: %v", l)
 	}
-	return passCnt
-}
 
-func require_JWTAbsent(t *testing.T, dir string, pub string) {
-	t.Helper()
-	_, err := os.Stat(filepath.Join(dir, pub+".jwt"))
-	require_Error(t, err)
-	require_True(t, os.IsNotExist(err))
-}
+	// add a signing key
+	nac.SigningKeys.Add(aspub)
+	// update the memory resolver
+	acc, _ := s.LookupAccount(apub)
+	s.UpdateAccountClaims(acc, nac)
 
-func require_JWTPresent(t *testing.T, dir string, pub string) {
-	t.Helper()
-	_, err := os.Stat(filepath.Join(dir, pub+".jwt"))
-	require_NoError(t, err)
-}
+	// Create a client with a signing key
+	c, cr, cs = createClientWithIssuer(t, s, askp, apub)
+	defer c.close()
 
-func require_JWTEqual(t *testing.T, dir string, pub string, jwt string) {
-	t.Helper()
-	content, err := ioutil.ReadFile(filepath.Join(dir, pub+".jwt"))
-	require_NoError(t, err)
-	require_Equal(t, string(content), jwt)
-}
+	// expect this to work
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected a PONG, got %q", l)
+	}
 
-func createDir(t *testing.T, prefix string) string {
-	t.Helper()
-	dir, err := ioutil.TempDir("", prefix)
-	require_NoError(t, err)
-	return dir
-}
+	isClosed := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.isClosed()
+	}
 
-func writeJWT(t *testing.T, dir string, pub string, jwt string) {
-	t.Helper()
-	err := ioutil.WriteFile(filepath.Join(dir, pub+".jwt"), []byte(jwt), 0644)
-	require_NoError(t, err)
+	if isClosed() {
+		t.Fatal("expected client to be alive")
+	}
+	// remove the signing key should bounce client
+	nac.SigningKeys = nil
+	acc, _ = s.LookupAccount(apub)
+	s.UpdateAccountClaims(acc, nac)
+
+	if !isClosed() {
+		t.Fatal("expected client to be gone")
+	}
 }
 
-func TestAccountNATSResolverFetch(t *testing.T) {
-	origEventsHBInterval := eventsHBInterval
-	eventsHBInterval = 50 * time.Millisecond // speed up eventing
-	defer func() { eventsHBInterval = origEventsHBInterval }()
-	require_NoLocalOrRemoteConnections := func(account string, srvs ...*Server) {
-		t.Helper()
-		for _, srv := range srvs {
-			if acc, ok := srv.accounts.Load(account); ok {
-				checkAccClientsCount(t, acc.(*Account), 0)
-			}
-		}
+func TestJWTUserSigningKeyRevoked(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create an account
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+
+	// Create a signing key for the account
+	askp, _ := nkeys.CreateAccount()
+	aspub, _ := askp.PublicKey()
+
+	nac := jwt.NewAccountClaims(apub)
+	nac.SigningKeys.Add(aspub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
 	}
-	// After each connection check, require_XConnection and connect assures that
-	// listed server have no connections for the account used
-	require_1Connection := func(url, creds, acc string, srvs ...*Server) {
-		t.Helper()
-		func() {
-			t.Helper()
-			c := natsConnect(t, url, nats.UserCredentials(creds))
-			defer c.Close()
-			if _, err := nats.Connect(url, nats.UserCredentials(creds)); err == nil {
-				t.Fatal("Second connection was supposed to fail due to limits")
-			} else if !strings.Contains(err.Error(), ErrTooManyAccountConnections.Error()) {
-				t.Fatal("Second connection was supposed to fail with too many conns")
-			}
-		}()
-		require_NoLocalOrRemoteConnections(acc, srvs...)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	// Create a client with the signing key and one with the account key.
+	c, cr, cs := createClientWithIssuer(t, s, askp, apub)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	ac, acr, acs := createClient(t, s, akp)
+	defer ac.close()
+	ac.parseAsync(acs)
+	expectPong(t, acr)
+
+	// Revoke the signing key, but keep it in the list of signing keys.
+	nac.Revoke(aspub)
+	acc, _ := s.LookupAccount(apub)
+	s.UpdateAccountClaims(acc, nac)
+
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR 'Authorization Revoked'") {
+		t.Fatalf("Expected revoked error, got %q", l)
 	}
-	require_2Connection := func(url, creds, acc string, srvs ...*Server) {
-		t.Helper()
-		func() {
-			t.Helper()
-			c1 := natsConnect(t, url, nats.UserCredentials(creds))
-			defer c1.Close()
-			c2 := natsConnect(t, url, nats.UserCredentials(creds))
-			defer c2.Close()
-			if _, err := nats.Connect(url, nats.UserCredentials(creds)); err == nil {
-				t.Fatal("Third connection was supposed to fail due to limits")
-			} else if !strings.Contains(err.Error(), ErrTooManyAccountConnections.Error()) {
-				t.Fatal("Third connection was supposed to fail with too many conns")
-			}
-		}()
-		require_NoLocalOrRemoteConnections(acc, srvs...)
+	c.mu.Lock()
+	closed := c.isClosed()
+	c.mu.Unlock()
+	if !closed {
+		t.Fatal("expected client to be gone")
 	}
-	connect := func(url string, credsfile string, acc string, srvs ...*Server) {
-		t.Helper()
-		nc := natsConnect(t, url, nats.UserCredentials(credsfile))
-		nc.Close()
+
+	// Client issued directly by the account should not be affected.
+	ac.parseAsync("PING\r\n")
+	expectPong(t, acr)
+
+	// A user issued by the revoked signing key can not connect either.
+	c, cr, cs = createClientWithIssuer(t, s, askp, apub)
+	defer c.close()
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got %q", l)
+	}
+}
+
+func TestJWTAccountImportActivationSigner(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	// Exporter keys
+	srvKP, _ := nkeys.CreateAccount()
+	srvPK, _ := srvKP.PublicKey()
+	srvSignerKP, _ := nkeys.CreateAccount()
+	srvSignerPK, _ := srvSignerKP.PublicKey()
+	// Keys that are not related to the exporter
+	otherKP, _ := nkeys.CreateAccount()
+	otherPK, _ := otherKP.PublicKey()
+
+	// Importer keys
+	clientKP, _ := nkeys.CreateAccount()
+	clientPK, _ := clientKP.PublicKey()
+
+	srvAC := jwt.NewAccountClaims(srvPK)
+	srvAC.SigningKeys.Add(srvSignerPK)
+	srvAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+	srvJWT, err := srvAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating exporter JWT: %v", err)
+	}
+	addAccountToMemResolver(s, srvPK, srvJWT)
+	srvAcc, err := s.LookupAccount(srvPK)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	clientJWT, err := jwt.NewAccountClaims(clientPK).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating importer JWT: %v", err)
+	}
+	addAccountToMemResolver(s, clientPK, clientJWT)
+	clientAcc, err := s.LookupAccount(clientPK)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		signer        nkeys.KeyPair
+		issuerAccount string
+		ok            bool
+	}{
+		{"exporter key", srvKP, "", true},
+		{"exporter key with issuer account", srvKP, srvPK, true},
+		{"signing key", srvSignerKP, srvPK, true},
+		{"signing key without issuer account", srvSignerKP, "", false},
+		{"signing key with other issuer account", srvSignerKP, otherPK, false},
+		{"other key", otherKP, "", false},
+		{"other key with issuer account", otherKP, srvPK, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			act := jwt.NewActivationClaims(clientPK)
+			act.IssuerAccount = test.issuerAccount
+			act.ImportType = jwt.Service
+			act.ImportSubject = "foo"
+			token, err := act.Encode(test.signer)
+			if err != nil {
+				t.Fatalf("Error generating activation token: %v", err)
+			}
+			imp := &jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: token}
+			if ok := srvAcc.checkActivation(clientAcc, imp, false); ok != test.ok {
+				t.Fatalf("Expected activation check to return %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestJWTAccountImportSignerRemoved(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Exporter keys
+	srvKP, _ := nkeys.CreateAccount()
+	srvPK, _ := srvKP.PublicKey()
+	srvSignerKP, _ := nkeys.CreateAccount()
+	srvSignerPK, _ := srvSignerKP.PublicKey()
+
+	// Importer keys
+	clientKP, _ := nkeys.CreateAccount()
+	clientPK, _ := clientKP.PublicKey()
+
+	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
+		ac := jwt.NewAccountClaims(srvPK)
+		ac.SigningKeys.Add(signingKeys...)
+		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating exporter JWT: %v", err)
+		}
+		return token, ac
+	}
+
+	createImportToken := func(sub string, kind jwt.ExportType) string {
+		actC := jwt.NewActivationClaims(clientPK)
+		actC.IssuerAccount = srvPK
+		actC.ImportType = kind
+		actC.ImportSubject = jwt.Subject(sub)
+		token, err := actC.Encode(srvSignerKP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	createClientJwt := func() string {
+		ac := jwt.NewAccountClaims(clientPK)
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating importer JWT: %v", err)
+		}
+		return token
+	}
+
+	srvJWT, _ := createSrvJwt(srvSignerPK)
+	addAccountToMemResolver(s, srvPK, srvJWT)
+
+	clientJWT := createClientJwt()
+	addAccountToMemResolver(s, clientPK, clientJWT)
+
+	// Create a client that will send the request
+	client, clientReader, clientCS := createClient(t, s, clientKP)
+	defer client.close()
+	client.parseAsync(clientCS)
+	expectPong(t, clientReader)
+
+	checkShadow := func(expected int) {
+		t.Helper()
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		sub := client.subs["1"]
+		count := 0
+		if sub != nil {
+			count = len(sub.shadow)
+		}
+		if count != expected {
+			t.Fatalf("Expected shadows to be %d, got %d", expected, count)
+		}
+	}
+
+	checkShadow(0)
+	// Create the client that will respond to the requests.
+	srv, srvReader, srvCS := createClient(t, s, srvKP)
+	defer srv.close()
+	srv.parseAsync(srvCS)
+	expectPong(t, srvReader)
+
+	// Create Subscriber.
+	srv.parseAsync("SUB foo 1\r\nPING\r\n")
+	expectPong(t, srvReader)
+
+	// Send Request
+	client.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
+	expectPong(t, clientReader)
+
+	// We should receive the request. PING needed to flush.
+	srv.parseAsync("PING\r\n")
+	expectMsg(t, srvReader, "foo", "hi")
+
+	client.parseAsync("SUB bar 1\r\nPING\r\n")
+	expectPong(t, clientReader)
+	checkShadow(1)
+
+	srv.parseAsync("PUB bar 2\r\nhi\r\nPING\r\n")
+	expectPong(t, srvReader)
+
+	// We should receive from stream. PING needed to flush.
+	client.parseAsync("PING\r\n")
+	expectMsg(t, clientReader, "bar", "hi")
+
+	// Now update the exported service no signer
+	srvJWT, srvAC := createSrvJwt()
+	addAccountToMemResolver(s, srvPK, srvJWT)
+	acc, _ := s.LookupAccount(srvPK)
+	s.UpdateAccountClaims(acc, srvAC)
+
+	// Send Another Request
+	client.parseAsync("PUB foo 2\r\nhi\r\nPING\r\n")
+	expectPong(t, clientReader)
+
+	// We should not receive the request this time.
+	srv.parseAsync("PING\r\n")
+	expectPong(t, srvReader)
+
+	// Publish on the stream
+	srv.parseAsync("PUB bar 2\r\nhi\r\nPING\r\n")
+	expectPong(t, srvReader)
+
+	// We should not receive from the stream this time
+	client.parseAsync("PING\r\n")
+	expectPong(t, clientReader)
+	checkShadow(0)
+}
+
+func TestJWTAccountImportSignerDeadlock(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Exporter keys
+	srvKP, _ := nkeys.CreateAccount()
+	srvPK, _ := srvKP.PublicKey()
+	srvSignerKP, _ := nkeys.CreateAccount()
+	srvSignerPK, _ := srvSignerKP.PublicKey()
+
+	// Importer keys
+	clientKP, _ := nkeys.CreateAccount()
+	clientPK, _ := clientKP.PublicKey()
+
+	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
+		ac := jwt.NewAccountClaims(srvPK)
+		ac.SigningKeys.Add(signingKeys...)
+		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating exporter JWT: %v", err)
+		}
+		return token, ac
+	}
+
+	createImportToken := func(sub string, kind jwt.ExportType) string {
+		actC := jwt.NewActivationClaims(clientPK)
+		actC.IssuerAccount = srvPK
+		actC.ImportType = kind
+		actC.ImportSubject = jwt.Subject(sub)
+		token, err := actC.Encode(srvSignerKP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	createClientJwt := func() string {
+		ac := jwt.NewAccountClaims(clientPK)
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating importer JWT: %v", err)
+		}
+		return token
+	}
+
+	srvJWT, _ := createSrvJwt(srvSignerPK)
+	addAccountToMemResolver(s, srvPK, srvJWT)
+
+	clientJWT := createClientJwt()
+	addAccountToMemResolver(s, clientPK, clientJWT)
+
+	acc, _ := s.LookupAccount(srvPK)
+	// Have a go routine that constantly gets/releases the acc's write lock.
+	// There was a bug that could cause AddServiceImportWithClaim to deadlock.
+	ch := make(chan bool, 1)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ch:
+				return
+			default:
+				acc.mu.Lock()
+				acc.mu.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// Create a client that will send the request
+	client, clientReader, clientCS := createClient(t, s, clientKP)
+	defer client.close()
+	client.parseAsync(clientCS)
+	expectPong(t, clientReader)
+
+	close(ch)
+	wg.Wait()
+}
+
+func TestJWTAccountServiceImportActivationFetchedUnlocked(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Exports.Add(&jwt.Export{Subject: "req.add", Type: jwt.Service, TokenReq: true})
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barJWT, err := jwt.NewAccountClaims(barPub).Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "req.add"
+	activation.ImportType = jwt.Service
+	actJWT, err := activation.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating activation token: %v", err)
+	}
+
+	fooAcc, _ := s.LookupAccount(fooPub)
+	barAcc, _ := s.LookupAccount(barPub)
+
+	// The exporting account must not be locked while the token is fetched.
+	locked := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := make(chan struct{})
+		go func() {
+			fooAcc.mu.Lock()
+			fooAcc.mu.Unlock()
+			close(done)
+		}()
+		select {
+		case <-done:
+			locked <- false
+		case <-time.After(time.Second):
+			locked <- true
+		}
+		w.Write([]byte(actJWT))
+	}))
+	defer ts.Close()
+
+	imp := &jwt.Import{Account: fooPub, Subject: "req.add", Token: ts.URL, Type: jwt.Service}
+	if err := barAcc.AddServiceImportWithClaim(fooAcc, "req.add", _EMPTY_, imp); err != nil {
+		t.Fatalf("Error adding service import: %v", err)
+	}
+	if <-locked {
+		t.Fatalf("Expected the exporting account to not be locked while fetching the activation")
+	}
+	if n := barAcc.NumServiceImports(); n != 1 {
+		t.Fatalf("Expected 1 service import, got %d", n)
+	}
+}
+
+func TestJWTAccountImportWrongIssuerAccount(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	l := &captureErrorLogger{errCh: make(chan string, 2)}
+	s.SetLogger(l, false, false)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Exporter keys
+	srvKP, _ := nkeys.CreateAccount()
+	srvPK, _ := srvKP.PublicKey()
+	srvSignerKP, _ := nkeys.CreateAccount()
+	srvSignerPK, _ := srvSignerKP.PublicKey()
+
+	// Importer keys
+	clientKP, _ := nkeys.CreateAccount()
+	clientPK, _ := clientKP.PublicKey()
+
+	createSrvJwt := func(signingKeys ...string) (string, *jwt.AccountClaims) {
+		ac := jwt.NewAccountClaims(srvPK)
+		ac.SigningKeys.Add(signingKeys...)
+		ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+		ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating exporter JWT: %v", err)
+		}
+		return token, ac
+	}
+
+	createImportToken := func(sub string, kind jwt.ExportType) string {
+		actC := jwt.NewActivationClaims(clientPK)
+		// Reference ourselves, which is wrong.
+		actC.IssuerAccount = clientPK
+		actC.ImportType = kind
+		actC.ImportSubject = jwt.Subject(sub)
+		token, err := actC.Encode(srvSignerKP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	createClientJwt := func() string {
+		ac := jwt.NewAccountClaims(clientPK)
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
+		ac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
+		token, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating importer JWT: %v", err)
+		}
+		return token
+	}
+
+	srvJWT, _ := createSrvJwt(srvSignerPK)
+	addAccountToMemResolver(s, srvPK, srvJWT)
+
+	clientJWT := createClientJwt()
+	addAccountToMemResolver(s, clientPK, clientJWT)
+
+	// Create a client that will send the request
+	client, clientReader, clientCS := createClient(t, s, clientKP)
+	defer client.close()
+	client.parseAsync(clientCS)
+	expectPong(t, clientReader)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-l.errCh:
+			if !strings.HasPrefix(e, fmt.Sprintf("Invalid issuer account %q in activation claim", clientPK)) {
+				t.Fatalf("Unexpected error: %v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get error regarding issuer account")
+		}
+	}
+}
+
+func TestJWTAccountImportActivationWrongSubject(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	l := &captureErrorLogger{errCh: make(chan string, 2)}
+	s.SetLogger(l, false, false)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Exporter keys
+	srvKP, _ := nkeys.CreateAccount()
+	srvPK, _ := srvKP.PublicKey()
+
+	// Importer keys, the activation is issued for clientPK only.
+	clientKP, _ := nkeys.CreateAccount()
+	clientPK, _ := clientKP.PublicKey()
+	otherKP, _ := nkeys.CreateAccount()
+	otherPK, _ := otherKP.PublicKey()
+
+	ac := jwt.NewAccountClaims(srvPK)
+	ac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true})
+	ac.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream, TokenReq: true})
+	srvJWT, err := ac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating exporter JWT: %v", err)
+	}
+	addAccountToMemResolver(s, srvPK, srvJWT)
+
+	createImportToken := func(sub string, kind jwt.ExportType) string {
+		actC := jwt.NewActivationClaims(clientPK)
+		actC.ImportType = kind
+		actC.ImportSubject = jwt.Subject(sub)
+		token, err := actC.Encode(srvKP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// Reuse the activation tokens of clientPK in the other account.
+	oac := jwt.NewAccountClaims(otherPK)
+	oac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "foo", Type: jwt.Service, Token: createImportToken("foo", jwt.Service)})
+	oac.Imports.Add(&jwt.Import{Account: srvPK, Subject: "bar", Type: jwt.Stream, Token: createImportToken("bar", jwt.Stream)})
+	otherJWT, err := oac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating importer JWT: %v", err)
+	}
+	addAccountToMemResolver(s, otherPK, otherJWT)
+
+	acc, err := s.LookupAccount(otherPK)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-l.errCh:
+			expected := fmt.Sprintf("Activation token subject %q does not match importing account %q", clientPK, otherPK)
+			if !strings.HasPrefix(e, expected) {
+				t.Fatalf("Unexpected error: %v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get error regarding activation subject")
+		}
+	}
+	// Both imports should have been dropped.
+	if n := acc.NumServiceImports(); n != 0 {
+		t.Fatalf("Expected no service imports, got %d", n)
+	}
+	acc.mu.RLock()
+	nsi := len(acc.imports.streams)
+	acc.mu.RUnlock()
+	if nsi != 0 {
+		t.Fatalf("Expected no stream imports, got %d", nsi)
+	}
+}
+
+func TestJWTUserRevokedOnAccountUpdate(t *testing.T) {
+	nac := newJWTTestAccountClaims()
+	s, akp, c, cr := setupJWTTestWitAccountClaims(t, nac, "+OK")
+	defer s.Shutdown()
+	defer c.close()
+
+	expectPong(t, cr)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	apub, _ := akp.PublicKey()
+
+	c.mu.Lock()
+	pub := c.user.Nkey
+	c.mu.Unlock()
+
+	// Now revoke the user.
+	nac.Revoke(pub)
+
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	// Update the account on the server.
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up the account: %v", err)
+	}
+
+	// This is simulating a system update for the account claims.
+	go s.updateAccountWithClaimJWT(acc, ajwt)
+
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
+	}
+	if !strings.Contains(l, "Revoked") {
+		t.Fatalf("Expected 'Revoked' to be in the error")
+	}
+}
+
+func TestJWTUserRevoked(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create a new user that we will make sure has been revoked.
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := jwt.NewUserClaims(pub)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	// Revoke the user right away.
+	nac.Revoke(pub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	// Sign for the user.
+	jwt, err := nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+
+	// Sign Nonce
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	sigraw, _ := nkp.Sign([]byte(info.Nonce))
+	sig := base64.RawURLEncoding.EncodeToString(sigraw)
+
+	// PING needed to flush the +OK/-ERR to us.
+	cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", jwt, sig)
+
+	c.parseAsync(cs)
+
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error")
+	}
+	if !strings.Contains(l, "Authorization") {
+		t.Fatalf("Expected 'Revoked' to be in the error")
+	}
+}
+
+func TestJWTUserTagPermissions(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+		user_tag_permissions: {
+			admin: { subscribe: "$SYS.>" }
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	createUser := func(tags ...string) nats.Option {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		nuc := jwt.NewUserClaims(upub)
+		nuc.Sub.Allow.Add("foo")
+		nuc.Tags.Add(tags...)
+		ujwt, err := nuc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) })
+	}
+
+	for _, test := range []struct {
+		name    string
+		tags    []string
+		allowed bool
+	}{
+		{"untagged", nil, false},
+		{"tagged", []string{"Admin"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			errCh := make(chan error, 10)
+			nc := natsConnect(t, s.ClientURL(), createUser(test.tags...),
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			defer nc.Close()
+
+			// The explicit user permission applies in both cases.
+			natsSubSync(t, nc, "foo")
+			natsSubSync(t, nc, "$SYS.ACCOUNT.>")
+			natsFlush(t, nc)
+
+			select {
+			case err := <-errCh:
+				if test.allowed || !strings.Contains(err.Error(), `Subscription to "$SYS.ACCOUNT.>"`) {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			case <-time.After(250 * time.Millisecond):
+				if !test.allowed {
+					t.Fatalf("Expected permissions violation")
+				}
+			}
+		})
+	}
+}
+
+func TestJWTUserIssuedBeforeCutoff(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	createUser := func() (nats.Option, int64) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		nuc := jwt.NewUserClaims(upub)
+		ujwt, err := nuc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }), nuc.IssuedAt
+	}
+
+	oldUser, iat := createUser()
+	// Make sure the cutoff is after the old user was issued.
+	for time.Now().Unix() <= iat {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cutoff := time.Now().UTC()
+	newUser, _ := createUser()
+
+	confTemplate := `
+		listen: -1
+		operator: %s
+		resolver: MEMORY
+		resolver_preload: {
+			%s: %s
+		}
+		%s
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, ojwt, apub, ajwt, "")))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	closed := make(chan struct{}, 1)
+	nc := natsConnect(t, s.ClientURL(), oldUser, nats.NoReconnect(),
+		nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+	defer nc.Close()
+
+	// Set the cutoff, which should disconnect the old user.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(confTemplate, ojwt, apub, ajwt,
+		fmt.Sprintf("reject_users_issued_before: %s", cutoff.Format("2006-01-02T15:04:05Z")))))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected user issued before the cutoff to be disconnected")
+	}
+
+	if _, err := nats.Connect(s.ClientURL(), oldUser); err == nil ||
+		!strings.Contains(strings.ToLower(err.Error()), "authorization violation") {
+		t.Fatalf("Expected authorization violation, got %v", err)
+	}
+	nc = natsConnect(t, s.ClientURL(), newUser)
+	nc.Close()
+}
+
+// Test that an account update that revokes an import authorization cancels the import.
+func TestJWTImportTokenRevokedAfter(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+
+	// Now create Exports.
+	export := &jwt.Export{Subject: "foo.private", Type: jwt.Stream, TokenReq: true}
+
+	fooAC.Exports.Add(export)
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	simport := &jwt.Import{Account: fooPub, Subject: "foo.private", Type: jwt.Stream}
+
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "foo.private"
+	activation.ImportType = jwt.Stream
+	actJWT, err := activation.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating activation token: %v", err)
+	}
+
+	simport.Token = actJWT
+	barAC.Imports.Add(simport)
+	barJWT, err := barAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	// Now revoke the export.
+	decoded, _ := jwt.DecodeActivationClaims(actJWT)
+	export.Revoke(decoded.Subject)
+
+	fooJWT, err = fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	fooAcc, _ := s.LookupAccount(fooPub)
+	if fooAcc == nil {
+		t.Fatalf("Expected to retrieve the account")
+	}
+
+	// Now lookup bar account and make sure it was revoked.
+	acc, _ := s.LookupAccount(barPub)
+	if acc == nil {
+		t.Fatalf("Expected to retrieve the account")
+	}
+	if les := len(acc.imports.streams); les != 0 {
+		t.Fatalf("Expected imports streams len of 0, got %d", les)
+	}
+}
+
+// Test that an account update that revokes an import authorization cancels the import.
+func TestJWTImportTokenRevokedBefore(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+
+	// Now create Exports.
+	export := &jwt.Export{Subject: "foo.private", Type: jwt.Stream, TokenReq: true}
+
+	fooAC.Exports.Add(export)
+
+	// Import account
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	simport := &jwt.Import{Account: fooPub, Subject: "foo.private", Type: jwt.Stream}
+
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "foo.private"
+	activation.ImportType = jwt.Stream
+	actJWT, err := activation.Encode(fooKP)
+	if err != nil {
+		t.Fatalf("Error generating activation token: %v", err)
+	}
+
+	simport.Token = actJWT
+	barAC.Imports.Add(simport)
+
+	// Now revoke the export.
+	decoded, _ := jwt.DecodeActivationClaims(actJWT)
+	export.Revoke(decoded.Subject)
+
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barJWT, err := barAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	fooAcc, _ := s.LookupAccount(fooPub)
+	if fooAcc == nil {
+		t.Fatalf("Expected to retrieve the account")
+	}
+
+	// Now lookup bar account and make sure it was revoked.
+	acc, _ := s.LookupAccount(barPub)
+	if acc == nil {
+		t.Fatalf("Expected to retrieve the account")
+	}
+	if les := len(acc.imports.streams); les != 0 {
+		t.Fatalf("Expected imports streams len of 0, got %d", les)
+	}
+}
+
+func TestJWTCircularAccountServiceImport(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+
+	// Create service export/import for account foo
+	serviceExport := &jwt.Export{Subject: "foo", Type: jwt.Service, TokenReq: true}
+	serviceImport := &jwt.Import{Account: barPub, Subject: "bar", Type: jwt.Service}
+
+	fooAC.Exports.Add(serviceExport)
+	fooAC.Imports.Add(serviceImport)
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	// Create service export/import for account bar
+	serviceExport = &jwt.Export{Subject: "bar", Type: jwt.Service, TokenReq: true}
+	serviceImport = &jwt.Import{Account: fooPub, Subject: "foo", Type: jwt.Service}
+
+	barAC.Exports.Add(serviceExport)
+	barAC.Imports.Add(serviceImport)
+	barJWT, err := barAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	c, cr, cs := createClient(t, s, fooKP)
+	defer c.close()
+
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	c.parseAsync("SUB foo 1\r\nPING\r\n")
+	expectPong(t, cr)
+}
+
+func TestJWTServiceImportCycleDetected(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	l := &captureErrorLogger{errCh: make(chan string, 10)}
+	s.SetLogger(l, false, false)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create 3 accounts, each exporting "svc" and importing it from the next one.
+	var pubs []string
+	var acs []*jwt.AccountClaims
+	for i := 0; i < 3; i++ {
+		kp, _ := nkeys.CreateAccount()
+		pub, _ := kp.PublicKey()
+		pubs = append(pubs, pub)
+		ac := jwt.NewAccountClaims(pub)
+		ac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+		acs = append(acs, ac)
+	}
+	for i, ac := range acs {
+		ac.Imports.Add(&jwt.Import{Account: pubs[(i+1)%3], Subject: "svc", Type: jwt.Service})
+		ajwt, err := ac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		addAccountToMemResolver(s, pubs[i], ajwt)
+	}
+
+	// Looking up an account only pulls in its exporter, whose imports are
+	// resolved when it is looked up itself. The import closing the cycle
+	// is the one of the last account.
+	for _, pub := range pubs[:2] {
+		acc, err := s.LookupAccount(pub)
+		if err != nil {
+			t.Fatalf("Error looking up account: %v", err)
+		}
+		if n := acc.NumServiceImports(); n != 1 {
+			t.Fatalf("Expected 1 service import, got %d", n)
+		}
+	}
+	acc, err := s.LookupAccount(pubs[2])
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	select {
+	case e := <-l.errCh:
+		if !strings.Contains(e, ErrServiceImportCycle.Error()) {
+			t.Fatalf("Expected cycle to be detected, got %q", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected cycle to be detected")
+	}
+	if n := acc.NumServiceImports(); n != 0 {
+		t.Fatalf("Expected no service imports, got %d", n)
+	}
+	if acc.incomplete {
+		t.Fatalf("Expected a dropped import to not make the account incomplete")
+	}
+}
+
+// This test ensures that connected clients are properly evicted
+// (no deadlock) if the max conns of an account has been lowered
+// and the account is being updated (following expiration during
+// a lookup).
+func TestJWTDrainAccount(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	bjwt, err := jwt.NewAccountClaims(bpub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+		}
+	`, ojwt, apub, ajwt, bpub, bjwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if n := s.DrainAccount(apub, "maintenance"); n != 0 {
+		t.Fatalf("Expected no clients to be drained, got %d", n)
+	}
+
+	closed := make(chan struct{}, 10)
+	for i := 0; i < 3; i++ {
+		nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp), nats.NoReconnect(),
+			nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+		defer nc.Close()
+	}
+	// Clients of other accounts are not affected.
+	ncb := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, bkp))
+	defer ncb.Close()
+
+	if n := s.DrainAccount(apub, "maintenance"); n != 3 {
+		t.Fatalf("Expected 3 clients to be drained, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected client to be disconnected")
+		}
+	}
+	if !ncb.IsConnected() {
+		t.Fatalf("Expected client of other account to remain connected")
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		drained := 0
+		for _, cc := range s.closedClients() {
+			if cc.acc == apub && cc.Reason == AccountDrained.String() {
+				drained++
+			}
+		}
+		if drained != 3 {
+			return fmt.Errorf("Expected 3 closed connections with reason %q, got %d", AccountDrained, drained)
+		}
+		return nil
+	})
+
+	// New connections are rejected while the account is draining.
+	if _, err := nats.Connect(s.ClientURL(), createUserCreds(t, nil, akp)); err == nil ||
+		!strings.Contains(err.Error(), ErrAccountDraining.Error()) {
+		t.Fatalf("Expected error %q, got %v", ErrAccountDraining, err)
+	}
+}
+
+func TestJWTAccountLimitsMaxConnsAfterExpired(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// Create accounts and imports/exports.
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Limits.Conn = 10
+	fooJWT, err := fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	newClient := func(expPre string) *testAsyncClient {
+		t.Helper()
+		// Create a client.
+		c, cr, cs := createClient(t, s, fooKP)
+		c.parseAsync(cs)
+		l, _ := cr.ReadString('\n')
+		if !strings.HasPrefix(l, expPre) {
+			t.Fatalf("Expected a response starting with %q, got %q", expPre, l)
+		}
+		go func() {
+			for {
+				if _, _, err := cr.ReadLine(); err != nil {
+					return
+				}
+			}
+		}()
+		return c
+	}
+
+	for i := 0; i < 4; i++ {
+		c := newClient("PONG")
+		defer c.close()
+	}
+
+	// We will simulate that the account has expired. When
+	// a new client will connect, the server will do a lookup
+	// and find the account expired, which then will cause
+	// a fetch and a rebuild of the account. Since max conns
+	// is now lower, some clients should have been removed.
+	acc, _ := s.LookupAccount(fooPub)
+	acc.mu.Lock()
+	acc.expired = true
+	acc.updated = time.Now().Add(-2 * time.Second) // work around updating to quickly
+	acc.mu.Unlock()
+
+	// Now update with new expiration and max connections lowered to 2
+	fooAC.Limits.Conn = 2
+	fooJWT, err = fooAC.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	// Cause the lookup that will detect that account was expired
+	// and rebuild it, and kick clients out.
+	c := newClient("-ERR ")
+	defer c.close()
+
+	acc, _ = s.LookupAccount(fooPub)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		acc.mu.RLock()
+		numClients := len(acc.clients)
+		acc.mu.RUnlock()
+		if numClients != 2 {
+			return fmt.Errorf("Should have 2 clients, got %v", numClients)
+		}
+		return nil
+	})
+}
+
+func TestBearerToken(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := newJWTTestUserClaims()
+	nuc.Subject = pub
+	// Set bearer token.
+	nuc.BearerToken = true
+	jwt, err := nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+
+	// Skip nonce signature...
+
+	// PING needed to flush the +OK/-ERR to us.
+	cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", jwt)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		c.parse([]byte(cs))
+		wg.Done()
+	}()
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected +OK, got %s", l)
+	}
+	wg.Wait()
+}
+
+func TestJWTAccountUserAuthMethod(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	for _, test := range []struct {
+		userAuth     string
+		bearerAnswer string
+		nonceAnswer  string
+	}{
+		{"", "+OK", "+OK"},
+		{"bearer", "+OK", "-ERR"},
+		{"NONCE", "-ERR", "+OK"},
+	} {
+		t.Run(test.userAuth, func(t *testing.T) {
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			addAccountToMemResolver(s, apub, encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp,
+				map[string]interface{}{"user_auth": test.userAuth}))
+
+			connect := func(bearer bool, expected string) {
+				t.Helper()
+				nkp, _ := nkeys.CreateUser()
+				pub, _ := nkp.PublicKey()
+				nuc := newJWTTestUserClaims()
+				nuc.Subject = pub
+				nuc.BearerToken = bearer
+				ujwt, err := nuc.Encode(akp)
+				if err != nil {
+					t.Fatalf("Error generating user JWT: %v", err)
+				}
+				c, cr, l := newClientForServer(s)
+				defer c.close()
+				var cs string
+				if bearer {
+					cs = fmt.Sprintf("CONNECT {\"jwt\":%q,\"verbose\":true}\r\nPING\r\n", ujwt)
+				} else {
+					var info nonceInfo
+					json.Unmarshal([]byte(l[5:]), &info)
+					sigraw, _ := nkp.Sign([]byte(info.Nonce))
+					sig := base64.RawURLEncoding.EncodeToString(sigraw)
+					cs = fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\",\"verbose\":true}\r\nPING\r\n", ujwt, sig)
+				}
+				c.parseAsync(cs)
+				if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, expected) {
+					t.Fatalf("Expected %q for bearer=%v, got %q", expected, bearer, l)
+				}
+			}
+			connect(true, test.bearerAnswer)
+			connect(false, test.nonceAnswer)
+		})
+	}
+}
+
+func TestExpiredUserCredentialsRenewal(t *testing.T) {
+	createTmpFile := func(t *testing.T, content []byte) string {
+		t.Helper()
+		conf, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatalf("Error creating conf file: %v", err)
+		}
+		fName := conf.Name()
+		conf.Close()
+		if err := ioutil.WriteFile(fName, content, 0666); err != nil {
+			os.Remove(fName)
+			t.Fatalf("Error writing conf file: %v", err)
+		}
+		return fName
+	}
+	waitTime := func(ch chan bool, timeout time.Duration) error {
+		select {
+		case <-ch:
+			return nil
+		case <-time.After(timeout):
+		}
+		return errors.New("timeout")
+	}
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	akp, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatalf("Error generating account")
+	}
+	aPub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(aPub)
+	aJwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	kp, _ := nkeys.FromSeed(oSeed)
+	oPub, _ := kp.PublicKey()
+	opts := defaultServerOptions
+	opts.TrustedKeys = []string{oPub}
+	s := RunServer(&opts)
+	if s == nil {
+		t.Fatal("Server did not start")
+	}
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, aPub, aJwt)
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	uSeed, _ := nkp.Seed()
+	nuc := newJWTTestUserClaims()
+	nuc.Subject = pub
+	nuc.Expires = time.Now().Add(time.Second).Unix()
+	uJwt, err := nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	creds, err := jwt.FormatUserConfig(uJwt, uSeed)
+	if err != nil {
+		t.Fatalf("Error encoding credentials: %v", err)
+	}
+	chainedFile := createTmpFile(t, creds)
+	defer os.Remove(chainedFile)
+
+	rch := make(chan bool)
+
+	url := fmt.Sprintf("nats://%s:%d", s.opts.Host, s.opts.Port)
+	nc, err := nats.Connect(url,
+		nats.UserCredentials(chainedFile),
+		nats.ReconnectWait(25*time.Millisecond),
+		nats.ReconnectJitter(0, 0),
+		nats.MaxReconnects(2),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			rch <- true
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Expected to connect, got %v %s", err, url)
+	}
+	defer nc.Close()
+
+	// Place new credentials underneath.
+	nuc.Expires = time.Now().Add(30 * time.Second).Unix()
+	uJwt, err = nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error encoding user jwt: %v", err)
+	}
+	creds, err = jwt.FormatUserConfig(uJwt, uSeed)
+	if err != nil {
+		t.Fatalf("Error encoding credentials: %v", err)
+	}
+	if err := ioutil.WriteFile(chainedFile, creds, 0666); err != nil {
+		t.Fatalf("Error writing conf file: %v", err)
+	}
+
+	// Make sure we get disconnected and reconnected first.
+	if err := waitTime(rch, 2*time.Second); err != nil {
+		t.Fatal("Should have reconnected.")
+	}
+
+	// We should not have been closed.
+	if nc.IsClosed() {
+		t.Fatal("Got disconnected when we should have reconnected.")
+	}
+
+	// Check that we clear the lastErr that can cause the disconnect.
+	// Our reconnect CB will happen before the clear. So check after a bit.
+	time.Sleep(50 * time.Millisecond)
+	if nc.LastError() != nil {
+		t.Fatalf("Expected lastErr to be cleared, got %q", nc.LastError())
+	}
+}
+
+func updateJwt(t *testing.T, url string, creds string, pubKey string, jwt string, respCnt int) int {
+	t.Helper()
+	require_NextMsg := func(sub *nats.Subscription) bool {
+		t.Helper()
+		msg := natsNexMsg(t, sub, time.Second)
+		content := make(map[string]interface{})
+		json.Unmarshal(msg.Data, &content)
+		if _, ok := content["data"]; ok {
+			return true
+		}
+		return false
+	}
+	c := natsConnect(t, url, nats.UserCredentials(creds),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				t.Fatal("error not expected in this test", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			t.Fatal("error not expected in this test", err)
+		}),
+	)
+	defer c.Close()
+	resp := c.NewRespInbox()
+	sub := natsSubSync(t, c, resp)
+	err := sub.AutoUnsubscribe(respCnt)
+	require_NoError(t, err)
+	require_NoError(t, c.PublishRequest(fmt.Sprintf(accUpdateEventSubjNew, pubKey), resp, []byte(jwt)))
+	passCnt := 0
+	for i := 0; i < respCnt; i++ {
+		if require_NextMsg(sub) {
+			passCnt++
+		}
+	}
+	return passCnt
+}
+
+func require_JWTAbsent(t *testing.T, dir string, pub string) {
+	t.Helper()
+	_, err := os.Stat(filepath.Join(dir, pub+".jwt"))
+	require_Error(t, err)
+	require_True(t, os.IsNotExist(err))
+}
+
+func require_JWTPresent(t *testing.T, dir string, pub string) {
+	t.Helper()
+	_, err := os.Stat(filepath.Join(dir, pub+".jwt"))
+	require_NoError(t, err)
+}
+
+func require_JWTEqual(t *testing.T, dir string, pub string, jwt string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(dir, pub+".jwt"))
+	require_NoError(t, err)
+	require_Equal(t, string(content), jwt)
+}
+
+func createDir(t *testing.T, prefix string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", prefix)
+	require_NoError(t, err)
+	return dir
+}
+
+func writeJWT(t *testing.T, dir string, pub string, jwt string) {
+	t.Helper()
+	err := ioutil.WriteFile(filepath.Join(dir, pub+".jwt"), []byte(jwt), 0644)
+	require_NoError(t, err)
+}
+
+func TestAccountResolverConfig(t *testing.T) {
+	dirFull, _ := ioutil.TempDir("", "srv-full")
+	defer os.RemoveAll(dirFull)
+	dirCache, _ := ioutil.TempDir("", "srv-cache")
+	defer os.RemoveAll(dirCache)
+
+	for _, test := range []struct {
+		resolver string
+		expected AccountResolverConfig
+	}{
+		{fmt.Sprintf(`{
+			type: full
+			dir: %s
+			interval: "200ms"
+			limit: 4
+		}`, dirFull), AccountResolverConfig{Type: "FULL", Dir: dirFull, Limit: 4, Interval: 200 * time.Millisecond}},
+		{fmt.Sprintf(`{
+			type: cache
+			dir: %s
+			ttl: "1m"
+			limit: 10
+		}`, dirCache), AccountResolverConfig{Type: "CACHE", Dir: dirCache, Limit: 10, TTL: time.Minute}},
+		{"MEMORY", AccountResolverConfig{Type: "MEM"}},
+		{`URL("http://127.0.0.1:1234/jwt")`, AccountResolverConfig{Type: "URL", URL: "http://127.0.0.1:1234/jwt/"}},
+	} {
+		t.Run(test.expected.Type, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				operator: %s
+				resolver: %s
+			`, ojwt, test.resolver)))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			if err != nil {
+				t.Fatalf("Error processing config file: %v", err)
+			}
+			defer opts.AccountResolver.Close()
+			cfg := opts.AccountResolverConfig()
+			if cfg == nil || *cfg != test.expected {
+				t.Fatalf("Expected resolver config %+v, got %+v", test.expected, cfg)
+			}
+			// Make sure we are handed a copy.
+			cfg.Dir, cfg.Limit = "changed", 1
+			if cfg = opts.AccountResolverConfig(); *cfg != test.expected {
+				t.Fatalf("Expected resolver config %+v, got %+v", test.expected, cfg)
+			}
+		})
+	}
+}
+
+func TestAccountNATSResolverFetch(t *testing.T) {
+	origEventsHBInterval := eventsHBInterval
+	eventsHBInterval = 50 * time.Millisecond // speed up eventing
+	defer func() { eventsHBInterval = origEventsHBInterval }()
+	require_NoLocalOrRemoteConnections := func(account string, srvs ...*Server) {
+		t.Helper()
+		for _, srv := range srvs {
+			if acc, ok := srv.accounts.Load(account); ok {
+				checkAccClientsCount(t, acc.(*Account), 0)
+			}
+		}
+	}
+	// After each connection check, require_XConnection and connect assures that
+	// listed server have no connections for the account used
+	require_1Connection := func(url, creds, acc string, srvs ...*Server) {
+		t.Helper()
+		func() {
+			t.Helper()
+			c := natsConnect(t, url, nats.UserCredentials(creds))
+			defer c.Close()
+			if _, err := nats.Connect(url, nats.UserCredentials(creds)); err == nil {
+				t.Fatal("Second connection was supposed to fail due to limits")
+			} else if !strings.Contains(err.Error(), ErrTooManyAccountConnections.Error()) {
+				t.Fatal("Second connection was supposed to fail with too many conns")
+			}
+		}()
+		require_NoLocalOrRemoteConnections(acc, srvs...)
+	}
+	require_2Connection := func(url, creds, acc string, srvs ...*Server) {
+		t.Helper()
+		func() {
+			t.Helper()
+			c1 := natsConnect(t, url, nats.UserCredentials(creds))
+			defer c1.Close()
+			c2 := natsConnect(t, url, nats.UserCredentials(creds))
+			defer c2.Close()
+			if _, err := nats.Connect(url, nats.UserCredentials(creds)); err == nil {
+				t.Fatal("Third connection was supposed to fail due to limits")
+			} else if !strings.Contains(err.Error(), ErrTooManyAccountConnections.Error()) {
+				t.Fatal("Third connection was supposed to fail with too many conns")
+			}
+		}()
+		require_NoLocalOrRemoteConnections(acc, srvs...)
+	}
+	connect := func(url string, credsfile string, acc string, srvs ...*Server) {
+		t.Helper()
+		nc := natsConnect(t, url, nats.UserCredentials(credsfile))
+		nc.Close()
 		require_NoLocalOrRemoteConnections(acc, srvs...)
 	}
-	createAccountAndUser := func(limit bool, done chan struct{}, pubKey, jwt1, jwt2, creds *string) {
-		t.Helper()
-		kp, _ := nkeys.CreateAccount()
-		*pubKey, _ = kp.PublicKey()
-		claim := jwt.NewAccountClaims(*pubKey)
-		if limit {
-			claim.Limits.Conn = 1
+	createAccountAndUser := func(limit bool, done chan struct{}, pubKey, jwt1, jwt2, creds *string) {
+		t.Helper()
+		kp, _ := nkeys.CreateAccount()
+		*pubKey, _ = kp.PublicKey()
+		claim := jwt.NewAccountClaims(*pubKey)
+		if limit {
+			claim.Limits.Conn = 1
+		}
+		var err error
+		*jwt1, err = claim.Encode(oKp)
+		require_NoError(t, err)
+		// need to assure that create time differs (resolution is sec)
+		time.Sleep(time.Millisecond * 1100)
+		// create updated claim allowing more connections
+		if limit {
+			claim.Limits.Conn = 2
+		}
+		*jwt2, err = claim.Encode(oKp)
+		require_NoError(t, err)
+		ukp, _ := nkeys.CreateUser()
+		seed, _ := ukp.Seed()
+		upub, _ := ukp.PublicKey()
+		uclaim := newJWTTestUserClaims()
+		uclaim.Subject = upub
+		ujwt, err := uclaim.Encode(kp)
+		require_NoError(t, err)
+		*creds = genCredsFile(t, ujwt, seed)
+		done <- struct{}{}
+	}
+	// Create Accounts and corresponding user creds. Do so concurrently to speed up the test
+	doneChan := make(chan struct{}, 5)
+	defer close(doneChan)
+	var syspub, sysjwt, dummy1, sysCreds string
+	go createAccountAndUser(false, doneChan, &syspub, &sysjwt, &dummy1, &sysCreds)
+	var apub, ajwt1, ajwt2, aCreds string
+	go createAccountAndUser(true, doneChan, &apub, &ajwt1, &ajwt2, &aCreds)
+	var bpub, bjwt1, bjwt2, bCreds string
+	go createAccountAndUser(true, doneChan, &bpub, &bjwt1, &bjwt2, &bCreds)
+	var cpub, cjwt1, cjwt2, cCreds string
+	go createAccountAndUser(true, doneChan, &cpub, &cjwt1, &cjwt2, &cCreds)
+	var dpub, djwt1, dummy2, dCreds string // extra user used later in the test in order to test limits
+	go createAccountAndUser(true, doneChan, &dpub, &djwt1, &dummy2, &dCreds)
+	for i := 0; i < cap(doneChan); i++ {
+		<-doneChan
+	}
+	defer os.Remove(sysCreds)
+	defer os.Remove(aCreds)
+	defer os.Remove(bCreds)
+	defer os.Remove(cCreds)
+	defer os.Remove(dCreds)
+	// Create one directory for each server
+	dirA := createDir(t, "srv-a")
+	defer os.RemoveAll(dirA)
+	dirB := createDir(t, "srv-b")
+	defer os.RemoveAll(dirB)
+	dirC := createDir(t, "srv-c")
+	defer os.RemoveAll(dirC)
+	// simulate a restart of the server by storing files in them
+	// Server A/B will completely sync, so after startup each server
+	// will contain the union off all stored/configured jwt
+	// Server C will send out lookup requests for jwt it does not store itself
+	writeJWT(t, dirA, apub, ajwt1)
+	writeJWT(t, dirB, bpub, bjwt1)
+	writeJWT(t, dirC, cpub, cjwt1)
+	// Create seed server A (using no_advertise to prevent fail over)
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-A
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+			limit: 4
+		}
+		resolver_preload: {
+			%s: %s
+		}
+		cluster {
+			name: clust
+			listen: -1
+			no_advertise: true
+		}
+    `, ojwt, syspub, dirA, cpub, cjwt1)))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+	// during startup resolver_preload causes the directory to contain data
+	require_JWTPresent(t, dirA, cpub)
+	// Create Server B (using no_advertise to prevent fail over)
+	confB := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-B
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+			limit: 4
+		}
+		cluster {
+			name: clust
+			listen: -1 
+			no_advertise: true
+			routes [
+				nats-route://localhost:%d
+			]
+		}
+    `, ojwt, syspub, dirB, sA.opts.Cluster.Port)))
+	defer os.Remove(confB)
+	sB, _ := RunServerWithConfig(confB)
+	defer sB.Shutdown()
+	// Create Server C (using no_advertise to prevent fail over)
+	fmtC := `
+		listen: -1
+		server_name: srv-C
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: cache
+			dir: %s
+			ttl: "%dms"
+			limit: 4
+		}
+		cluster {
+			name: clust
+			listen: -1 
+			no_advertise: true
+			routes [
+				nats-route://localhost:%d
+			]
+		}
+    `
+	confClongTTL := createConfFile(t, []byte(fmt.Sprintf(fmtC, ojwt, syspub, dirC, 10000, sA.opts.Cluster.Port)))
+	defer os.Remove(confClongTTL)
+	confCshortTTL := createConfFile(t, []byte(fmt.Sprintf(fmtC, ojwt, syspub, dirC, 1000, sA.opts.Cluster.Port)))
+	defer os.Remove(confCshortTTL)
+	sC, _ := RunServerWithConfig(confClongTTL) // use long ttl to assure it is not kicking
+	defer sC.Shutdown()
+	// startup cluster
+	checkClusterFormed(t, sA, sB, sC)
+	time.Sleep(500 * time.Millisecond) // wait for the protocol to converge
+	// Check all accounts
+	require_JWTPresent(t, dirA, apub) // was already present on startup
+	require_JWTPresent(t, dirB, apub) // was copied from server A
+	require_JWTAbsent(t, dirC, apub)
+	require_JWTPresent(t, dirA, bpub) // was copied from server B
+	require_JWTPresent(t, dirB, bpub) // was already present on startup
+	require_JWTAbsent(t, dirC, bpub)
+	require_JWTPresent(t, dirA, cpub) // was present in preload
+	require_JWTPresent(t, dirB, cpub) // was copied from server A
+	require_JWTPresent(t, dirC, cpub) // was already present on startup
+	// This is to test that connecting to it still works
+	require_JWTAbsent(t, dirA, syspub)
+	require_JWTAbsent(t, dirB, syspub)
+	require_JWTAbsent(t, dirC, syspub)
+	// system account client can connect to every server
+	connect(sA.ClientURL(), sysCreds, "")
+	connect(sB.ClientURL(), sysCreds, "")
+	connect(sC.ClientURL(), sysCreds, "")
+	checkClusterFormed(t, sA, sB, sC)
+	// upload system account and require a response from each server
+	passCnt := updateJwt(t, sA.ClientURL(), sysCreds, syspub, sysjwt, 3)
+	require_True(t, passCnt == 3)
+	require_JWTPresent(t, dirA, syspub) // was just received
+	require_JWTPresent(t, dirB, syspub) // was just received
+	require_JWTPresent(t, dirC, syspub) // was just received
+	// Only files missing are in C, which is only caching
+	connect(sC.ClientURL(), aCreds, apub, sA, sB, sC)
+	connect(sC.ClientURL(), bCreds, bpub, sA, sB, sC)
+	require_JWTPresent(t, dirC, apub) // was looked up form A or B
+	require_JWTPresent(t, dirC, bpub) // was looked up from A or B
+	// Check limits and update jwt B connecting to server A
+	for port, v := range map[string]struct{ pub, jwt, creds string }{
+		sB.ClientURL(): {bpub, bjwt2, bCreds},
+		sC.ClientURL(): {cpub, cjwt2, cCreds},
+	} {
+		require_1Connection(sA.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		require_1Connection(sB.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		require_1Connection(sC.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		passCnt := updateJwt(t, port, sysCreds, v.pub, v.jwt, 3)
+		require_True(t, passCnt == 3)
+		require_2Connection(sA.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		require_2Connection(sB.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		require_2Connection(sC.ClientURL(), v.creds, v.pub, sA, sB, sC)
+		require_JWTEqual(t, dirA, v.pub, v.jwt)
+		require_JWTEqual(t, dirB, v.pub, v.jwt)
+		require_JWTEqual(t, dirC, v.pub, v.jwt)
+	}
+	// Simulates A having missed an update
+	// shutting B down as it has it will directly connect to A and connect right away
+	sB.Shutdown()
+	writeJWT(t, dirB, apub, ajwt2) // this will be copied to server A
+	sB, _ = RunServerWithConfig(confB)
+	defer sB.Shutdown()
+	checkClusterFormed(t, sA, sB, sC)
+	time.Sleep(500 * time.Millisecond) // wait for the protocol to converge
+	// Restart server C. this is a workaround to force C to do a lookup in the absence of account cleanup
+	sC.Shutdown()
+	sC, _ = RunServerWithConfig(confClongTTL) //TODO remove this once we clean up accounts
+	defer sC.Shutdown()
+	require_JWTEqual(t, dirA, apub, ajwt2) // was copied from server B
+	require_JWTEqual(t, dirB, apub, ajwt2) // was restarted with this
+	require_JWTEqual(t, dirC, apub, ajwt1) // still contains old cached value
+	require_2Connection(sA.ClientURL(), aCreds, apub, sA, sB, sC)
+	require_2Connection(sB.ClientURL(), aCreds, apub, sA, sB, sC)
+	require_1Connection(sC.ClientURL(), aCreds, apub, sA, sB, sC)
+	// Restart server C. this is a workaround to force C to do a lookup in the absence of account cleanup
+	sC.Shutdown()
+	sC, _ = RunServerWithConfig(confCshortTTL) //TODO remove this once we clean up accounts
+	defer sC.Shutdown()
+	require_JWTEqual(t, dirC, apub, ajwt1) // still contains old cached value
+	checkClusterFormed(t, sA, sB, sC)
+	// Force next connect to do a lookup exceeds ttl
+	fname := filepath.Join(dirC, apub+".jwt")
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		_, err := os.Stat(fname)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("File not removed in time")
+	})
+	connect(sC.ClientURL(), aCreds, apub, sA, sB, sC) // When lookup happens
+	require_JWTEqual(t, dirC, apub, ajwt2)            // was looked up form A or B
+	require_2Connection(sC.ClientURL(), aCreds, apub, sA, sB, sC)
+	// Test exceeding limit. For the exclusive directory resolver, limit is a stop gap measure.
+	// It is not expected to be hit. When hit the administrator is supposed to take action.
+	passCnt = updateJwt(t, sA.ClientURL(), sysCreds, dpub, djwt1, 3)
+	require_True(t, passCnt == 1) // Only Server C updated
+	for _, srv := range []*Server{sA, sB, sC} {
+		if a, ok := srv.accounts.Load(syspub); ok {
+			acc := a.(*Account)
+			checkFor(t, time.Second, 20*time.Millisecond, func() error {
+				acc.mu.Lock()
+				defer acc.mu.Unlock()
+				if acc.ctmr != nil {
+					return fmt.Errorf("Timer still exists")
+				}
+				return nil
+			})
+		}
+	}
+}
+
+func TestAccountNATSResolverCrossClusterFetch(t *testing.T) {
+	connect := func(url string, credsfile string) {
+		t.Helper()
+		nc := natsConnect(t, url, nats.UserCredentials(credsfile))
+		nc.Close()
+	}
+	createAccountAndUser := func(done chan struct{}, pubKey, jwt1, jwt2, creds *string) {
+		t.Helper()
+		kp, _ := nkeys.CreateAccount()
+		*pubKey, _ = kp.PublicKey()
+		claim := jwt.NewAccountClaims(*pubKey)
+		var err error
+		*jwt1, err = claim.Encode(oKp)
+		require_NoError(t, err)
+		// need to assure that create time differs (resolution is sec)
+		time.Sleep(time.Millisecond * 1100)
+		// create updated claim
+		claim.Tags.Add("tag")
+		*jwt2, err = claim.Encode(oKp)
+		require_NoError(t, err)
+		ukp, _ := nkeys.CreateUser()
+		seed, _ := ukp.Seed()
+		upub, _ := ukp.PublicKey()
+		uclaim := newJWTTestUserClaims()
+		uclaim.Subject = upub
+		ujwt, err := uclaim.Encode(kp)
+		require_NoError(t, err)
+		*creds = genCredsFile(t, ujwt, seed)
+		done <- struct{}{}
+	}
+	// Create Accounts and corresponding user creds. Do so concurrently to speed up the test
+	doneChan := make(chan struct{}, 3)
+	defer close(doneChan)
+	var syspub, sysjwt, dummy1, sysCreds string
+	go createAccountAndUser(doneChan, &syspub, &sysjwt, &dummy1, &sysCreds)
+	var apub, ajwt1, ajwt2, aCreds string
+	go createAccountAndUser(doneChan, &apub, &ajwt1, &ajwt2, &aCreds)
+	var bpub, bjwt1, bjwt2, bCreds string
+	go createAccountAndUser(doneChan, &bpub, &bjwt1, &bjwt2, &bCreds)
+	for i := 0; i < cap(doneChan); i++ {
+		<-doneChan
+	}
+	defer os.Remove(sysCreds)
+	defer os.Remove(aCreds)
+	defer os.Remove(bCreds)
+	// Create one directory for each server
+	dirAA := createDir(t, "srv-a-a")
+	defer os.RemoveAll(dirAA)
+	dirAB := createDir(t, "srv-a-b")
+	defer os.RemoveAll(dirAB)
+	dirBA := createDir(t, "srv-b-a")
+	defer os.RemoveAll(dirBA)
+	dirBB := createDir(t, "srv-b-b")
+	defer os.RemoveAll(dirBB)
+	// simulate a restart of the server by storing files in them
+	// Server AA & AB will completely sync
+	// Server BA & BB will completely sync
+	// Be aware that no syncing will occur between cluster
+	writeJWT(t, dirAA, apub, ajwt1)
+	writeJWT(t, dirBA, bpub, bjwt1)
+	// Create seed server A (using no_advertise to prevent fail over)
+	confAA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-A-A
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+		}
+		gateway: {
+			name: "clust-A"
+			listen: -1
+		}
+		cluster {
+			name: clust-A
+			listen: -1
+			no_advertise: true
+		}
+    `, ojwt, syspub, dirAA)))
+	defer os.Remove(confAA)
+	sAA, _ := RunServerWithConfig(confAA)
+	defer sAA.Shutdown()
+	// Create Server B (using no_advertise to prevent fail over)
+	confAB := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-A-B
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+		}
+		gateway: {
+			name: "clust-A"
+			listen: -1
+		}
+		cluster {
+			name: clust-A
+			listen: -1 
+			no_advertise: true
+			routes [
+				nats-route://localhost:%d
+			]
+		}
+    `, ojwt, syspub, dirAB, sAA.opts.Cluster.Port)))
+	defer os.Remove(confAB)
+	sAB, _ := RunServerWithConfig(confAB)
+	defer sAB.Shutdown()
+	// Create Server C (using no_advertise to prevent fail over)
+	confBA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-B-A
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+		}
+		gateway: {
+			name: "clust-B"
+			listen: -1
+			gateways: [
+				{name: "clust-A", url: "nats://localhost:%d"},
+			]
+		}
+		cluster {
+			name: clust-B
+			listen: -1
+			no_advertise: true
+		}
+    `, ojwt, syspub, dirBA, sAA.opts.Gateway.Port)))
+	defer os.Remove(confBA)
+	sBA, _ := RunServerWithConfig(confBA)
+	defer sBA.Shutdown()
+	// Create Sever BA  (using no_advertise to prevent fail over)
+	confBB := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-B-B
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
+		}
+		cluster {
+			name: clust-B
+			listen: -1
+			no_advertise: true
+			routes [
+				nats-route://localhost:%d
+			]
+		}
+		gateway: {
+			name: "clust-B"
+			listen: -1
+			gateways: [
+				{name: "clust-A", url: "nats://localhost:%d"},
+			]
+		}
+    `, ojwt, syspub, dirBB, sBA.opts.Cluster.Port, sAA.opts.Cluster.Port)))
+	defer os.Remove(confBB)
+	sBB, _ := RunServerWithConfig(confBB)
+	defer sBB.Shutdown()
+	// Assert topology
+	checkClusterFormed(t, sAA, sAB)
+	checkClusterFormed(t, sBA, sBB)
+	waitForOutboundGateways(t, sAA, 1, 5*time.Second)
+	waitForOutboundGateways(t, sAB, 1, 5*time.Second)
+	waitForOutboundGateways(t, sBA, 1, 5*time.Second)
+	waitForOutboundGateways(t, sBB, 1, 5*time.Second)
+	time.Sleep(500 * time.Millisecond)                         // wait for the protocol to converge
+	updateJwt(t, sAA.ClientURL(), sysCreds, syspub, sysjwt, 4) // update system account jwt on all server
+	require_JWTEqual(t, dirAA, syspub, sysjwt)                 // assure this update made it to every server
+	require_JWTEqual(t, dirAB, syspub, sysjwt)                 // assure this update made it to every server
+	require_JWTEqual(t, dirBA, syspub, sysjwt)                 // assure this update made it to every server
+	require_JWTEqual(t, dirBB, syspub, sysjwt)                 // assure this update made it to every server
+	require_JWTAbsent(t, dirAA, bpub)                          // assure that jwt are not synced across cluster
+	require_JWTAbsent(t, dirAB, bpub)                          // assure that jwt are not synced across cluster
+	require_JWTAbsent(t, dirBA, apub)                          // assure that jwt are not synced across cluster
+	require_JWTAbsent(t, dirBB, apub)                          // assure that jwt are not synced across cluster
+	connect(sAA.ClientURL(), aCreds)                           // connect to cluster where jwt was initially stored
+	connect(sAB.ClientURL(), aCreds)                           // connect to cluster where jwt was initially stored
+	connect(sBA.ClientURL(), bCreds)                           // connect to cluster where jwt was initially stored
+	connect(sBB.ClientURL(), bCreds)                           // connect to cluster where jwt was initially stored
+	time.Sleep(500 * time.Millisecond)                         // wait for the protocol to (NOT) converge
+	require_JWTAbsent(t, dirAA, bpub)                          // assure that jwt are still not synced across cluster
+	require_JWTAbsent(t, dirAB, bpub)                          // assure that jwt are still not synced across cluster
+	require_JWTAbsent(t, dirBA, apub)                          // assure that jwt are still not synced across cluster
+	require_JWTAbsent(t, dirBB, apub)                          // assure that jwt are still not synced across cluster
+	// We have verified that account B does not exist in cluster A, neither does account A in cluster B
+	// Despite that clients from account B can connect to server A, same for account A in cluster B
+	connect(sAA.ClientURL(), bCreds)                        // connect to cluster where jwt was not initially stored
+	connect(sAB.ClientURL(), bCreds)                        // connect to cluster where jwt was not initially stored
+	connect(sBA.ClientURL(), aCreds)                        // connect to cluster where jwt was not initially stored
+	connect(sBB.ClientURL(), aCreds)                        // connect to cluster where jwt was not initially stored
+	require_JWTEqual(t, dirAA, bpub, bjwt1)                 // assure that now jwt used in connect is stored
+	require_JWTEqual(t, dirAB, bpub, bjwt1)                 // assure that now jwt used in connect is stored
+	require_JWTEqual(t, dirBA, apub, ajwt1)                 // assure that now jwt used in connect is stored
+	require_JWTEqual(t, dirBB, apub, ajwt1)                 // assure that now jwt used in connect is stored
+	updateJwt(t, sAA.ClientURL(), sysCreds, bpub, bjwt2, 4) // update bjwt, expect updates from everywhere
+	updateJwt(t, sBA.ClientURL(), sysCreds, apub, ajwt2, 4) // update ajwt, expect updates from everywhere
+	require_JWTEqual(t, dirAA, bpub, bjwt2)                 // assure that jwt got updated accordingly
+	require_JWTEqual(t, dirAB, bpub, bjwt2)                 // assure that jwt got updated accordingly
+	require_JWTEqual(t, dirBA, apub, ajwt2)                 // assure that jwt got updated accordingly
+	require_JWTEqual(t, dirBB, apub, ajwt2)                 // assure that jwt got updated accordingly
+}
+
+func newTimeRange(start time.Time, dur time.Duration) jwt.TimeRange {
+	return jwt.TimeRange{Start: start.Format("15:04:05"), End: start.Add(dur).Format("15:04:05")}
+}
+
+func createUserWithLimit(t *testing.T, accKp nkeys.KeyPair, expiration time.Time, limits func(*jwt.Limits)) string {
+	t.Helper()
+	ukp, _ := nkeys.CreateUser()
+	seed, _ := ukp.Seed()
+	upub, _ := ukp.PublicKey()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject = upub
+	if limits != nil {
+		limits(&uclaim.Limits)
+	}
+	if !expiration.IsZero() {
+		uclaim.Expires = expiration.Unix()
+	}
+	vr := jwt.ValidationResults{}
+	uclaim.Validate(&vr)
+	require_Len(t, len(vr.Errors()), 0)
+	ujwt, err := uclaim.Encode(accKp)
+	require_NoError(t, err)
+	return genCredsFile(t, ujwt, seed)
+}
+
+func TestJWTMemResolverPreloadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mem-preload")
+	require_NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var pubs []string
+	for i := 0; i < 2; i++ {
+		kp, _ := nkeys.CreateAccount()
+		pub, _ := kp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(pub).Encode(oKp)
+		require_NoError(t, err)
+		require_NoError(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.jwt", i)), []byte(ajwt), 0644))
+		pubs = append(pubs, pub)
+	}
+	// An invalid file and one signed by an untrusted operator should be skipped.
+	require_NoError(t, ioutil.WriteFile(filepath.Join(dir, "bad.jwt"), []byte("not a jwt"), 0644))
+	okp, _ := nkeys.CreateOperator()
+	kp, _ := nkeys.CreateAccount()
+	untrusted, _ := kp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(untrusted).Encode(okp)
+	require_NoError(t, err)
+	require_NoError(t, ioutil.WriteFile(filepath.Join(dir, "untrusted.jwt"), []byte(ajwt), 0644))
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload_dir: %q
+    `, ojwt, dir)))
+	defer os.Remove(conf)
+
+	s, err := NewServer(LoadConfig(conf))
+	require_NoError(t, err)
+	l := &captureErrorLogger{errCh: make(chan string, 10)}
+	s.SetLogger(l, false, false)
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("Server not ready")
+	}
+	defer s.Shutdown()
+
+	for _, pub := range pubs {
+		if _, err := s.LookupAccount(pub); err != nil {
+			t.Fatalf("Expected preloaded account %q, got %v", pub, err)
+		}
+	}
+	if _, err := s.LookupAccount(untrusted); err == nil {
+		t.Fatalf("Expected account from untrusted operator to not be preloaded")
+	}
+	for _, file := range []string{"bad.jwt", "untrusted.jwt"} {
+		select {
+		case e := <-l.errCh:
+			if !strings.Contains(e, file) {
+				t.Fatalf("Expected error for %q, got %q", file, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected error for %q", file)
+		}
+	}
+}
+
+func TestJWTUserLimits(t *testing.T) {
+	// helper for time
+	inAnHour := time.Now().Add(time.Hour)
+	inTwoHours := time.Now().Add(2 * time.Hour)
+	doNotExpire := time.Now().AddDate(1, 0, 0)
+	// create account
+	kp, _ := nkeys.CreateAccount()
+	aPub, _ := kp.PublicKey()
+	claim := jwt.NewAccountClaims(aPub)
+	aJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+    `, ojwt, aPub, aJwt)))
+	defer os.Remove(conf)
+	sA, _ := RunServerWithConfig(conf)
+	defer sA.Shutdown()
+	for _, v := range []struct {
+		pass bool
+		f    func(*jwt.Limits)
+	}{
+		{true, nil},
+		{false, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8") }},
+		{true, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/0") }},
+		{true, func(j *jwt.Limits) { j.Src.Set("127.0.0.1/8") }},
+		{true, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8,127.0.0.1/8") }},
+		{false, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8,9.9.9.9/8") }},
+		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), time.Hour)) }},
+		{false, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now().Add(time.Hour), time.Hour)) }},
+		{true, func(j *jwt.Limits) {
+			j.Times = append(j.Times, newTimeRange(inAnHour, time.Hour), newTimeRange(time.Now(), time.Hour))
+		}}, // last one is within range
+		{false, func(j *jwt.Limits) {
+			j.Times = append(j.Times, newTimeRange(inAnHour, time.Hour), newTimeRange(inTwoHours, time.Hour))
+		}}, // out of range
+		{false, func(j *jwt.Limits) {
+			j.Times = append(j.Times, newTimeRange(inAnHour, 3*time.Hour), newTimeRange(inTwoHours, 2*time.Hour))
+		}}, // overlapping [a[]b] out of range*/
+		{false, func(j *jwt.Limits) {
+			j.Times = append(j.Times, newTimeRange(inAnHour, 3*time.Hour), newTimeRange(inTwoHours, time.Hour))
+		}}, // overlapping [a[b]] out of range
+		// next day tests where end < begin
+		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), 25*time.Hour)) }},
+		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), -time.Hour)) }},
+	} {
+		t.Run("", func(t *testing.T) {
+			creds := createUserWithLimit(t, kp, doNotExpire, v.f)
+			defer os.Remove(creds)
+			if c, err := nats.Connect(sA.ClientURL(), nats.UserCredentials(creds)); err == nil {
+				c.Close()
+				if !v.pass {
+					t.Fatalf("Expected failure got none")
+				}
+			} else if v.pass {
+				t.Fatalf("Expected success got %v", err)
+			} else if !strings.Contains(err.Error(), "Authorization Violation") {
+				t.Fatalf("Expected error other than %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTTimeExpiration(t *testing.T) {
+	validFor := 1500 * time.Millisecond
+	validRange := 500 * time.Millisecond
+	doNotExpire := time.Now().AddDate(1, 0, 0)
+	// create account
+	kp, _ := nkeys.CreateAccount()
+	aPub, _ := kp.PublicKey()
+	claim := jwt.NewAccountClaims(aPub)
+	aJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+    `, ojwt, aPub, aJwt)))
+	defer os.Remove(conf)
+	sA, _ := RunServerWithConfig(conf)
+	defer sA.Shutdown()
+	for _, l := range []string{"", "Europe/Berlin", "America/New_York"} {
+		t.Run("simple expiration "+l, func(t *testing.T) {
+			start := time.Now()
+			creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) {
+				if l == "" {
+					j.Times = []jwt.TimeRange{newTimeRange(start, validFor)}
+				} else {
+					loc, err := time.LoadLocation(l)
+					require_NoError(t, err)
+					j.Times = []jwt.TimeRange{newTimeRange(start.In(loc), validFor)}
+					j.Locale = l
+				}
+			})
+			defer os.Remove(creds)
+			disconnectChan := make(chan struct{})
+			defer close(disconnectChan)
+			errChan := make(chan struct{})
+			defer close(errChan)
+			c := natsConnect(t, sA.ClientURL(),
+				nats.UserCredentials(creds),
+				nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+					if err != io.EOF {
+						return
+					}
+					disconnectChan <- struct{}{}
+				}),
+				nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
+					if err != nats.ErrAuthExpired {
+						return
+					}
+					now := time.Now()
+					stop := start.Add(validFor)
+					// assure event happens within a second of stop
+					if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
+						errChan <- struct{}{}
+					}
+				}))
+			chanRecv(t, errChan, 10*time.Second)
+			chanRecv(t, disconnectChan, 10*time.Second)
+			require_True(t, c.IsReconnecting())
+			require_False(t, c.IsConnected())
+			c.Close()
+		})
+	}
+	t.Run("double expiration", func(t *testing.T) {
+		start1 := time.Now()
+		start2 := start1.Add(2 * validFor)
+		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) {
+			j.Times = []jwt.TimeRange{newTimeRange(start1, validFor), newTimeRange(start2, validFor)}
+		})
+		defer os.Remove(creds)
+		errChan := make(chan struct{})
+		defer close(errChan)
+		reConnectChan := make(chan struct{})
+		defer close(reConnectChan)
+		c := natsConnect(t, sA.ClientURL(),
+			nats.UserCredentials(creds),
+			nats.ReconnectHandler(func(conn *nats.Conn) {
+				reConnectChan <- struct{}{}
+			}),
+			nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
+				if err != nats.ErrAuthExpired {
+					return
+				}
+				now := time.Now()
+				stop := start1.Add(validFor)
+				// assure event happens within a second of stop
+				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
+					errChan <- struct{}{}
+					return
+				}
+				stop = start2.Add(validFor)
+				// assure event happens within a second of stop
+				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
+					errChan <- struct{}{}
+				}
+			}))
+		chanRecv(t, errChan, 10*time.Second)
+		chanRecv(t, reConnectChan, 10*time.Second)
+		require_False(t, c.IsReconnecting())
+		require_True(t, c.IsConnected())
+		chanRecv(t, errChan, 10*time.Second)
+		c.Close()
+	})
+	t.Run("lower jwt expiration overwrites time", func(t *testing.T) {
+		start := time.Now()
+		creds := createUserWithLimit(t, kp, start.Add(validFor), func(j *jwt.Limits) { j.Times = []jwt.TimeRange{newTimeRange(start, 2*validFor)} })
+		defer os.Remove(creds)
+		disconnectChan := make(chan struct{})
+		defer close(disconnectChan)
+		errChan := make(chan struct{})
+		defer close(errChan)
+		c := natsConnect(t, sA.ClientURL(),
+			nats.UserCredentials(creds),
+			nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+				if err != io.EOF {
+					return
+				}
+				disconnectChan <- struct{}{}
+			}),
+			nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
+				if err != nats.ErrAuthExpired {
+					return
+				}
+				now := time.Now()
+				stop := start.Add(validFor)
+				// assure event happens within a second of stop
+				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
+					errChan <- struct{}{}
+				}
+			}))
+		chanRecv(t, errChan, 10*time.Second)
+		chanRecv(t, disconnectChan, 10*time.Second)
+		require_True(t, c.IsReconnecting())
+		require_False(t, c.IsConnected())
+		c.Close()
+	})
+}
+
+func TestJWTLimits(t *testing.T) {
+	doNotExpire := time.Now().AddDate(1, 0, 0)
+	// create account
+	kp, _ := nkeys.CreateAccount()
+	aPub, _ := kp.PublicKey()
+	claim := jwt.NewAccountClaims(aPub)
+	aJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+    `, ojwt, aPub, aJwt)))
+	defer os.Remove(conf)
+	sA, _ := RunServerWithConfig(conf)
+	defer sA.Shutdown()
+	errChan := make(chan struct{})
+	defer close(errChan)
+	t.Run("subs", func(t *testing.T) {
+		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) { j.Subs = 1 })
+		defer os.Remove(creds)
+		c := natsConnect(t, sA.ClientURL(), nats.UserCredentials(creds),
+			nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+				if e := conn.LastError(); e != nil && strings.Contains(e.Error(), "maximum subscriptions exceeded") {
+					errChan <- struct{}{}
+				}
+			}),
+		)
+		defer c.Close()
+		if _, err := c.Subscribe("foo", func(msg *nats.Msg) {}); err != nil {
+			t.Fatalf("couldn't subscribe: %v", err)
+		}
+		if _, err = c.Subscribe("bar", func(msg *nats.Msg) {}); err != nil {
+			t.Fatalf("expected error got: %v", err)
+		}
+		chanRecv(t, errChan, time.Second)
+	})
+	t.Run("payload", func(t *testing.T) {
+		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) { j.Payload = 5 })
+		defer os.Remove(creds)
+		c := natsConnect(t, sA.ClientURL(), nats.UserCredentials(creds))
+		defer c.Close()
+		if err := c.Flush(); err != nil {
+			t.Fatalf("flush failed %v", err)
+		}
+		if err := c.Publish("foo", []byte("world")); err != nil {
+			t.Fatalf("couldn't publish: %v", err)
+		}
+		if err := c.Publish("foo", []byte("worldX")); err != nats.ErrMaxPayload {
+			t.Fatalf("couldn't publish: %v", err)
+		}
+	})
+}
+
+func TestJWTNoOperatorMode(t *testing.T) {
+	for _, login := range []bool{true, false} {
+		t.Run("", func(t *testing.T) {
+			opts := DefaultOptions()
+			if login {
+				opts.Users = append(opts.Users, &User{Username: "u", Password: "pwd"})
+			}
+			sA := RunServer(opts)
+			defer sA.Shutdown()
+			kp, _ := nkeys.CreateAccount()
+			creds := createUserWithLimit(t, kp, time.Now().Add(time.Hour), nil)
+			defer os.Remove(creds)
+			url := sA.ClientURL()
+			if login {
+				url = fmt.Sprintf("nats://u:pwd@%s:%d", sA.opts.Host, sA.opts.Port)
+			}
+			c := natsConnect(t, url, nats.UserCredentials(creds))
+			defer c.Close()
+			sA.mu.Lock()
+			defer sA.mu.Unlock()
+			if len(sA.clients) != 1 {
+				t.Fatalf("Expected exactly one client")
+			}
+			for _, v := range sA.clients {
+				if v.opts.JWT != "" {
+					t.Fatalf("Expected no jwt %v", v.opts.JWT)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTJetStreamLimits(t *testing.T) {
+	updateJwt := func(url string, creds string, pubKey string, jwt string) {
+		t.Helper()
+		c := natsConnect(t, url, nats.UserCredentials(creds))
+		defer c.Close()
+		if msg, err := c.Request(fmt.Sprintf(accUpdateEventSubjNew, pubKey), []byte(jwt), time.Second); err != nil {
+			t.Fatal("error not expected in this test", err)
+		} else {
+			content := make(map[string]interface{})
+			if err := json.Unmarshal(msg.Data, &content); err != nil {
+				t.Fatalf("%v", err)
+			} else if _, ok := content["data"]; !ok {
+				t.Fatalf("did not get an ok response got: %v", content)
+			}
+		}
+	}
+	require_IdenticalLimits := func(infoLim JetStreamAccountLimits, lim jwt.JetStreamLimits) {
+		t.Helper()
+		if int64(infoLim.MaxConsumers) != lim.Consumer || int64(infoLim.MaxStreams) != lim.Streams ||
+			infoLim.MaxMemory != lim.MemoryStorage || infoLim.MaxStore != lim.DiskStorage {
+			t.Fatalf("limits do not match %v != %v", infoLim, lim)
+		}
+	}
+	expect_JSDisabledForAccount := func(c *nats.Conn) {
+		t.Helper()
+		if _, err := c.Request("$JS.API.INFO", nil, time.Second); err != nats.ErrTimeout {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	expect_InfoError := func(c *nats.Conn) {
+		t.Helper()
+		var info JSApiAccountInfoResponse
+		if resp, err := c.Request("$JS.API.INFO", nil, time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if err = json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("response1 %v got error %v", string(resp.Data), err)
+		} else if info.Error == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	validate_limits := func(c *nats.Conn, expectedLimits jwt.JetStreamLimits) {
+		t.Helper()
+		var info JSApiAccountInfoResponse
+		if resp, err := c.Request("$JS.API.INFO", nil, time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if err = json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("response1 %v got error %v", string(resp.Data), err)
+		} else {
+			require_IdenticalLimits(info.Limits, expectedLimits)
+		}
+	}
+	// create system account
+	sysKp, _ := nkeys.CreateAccount()
+	sysPub, _ := sysKp.PublicKey()
+	claim := jwt.NewAccountClaims(sysPub)
+	sysJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	sysUKp, _ := nkeys.CreateUser()
+	sysUSeed, _ := sysUKp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = sysUKp.PublicKey()
+	sysUserJwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysKp.Seed()
+	sysCreds := genCredsFile(t, sysUserJwt, sysUSeed)
+	// limits to apply and check
+	limits1 := jwt.JetStreamLimits{MemoryStorage: 1024 * 1024, DiskStorage: 2048 * 1024, Streams: 1, Consumer: 2}
+	// has valid limits that would fail when incorrectly applied twice
+	limits2 := jwt.JetStreamLimits{MemoryStorage: 4096 * 1024, DiskStorage: 8192 * 1024, Streams: 3, Consumer: 4}
+	// limits exceeding actual configured value of DiskStorage
+	limitsExceeded := jwt.JetStreamLimits{MemoryStorage: 8192 * 1024, DiskStorage: 16384 * 1024, Streams: 5, Consumer: 6}
+	// create account using jetstream with both limits
+	akp, _ := nkeys.CreateAccount()
+	aPub, _ := akp.PublicKey()
+	claim = jwt.NewAccountClaims(aPub)
+	claim.Limits.JetStreamLimits = limits1
+	aJwt1, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	claim.Limits.JetStreamLimits = limits2
+	aJwt2, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	claim.Limits.JetStreamLimits = limitsExceeded
+	aJwtLimitsExceeded, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	claim.Limits.JetStreamLimits = jwt.JetStreamLimits{} // disabled
+	aJwt4, err := claim.Encode(oKp)
+	require_NoError(t, err)
+	// account user
+	uKp, _ := nkeys.CreateUser()
+	uSeed, _ := uKp.Seed()
+	uclaim = newJWTTestUserClaims()
+	uclaim.Subject, _ = uKp.PublicKey()
+	userJwt, err := uclaim.Encode(akp)
+	require_NoError(t, err)
+	userCreds := genCredsFile(t, userJwt, uSeed)
+	dir, err := ioutil.TempDir("", "srv")
+	require_NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		jetstream: {max_mem_store: 10Mb, max_file_store: 10Mb}
+		operator: %s
+		resolver: {
+			type: full
+			dir: %s
+		}
+		system_account: %s
+    `, ojwt, dir, sysPub)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	port := opts.Port
+	updateJwt(s.ClientURL(), sysCreds, sysPub, sysJwt)
+	sys := natsConnect(t, s.ClientURL(), nats.UserCredentials(sysCreds))
+	expect_InfoError(sys)
+	sys.Close()
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt1)
+	c := natsConnect(t, s.ClientURL(), nats.UserCredentials(userCreds), nats.ReconnectWait(200*time.Millisecond))
+	defer c.Close()
+	validate_limits(c, limits1)
+	// keep using the same connection
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
+	validate_limits(c, limits2)
+	// keep using the same connection but do NOT CHANGE anything.
+	// This tests if the jwt is applied a second time (would fail)
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
+	validate_limits(c, limits2)
+	// keep using the same connection. This update EXCEEDS LIMITS
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
+	validate_limits(c, limits2)
+	// disable test after failure
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt4)
+	expect_InfoError(c)
+	// re enable, again testing with a value that can't be applied twice
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
+	validate_limits(c, limits2)
+	// disable test no prior failure
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt4)
+	expect_InfoError(c)
+	// Wrong limits form start
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
+	expect_JSDisabledForAccount(c)
+	// enable js but exceed limits. Followed by fix via restart
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
+	validate_limits(c, limits2)
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
+	validate_limits(c, limits2)
+	s.Shutdown()
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		listen: %d
+		jetstream: {max_mem_store: 20Mb, max_file_store: 20Mb}
+		operator: %s
+		resolver: {
+			type: full
+			dir: %s
+		}
+		system_account: %s
+    `, port, ojwt, dir, sysPub)))
+	defer os.Remove(conf)
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	c.Flush() // force client to discover the disconnect
+	checkClientsCount(t, s, 1)
+	validate_limits(c, limitsExceeded)
+	s.Shutdown()
+	// disable jetstream test
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		listen: %d
+		operator: %s
+		resolver: {
+			type: full
+			dir: %s
+		}
+		system_account: %s
+    `, port, ojwt, dir, sysPub)))
+	defer os.Remove(conf)
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	c.Flush() // force client to discover the disconnect
+	checkClientsCount(t, s, 1)
+	expect_JSDisabledForAccount(c)
+	// test that it stays disabled
+	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
+	expect_JSDisabledForAccount(c)
+	c.Close()
+}
+
+func TestJWTUserRevocation(t *testing.T) {
+	createAccountAndUser := func(done chan struct{}, pubKey, jwt1, jwt2, creds1, creds2 *string) {
+		t.Helper()
+		kp, _ := nkeys.CreateAccount()
+		*pubKey, _ = kp.PublicKey()
+		claim := jwt.NewAccountClaims(*pubKey)
+		var err error
+		*jwt1, err = claim.Encode(oKp)
+		require_NoError(t, err)
+
+		ukp, _ := nkeys.CreateUser()
+		seed, _ := ukp.Seed()
+		upub, _ := ukp.PublicKey()
+		uclaim := newJWTTestUserClaims()
+		uclaim.Subject = upub
+
+		ujwt1, err := uclaim.Encode(kp)
+		require_NoError(t, err)
+		*creds1 = genCredsFile(t, ujwt1, seed)
+
+		// create updated claim need to assure that issue time differs
+		claim.Revoke(upub) // revokes all jwt from now on
+		time.Sleep(time.Millisecond * 1100)
+		*jwt2, err = claim.Encode(oKp)
+		require_NoError(t, err)
+
+		ujwt2, err := uclaim.Encode(kp)
+		require_NoError(t, err)
+		*creds2 = genCredsFile(t, ujwt2, seed)
+
+		done <- struct{}{}
+	}
+	// Create Accounts and corresponding revoked and non revoked user creds. Do so concurrently to speed up the test
+	doneChan := make(chan struct{}, 2)
+	defer close(doneChan)
+	var syspub, sysjwt, dummy1, sysCreds, dummyCreds string
+	go createAccountAndUser(doneChan, &syspub, &sysjwt, &dummy1, &sysCreds, &dummyCreds)
+	var apub, ajwt1, ajwt2, aCreds1, aCreds2 string
+	go createAccountAndUser(doneChan, &apub, &ajwt1, &ajwt2, &aCreds1, &aCreds2)
+	for i := 0; i < cap(doneChan); i++ {
+		<-doneChan
+	}
+	defer os.Remove(sysCreds)
+	defer os.Remove(dummyCreds)
+	defer os.Remove(aCreds1)
+	defer os.Remove(aCreds2)
+	dirSrv := createDir(t, "srv")
+	defer os.RemoveAll(dirSrv)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+		}
+    `, ojwt, syspub, dirSrv)))
+	defer os.Remove(conf)
+	srv, _ := RunServerWithConfig(conf)
+	defer srv.Shutdown()
+	updateJwt(t, srv.ClientURL(), sysCreds, syspub, sysjwt, 1) // update system account jwt
+	updateJwt(t, srv.ClientURL(), sysCreds, apub, ajwt1, 1)    // set account jwt without revocation
+	// use credentials that will be revoked ans assure that the connection will be disconnected
+	nc := natsConnect(t, srv.ClientURL(), nats.UserCredentials(aCreds1),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			if lErr := conn.LastError(); lErr != nil && strings.Contains(lErr.Error(), "Authentication Revoked") {
+				doneChan <- struct{}{}
+			}
+		}))
+	defer nc.Close()
+	// update account jwt to contain revocation
+	if passCnt := updateJwt(t, srv.ClientURL(), sysCreds, apub, ajwt2, 1); passCnt != 1 {
+		t.Fatalf("Expected jwt update to pass")
+	}
+	// assure that nc got disconnected due to the revocation
+	select {
+	case <-doneChan:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected connection to have failed")
+	}
+	// try again with old credentials. Expected to fail
+	if nc1, err := nats.Connect(srv.ClientURL(), nats.UserCredentials(aCreds1)); err == nil {
+		nc1.Close()
+		t.Fatalf("Expected revoked credentials to fail")
+	}
+	// Assure new creds pass
+	nc2 := natsConnect(t, srv.ClientURL(), nats.UserCredentials(aCreds2))
+	defer nc2.Close()
+}
+
+func TestJWTAuthFailureErrors(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+
+	newUser := func(f func(*jwt.UserClaims)) (string, nkeys.KeyPair) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		if f != nil {
+			f(uc)
+		}
+		ujwt, err := uc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return ujwt, ukp
+	}
+	expiredJWT, expiredKp := newUser(func(uc *jwt.UserClaims) {
+		uc.IssuedAt = time.Now().Add(-time.Hour).Unix()
+		uc.Expires = time.Now().Add(-time.Minute).Unix()
+	})
+	srcJWT, srcKp := newUser(func(uc *jwt.UserClaims) { uc.Src.Set("192.0.2.1/32") })
+	revokedJWT, revokedKp := newUser(nil)
+	revokedPub, _ := revokedKp.PublicKey()
+
+	ac := jwt.NewAccountClaims(apub)
+	ac.Revoke(revokedPub)
+	ajwt, err := ac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		name string
+		jwt  string
+		kp   nkeys.KeyPair
+		err  error
+	}{
+		{"expired", expiredJWT, expiredKp, ErrJWTExpired},
+		{"revoked", revokedJWT, revokedKp, ErrJWTRevoked},
+		{"src", srcJWT, srcKp, ErrJWTUserPermissions},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ujwt, ukp := test.jwt, test.kp
+			nc, err := nats.Connect(s.ClientURL(), nats.UserJWT(
+				func() (string, error) { return ujwt, nil },
+				func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }))
+			if err == nil {
+				nc.Close()
+				t.Fatalf("Expected connection to fail")
+			}
+			// The wire error is unchanged.
+			if !strings.Contains(err.Error(), "Authorization") {
+				t.Fatalf("Expected authorization error, got %v", err)
+			}
+			checkFor(t, time.Second, 15*time.Millisecond, func() error {
+				for _, cc := range s.closedClients() {
+					if cc.AuthError == test.err.Error() && cc.Reason == AuthenticationViolation.String() {
+						return nil
+					}
+				}
+				return fmt.Errorf("No closed connection with auth error %q", test.err)
+			})
+		})
+	}
+
+	for _, test := range []struct {
+		reason ClosedState
+		err    error
+	}{
+		{AuthenticationExpired, ErrJWTExpired},
+		{AccountAuthenticationExpired, ErrJWTAccountExpired},
+		{Revocation, ErrJWTRevoked},
+		{MaxSubscriptionsExceeded, ErrTooManySubs},
+		{MaxUserConnectionsExceeded, ErrTooManyUserConnections},
+		{ClientClosed, nil},
+	} {
+		if err := test.reason.Err(); err != test.err {
+			t.Fatalf("Expected %v for %q, got %v", test.err, test.reason, err)
+		}
+	}
+}
+
+func TestJWTAccountDefaultPermissions(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.DefaultPermissions.Pub.Allow.Add("foo")
+	ac.DefaultPermissions.Sub.Allow.Add("foo")
+	ajwt, err := ac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(perms *jwt.Permissions) (*nats.Conn, chan error) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		if perms != nil {
+			uc.Permissions = *perms
+		}
+		ujwt, err := uc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		errCh := make(chan error, 10)
+		nc := natsConnect(t, s.ClientURL(), nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }),
+			nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+		return nc, errCh
+	}
+	expectViolation := func(errCh chan error, subj string) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), fmt.Sprintf("Subscription to %q", subj)) {
+				t.Fatalf("Expected permissions violation on %q, got %v", subj, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected permissions violation on %q", subj)
+		}
+	}
+	expectNoViolation := func(errCh chan error) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			t.Fatalf("Unexpected error: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// User without permissions inherits the account defaults.
+	nc, errCh := connect(nil)
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+	expectNoViolation(errCh)
+	natsSubSync(t, nc, "bar")
+	natsFlush(t, nc)
+	expectViolation(errCh, "bar")
+
+	// User with explicit permissions does not get the defaults.
+	up := &jwt.Permissions{}
+	up.Pub.Allow.Add("bar")
+	up.Sub.Allow.Add("bar")
+	nc2, errCh2 := connect(up)
+	defer nc2.Close()
+	natsSubSync(t, nc2, "bar")
+	natsFlush(t, nc2)
+	expectNoViolation(errCh2)
+	natsSubSync(t, nc2, "foo")
+	natsFlush(t, nc2)
+	expectViolation(errCh2, "foo")
+}
+
+func TestJWTAccountUpdateSkipsUnchangedUserPermissions(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.DefaultPermissions.Sub.Allow.Add("foo")
+	ajwt, err := ac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(perms *jwt.Permissions) (*nats.Conn, string) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		if perms != nil {
+			uc.Permissions = *perms
+		}
+		ujwt, err := uc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		nc := natsConnect(t, s.ClientURL(), nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }))
+		return nc, upub
+	}
+	// One user inherits the account defaults, the other has its own.
+	ncDef, defPub := connect(nil)
+	defer ncDef.Close()
+	up := &jwt.Permissions{}
+	up.Sub.Allow.Add("bar")
+	ncOwn, ownPub := connect(up)
+	defer ncOwn.Close()
+
+	acc, _ := s.LookupAccount(apub)
+	permsBuilds := func() map[string]int {
+		t.Helper()
+		acc.mu.RLock()
+		clients := make([]*client, 0, len(acc.clients))
+		for c := range acc.clients {
+			clients = append(clients, c)
+		}
+		acc.mu.RUnlock()
+		builds := make(map[string]int)
+		for _, c := range clients {
+			c.mu.Lock()
+			builds[c.pubKey] = c.permsBuild
+			c.mu.Unlock()
+		}
+		return builds
+	}
+	before := permsBuilds()
+	if before[defPub] != 1 || before[ownPub] != 1 {
+		t.Fatalf("Expected permissions to be built once, got %v", before)
+	}
+
+	// An update unrelated to permissions does not rebuild them.
+	ac.Limits.Subs = 100
+	s.UpdateAccountClaims(acc, ac)
+	if after := permsBuilds(); !reflect.DeepEqual(after, before) {
+		t.Fatalf("Expected permissions not to be rebuilt, got %v", after)
+	}
+
+	// Changing the defaults only rebuilds the user that inherits them.
+	ac.DefaultPermissions.Sub.Allow.Add("baz")
+	s.UpdateAccountClaims(acc, ac)
+	after := permsBuilds()
+	if after[defPub] != 2 || after[ownPub] != 1 {
+		t.Fatalf("Expected only the default permissions user to be rebuilt, got %v", after)
+	}
+	errCh := make(chan error, 1)
+	ncDef.SetErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err })
+	natsSubSync(t, ncDef, "baz")
+	natsFlush(t, ncDef)
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestJWTAccountPendingImports(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	expjwt, err := expac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: "foo", To: "bar", Type: jwt.Stream})
+	impjwt, err := impac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, imppub, impjwt)
+
+	// The exporter is not known yet, so the import is pending.
+	acc, err := s.LookupAccount(imppub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	pending := acc.PendingImports()
+	expected := []PendingImport{{Account: exppub, Subject: "foo", To: "bar", Type: jwt.Stream}}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Fatalf("Expected pending imports %+v, got %+v", expected, pending)
+	}
+	if n := len(acc.imports.streams); n != 0 {
+		t.Fatalf("Expected no stream imports, got %d", n)
+	}
+
+	// Once the exporter is loaded the import is resolved.
+	addAccountToMemResolver(s, exppub, expjwt)
+	if _, err := s.LookupAccount(exppub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if pending := acc.PendingImports(); len(pending) != 0 {
+		t.Fatalf("Expected no pending imports, got %+v", pending)
+	}
+	acc.mu.RLock()
+	n := len(acc.imports.streams)
+	acc.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("Expected 1 stream import, got %d", n)
+	}
+}
+
+func TestJWTAccountRequiredImports(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	expac.Exports.Add(&jwt.Export{Subject: "req", Type: jwt.Service})
+	expjwt, err := expac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	// The stream import is optional, the service import is required.
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: "foo", Type: jwt.Stream})
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: "req", Type: jwt.Service})
+	impjwt := encodeClaimsWithExt(t, impac, oKp, map[string]interface{}{
+		"required_imports": map[string][]string{exppub: {"req"}},
+	})
+	addAccountToMemResolver(s, imppub, impjwt)
+
+	acc, err := s.LookupAccount(imppub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	expected := []PendingImport{
+		{Account: exppub, Subject: "foo", Type: jwt.Stream},
+		{Account: exppub, Subject: "req", Type: jwt.Service, Required: true},
+	}
+	if pending := acc.PendingImports(); !reflect.DeepEqual(pending, expected) {
+		t.Fatalf("Expected pending imports %+v, got %+v", expected, pending)
+	}
+
+	// Connections are rejected while the required import is unresolved.
+	c, cr, cs := createClient(t, s, impkp)
+	defer c.close()
+	c.parseAsync(cs)
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got: %q", l)
+	}
+
+	// Once the exporter is loaded the import resolves and connections are accepted.
+	addAccountToMemResolver(s, exppub, expjwt)
+	if _, err := s.LookupAccount(exppub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if pending := acc.PendingImports(); len(pending) != 0 {
+		t.Fatalf("Expected no pending imports, got %+v", pending)
+	}
+	c, cr, cs = createClient(t, s, impkp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+}
+
+func TestJWTAccountUpdateMinInterval(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		interval string
+		err      error
+		msubs    int32
+	}{
+		// The account was just loaded, so both updates are too soon.
+		{"default", "", ErrAccountResolverUpdateTooSoon, -1},
+		{"disabled", `account_update_min_interval: "-1s"`, nil, 20},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			ac := jwt.NewAccountClaims(apub)
+			ajwt, err := ac.Encode(oKp)
+			if err != nil {
+				t.Fatalf("Error generating account JWT: %v", err)
+			}
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: -1
+				operator: %s
+				resolver: MEM
+				resolver_preload: {
+					%s: %s
+				}
+				%s
+			`, ojwt, apub, ajwt, test.interval)))
+			defer os.Remove(conf)
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			acc, err := s.LookupAccount(apub)
+			if err != nil {
+				t.Fatalf("Error looking up account: %v", err)
+			}
+			// Push two updates in quick succession.
+			for i := 1; i <= 2; i++ {
+				ac.Limits.Subs = int64(i * 10)
+				ajwt, err := ac.Encode(oKp)
+				if err != nil {
+					t.Fatalf("Error generating account JWT: %v", err)
+				}
+				addAccountToMemResolver(s, apub, ajwt)
+				if err := s.updateAccount(acc); err != test.err {
+					t.Fatalf("Expected error %v on update %d, got %v", test.err, i, err)
+				}
+			}
+			acc.mu.RLock()
+			msubs := acc.msubs
+			acc.mu.RUnlock()
+			if msubs != test.msubs {
+				t.Fatalf("Expected max subs of %d, got %d", test.msubs, msubs)
+			}
+		})
+	}
+}
+
+func TestJWTAccountServiceExportAllowedAccounts(t *testing.T) {
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	// Both accounts can import, but only account A may send requests.
+	expjwt := encodeClaimsWithExt(t, expac, oKp, map[string]interface{}{
+		"service_allowed_accounts": map[string][]string{"svc": {apub}},
+	})
+	importer := func(pub string) string {
+		ac := jwt.NewAccountClaims(pub)
+		ac.Imports.Add(&jwt.Import{Account: exppub, Subject: "svc", Type: jwt.Service})
+		ajwt, err := ac.Encode(oKp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		return ajwt
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+			%s: %s
+		}
+	`, ojwt, exppub, expjwt, apub, importer(apub), bpub, importer(bpub))))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncExp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncExp.Close()
+	received := int32(0)
+	natsSub(t, ncExp, "svc", func(m *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+		m.Respond([]byte("ok"))
+	})
+	natsFlush(t, ncExp)
+
+	ncA := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp))
+	defer ncA.Close()
+	if _, err := ncA.Request("svc", nil, time.Second); err != nil {
+		t.Fatalf("Expected response for allowed account, got %v", err)
+	}
+
+	ncB := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, bkp))
+	defer ncB.Close()
+	if _, err := ncB.Request("svc", nil, 250*time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected request from blocked account to time out, got %v", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Fatalf("Expected service to receive 1 request, got %d", n)
+	}
+
+	// Removing the restriction lets account B through.
+	expacc, _ := s.LookupAccount(exppub)
+	if err := expacc.SetServiceExportAllowedAccounts("svc", nil); err != nil {
+		t.Fatalf("Error removing allowed accounts: %v", err)
+	}
+	if _, err := ncB.Request("svc", nil, time.Second); err != nil {
+		t.Fatalf("Expected response once unrestricted, got %v", err)
+	}
+	if err := expacc.SetServiceExportAllowedAccounts("missing", []string{apub}); err != ErrMissingService {
+		t.Fatalf("Expected %v, got %v", ErrMissingService, err)
+	}
+}
+
+func TestJWTAccountServiceExportAllowedHeaders(t *testing.T) {
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	expjwt := encodeClaimsWithExt(t, expac, oKp, map[string]interface{}{
+		"service_allowed_headers": map[string][]string{"svc": {"x-allowed"}},
+	})
+	ac := jwt.NewAccountClaims(apub)
+	ac.Imports.Add(&jwt.Import{Account: exppub, Subject: "svc", Type: jwt.Service})
+	ajwt, err := ac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+		}
+	`, ojwt, exppub, expjwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncExp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncExp.Close()
+	sub := natsSubSync(t, ncExp, "svc")
+	natsFlush(t, ncExp)
+
+	ncA := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp))
+	defer ncA.Close()
+	send := func() *nats.Msg {
+		t.Helper()
+		m := nats.NewMsg("svc")
+		m.Header.Set("X-Allowed", "yes")
+		m.Header.Set("X-Injected", "no")
+		m.Data = []byte("payload")
+		if err := ncA.PublishMsg(m); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+		return natsNexMsg(t, sub, time.Second)
+	}
+
+	m := send()
+	if v := m.Header.Get("X-Allowed"); v != "yes" {
+		t.Fatalf("Expected allowed header to pass, got %q", v)
+	}
+	if v := m.Header.Get("X-Injected"); v != _EMPTY_ {
+		t.Fatalf("Expected disallowed header to be stripped, got %q", v)
+	}
+	if string(m.Data) != "payload" {
+		t.Fatalf("Unexpected payload %q", m.Data)
+	}
+
+	// An empty list strips all headers.
+	expacc, _ := s.LookupAccount(exppub)
+	if err := expacc.SetServiceExportAllowedHeaders("svc", []string{}); err != nil {
+		t.Fatalf("Error setting allowed headers: %v", err)
+	}
+	if m = send(); len(m.Header) != 0 || string(m.Data) != "payload" {
+		t.Fatalf("Expected headers to be stripped, got %v with payload %q", m.Header, m.Data)
+	}
+
+	// Removing the restriction passes all headers.
+	if err := expacc.SetServiceExportAllowedHeaders("svc", nil); err != nil {
+		t.Fatalf("Error removing allowed headers: %v", err)
+	}
+	if m = send(); m.Header.Get("X-Allowed") != "yes" || m.Header.Get("X-Injected") != "no" {
+		t.Fatalf("Expected all headers to pass, got %v", m.Header)
+	}
+	if err := expacc.SetServiceExportAllowedHeaders("missing", nil); err != ErrMissingService {
+		t.Fatalf("Expected %v, got %v", ErrMissingService, err)
+	}
+}
+
+func TestJWTAccountValidationLogsSigningKey(t *testing.T) {
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	skp, _ := nkeys.CreateOperator()
+	spub, _ := skp.PublicKey()
+	oc := jwt.NewOperatorClaims(opub)
+	oc.SigningKeys.Add(spub)
+	opJWT, err := oc.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating operator JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+	`, opJWT)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	l := &captureDebugLogger{dbgCh: make(chan string, 100)}
+	s.SetLogger(l, true, false)
+
+	for _, test := range []struct {
+		name   string
+		signer nkeys.KeyPair
+		line   string
+	}{
+		{"operator", okp, fmt.Sprintf("validated by operator key %q", opub)},
+		{"signing key", skp, fmt.Sprintf("validated by operator signing key %q", spub)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			ajwt, err := jwt.NewAccountClaims(apub).Encode(test.signer)
+			if err != nil {
+				t.Fatalf("Error generating account JWT: %v", err)
+			}
+			s.AccountResolver().Store(apub, ajwt)
+			if _, err := s.LookupAccount(apub); err != nil {
+				t.Fatalf("Error looking up account: %v", err)
+			}
+			expected := fmt.Sprintf("Account %q %s", apub, test.line)
+			for {
+				select {
+				case line := <-l.dbgCh:
+					if line == expected {
+						return
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected debug line %q", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTAccountImportSameExportMultiplePrefixes(t *testing.T) {
+	expkp, _ := nkeys.CreateAccount()
+	exppub, _ := expkp.PublicKey()
+	expac := jwt.NewAccountClaims(exppub)
+	expac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	expjwt, err := expac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	impkp, _ := nkeys.CreateAccount()
+	imppub, _ := impkp.PublicKey()
+	impac := jwt.NewAccountClaims(imppub)
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: "foo", To: "a", Type: jwt.Stream})
+	impac.Imports.Add(&jwt.Import{Account: exppub, Subject: "foo", To: "b", Type: jwt.Stream})
+	impjwt, err := impac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+		}
+	`, ojwt, exppub, expjwt, imppub, impjwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncImp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, impkp))
+	defer ncImp.Close()
+	subA := natsSubSync(t, ncImp, "a.foo")
+	subB := natsSubSync(t, ncImp, "b.foo")
+	natsSubSync(t, ncImp, ">")
+	natsFlush(t, ncImp)
+
+	// The wildcard subscription gets a shadow for each import.
+	cid, err := ncImp.GetClientID()
+	if err != nil {
+		t.Fatalf("Error getting client id: %v", err)
+	}
+	c := s.getClient(cid)
+	if c == nil {
+		t.Fatal("Could not find client")
+	}
+	c.mu.Lock()
+	n := len(c.subs["3"].shadow)
+	c.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("Expected 2 shadow subscriptions, got %d", n)
+	}
+
+	ncExp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, expkp))
+	defer ncExp.Close()
+	natsPub(t, ncExp, "foo", []byte("hello"))
+	natsFlush(t, ncExp)
+	for _, sub := range []*nats.Subscription{subA, subB} {
+		if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != "hello" {
+			t.Fatalf("Unexpected message on %q: %q", msg.Subject, msg.Data)
+		}
+	}
+}
+
+func TestJWTRequireJetStreamLimits(t *testing.T) {
+	newAccount := func(f func(*jwt.AccountClaims) string) (string, string) {
+		t.Helper()
+		akp, _ := nkeys.CreateAccount()
+		apub, _ := akp.PublicKey()
+		return apub, f(jwt.NewAccountClaims(apub))
+	}
+	encode := func(ac *jwt.AccountClaims) string {
+		ajwt, err := ac.Encode(oKp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		return ajwt
+	}
+	noLimitsPub, noLimitsJWT := newAccount(func(ac *jwt.AccountClaims) string {
+		ac.Limits.JetStreamLimits = jwt.JetStreamLimits{}
+		return encode(ac)
+	})
+	limitsPub, limitsJWT := newAccount(func(ac *jwt.AccountClaims) string {
+		ac.Limits.JetStreamLimits = jwt.JetStreamLimits{DiskStorage: 1024}
+		return encode(ac)
+	})
+	// Zero limits are omitted by the jwt library, so set them explicitly.
+	zeroLimitsPub, zeroLimitsJWT := newAccount(func(ac *jwt.AccountClaims) string {
+		return encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{
+			"limits": map[string]interface{}{
+				"subs": -1, "data": -1, "payload": -1, "imports": -1, "exports": -1,
+				"wildcards": true, "conn": -1, "leaf": -1, "mem_storage": 0, "disk_storage": 0,
+			},
+		})
+	})
+
+	for _, test := range []struct {
+		name   string
+		strict bool
+	}{
+		{"default", false},
+		{"strict", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := opTrustBasicSetup()
+			defer s.Shutdown()
+			buildMemAccResolver(s)
+			s.optsMu.Lock()
+			s.opts.RequireJetStreamLimits = test.strict
+			s.optsMu.Unlock()
+
+			for _, acc := range []struct {
+				pub, jwt string
+			}{{noLimitsPub, noLimitsJWT}, {limitsPub, limitsJWT}, {zeroLimitsPub, zeroLimitsJWT}} {
+				addAccountToMemResolver(s, acc.pub, acc.jwt)
+			}
+			for _, pub := range []string{limitsPub, zeroLimitsPub} {
+				if _, err := s.LookupAccount(pub); err != nil {
+					t.Fatalf("Expected account with JetStream limits to load, got %v", err)
+				}
+			}
+			_, err := s.LookupAccount(noLimitsPub)
+			if test.strict && err != ErrAccountJetStreamLimitsRequired {
+				t.Fatalf("Expected error %v, got %v", ErrAccountJetStreamLimitsRequired, err)
+			} else if !test.strict && err != nil {
+				t.Fatalf("Expected account without JetStream limits to load, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTJetStreamLimitsAccessor(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	sysPub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(sysPub).Encode(oKp)
+	require_NoError(t, err)
+
+	limits := jwt.JetStreamLimits{MemoryStorage: 1024 * 1024, DiskStorage: 2048 * 1024, Streams: 1, Consumer: 2}
+	akp, _ := nkeys.CreateAccount()
+	aPub, _ := akp.PublicKey()
+	claim := jwt.NewAccountClaims(aPub)
+	claim.Limits.JetStreamLimits = limits
+	aJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+
+	// Exceeds the server's max_file_store, so JetStream can't be enabled.
+	bkp, _ := nkeys.CreateAccount()
+	bPub, _ := bkp.PublicKey()
+	claim = jwt.NewAccountClaims(bPub)
+	claim.Limits.JetStreamLimits = jwt.JetStreamLimits{MemoryStorage: 1024, DiskStorage: 16384 * 1024, Streams: 1, Consumer: 1}
+	bJwt, err := claim.Encode(oKp)
+	require_NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "srv")
+	require_NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		jetstream: {max_mem_store: 10Mb, max_file_store: 10Mb, store_dir: %q}
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+			%s: %s
+		}
+		system_account: %s
+	`, dir, ojwt, sysPub, sysJwt, aPub, aJwt, bPub, bJwt, sysPub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp))
+	defer nc.Close()
+	var info JSApiAccountInfoResponse
+	resp, err := nc.Request("$JS.API.INFO", nil, time.Second)
+	require_NoError(t, err)
+	require_NoError(t, json.Unmarshal(resp.Data, &info))
+
+	acc, err := s.LookupAccount(aPub)
+	require_NoError(t, err)
+	lim, enabled := acc.JetStreamLimits()
+	if !enabled {
+		t.Fatal("Expected JetStream to be enabled")
+	}
+	if lim != info.Limits {
+		t.Fatalf("Expected limits %+v to match info %+v", lim, info.Limits)
+	}
+
+	acc, err = s.LookupAccount(bPub)
+	require_NoError(t, err)
+	if lim, enabled := acc.JetStreamLimits(); enabled {
+		t.Fatalf("Expected JetStream to be disabled, got limits %+v", lim)
+	}
+	ncb := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, bkp))
+	defer ncb.Close()
+	if _, err := ncb.Request("$JS.API.INFO", nil, 250*time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected JetStream to be unavailable, got %v", err)
+	}
+}
+
+func TestJWTUserCredentialRevocation(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ajwt, err := ac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	encodeUser := func() (string, int64) {
+		t.Helper()
+		uc := jwt.NewUserClaims(upub)
+		ujwt, err := uc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return ujwt, uc.IssuedAt
+	}
+	connect := func(ujwt string, opts ...nats.Option) (*nats.Conn, error) {
+		opts = append(opts, nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }))
+		return nats.Connect(s.ClientURL(), opts...)
+	}
+	v1, v1IssuedAt := encodeUser()
+	// Issued at times have a resolution of a second.
+	time.Sleep(1100 * time.Millisecond)
+	v2, _ := encodeUser()
+
+	closed := make(chan struct{}, 1)
+	nc1, err := connect(v1, nats.NoReconnect(), nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+	if err != nil {
+		t.Fatalf("Error connecting with v1: %v", err)
+	}
+	defer nc1.Close()
+	nc2, err := connect(v2, nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("Error connecting with v2: %v", err)
+	}
+	defer nc2.Close()
+
+	// Revoke only the first credential.
+	ajwt = encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{
+		"revoked_credentials": map[string][]int64{upub: {v1IssuedAt}},
+	})
+	acc, _ := s.LookupAccount(apub)
+	if err := s.updateAccountWithClaimJWT(acc, ajwt); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected connection using the revoked credential to be closed")
+	}
+	natsFlush(t, nc2)
+
+	if nc, err := connect(v1); err == nil {
+		nc.Close()
+		t.Fatal("Expected revoked credential to be rejected")
+	}
+	nc, err := connect(v2)
+	if err != nil {
+		t.Fatalf("Expected newer credential to connect, got %v", err)
+	}
+	nc.Close()
+}
+
+func TestAccountNATSResolverSyncStatus(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+
+	dirA, err := ioutil.TempDir("", "srv-a")
+	require_NoError(t, err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "srv-b")
+	require_NoError(t, err)
+	defer os.RemoveAll(dirB)
+	// Only server A knows about account A, server B gets it through syncing.
+	writeJWT(t, dirA, apub, ajwt)
+	writeJWT(t, dirA, syspub, sysjwt)
+	writeJWT(t, dirB, syspub, sysjwt)
+
+	tmpl := `
+		listen: -1
+		server_name: %s
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "200ms"
 		}
-		var err error
-		*jwt1, err = claim.Encode(oKp)
-		require_NoError(t, err)
-		// need to assure that create time differs (resolution is sec)
-		time.Sleep(time.Millisecond * 1100)
-		// create updated claim allowing more connections
-		if limit {
-			claim.Limits.Conn = 2
+		cluster {
+			name: clust
+			listen: -1
+			%s
 		}
-		*jwt2, err = claim.Encode(oKp)
-		require_NoError(t, err)
+	`
+	confA := createConfFile(t, []byte(fmt.Sprintf(tmpl, "srv-A", ojwt, syspub, dirA, "")))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+	confB := createConfFile(t, []byte(fmt.Sprintf(tmpl, "srv-B", ojwt, syspub, dirB,
+		fmt.Sprintf("routes: [nats-route://127.0.0.1:%d]", sA.ClusterAddr().Port))))
+	defer os.Remove(confB)
+	sB, _ := RunServerWithConfig(confB)
+	defer sB.Shutdown()
+	checkClusterFormed(t, sA, sB)
+
+	nc := natsConnect(t, sA.ClientURL(), createUserCreds(t, nil, syskp))
+	defer nc.Close()
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		reply := nats.NewInbox()
+		sub := natsSubSync(t, nc, reply)
+		defer sub.Unsubscribe()
+		if err := nc.PublishRequest(fmt.Sprintf(serverPingReqSubj, "RESOLVER"), reply, nil); err != nil {
+			return err
+		}
+		statuses := map[string]*ResolverStatus{}
+		for i := 0; i < 2; i++ {
+			msg, err := sub.NextMsg(time.Second)
+			if err != nil {
+				return err
+			}
+			var resp struct {
+				Server ServerInfo      `json:"server"`
+				Data   *ResolverStatus `json:"data"`
+			}
+			if err := json.Unmarshal(msg.Data, &resp); err != nil {
+				return err
+			}
+			statuses[resp.Server.Name] = resp.Data
+		}
+		for _, name := range []string{"srv-A", "srv-B"} {
+			st := statuses[name]
+			if st == nil {
+				return fmt.Errorf("No resolver status from %s", name)
+			}
+			if st.Type != "FULL" {
+				return fmt.Errorf("Expected FULL resolver for %s, got %q", name, st.Type)
+			}
+			if st.JWTs != 2 {
+				return fmt.Errorf("Expected 2 jwts for %s, got %d", name, st.JWTs)
+			}
+			if st.LastSync.IsZero() {
+				return fmt.Errorf("Expected %s to have synced", name)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRecordingResolver(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	rr := newRecordingResolver(&MemAccResolver{})
+	s.SetAccountResolver(rr)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	start := time.Now()
+	// The account is not stored yet, so the lookup fails after a fetch.
+	if _, err := s.LookupAccount(apub); err == nil {
+		t.Fatalf("Expected lookup to fail")
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+
+	expected := []string{"fetch:" + apub, "store:" + apub}
+	if ops := rr.Ops(); !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, ops)
+	}
+	calls := rr.Calls()
+	if calls[0].Time.Before(start) || calls[1].Time.Before(calls[0].Time) {
+		t.Fatalf("Expected call times to be ordered, got %+v", calls)
+	}
+	// The stored JWT is available from the wrapped resolver.
+	if j, err := rr.Fetch(apub); err != nil || j != ajwt {
+		t.Fatalf("Expected stored JWT, got %q, %v", j, err)
+	}
+
+	rr.Reset()
+	if calls := rr.Calls(); len(calls) != 0 {
+		t.Fatalf("Expected no calls after reset, got %+v", calls)
+	}
+}
+
+func TestJWTAddUserFromCreds(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+
+	readCreds := func(ujwt string, seed []byte) []byte {
+		t.Helper()
+		credsFile := genCredsFile(t, ujwt, seed)
+		defer os.Remove(credsFile)
+		creds, err := ioutil.ReadFile(credsFile)
+		if err != nil {
+			t.Fatalf("Error reading creds file: %v", err)
+		}
+		return creds
+	}
+	newUser := func(akp nkeys.KeyPair) (string, []byte) {
+		t.Helper()
 		ukp, _ := nkeys.CreateUser()
-		seed, _ := ukp.Seed()
 		upub, _ := ukp.PublicKey()
-		uclaim := newJWTTestUserClaims()
-		uclaim.Subject = upub
-		ujwt, err := uclaim.Encode(kp)
-		require_NoError(t, err)
-		*creds = genCredsFile(t, ujwt, seed)
-		done <- struct{}{}
+		seed, _ := ukp.Seed()
+		ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		return ujwt, seed
 	}
-	// Create Accounts and corresponding user creds. Do so concurrently to speed up the test
-	doneChan := make(chan struct{}, 5)
-	defer close(doneChan)
-	var syspub, sysjwt, dummy1, sysCreds string
-	go createAccountAndUser(false, doneChan, &syspub, &sysjwt, &dummy1, &sysCreds)
-	var apub, ajwt1, ajwt2, aCreds string
-	go createAccountAndUser(true, doneChan, &apub, &ajwt1, &ajwt2, &aCreds)
-	var bpub, bjwt1, bjwt2, bCreds string
-	go createAccountAndUser(true, doneChan, &bpub, &bjwt1, &bjwt2, &bCreds)
-	var cpub, cjwt1, cjwt2, cCreds string
-	go createAccountAndUser(true, doneChan, &cpub, &cjwt1, &cjwt2, &cCreds)
-	var dpub, djwt1, dummy2, dCreds string // extra user used later in the test in order to test limits
-	go createAccountAndUser(true, doneChan, &dpub, &djwt1, &dummy2, &dCreds)
-	for i := 0; i < cap(doneChan); i++ {
-		<-doneChan
+
+	if _, ok := s.accounts.Load(apub); ok {
+		t.Fatalf("Expected account not to be loaded yet")
 	}
-	defer os.Remove(sysCreds)
-	defer os.Remove(aCreds)
-	defer os.Remove(bCreds)
-	defer os.Remove(cCreds)
-	defer os.Remove(dCreds)
-	// Create one directory for each server
-	dirA := createDir(t, "srv-a")
-	defer os.RemoveAll(dirA)
-	dirB := createDir(t, "srv-b")
-	defer os.RemoveAll(dirB)
-	dirC := createDir(t, "srv-c")
-	defer os.RemoveAll(dirC)
-	// simulate a restart of the server by storing files in them
-	// Server A/B will completely sync, so after startup each server
-	// will contain the union off all stored/configured jwt
-	// Server C will send out lookup requests for jwt it does not store itself
-	writeJWT(t, dirA, apub, ajwt1)
-	writeJWT(t, dirB, bpub, bjwt1)
-	writeJWT(t, dirC, cpub, cjwt1)
-	// Create seed server A (using no_advertise to prevent fail over)
-	confA := createConfFile(t, []byte(fmt.Sprintf(`
+	ujwt, seed := newUser(akp)
+	if err := s.AddUserFromCreds(readCreds(ujwt, seed)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := s.accounts.Load(apub); !ok {
+		t.Fatalf("Expected account to be loaded")
+	}
+
+	// A seed that does not belong to the user is rejected.
+	_, otherSeed := newUser(akp)
+	if err := s.AddUserFromCreds(readCreds(ujwt, otherSeed)); err == nil {
+		t.Fatalf("Expected error for mismatched seed")
+	}
+
+	// As are users of accounts that can not be resolved.
+	unknownKP, _ := nkeys.CreateAccount()
+	ujwt, seed = newUser(unknownKP)
+	if err := s.AddUserFromCreds(readCreds(ujwt, seed)); err == nil {
+		t.Fatalf("Expected error for unknown account")
+	}
+}
+
+func TestJWTAccountExportAdvertise(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	expKP, _ := nkeys.CreateAccount()
+	expPub, _ := expKP.PublicKey()
+	impKP, _ := nkeys.CreateAccount()
+	impPub, _ := impKP.PublicKey()
+
+	expAC := jwt.NewAccountClaims(expPub)
+	expAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	expAC.Exports.Add(&jwt.Export{Subject: "bar", Type: jwt.Stream})
+	// "foo" is not advertised, "bar" is by default.
+	expJWT := encodeClaimsWithExt(t, expAC, oKp, map[string]interface{}{
+		"exports": []map[string]interface{}{
+			{"subject": "foo", "type": "stream", "advertise": false},
+			{"subject": "bar", "type": "stream"},
+		},
+	})
+	addAccountToMemResolver(s, expPub, expJWT)
+
+	impAC := jwt.NewAccountClaims(impPub)
+	impAC.Imports.Add(&jwt.Import{Account: expPub, Subject: "foo", Type: jwt.Stream})
+	impJWT, err := impAC.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, impPub, impJWT)
+
+	// The hidden export can still be imported.
+	impAcc, err := s.LookupAccount(impPub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	impAcc.mu.RLock()
+	streams := impAcc.imports.streams
+	impAcc.mu.RUnlock()
+	if len(streams) != 1 || streams[0].invalid {
+		t.Fatalf("Expected a valid stream import, got %+v", streams)
+	}
+	c, cr, cs := createClient(t, s, impKP)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	// But it is not listed.
+	info, err := s.accountInfo(expPub)
+	if err != nil {
+		t.Fatalf("Error getting account info: %v", err)
+	}
+	if len(info.Exports) != 1 || info.Exports[0].Subject != "bar" {
+		t.Fatalf("Expected only the %q export, got %+v", "bar", info.Exports)
+	}
+
+	expAcc, _ := s.LookupAccount(expPub)
+	if err := expAcc.SetExportAdvertised("baz", false); err != ErrMissingExport {
+		t.Fatalf("Expected error %v, got %v", ErrMissingExport, err)
+	}
+	if err := expAcc.SetExportAdvertised("foo", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info, _ := s.accountInfo(expPub); len(info.Exports) != 2 {
+		t.Fatalf("Expected 2 exports, got %+v", info.Exports)
+	}
+}
+
+func TestJWTAccountInfoNameAndTags(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.Name = "billing"
+	nac.Tags.Add("team:payments", "env:prod")
+	ajwt, err := nac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	info, err := s.accountInfo(apub)
+	if err != nil {
+		t.Fatalf("Error getting account info: %v", err)
+	}
+	if info.NameTag != "billing" {
+		t.Fatalf("Expected name tag %q, got %q", "billing", info.NameTag)
+	}
+	if len(info.Tags) != 2 || !info.Tags.Contains("team:payments") || !info.Tags.Contains("env:prod") {
+		t.Fatalf("Unexpected tags: %v", info.Tags)
+	}
+
+	// Tags follow claim updates.
+	nac = jwt.NewAccountClaims(apub)
+	nac.Tags.Add("team:ledger")
+	s.UpdateAccountClaims(acc, nac)
+	info, err = s.accountInfo(apub)
+	if err != nil {
+		t.Fatalf("Error getting account info: %v", err)
+	}
+	if info.NameTag != "" || len(info.Tags) != 1 || !info.Tags.Contains("team:ledger") {
+		t.Fatalf("Unexpected name tag %q and tags %v", info.NameTag, info.Tags)
+	}
+}
+
+func TestAccountURLResolverMaxFetches(t *testing.T) {
+	const maxFetches = 2
+	var inflight, maxInflight int32
+	accounts := map[string]string{}
+	for i := 0; i < 10; i++ {
+		akp, _ := nkeys.CreateAccount()
+		apub, _ := akp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		accounts[apub] = ajwt
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server startup
+			w.Write(nil)
+			return
+		}
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(accounts[strings.TrimPrefix(r.URL.Path, "/A/")]))
+	}))
+	defer ts.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: URL("%s/A/")
+		max_resolver_fetches: %d
+    `, ojwt, ts.URL, maxFetches)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(accounts))
+	for apub := range accounts {
+		wg.Add(1)
+		go func(apub string) {
+			defer wg.Done()
+			if _, err := s.LookupAccount(apub); err != nil {
+				errCh <- err
+			}
+		}(apub)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if n := atomic.LoadInt32(&maxInflight); n == 0 || n > maxFetches {
+		t.Fatalf("Expected at most %d concurrent fetches, got %d", maxFetches, n)
+	}
+}
+
+func TestAccountURLResolverSharesConcurrentFetches(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/A/" {
+			// Server startup
+			w.Write(nil)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(250 * time.Millisecond)
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		server_name: srv-A
 		operator: %s
-		system_account: %s
-		resolver: {
-			type: full
-			dir: %s
-			interval: "200ms"
-			limit: 4
+		resolver: URL("%s/A/")
+    `, ojwt, ts.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	const lookups = 10
+	var wg sync.WaitGroup
+	accCh := make(chan *Account, lookups)
+	errCh := make(chan error, lookups)
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if acc, err := s.LookupAccount(apub); err != nil {
+				errCh <- err
+			} else {
+				accCh <- acc
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	close(accCh)
+	for err := range errCh {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	acc, _ := s.LookupAccount(apub)
+	for a := range accCh {
+		if a != acc {
+			t.Fatalf("Expected all lookups to return the same account")
 		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Expected a single fetch, got %d", n)
+	}
+}
+
+func TestJWTAccountServiceLatencyStream(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	sysPub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(sysPub).Encode(oKp)
+	require_NoError(t, err)
+
+	expKp, _ := nkeys.CreateAccount()
+	expPub, _ := expKp.PublicKey()
+	expAC := jwt.NewAccountClaims(expPub)
+	expAC.Limits.JetStreamLimits = jwt.JetStreamLimits{MemoryStorage: 1024 * 1024, DiskStorage: 1024 * 1024, Streams: 1, Consumer: 1}
+	expAC.Exports.Add(&jwt.Export{
+		Subject: "svc",
+		Type:    jwt.Service,
+		Latency: &jwt.ServiceLatency{Sampling: 100, Results: "latency.results"},
+	})
+	expJwt := encodeClaimsWithExt(t, expAC, oKp, map[string]interface{}{
+		"exports": []map[string]interface{}{
+			{
+				"subject":         "svc",
+				"type":            "service",
+				"service_latency": map[string]interface{}{"sampling": 100, "results": "latency.results"},
+				"latency_stream":  "LATENCY",
+			},
+		},
+	})
+
+	impKp, _ := nkeys.CreateAccount()
+	impPub, _ := impKp.PublicKey()
+	impAC := jwt.NewAccountClaims(impPub)
+	impAC.Imports.Add(&jwt.Import{Account: expPub, Subject: "svc", Type: jwt.Service})
+	impJwt, err := impAC.Encode(oKp)
+	require_NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "srv")
+	require_NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		jetstream: {max_mem_store: 10Mb, max_file_store: 10Mb, store_dir: %q}
+		operator: %s
+		resolver: MEM
 		resolver_preload: {
 			%s: %s
+			%s: %s
+			%s: %s
 		}
-		cluster {
-			name: clust
-			listen: -1
-			no_advertise: true
-		}
-    `, ojwt, syspub, dirA, cpub, cjwt1)))
-	defer os.Remove(confA)
-	sA, _ := RunServerWithConfig(confA)
-	defer sA.Shutdown()
-	// during startup resolver_preload causes the directory to contain data
-	require_JWTPresent(t, dirA, cpub)
-	// Create Server B (using no_advertise to prevent fail over)
-	confB := createConfFile(t, []byte(fmt.Sprintf(`
-		listen: -1
-		server_name: srv-B
-		operator: %s
 		system_account: %s
-		resolver: {
-			type: full
-			dir: %s
-			interval: "200ms"
-			limit: 4
-		}
-		cluster {
-			name: clust
-			listen: -1 
-			no_advertise: true
-			routes [
-				nats-route://localhost:%d
-			]
+	`, dir, ojwt, sysPub, sysJwt, expPub, expJwt, impPub, impJwt, sysPub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// The stream is created after the claims are first applied, so apply them again.
+	expAcc, err := s.LookupAccount(expPub)
+	require_NoError(t, err)
+	mset, err := expAcc.AddStream(&StreamConfig{Name: "LATENCY", Subjects: []string{"metrics.latency"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	s.UpdateAccountClaims(expAcc, expAC)
+
+	ncExp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, expKp))
+	defer ncExp.Close()
+	natsSub(t, ncExp, "svc", func(m *nats.Msg) {
+		m.Respond([]byte("ok"))
+	})
+	natsFlush(t, ncExp)
+
+	ncImp := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, impKp))
+	defer ncImp.Close()
+	if _, err := ncImp.Request("svc", nil, time.Second); err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := mset.State().Msgs; n != 1 {
+			return fmt.Errorf("Expected 1 latency result in the stream, got %d", n)
 		}
-    `, ojwt, syspub, dirB, sA.opts.Cluster.Port)))
-	defer os.Remove(confB)
-	sB, _ := RunServerWithConfig(confB)
-	defer sB.Shutdown()
-	// Create Server C (using no_advertise to prevent fail over)
-	fmtC := `
-		listen: -1
-		server_name: srv-C
-		operator: %s
-		system_account: %s
-		resolver: {
-			type: cache
-			dir: %s
-			ttl: "%dms"
-			limit: 4
+		return nil
+	})
+	sm, err := mset.GetMsg(1)
+	require_NoError(t, err)
+	var sl ServiceLatency
+	require_NoError(t, json.Unmarshal(sm.Data, &sl))
+	if sl.Type != ServiceLatencyType {
+		t.Fatalf("Expected a latency result, got %q", sm.Data)
+	}
+}
+
+func TestJWTAccountRevalidateClients(t *testing.T) {
+	s, _ := runTrustedServer(t)
+	defer s.Shutdown()
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+
+	connect := func() (*nats.Conn, string, chan struct{}) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
 		}
-		cluster {
-			name: clust
-			listen: -1 
-			no_advertise: true
-			routes [
-				nats-route://localhost:%d
-			]
+		closed := make(chan struct{})
+		nc := natsConnect(t, s.ClientURL(),
+			nats.UserJWT(func() (string, error) { return ujwt, nil }, func(nonce []byte) ([]byte, error) {
+				return ukp.Sign(nonce)
+			}),
+			nats.NoReconnect(),
+			nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+		return nc, upub, closed
+	}
+	nc1, upub1, closed1 := connect()
+	defer nc1.Close()
+	nc2, _, closed2 := connect()
+	defer nc2.Close()
+
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if n := acc.RevalidateClients(); n != 0 {
+		t.Fatalf("Expected no client to be disconnected, got %d", n)
+	}
+
+	// Revoke the first user without updating the account claims.
+	acc.mu.Lock()
+	acc.usersRevoked = map[string]int64{upub1: time.Now().Unix()}
+	acc.mu.Unlock()
+
+	if n := acc.RevalidateClients(); n != 1 {
+		t.Fatalf("Expected 1 client to be disconnected, got %d", n)
+	}
+	select {
+	case <-closed1:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the revoked user to be disconnected")
+	}
+	select {
+	case <-closed2:
+		t.Fatal("Did not expect the other user to be disconnected")
+	case <-time.After(100 * time.Millisecond):
+	}
+	natsFlush(t, nc2)
+
+	// Default permissions are re-applied like on an update of the claims.
+	acc.mu.Lock()
+	acc.defaultPerms = &Permissions{Publish: &SubjectPermission{Deny: []string{"foo"}}}
+	var c *client
+	for cl := range acc.clients {
+		if cl.kind == CLIENT {
+			c = cl
 		}
-    `
-	confClongTTL := createConfFile(t, []byte(fmt.Sprintf(fmtC, ojwt, syspub, dirC, 10000, sA.opts.Cluster.Port)))
-	defer os.Remove(confClongTTL)
-	confCshortTTL := createConfFile(t, []byte(fmt.Sprintf(fmtC, ojwt, syspub, dirC, 1000, sA.opts.Cluster.Port)))
-	defer os.Remove(confCshortTTL)
-	sC, _ := RunServerWithConfig(confClongTTL) // use long ttl to assure it is not kicking
-	defer sC.Shutdown()
-	// startup cluster
-	checkClusterFormed(t, sA, sB, sC)
-	time.Sleep(500 * time.Millisecond) // wait for the protocol to converge
-	// Check all accounts
-	require_JWTPresent(t, dirA, apub) // was already present on startup
-	require_JWTPresent(t, dirB, apub) // was copied from server A
-	require_JWTAbsent(t, dirC, apub)
-	require_JWTPresent(t, dirA, bpub) // was copied from server B
-	require_JWTPresent(t, dirB, bpub) // was already present on startup
-	require_JWTAbsent(t, dirC, bpub)
-	require_JWTPresent(t, dirA, cpub) // was present in preload
-	require_JWTPresent(t, dirB, cpub) // was copied from server A
-	require_JWTPresent(t, dirC, cpub) // was already present on startup
-	// This is to test that connecting to it still works
-	require_JWTAbsent(t, dirA, syspub)
-	require_JWTAbsent(t, dirB, syspub)
-	require_JWTAbsent(t, dirC, syspub)
-	// system account client can connect to every server
-	connect(sA.ClientURL(), sysCreds, "")
-	connect(sB.ClientURL(), sysCreds, "")
-	connect(sC.ClientURL(), sysCreds, "")
-	checkClusterFormed(t, sA, sB, sC)
-	// upload system account and require a response from each server
-	passCnt := updateJwt(t, sA.ClientURL(), sysCreds, syspub, sysjwt, 3)
-	require_True(t, passCnt == 3)
-	require_JWTPresent(t, dirA, syspub) // was just received
-	require_JWTPresent(t, dirB, syspub) // was just received
-	require_JWTPresent(t, dirC, syspub) // was just received
-	// Only files missing are in C, which is only caching
-	connect(sC.ClientURL(), aCreds, apub, sA, sB, sC)
-	connect(sC.ClientURL(), bCreds, bpub, sA, sB, sC)
-	require_JWTPresent(t, dirC, apub) // was looked up form A or B
-	require_JWTPresent(t, dirC, bpub) // was looked up from A or B
-	// Check limits and update jwt B connecting to server A
-	for port, v := range map[string]struct{ pub, jwt, creds string }{
-		sB.ClientURL(): {bpub, bjwt2, bCreds},
-		sC.ClientURL(): {cpub, cjwt2, cCreds},
-	} {
-		require_1Connection(sA.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		require_1Connection(sB.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		require_1Connection(sC.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		passCnt := updateJwt(t, port, sysCreds, v.pub, v.jwt, 3)
-		require_True(t, passCnt == 3)
-		require_2Connection(sA.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		require_2Connection(sB.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		require_2Connection(sC.ClientURL(), v.creds, v.pub, sA, sB, sC)
-		require_JWTEqual(t, dirA, v.pub, v.jwt)
-		require_JWTEqual(t, dirB, v.pub, v.jwt)
-		require_JWTEqual(t, dirC, v.pub, v.jwt)
 	}
-	// Simulates A having missed an update
-	// shutting B down as it has it will directly connect to A and connect right away
-	sB.Shutdown()
-	writeJWT(t, dirB, apub, ajwt2) // this will be copied to server A
-	sB, _ = RunServerWithConfig(confB)
-	defer sB.Shutdown()
-	checkClusterFormed(t, sA, sB, sC)
-	time.Sleep(500 * time.Millisecond) // wait for the protocol to converge
-	// Restart server C. this is a workaround to force C to do a lookup in the absence of account cleanup
-	sC.Shutdown()
-	sC, _ = RunServerWithConfig(confClongTTL) //TODO remove this once we clean up accounts
-	defer sC.Shutdown()
-	require_JWTEqual(t, dirA, apub, ajwt2) // was copied from server B
-	require_JWTEqual(t, dirB, apub, ajwt2) // was restarted with this
-	require_JWTEqual(t, dirC, apub, ajwt1) // still contains old cached value
-	require_2Connection(sA.ClientURL(), aCreds, apub, sA, sB, sC)
-	require_2Connection(sB.ClientURL(), aCreds, apub, sA, sB, sC)
-	require_1Connection(sC.ClientURL(), aCreds, apub, sA, sB, sC)
-	// Restart server C. this is a workaround to force C to do a lookup in the absence of account cleanup
-	sC.Shutdown()
-	sC, _ = RunServerWithConfig(confCshortTTL) //TODO remove this once we clean up accounts
-	defer sC.Shutdown()
-	require_JWTEqual(t, dirC, apub, ajwt1) // still contains old cached value
-	checkClusterFormed(t, sA, sB, sC)
-	// Force next connect to do a lookup exceeds ttl
-	fname := filepath.Join(dirC, apub+".jwt")
-	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
-		_, err := os.Stat(fname)
-		if os.IsNotExist(err) {
-			return nil
+	acc.mu.Unlock()
+	if n := acc.RevalidateClients(); n != 0 {
+		t.Fatalf("Expected no client to be disconnected, got %d", n)
+	}
+	if c.pubAllowed("foo") {
+		t.Fatal("Expected the default permissions to be applied")
+	}
+
+	// So are the limits per connection type.
+	acc.mu.Lock()
+	acc.mctconns = map[string]int32{jwt.ConnectionTypeStandard: 0}
+	acc.mu.Unlock()
+	if n := acc.RevalidateClients(); n != 1 {
+		t.Fatalf("Expected 1 client to be disconnected, got %d", n)
+	}
+	select {
+	case <-closed2:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the user over the connection type limit to be disconnected")
+	}
+}
+
+func TestJWTAccountExportClaims(t *testing.T) {
+	// Latency tracking requires the system account.
+	s, _ := runTrustedServer(t)
+	defer s.Shutdown()
+	sacc, _ := createAccount(s)
+	s.setSystemAccount(sacc)
+
+	// Exporting account.
+	ekp, _ := nkeys.CreateAccount()
+	epub, _ := ekp.PublicKey()
+	eac := jwt.NewAccountClaims(epub)
+	eac.Exports.Add(
+		&jwt.Export{Subject: "events.>", Type: jwt.Stream},
+		&jwt.Export{Subject: "private.>", Type: jwt.Stream, TokenReq: true},
+		&jwt.Export{Subject: "req.chunked", Type: jwt.Service, ResponseType: jwt.ResponseTypeChunked},
+		&jwt.Export{Subject: "req.stream", Type: jwt.Service, ResponseType: jwt.ResponseTypeStream},
+		&jwt.Export{
+			Subject: "req.single",
+			Type:    jwt.Service,
+			Latency: &jwt.ServiceLatency{Sampling: 50, Results: "latency.req"},
+		},
+	)
+	eac.Limits.Subs = 10
+	eac.Limits.Payload = 1024
+	eac.Limits.Conn = 5
+	eac.Limits.LeafNodeConn = 2
+	eac.Limits.JetStreamLimits = jwt.JetStreamLimits{}
+	ejwt, err := eac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, epub, ejwt)
+
+	// Importing account.
+	ikp, _ := nkeys.CreateAccount()
+	ipub, _ := ikp.PublicKey()
+	iac := jwt.NewAccountClaims(ipub)
+	iac.Imports.Add(
+		&jwt.Import{Account: epub, Subject: "events.>", To: "imported", Type: jwt.Stream},
+		&jwt.Import{Account: epub, Subject: "local.req", To: "req.stream", Type: jwt.Service},
+		&jwt.Import{Account: epub, Subject: "req.chunked", Type: jwt.Service},
+	)
+	iac.Limits.JetStreamLimits = jwt.JetStreamLimits{}
+	ijwt, err := iac.Encode(oKp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, ipub, ijwt)
+
+	ea, err := s.LookupAccount(epub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	ia, err := s.LookupAccount(ipub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	checkExports := func(ac *jwt.AccountClaims) {
+		t.Helper()
+		exported := ea.ExportClaims()
+		if exported.Subject != ac.Subject || exported.Issuer != ac.Issuer {
+			t.Fatalf("Expected subject and issuer %q/%q, got %q/%q", ac.Subject, ac.Issuer, exported.Subject, exported.Issuer)
 		}
-		return fmt.Errorf("File not removed in time")
-	})
-	connect(sC.ClientURL(), aCreds, apub, sA, sB, sC) // When lookup happens
-	require_JWTEqual(t, dirC, apub, ajwt2)            // was looked up form A or B
-	require_2Connection(sC.ClientURL(), aCreds, apub, sA, sB, sC)
-	// Test exceeding limit. For the exclusive directory resolver, limit is a stop gap measure.
-	// It is not expected to be hit. When hit the administrator is supposed to take action.
-	passCnt = updateJwt(t, sA.ClientURL(), sysCreds, dpub, djwt1, 3)
-	require_True(t, passCnt == 1) // Only Server C updated
-	for _, srv := range []*Server{sA, sB, sC} {
-		if a, ok := srv.accounts.Load(syspub); ok {
-			acc := a.(*Account)
-			checkFor(t, time.Second, 20*time.Millisecond, func() error {
-				acc.mu.Lock()
-				defer acc.mu.Unlock()
-				if acc.ctmr != nil {
-					return fmt.Errorf("Timer still exists")
+		if len(exported.Exports) != len(ac.Exports) {
+			t.Fatalf("Expected %d exports, got %d", len(ac.Exports), len(exported.Exports))
+		}
+		for _, e := range ac.Exports {
+			var got *jwt.Export
+			for _, x := range exported.Exports {
+				if x.Subject == e.Subject {
+					got = x
 				}
-				return nil
-			})
+			}
+			if got == nil {
+				t.Fatalf("Expected export %q to be present", e.Subject)
+			}
+			rt := e.ResponseType
+			if e.IsService() && rt == _EMPTY_ {
+				rt = jwt.ResponseTypeSingleton
+			}
+			if got.Type != e.Type || got.TokenReq != e.TokenReq || got.ResponseType != rt {
+				t.Fatalf("Export %q mismatch: expected %+v, got %+v", e.Subject, e, got)
+			}
+			if (e.Latency == nil) != (got.Latency == nil) ||
+				(e.Latency != nil && *e.Latency != *got.Latency) {
+				t.Fatalf("Export %q latency mismatch: expected %+v, got %+v", e.Subject, e.Latency, got.Latency)
+			}
+		}
+		if exported.Limits != ac.Limits {
+			t.Fatalf("Expected limits %+v, got %+v", ac.Limits, exported.Limits)
 		}
 	}
-}
+	checkExports(eac)
 
-func TestAccountNATSResolverCrossClusterFetch(t *testing.T) {
-	connect := func(url string, credsfile string) {
-		t.Helper()
-		nc := natsConnect(t, url, nats.UserCredentials(credsfile))
-		nc.Close()
+	imported := ia.ExportClaims()
+	if len(imported.Imports) != len(iac.Imports) {
+		t.Fatalf("Expected %d imports, got %d", len(iac.Imports), len(imported.Imports))
 	}
-	createAccountAndUser := func(done chan struct{}, pubKey, jwt1, jwt2, creds *string) {
+	for _, i := range iac.Imports {
+		var got *jwt.Import
+		for _, x := range imported.Imports {
+			if x.Subject == i.Subject {
+				got = x
+			}
+		}
+		if got == nil {
+			t.Fatalf("Expected import %q to be present", i.Subject)
+		}
+		if *got != *i {
+			t.Fatalf("Import %q mismatch: expected %+v, got %+v", i.Subject, i, got)
+		}
+	}
+
+	// Re-encode what the server exported and push it back, the result
+	// must be the same.
+	exported := ea.ExportClaims()
+	exported.Exports = exported.Exports[1:]
+	exported.Limits.Subs = 20
+	if _, err := exported.Encode(oKp); err != nil {
+		t.Fatalf("Error encoding exported claims: %v", err)
+	}
+	s.UpdateAccountClaims(ea, exported)
+	checkExports(exported)
+}
+
+func TestJWTResolverStoreHandler(t *testing.T) {
+	createAccount := func() (nkeys.KeyPair, string, string) {
 		t.Helper()
 		kp, _ := nkeys.CreateAccount()
-		*pubKey, _ = kp.PublicKey()
-		claim := jwt.NewAccountClaims(*pubKey)
-		var err error
-		*jwt1, err = claim.Encode(oKp)
-		require_NoError(t, err)
-		// need to assure that create time differs (resolution is sec)
-		time.Sleep(time.Millisecond * 1100)
-		// create updated claim
-		claim.Tags.Add("tag")
-		*jwt2, err = claim.Encode(oKp)
-		require_NoError(t, err)
-		ukp, _ := nkeys.CreateUser()
-		seed, _ := ukp.Seed()
-		upub, _ := ukp.PublicKey()
-		uclaim := newJWTTestUserClaims()
-		uclaim.Subject = upub
-		ujwt, err := uclaim.Encode(kp)
+		pub, _ := kp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(pub).Encode(oKp)
 		require_NoError(t, err)
-		*creds = genCredsFile(t, ujwt, seed)
-		done <- struct{}{}
-	}
-	// Create Accounts and corresponding user creds. Do so concurrently to speed up the test
-	doneChan := make(chan struct{}, 3)
-	defer close(doneChan)
-	var syspub, sysjwt, dummy1, sysCreds string
-	go createAccountAndUser(doneChan, &syspub, &sysjwt, &dummy1, &sysCreds)
-	var apub, ajwt1, ajwt2, aCreds string
-	go createAccountAndUser(doneChan, &apub, &ajwt1, &ajwt2, &aCreds)
-	var bpub, bjwt1, bjwt2, bCreds string
-	go createAccountAndUser(doneChan, &bpub, &bjwt1, &bjwt2, &bCreds)
-	for i := 0; i < cap(doneChan); i++ {
-		<-doneChan
+		return kp, pub, ajwt
 	}
+	sysKp, syspub, sysJwt := createAccount()
+	_, apub, ajwt := createAccount()
+	_, bpub, bjwt := createAccount()
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysCreds := genCredsFile(t, ujwt, useed)
 	defer os.Remove(sysCreds)
-	defer os.Remove(aCreds)
-	defer os.Remove(bCreds)
-	// Create one directory for each server
-	dirAA := createDir(t, "srv-a-a")
-	defer os.RemoveAll(dirAA)
-	dirAB := createDir(t, "srv-a-b")
-	defer os.RemoveAll(dirAB)
-	dirBA := createDir(t, "srv-b-a")
-	defer os.RemoveAll(dirBA)
-	dirBB := createDir(t, "srv-b-b")
-	defer os.RemoveAll(dirBB)
-	// simulate a restart of the server by storing files in them
-	// Server AA & AB will completely sync
-	// Server BA & BB will completely sync
-	// Be aware that no syncing will occur between cluster
-	writeJWT(t, dirAA, apub, ajwt1)
-	writeJWT(t, dirBA, bpub, bjwt1)
-	// Create seed server A (using no_advertise to prevent fail over)
-	confAA := createConfFile(t, []byte(fmt.Sprintf(`
+
+	dirA := createDir(t, "srv-a")
+	defer os.RemoveAll(dirA)
+	dirB := createDir(t, "srv-b")
+	defer os.RemoveAll(dirB)
+	writeJWT(t, dirA, syspub, sysJwt)
+	writeJWT(t, dirB, syspub, sysJwt)
+	// Only server A knows about account B, server B gets it by syncing.
+	writeJWT(t, dirA, bpub, bjwt)
+
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		server_name: srv-A-A
+		server_name: srv-A
 		operator: %s
 		system_account: %s
 		resolver: {
@@ -3620,23 +8905,19 @@ func TestAccountNATSResolverCrossClusterFetch(t *testing.T) {
 			dir: %s
 			interval: "200ms"
 		}
-		gateway: {
-			name: "clust-A"
-			listen: -1
-		}
 		cluster {
-			name: clust-A
+			name: clust
 			listen: -1
 			no_advertise: true
 		}
-    `, ojwt, syspub, dirAA)))
-	defer os.Remove(confAA)
-	sAA, _ := RunServerWithConfig(confAA)
-	defer sAA.Shutdown()
-	// Create Server B (using no_advertise to prevent fail over)
-	confAB := createConfFile(t, []byte(fmt.Sprintf(`
+    `, ojwt, syspub, dirA)))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+
+	confB := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		server_name: srv-A-B
+		server_name: srv-B
 		operator: %s
 		system_account: %s
 		resolver: {
@@ -3644,159 +8925,426 @@ func TestAccountNATSResolverCrossClusterFetch(t *testing.T) {
 			dir: %s
 			interval: "200ms"
 		}
-		gateway: {
-			name: "clust-A"
-			listen: -1
-		}
 		cluster {
-			name: clust-A
-			listen: -1 
+			name: clust
+			listen: -1
 			no_advertise: true
 			routes [
 				nats-route://localhost:%d
 			]
 		}
-    `, ojwt, syspub, dirAB, sAA.opts.Cluster.Port)))
-	defer os.Remove(confAB)
-	sAB, _ := RunServerWithConfig(confAB)
-	defer sAB.Shutdown()
-	// Create Server C (using no_advertise to prevent fail over)
-	confBA := createConfFile(t, []byte(fmt.Sprintf(`
+    `, ojwt, syspub, dirB, sA.opts.Cluster.Port)))
+	defer os.Remove(confB)
+	sB, _ := RunServerWithConfig(confB)
+	defer sB.Shutdown()
+
+	type storeEvent struct{ pub, jwt, source string }
+	events := make(chan storeEvent, 10)
+	sB.SetResolverStoreHandler(func(pub, jwt, source string) {
+		events <- storeEvent{pub, jwt, source}
+	})
+	checkClusterFormed(t, sA, sB)
+
+	require_True(t, updateJwt(t, sB.ClientURL(), sysCreds, apub, ajwt, 2) == 2)
+
+	expected := map[string]storeEvent{
+		apub: {apub, ajwt, ResolverStorePush},
+		bpub: {bpub, bjwt, ResolverStoreSync},
+	}
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case e := <-events:
+			if exp, ok := expected[e.pub]; !ok {
+				t.Fatalf("Unexpected store event: %+v", e)
+			} else if e != exp {
+				t.Fatalf("Expected store event %+v, got %+v", exp, e)
+			}
+			delete(expected, e.pub)
+		case <-timeout:
+			t.Fatalf("Did not get store events for %v", expected)
+		}
+	}
+}
+
+func TestJWTResolverStoreHandlerPreloadsOnReload(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// The handler calls back into the server, which requires it not to be
+	// invoked with the server lock held.
+	stored := make(chan string, 1)
+	s.SetResolverStoreHandler(func(pub, _, source string) {
+		s.NumClients()
+		if source == ResolverStorePreload {
+			stored <- pub
+		}
+	})
+	require_NoError(t, s.Reload())
+	select {
+	case pub := <-stored:
+		if pub != apub {
+			t.Fatalf("Expected preload of %q, got %q", apub, pub)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the preload to be reported")
+	}
+}
+
+func TestJWTExpiredOperator(t *testing.T) {
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	opc := jwt.NewOperatorClaims(opub)
+	opc.Expires = time.Now().Add(-time.Hour).Unix()
+	expiredJWT, err := opc.Encode(okp)
+	require_NoError(t, err)
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: -1
+				operator: %s
+				resolver: MEMORY
+				reject_expired_operators: %v
+			`, expiredJWT, strict)))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			require_NoError(t, err)
+			if len(opts.TrustedOperators) != 1 || !operatorExpired(opts.TrustedOperators[0]) {
+				t.Fatalf("Expected an expired operator, got %+v", opts.TrustedOperators)
+			}
+			s, err := NewServer(opts)
+			if strict {
+				if err == nil || !strings.Contains(err.Error(), "expired") {
+					t.Fatalf("Expected startup to fail for expired operator, got %v", err)
+				}
+				return
+			}
+			require_NoError(t, err)
+			s.Shutdown()
+		})
+	}
+}
+
+func TestJWTAccountScheduledUpdate(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	syspub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysCreds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(sysCreds)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 10
+	ajwt, err := ac.Encode(oKp)
+	require_NoError(t, err)
+
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
+	writeJWT(t, dir, syspub, sysJwt)
+	writeJWT(t, dir, apub, ajwt)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		server_name: srv-B-A
 		operator: %s
 		system_account: %s
 		resolver: {
 			type: full
 			dir: %s
-			interval: "200ms"
-		}
-		gateway: {
-			name: "clust-B"
-			listen: -1
-			gateways: [
-				{name: "clust-A", url: "nats://localhost:%d"},
-			]
 		}
-		cluster {
-			name: clust-B
-			listen: -1
-			no_advertise: true
+    `, ojwt, syspub, dir)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	msubs := func() int32 {
+		acc.mu.RLock()
+		defer acc.mu.RUnlock()
+		return acc.msubs
+	}
+	require_True(t, msubs() == 10)
+
+	applyAt := time.Now().Add(2 * time.Second).Unix()
+	ac = jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 20
+	newJwt := encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{"apply_at": applyAt})
+	require_True(t, updateJwt(t, s.ClientURL(), sysCreds, apub, newJwt, 1) == 1)
+
+	// The new JWT is stored right away, but the old claims still apply.
+	stored, err := ioutil.ReadFile(filepath.Join(dir, apub+".jwt"))
+	require_NoError(t, err)
+	require_True(t, string(stored) == newJwt)
+	require_True(t, msubs() == 10)
+
+	time.Sleep(time.Until(time.Unix(applyAt, 0)) - 250*time.Millisecond)
+	require_True(t, msubs() == 10)
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if n := msubs(); n != 20 {
+			return fmt.Errorf("Expected subscription limit of 20, got %d", n)
 		}
-    `, ojwt, syspub, dirBA, sAA.opts.Gateway.Port)))
-	defer os.Remove(confBA)
-	sBA, _ := RunServerWithConfig(confBA)
-	defer sBA.Shutdown()
-	// Create Sever BA  (using no_advertise to prevent fail over)
-	confBB := createConfFile(t, []byte(fmt.Sprintf(`
+		return nil
+	})
+	acc.mu.RLock()
+	claimJWT := acc.claimJWT
+	acc.mu.RUnlock()
+	require_True(t, claimJWT == newJwt)
+}
+
+func TestJWTAccountScheduledUpdateAfterRestart(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	syspub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysCreds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(sysCreds)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 10
+	ajwt, err := ac.Encode(oKp)
+	require_NoError(t, err)
+
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
+	writeJWT(t, dir, syspub, sysJwt)
+	writeJWT(t, dir, apub, ajwt)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		server_name: srv-B-B
 		operator: %s
 		system_account: %s
 		resolver: {
 			type: full
 			dir: %s
-			interval: "200ms"
 		}
-		cluster {
-			name: clust-B
-			listen: -1
-			no_advertise: true
-			routes [
-				nats-route://localhost:%d
-			]
+    `, ojwt, syspub, dir)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	_, err = s.LookupAccount(apub)
+	require_NoError(t, err)
+
+	applyAt := time.Now().Add(3 * time.Second).Unix()
+	ac = jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 20
+	newJwt := encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{"apply_at": applyAt})
+	require_True(t, updateJwt(t, s.ClientURL(), sysCreds, apub, newJwt, 1) == 1)
+	s.Shutdown()
+
+	// After a restart the pending claims are all the account has loaded
+	// from the store, the ones in effect still apply until then.
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	msubs := func() int32 {
+		acc.mu.RLock()
+		defer acc.mu.RUnlock()
+		return acc.msubs
+	}
+	require_True(t, msubs() == 10)
+
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if n := msubs(); n != 20 {
+			return fmt.Errorf("Expected subscription limit of 20, got %d", n)
 		}
-		gateway: {
-			name: "clust-B"
-			listen: -1
-			gateways: [
-				{name: "clust-A", url: "nats://localhost:%d"},
-			]
+		return nil
+	})
+}
+
+func TestJWTAccountScheduledUpdateMemResolverReload(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 10
+	ajwt, err := ac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	applyAt := time.Now().Add(time.Second).Unix()
+	ac = jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 20
+	addAccountToMemResolver(s, apub, encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{"apply_at": applyAt}))
+
+	// Loading the account only now still gets the claims in effect.
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	msubs := func() int32 {
+		acc.mu.RLock()
+		defer acc.mu.RUnlock()
+		return acc.msubs
+	}
+	require_True(t, msubs() == 10)
+
+	checkFor(t, 3*time.Second, 50*time.Millisecond, func() error {
+		if n := msubs(); n != 20 {
+			return fmt.Errorf("Expected subscription limit of 20, got %d", n)
 		}
-    `, ojwt, syspub, dirBB, sBA.opts.Cluster.Port, sAA.opts.Cluster.Port)))
-	defer os.Remove(confBB)
-	sBB, _ := RunServerWithConfig(confBB)
-	defer sBB.Shutdown()
-	// Assert topology
-	checkClusterFormed(t, sAA, sAB)
-	checkClusterFormed(t, sBA, sBB)
-	waitForOutboundGateways(t, sAA, 1, 5*time.Second)
-	waitForOutboundGateways(t, sAB, 1, 5*time.Second)
-	waitForOutboundGateways(t, sBA, 1, 5*time.Second)
-	waitForOutboundGateways(t, sBB, 1, 5*time.Second)
-	time.Sleep(500 * time.Millisecond)                         // wait for the protocol to converge
-	updateJwt(t, sAA.ClientURL(), sysCreds, syspub, sysjwt, 4) // update system account jwt on all server
-	require_JWTEqual(t, dirAA, syspub, sysjwt)                 // assure this update made it to every server
-	require_JWTEqual(t, dirAB, syspub, sysjwt)                 // assure this update made it to every server
-	require_JWTEqual(t, dirBA, syspub, sysjwt)                 // assure this update made it to every server
-	require_JWTEqual(t, dirBB, syspub, sysjwt)                 // assure this update made it to every server
-	require_JWTAbsent(t, dirAA, bpub)                          // assure that jwt are not synced across cluster
-	require_JWTAbsent(t, dirAB, bpub)                          // assure that jwt are not synced across cluster
-	require_JWTAbsent(t, dirBA, apub)                          // assure that jwt are not synced across cluster
-	require_JWTAbsent(t, dirBB, apub)                          // assure that jwt are not synced across cluster
-	connect(sAA.ClientURL(), aCreds)                           // connect to cluster where jwt was initially stored
-	connect(sAB.ClientURL(), aCreds)                           // connect to cluster where jwt was initially stored
-	connect(sBA.ClientURL(), bCreds)                           // connect to cluster where jwt was initially stored
-	connect(sBB.ClientURL(), bCreds)                           // connect to cluster where jwt was initially stored
-	time.Sleep(500 * time.Millisecond)                         // wait for the protocol to (NOT) converge
-	require_JWTAbsent(t, dirAA, bpub)                          // assure that jwt are still not synced across cluster
-	require_JWTAbsent(t, dirAB, bpub)                          // assure that jwt are still not synced across cluster
-	require_JWTAbsent(t, dirBA, apub)                          // assure that jwt are still not synced across cluster
-	require_JWTAbsent(t, dirBB, apub)                          // assure that jwt are still not synced across cluster
-	// We have verified that account B does not exist in cluster A, neither does account A in cluster B
-	// Despite that clients from account B can connect to server A, same for account A in cluster B
-	connect(sAA.ClientURL(), bCreds)                        // connect to cluster where jwt was not initially stored
-	connect(sAB.ClientURL(), bCreds)                        // connect to cluster where jwt was not initially stored
-	connect(sBA.ClientURL(), aCreds)                        // connect to cluster where jwt was not initially stored
-	connect(sBB.ClientURL(), aCreds)                        // connect to cluster where jwt was not initially stored
-	require_JWTEqual(t, dirAA, bpub, bjwt1)                 // assure that now jwt used in connect is stored
-	require_JWTEqual(t, dirAB, bpub, bjwt1)                 // assure that now jwt used in connect is stored
-	require_JWTEqual(t, dirBA, apub, ajwt1)                 // assure that now jwt used in connect is stored
-	require_JWTEqual(t, dirBB, apub, ajwt1)                 // assure that now jwt used in connect is stored
-	updateJwt(t, sAA.ClientURL(), sysCreds, bpub, bjwt2, 4) // update bjwt, expect updates from everywhere
-	updateJwt(t, sBA.ClientURL(), sysCreds, apub, ajwt2, 4) // update ajwt, expect updates from everywhere
-	require_JWTEqual(t, dirAA, bpub, bjwt2)                 // assure that jwt got updated accordingly
-	require_JWTEqual(t, dirAB, bpub, bjwt2)                 // assure that jwt got updated accordingly
-	require_JWTEqual(t, dirBA, apub, ajwt2)                 // assure that jwt got updated accordingly
-	require_JWTEqual(t, dirBB, apub, ajwt2)                 // assure that jwt got updated accordingly
+		return nil
+	})
 }
 
-func newTimeRange(start time.Time, dur time.Duration) jwt.TimeRange {
-	return jwt.TimeRange{Start: start.Format("15:04:05"), End: start.Add(dur).Format("15:04:05")}
+func TestJWTAccountScheduledClaimsNotLoadedBefore(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	applyAt := time.Now().Add(time.Second).Unix()
+	ac := jwt.NewAccountClaims(apub)
+	ac.Limits.Subs = 20
+	ajwt := encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{"apply_at": applyAt})
+	addAccountToMemResolver(s, apub, ajwt)
+
+	// There are no claims to keep until then, so the account is not loaded.
+	if _, err := s.LookupAccount(apub); err != ErrAccountClaimsNotApplied {
+		t.Fatalf("Expected %v, got %v", ErrAccountClaimsNotApplied, err)
+	}
+	if _, ok := s.accounts.Load(apub); ok {
+		t.Fatal("Expected the account to not be registered")
+	}
+
+	time.Sleep(time.Until(time.Unix(applyAt, 0)) + 100*time.Millisecond)
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	acc.mu.RLock()
+	msubs := acc.msubs
+	acc.mu.RUnlock()
+	require_True(t, msubs == 20)
 }
 
-func createUserWithLimit(t *testing.T, accKp nkeys.KeyPair, expiration time.Time, limits func(*jwt.Limits)) string {
-	t.Helper()
+func TestJWTAccountUpdateSubjectMismatch(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	syspub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
 	ukp, _ := nkeys.CreateUser()
-	seed, _ := ukp.Seed()
-	upub, _ := ukp.PublicKey()
+	useed, _ := ukp.Seed()
 	uclaim := newJWTTestUserClaims()
-	uclaim.Subject = upub
-	if limits != nil {
-		limits(&uclaim.Limits)
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysCreds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(sysCreds)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	bjwt, err := jwt.NewAccountClaims(bpub).Encode(oKp)
+	require_NoError(t, err)
+
+	for _, resType := range []string{"full", "cache"} {
+		t.Run(resType, func(t *testing.T) {
+			dir := createDir(t, "srv")
+			defer os.RemoveAll(dir)
+			writeJWT(t, dir, syspub, sysJwt)
+			writeJWT(t, dir, apub, ajwt)
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: -1
+				operator: %s
+				system_account: %s
+				resolver: {
+					type: %s
+					dir: %s
+				}
+			`, ojwt, syspub, resType, dir)))
+			defer os.Remove(conf)
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			// Push the JWT of account B on the update subject of account A.
+			require_True(t, updateJwt(t, s.ClientURL(), sysCreds, apub, bjwt, 1) == 0)
+
+			stored, err := ioutil.ReadFile(filepath.Join(dir, apub+".jwt"))
+			require_NoError(t, err)
+			require_True(t, string(stored) == ajwt)
+			_, err = os.Stat(filepath.Join(dir, bpub+".jwt"))
+			require_True(t, os.IsNotExist(err))
+		})
 	}
-	if !expiration.IsZero() {
-		uclaim.Expires = expiration.Unix()
+}
+
+func TestJWTFetchAccountJWT(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+	defer s.Shutdown()
+
+	if _, err := s.FetchAccountJWT("foo"); err != ErrNoAccountResolver {
+		t.Fatalf("Expected %v without a resolver, got %v", ErrNoAccountResolver, err)
 	}
-	vr := jwt.ValidationResults{}
-	uclaim.Validate(&vr)
-	require_Len(t, len(vr.Errors()), 0)
-	ujwt, err := uclaim.Encode(accKp)
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	require_NoError(t, err)
-	return genCredsFile(t, ujwt, seed)
-}
+	addAccountToMemResolver(s, apub, ajwt)
 
-func TestJWTUserLimits(t *testing.T) {
-	// helper for time
-	inAnHour := time.Now().Add(time.Hour)
-	inTwoHours := time.Now().Add(2 * time.Hour)
-	doNotExpire := time.Now().AddDate(1, 0, 0)
-	// create account
-	kp, _ := nkeys.CreateAccount()
-	aPub, _ := kp.PublicKey()
-	claim := jwt.NewAccountClaims(aPub)
-	aJwt, err := claim.Encode(oKp)
+	fetched, err := s.FetchAccountJWT(apub)
 	require_NoError(t, err)
+	if fetched != ajwt {
+		t.Fatalf("Expected the stored JWT, got %q", fetched)
+	}
+	// Fetching does not load the account.
+	if _, ok := s.accounts.Load(apub); ok {
+		t.Fatalf("Expected account to not be loaded")
+	}
+
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	if _, err := s.FetchAccountJWT(bpub); err == nil {
+		t.Fatalf("Expected an error for an unknown account")
+	}
+}
+
+func TestJWTAccountAllowedContentTypes(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt := encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp, map[string]interface{}{
+		"allowed_content_types": []string{"application/json", "application/protobuf"},
+	})
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
 		operator: %s
@@ -3804,64 +9352,220 @@ func TestJWTUserLimits(t *testing.T) {
 		resolver_preload: {
 			%s: %s
 		}
-    `, ojwt, aPub, aJwt)))
+	`, ojwt, apub, ajwt)))
 	defer os.Remove(conf)
-	sA, _ := RunServerWithConfig(conf)
-	defer sA.Shutdown()
-	for _, v := range []struct {
-		pass bool
-		f    func(*jwt.Limits)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt := encodeClaimsWithExt(t, uclaim, akp, map[string]interface{}{
+		"allowed_content_types": []string{"application/json"},
+	})
+	ucreds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(ucreds)
+
+	for _, test := range []struct {
+		name    string
+		opt     nats.Option
+		allowed []string
+		denied  []string
 	}{
-		{true, nil},
-		{false, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8") }},
-		{true, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/0") }},
-		{true, func(j *jwt.Limits) { j.Src.Set("127.0.0.1/8") }},
-		{true, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8,127.0.0.1/8") }},
-		{false, func(j *jwt.Limits) { j.Src.Set("8.8.8.8/8,9.9.9.9/8") }},
-		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), time.Hour)) }},
-		{false, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now().Add(time.Hour), time.Hour)) }},
-		{true, func(j *jwt.Limits) {
-			j.Times = append(j.Times, newTimeRange(inAnHour, time.Hour), newTimeRange(time.Now(), time.Hour))
-		}}, // last one is within range
-		{false, func(j *jwt.Limits) {
-			j.Times = append(j.Times, newTimeRange(inAnHour, time.Hour), newTimeRange(inTwoHours, time.Hour))
-		}}, // out of range
-		{false, func(j *jwt.Limits) {
-			j.Times = append(j.Times, newTimeRange(inAnHour, 3*time.Hour), newTimeRange(inTwoHours, 2*time.Hour))
-		}}, // overlapping [a[]b] out of range*/
-		{false, func(j *jwt.Limits) {
-			j.Times = append(j.Times, newTimeRange(inAnHour, 3*time.Hour), newTimeRange(inTwoHours, time.Hour))
-		}}, // overlapping [a[b]] out of range
-		// next day tests where end < begin
-		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), 25*time.Hour)) }},
-		{true, func(j *jwt.Limits) { j.Times = append(j.Times, newTimeRange(time.Now(), -time.Hour)) }},
+		{"account", createUserCreds(t, nil, akp),
+			[]string{"application/json", "Application/Protobuf; proto=foo", _EMPTY_},
+			[]string{"text/plain"}},
+		{"user", nats.UserCredentials(ucreds),
+			[]string{"application/json; charset=utf-8", _EMPTY_},
+			[]string{"application/protobuf", "text/plain"}},
 	} {
-		t.Run("", func(t *testing.T) {
-			creds := createUserWithLimit(t, kp, doNotExpire, v.f)
-			defer os.Remove(creds)
-			if c, err := nats.Connect(sA.ClientURL(), nats.UserCredentials(creds)); err == nil {
-				c.Close()
-				if !v.pass {
-					t.Fatalf("Expected failure got none")
+		t.Run(test.name, func(t *testing.T) {
+			errCh := make(chan error, 10)
+			nc := natsConnect(t, s.ClientURL(), test.opt,
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			defer nc.Close()
+			sub := natsSubSync(t, nc, "foo")
+			natsFlush(t, nc)
+
+			pub := func(ct string) {
+				t.Helper()
+				m := nats.NewMsg("foo")
+				if ct != _EMPTY_ {
+					m.Header.Set("Content-Type", ct)
+				} else {
+					m.Header.Set("X-Other", "bar")
+				}
+				if err := nc.PublishMsg(m); err != nil {
+					t.Fatalf("Error on publish: %v", err)
+				}
+			}
+			for _, ct := range test.allowed {
+				pub(ct)
+				natsNexMsg(t, sub, time.Second)
+			}
+			for _, ct := range test.denied {
+				pub(ct)
+				select {
+				case err := <-errCh:
+					if !strings.Contains(err.Error(), "Content-Type") {
+						t.Fatalf("Expected a content type violation, got %v", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected an error publishing %q", ct)
+				}
+				if m, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+					t.Fatalf("Expected no message, got %v, %v", m, err)
 				}
-			} else if v.pass {
-				t.Fatalf("Expected success got %v", err)
-			} else if !strings.Contains(err.Error(), "Authorization Violation") {
-				t.Fatalf("Expected error other than %v", err)
 			}
 		})
 	}
 }
 
-func TestJWTTimeExpiration(t *testing.T) {
-	validFor := 1500 * time.Millisecond
-	validRange := 500 * time.Millisecond
-	doNotExpire := time.Now().AddDate(1, 0, 0)
-	// create account
-	kp, _ := nkeys.CreateAccount()
-	aPub, _ := kp.PublicKey()
-	claim := jwt.NewAccountClaims(aPub)
-	aJwt, err := claim.Encode(oKp)
+func TestJWTMaxAccountsEvictsIdle(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	addAccount := func() (nkeys.KeyPair, string) {
+		t.Helper()
+		kp, _ := nkeys.CreateAccount()
+		pub, _ := kp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(pub).Encode(oKp)
+		require_NoError(t, err)
+		addAccountToMemResolver(s, pub, ajwt)
+		return kp, pub
+	}
+	isLoaded := func(pub string) bool {
+		_, ok := s.accounts.Load(pub)
+		return ok
+	}
+
+	// Leave room for two more accounts.
+	n := s.NumLoadedAccounts()
+	s.mu.Lock()
+	s.opts.MaxAccounts = n + 2
+	s.mu.Unlock()
+
+	akp, apub := addAccount()
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	_, bpub := addAccount()
+	_, err := s.LookupAccount(bpub)
+	require_NoError(t, err)
+	require_True(t, s.NumLoadedAccounts() == n+2)
+
+	// Account A is the least recently used, but has a connection.
+	_, cpub := addAccount()
+	_, err = s.LookupAccount(cpub)
+	require_NoError(t, err)
+	require_True(t, s.NumLoadedAccounts() == n+2)
+	require_True(t, isLoaded(apub))
+	require_True(t, !isLoaded(bpub))
+	require_True(t, isLoaded(cpub))
+
+	// An evicted account is loaded again when needed.
+	_, err = s.LookupAccount(bpub)
+	require_NoError(t, err)
+	require_True(t, isLoaded(bpub))
+	require_True(t, !isLoaded(cpub))
+}
+
+func TestJWTMaxAccountsKeepsImportedAccounts(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	isLoaded := func(pub string) bool {
+		_, ok := s.accounts.Load(pub)
+		return ok
+	}
+
+	ekp, _ := nkeys.CreateAccount()
+	epub, _ := ekp.PublicKey()
+	eac := jwt.NewAccountClaims(epub)
+	eac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	ejwt, err := eac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, epub, ejwt)
+
+	ikp, _ := nkeys.CreateAccount()
+	ipub, _ := ikp.PublicKey()
+	iac := jwt.NewAccountClaims(ipub)
+	iac.Imports.Add(&jwt.Import{Account: epub, Subject: "svc", Type: jwt.Service})
+	iac.Expires = time.Now().Add(time.Hour).Unix()
+	ijwt, err := iac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, ipub, ijwt)
+
+	// Leave room for the exporter and the importer.
+	n := s.NumLoadedAccounts()
+	s.mu.Lock()
+	s.opts.MaxAccounts = n + 2
+	s.mu.Unlock()
+
+	// Loading the importer loads the exporter as well.
+	iacc, err := s.LookupAccount(ipub)
+	require_NoError(t, err)
+	require_True(t, isLoaded(epub))
+	iacc.mu.RLock()
+	hasTimer := iacc.etmr != nil
+	iacc.mu.RUnlock()
+	require_True(t, hasTimer)
+
+	// The exporter is the least recently used, but the importer is evicted
+	// since the exporter is imported from.
+	time.Sleep(time.Millisecond)
+	_, err = s.LookupAccount(ipub)
+	require_NoError(t, err)
+	ckp, _ := nkeys.CreateAccount()
+	cpub, _ := ckp.PublicKey()
+	cjwt, err := jwt.NewAccountClaims(cpub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, cpub, cjwt)
+	_, err = s.LookupAccount(cpub)
+	require_NoError(t, err)
+	require_True(t, isLoaded(epub))
+	require_True(t, !isLoaded(ipub))
+	require_True(t, isLoaded(cpub))
+
+	// The timers of the evicted account are stopped.
+	iacc.mu.RLock()
+	hasTimer = iacc.etmr != nil
+	iacc.mu.RUnlock()
+	require_True(t, !hasTimer)
+
+	// The default system account is never evicted.
+	s.mu.Lock()
+	pinned := s.isPinnedAccount(NewAccount(DEFAULT_SYSTEM_ACCOUNT))
+	s.mu.Unlock()
+	require_True(t, pinned)
+}
+
+func TestJWTUserRevocationFromURL(t *testing.T) {
+	var revoked atomic.Value
+	revoked.Store("{}")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(revoked.Load().(string)))
+	}))
+	defer ts.Close()
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	require_NoError(t, err)
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
@@ -3870,491 +9574,1306 @@ func TestJWTTimeExpiration(t *testing.T) {
 		resolver_preload: {
 			%s: %s
 		}
-    `, ojwt, aPub, aJwt)))
+		revocations_url: %q
+		revocations_poll_interval: "100ms"
+	`, ojwt, apub, ajwt, ts.URL)))
 	defer os.Remove(conf)
-	sA, _ := RunServerWithConfig(conf)
-	defer sA.Shutdown()
-	for _, l := range []string{"", "Europe/Berlin", "America/New_York"} {
-		t.Run("simple expiration "+l, func(t *testing.T) {
-			start := time.Now()
-			creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) {
-				if l == "" {
-					j.Times = []jwt.TimeRange{newTimeRange(start, validFor)}
-				} else {
-					loc, err := time.LoadLocation(l)
-					require_NoError(t, err)
-					j.Times = []jwt.TimeRange{newTimeRange(start.In(loc), validFor)}
-					j.Locale = l
-				}
-			})
-			defer os.Remove(creds)
-			disconnectChan := make(chan struct{})
-			defer close(disconnectChan)
-			errChan := make(chan struct{})
-			defer close(errChan)
-			c := natsConnect(t, sA.ClientURL(),
-				nats.UserCredentials(creds),
-				nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
-					if err != io.EOF {
-						return
-					}
-					disconnectChan <- struct{}{}
-				}),
-				nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
-					if err != nats.ErrAuthExpired {
-						return
-					}
-					now := time.Now()
-					stop := start.Add(validFor)
-					// assure event happens within a second of stop
-					if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
-						errChan <- struct{}{}
-					}
-				}))
-			chanRecv(t, errChan, 10*time.Second)
-			chanRecv(t, disconnectChan, 10*time.Second)
-			require_True(t, c.IsReconnecting())
-			require_False(t, c.IsConnected())
-			c.Close()
-		})
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	newUserCreds := func() (string, string) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		useed, _ := ukp.Seed()
+		uclaim := newJWTTestUserClaims()
+		uclaim.Subject, _ = ukp.PublicKey()
+		ujwt, err := uclaim.Encode(akp)
+		require_NoError(t, err)
+		return uclaim.Subject, genCredsFile(t, ujwt, useed)
 	}
-	t.Run("double expiration", func(t *testing.T) {
-		start1 := time.Now()
-		start2 := start1.Add(2 * validFor)
-		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) {
-			j.Times = []jwt.TimeRange{newTimeRange(start1, validFor), newTimeRange(start2, validFor)}
+	connect := func(creds string) (*nats.Conn, chan struct{}) {
+		t.Helper()
+		closed := make(chan struct{})
+		nc := natsConnect(t, s.ClientURL(), nats.UserCredentials(creds), nats.NoReconnect(),
+			nats.ClosedHandler(func(_ *nats.Conn) { close(closed) }))
+		return nc, closed
+	}
+
+	upub, ucreds := newUserCreds()
+	defer os.Remove(ucreds)
+	_, vcreds := newUserCreds()
+	defer os.Remove(vcreds)
+
+	nc, closed := connect(ucreds)
+	defer nc.Close()
+	ncv, closedv := connect(vcreds)
+	defer ncv.Close()
+
+	revoked.Store(fmt.Sprintf(`{%q: %d}`, upub, time.Now().Unix()))
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected revoked user to be disconnected")
+	}
+	select {
+	case <-closedv:
+		t.Fatal("Expected other user to stay connected")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// The revoked user can no longer connect.
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserCredentials(ucreds)); err == nil {
+		nc.Close()
+		t.Fatal("Expected revoked user to be rejected")
+	}
+}
+
+func TestJWTRejectUnknownClaimFields(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			opts := defaultServerOptions
+			opub, _ := oKp.PublicKey()
+			opts.TrustedKeys = []string{opub}
+			opts.RejectUnknownClaimFields = strict
+			s, c, _, _ := rawSetup(opts)
+			c.close()
+			defer s.Shutdown()
+			buildMemAccResolver(s)
+
+			// Known server side fields are fine either way.
+			akp, _ := nkeys.CreateAccount()
+			apub, _ := akp.PublicKey()
+			addAccountToMemResolver(s, apub, encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp,
+				map[string]interface{}{"mappings": map[string]string{"foo": "bar"}}))
+			_, err := s.LookupAccount(apub)
+			require_NoError(t, err)
+
+			bkp, _ := nkeys.CreateAccount()
+			bpub, _ := bkp.PublicKey()
+			addAccountToMemResolver(s, bpub, encodeClaimsWithExt(t, jwt.NewAccountClaims(bpub), oKp,
+				map[string]interface{}{"future_field": 1}))
+			_, err = s.LookupAccount(bpub)
+			if strict && err != ErrClaimsUnknownFields {
+				t.Fatalf("Expected %v, got %v", ErrClaimsUnknownFields, err)
+			} else if !strict && err != nil {
+				t.Fatalf("Expected account to be accepted, got %v", err)
+			}
+
+			// A user of account A with an unknown field.
+			nkp, _ := nkeys.CreateUser()
+			pub, _ := nkp.PublicKey()
+			nuc := jwt.NewUserClaims(pub)
+			ujwt := encodeClaimsWithExt(t, nuc, akp, map[string]interface{}{"future_field": true})
+			c, cr, l := newClientForServer(s)
+			defer c.close()
+			var info nonceInfo
+			json.Unmarshal([]byte(l[5:]), &info)
+			sig, _ := nkp.Sign([]byte(info.Nonce))
+			sigs := base64.RawURLEncoding.EncodeToString(sig)
+			c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n", ujwt, sigs))
+			l, _ = cr.ReadString('\n')
+			if strict && !strings.HasPrefix(l, "-ERR ") {
+				t.Fatalf("Expected an error, got %q", l)
+			} else if !strict && !strings.HasPrefix(l, "PONG") {
+				t.Fatalf("Expected a PONG, got %q", l)
+			}
 		})
-		defer os.Remove(creds)
-		errChan := make(chan struct{})
-		defer close(errChan)
-		reConnectChan := make(chan struct{})
-		defer close(reConnectChan)
-		c := natsConnect(t, sA.ClientURL(),
-			nats.UserCredentials(creds),
-			nats.ReconnectHandler(func(conn *nats.Conn) {
-				reConnectChan <- struct{}{}
-			}),
-			nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
-				if err != nats.ErrAuthExpired {
-					return
-				}
-				now := time.Now()
-				stop := start1.Add(validFor)
-				// assure event happens within a second of stop
-				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
-					errChan <- struct{}{}
-					return
-				}
-				stop = start2.Add(validFor)
-				// assure event happens within a second of stop
-				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
-					errChan <- struct{}{}
-				}
-			}))
-		chanRecv(t, errChan, 10*time.Second)
-		chanRecv(t, reConnectChan, 10*time.Second)
-		require_False(t, c.IsReconnecting())
-		require_True(t, c.IsConnected())
-		chanRecv(t, errChan, 10*time.Second)
-		c.Close()
-	})
-	t.Run("lower jwt expiration overwrites time", func(t *testing.T) {
-		start := time.Now()
-		creds := createUserWithLimit(t, kp, start.Add(validFor), func(j *jwt.Limits) { j.Times = []jwt.TimeRange{newTimeRange(start, 2*validFor)} })
-		defer os.Remove(creds)
-		disconnectChan := make(chan struct{})
-		defer close(disconnectChan)
-		errChan := make(chan struct{})
-		defer close(errChan)
-		c := natsConnect(t, sA.ClientURL(),
-			nats.UserCredentials(creds),
-			nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
-				if err != io.EOF {
-					return
-				}
-				disconnectChan <- struct{}{}
-			}),
-			nats.ErrorHandler(func(conn *nats.Conn, s *nats.Subscription, err error) {
-				if err != nats.ErrAuthExpired {
-					return
-				}
-				now := time.Now()
-				stop := start.Add(validFor)
-				// assure event happens within a second of stop
-				if stop.Add(-validRange).Before(stop) && now.Before(stop.Add(validRange)) {
-					errChan <- struct{}{}
-				}
-			}))
-		chanRecv(t, errChan, 10*time.Second)
-		chanRecv(t, disconnectChan, 10*time.Second)
-		require_True(t, c.IsReconnecting())
-		require_False(t, c.IsConnected())
-		c.Close()
+	}
+}
+
+func TestJWTAccountRequireTLS(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt := encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp, map[string]interface{}{
+		"require_tls": true,
 	})
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+		}
+		tls {
+			cert_file: "../test/configs/certs/server-cert.pem"
+			key_file: "../test/configs/certs/server-key.pem"
+		}
+		allow_non_tls: true
+	`, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	require_NoError(t, err)
+	creds := nats.UserJWT(
+		func() (string, error) { return ujwt, nil },
+		func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) })
+
+	url := fmt.Sprintf("nats://%s", s.Addr())
+	errCh := make(chan error, 1)
+	nc, err := nats.Connect(url, creds, nats.NoReconnect(),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	if err == nil {
+		defer nc.Close()
+		select {
+		case err = <-errCh:
+		case <-time.After(time.Second):
+		}
+	}
+	if err == nil || !strings.Contains(strings.ToLower(err.Error()), "account requires tls") {
+		t.Fatalf("Expected the plaintext connection to be rejected, got %v", err)
+	}
+
+	// The client library used here does not upgrade to TLS when the server
+	// also accepts plaintext, so do the handshake by hand.
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require_NoError(t, err)
+	defer conn.Close()
+	l, err := bufio.NewReader(conn).ReadString('\n')
+	require_NoError(t, err)
+	var info nonceInfo
+	require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	require_NoError(t, tc.Handshake())
+	sig, _ := ukp.Sign([]byte(info.Nonce))
+	_, err = tc.Write([]byte(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":%q,\"verbose\":false}\r\nPING\r\n",
+		ujwt, base64.RawURLEncoding.EncodeToString(sig))))
+	require_NoError(t, err)
+	tc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if l, err = bufio.NewReader(tc).ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected the TLS connection to be accepted, got %q, %v", l, err)
+	}
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	require_True(t, acc.NumLocalConnections() == 1)
 }
 
-func TestJWTLimits(t *testing.T) {
-	doNotExpire := time.Now().AddDate(1, 0, 0)
-	// create account
-	kp, _ := nkeys.CreateAccount()
-	aPub, _ := kp.PublicKey()
-	claim := jwt.NewAccountClaims(aPub)
-	aJwt, err := claim.Encode(oKp)
+func TestJWTSwapAccountResolver(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	// Read only resolvers can not be migrated to.
+	ur, err := NewURLAccResolver("http://127.0.0.1:1/")
+	require_NoError(t, err)
+	if err := s.SwapAccountResolver(ur, true); err == nil {
+		t.Fatal("Expected migrating to a read only resolver to fail")
+	}
+
+	mr := &MemAccResolver{}
+	require_NoError(t, s.SwapAccountResolver(mr, true))
+	if s.AccountResolver() != mr {
+		t.Fatal("Expected the new resolver to be in place")
+	}
+	if j, err := mr.Fetch(apub); err != nil || j != ajwt {
+		t.Fatalf("Expected the account to be migrated, got %q, %v", j, err)
+	}
+
+	// The existing client is still connected and new ones are accepted.
+	c.parseAsync("PING\r\n")
+	expectPong(t, cr)
+	nc, ncr, ncs := createClient(t, s, akp)
+	defer nc.close()
+	nc.parseAsync(ncs)
+	expectPong(t, ncr)
+
+	// Without migration the new resolver is used as is.
+	er := &MemAccResolver{}
+	require_NoError(t, s.SwapAccountResolver(er, false))
+	if _, err := er.Fetch(apub); err != ErrMissingAccount {
+		t.Fatalf("Expected the account not to be migrated, got %v", err)
+	}
+}
+
+func TestJWTSwapAccountResolverDir(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
 	require_NoError(t, err)
+
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
 		operator: %s
-		resolver: MEM
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+			interval: "100ms"
+		}
 		resolver_preload: {
 			%s: %s
 		}
-    `, ojwt, aPub, aJwt)))
+	`, ojwt, syspub, dir, syspub, sysjwt)))
 	defer os.Remove(conf)
-	sA, _ := RunServerWithConfig(conf)
-	defer sA.Shutdown()
-	errChan := make(chan struct{})
-	defer close(errChan)
-	t.Run("subs", func(t *testing.T) {
-		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) { j.Subs = 1 })
-		defer os.Remove(creds)
-		c := natsConnect(t, sA.ClientURL(), nats.UserCredentials(creds),
-			nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
-				if e := conn.LastError(); e != nil && strings.Contains(e.Error(), "maximum subscriptions exceeded") {
-					errChan <- struct{}{}
-				}
-			}),
-		)
-		defer c.Close()
-		if _, err := c.Subscribe("foo", func(msg *nats.Msg) {}); err != nil {
-			t.Fatalf("couldn't subscribe: %v", err)
-		}
-		if _, err = c.Subscribe("bar", func(msg *nats.Msg) {}); err != nil {
-			t.Fatalf("expected error got: %v", err)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sysc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+
+	var packs int32
+	_, err = sysc.Subscribe(accPackReqSubj, func(_ *nats.Msg) {
+		atomic.AddInt32(&packs, 1)
+	})
+	require_NoError(t, err)
+	require_NoError(t, sysc.Flush())
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if atomic.LoadInt32(&packs) == 0 {
+			return fmt.Errorf("no pack request yet")
 		}
-		chanRecv(t, errChan, time.Second)
+		return nil
 	})
-	t.Run("payload", func(t *testing.T) {
-		creds := createUserWithLimit(t, kp, doNotExpire, func(j *jwt.Limits) { j.Payload = 5 })
-		defer os.Remove(creds)
-		c := natsConnect(t, sA.ClientURL(), nats.UserCredentials(creds))
-		defer c.Close()
-		if err := c.Flush(); err != nil {
-			t.Fatalf("flush failed %v", err)
+
+	lookupSubs := func() int {
+		r := s.SystemAccount().sl.Match(fmt.Sprintf(accLookupReqSubj, syspub))
+		return len(r.psubs) + len(r.qsubs)
+	}
+	if lookupSubs() == 0 {
+		t.Fatal("Expected the directory resolver to answer lookups")
+	}
+
+	mr := &MemAccResolver{}
+	require_NoError(t, s.SwapAccountResolver(mr, true))
+	if j, err := mr.Fetch(syspub); err != nil || j != sysjwt {
+		t.Fatalf("Expected the system account to be migrated, got %q, %v", j, err)
+	}
+
+	// The replaced resolver no longer answers nor syncs.
+	if n := lookupSubs(); n != 0 {
+		t.Fatalf("Expected no lookup subscription after the swap, got %d", n)
+	}
+	for _, subj := range []string{accPackReqSubj, accActiveReqSubj, fmt.Sprintf(accUpdateEventSubjNew, syspub)} {
+		r := s.SystemAccount().sl.Match(subj)
+		if n := len(r.qsubs); n != 0 {
+			t.Fatalf("Expected no queue subscription on %q after the swap, got %d", subj, n)
 		}
-		if err := c.Publish("foo", []byte("world")); err != nil {
-			t.Fatalf("couldn't publish: %v", err)
+		if subj != accPackReqSubj && len(r.psubs) != 0 {
+			t.Fatalf("Expected no subscription on %q after the swap, got %d", subj, len(r.psubs))
 		}
-		if err := c.Publish("foo", []byte("worldX")); err != nats.ErrMaxPayload {
-			t.Fatalf("couldn't publish: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&packs, 0)
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&packs); n != 0 {
+		t.Fatalf("Expected no pack request after the swap, got %d", n)
+	}
+}
+
+func TestJWTAccountMaintenance(t *testing.T) {
+	opts := defaultServerOptions
+	opub, _ := oKp.PublicKey()
+	opts.TrustedKeys = []string{opub}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	update := func(maintenance bool) {
+		t.Helper()
+		ac := jwt.NewAccountClaims(apub)
+		// Make sure the JWT differs from the previous one.
+		ac.Name = fmt.Sprintf("maintenance=%v", maintenance)
+		require_NoError(t, s.updateAccountWithClaimJWT(acc, encodeClaimsWithExt(t, ac, oKp,
+			map[string]interface{}{"maintenance": maintenance})))
+	}
+	update(true)
+
+	nc, ncr, ncs := createClient(t, s, akp)
+	defer nc.close()
+	nc.parseAsync(ncs)
+	l, _ := ncr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR 'Account In Maintenance'") {
+		t.Fatalf("Expected new connection to be rejected, got %q", l)
+	}
+
+	// The existing connection is still there.
+	c.parseAsync("PING\r\n")
+	expectPong(t, cr)
+	require_True(t, acc.NumLocalConnections() == 1)
+
+	update(false)
+	nc, ncr, ncs = createClient(t, s, akp)
+	defer nc.close()
+	nc.parseAsync(ncs)
+	expectPong(t, ncr)
+	require_True(t, acc.NumLocalConnections() == 2)
+}
+
+func TestJWTAccountMaintenanceKeepsClientsOnReload(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ajwt, err := ac.Encode(oKp)
+	require_NoError(t, err)
+
+	tmpl := `
+		listen: -1
+		operator: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
 		}
-	})
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, ojwt, apub, ajwt)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp))
+	defer nc.Close()
+
+	acc, err := s.LookupAccount(apub)
+	require_NoError(t, err)
+	// Clients still connected while the account drains are kept as well.
+	acc.mu.Lock()
+	acc.drainUntil = time.Now().Add(time.Minute)
+	acc.mu.Unlock()
+
+	// Put the account in maintenance and require TLS, neither of which
+	// applies to the plain text connection already established.
+	ac.Name = "maintenance"
+	ajwt = encodeClaimsWithExt(t, ac, oKp, map[string]interface{}{"maintenance": true, "require_tls": true})
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, ojwt, apub, ajwt)))
+	require_NoError(t, s.Reload())
+	require_True(t, acc.isDraining() && acc.inMaintenance() && acc.requiresTLS())
+	require_NoError(t, nc.Flush())
+	if !nc.IsConnected() {
+		t.Fatalf("Expected the client to stay connected")
+	}
+	require_True(t, acc.NumLocalConnections() == 1)
+
+	// New connections are rejected.
+	if nc2, err := nats.Connect(s.ClientURL(), createUserCreds(t, nil, akp)); err == nil {
+		nc2.Close()
+		t.Fatalf("Expected new connection to be rejected")
+	}
 }
 
-func TestJWTNoOperatorMode(t *testing.T) {
-	for _, login := range []bool{true, false} {
-		t.Run("", func(t *testing.T) {
-			opts := DefaultOptions()
-			if login {
-				opts.Users = append(opts.Users, &User{Username: "u", Password: "pwd"})
-			}
-			sA := RunServer(opts)
-			defer sA.Shutdown()
-			kp, _ := nkeys.CreateAccount()
-			creds := createUserWithLimit(t, kp, time.Now().Add(time.Hour), nil)
-			defer os.Remove(creds)
-			url := sA.ClientURL()
-			if login {
-				url = fmt.Sprintf("nats://u:pwd@%s:%d", sA.opts.Host, sA.opts.Port)
-			}
-			c := natsConnect(t, url, nats.UserCredentials(creds))
-			defer c.Close()
-			sA.mu.Lock()
-			defer sA.mu.Unlock()
-			if len(sA.clients) != 1 {
-				t.Fatalf("Expected exactly one client")
-			}
-			for _, v := range sA.clients {
-				if v.opts.JWT != "" {
-					t.Fatalf("Expected no jwt %v", v.opts.JWT)
-				}
-			}
-		})
+func TestJWTWrongCredentialType(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	// Present the account JWT as user credentials.
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	sig, _ := akp.Sign([]byte(info.Nonce))
+	c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n",
+		ajwt, base64.RawURLEncoding.EncodeToString(sig)))
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR 'expected user credential, got account'") {
+		t.Fatalf("Expected a credential type error, got %q", l)
+	}
+}
+
+func TestJWTSystemAccountJWTFromFile(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	syspub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	uclaim := newJWTTestUserClaims()
+	uclaim.Subject, _ = ukp.PublicKey()
+	ujwt, err := uclaim.Encode(sysKp)
+	require_NoError(t, err)
+	sysCreds := genCredsFile(t, ujwt, useed)
+	defer os.Remove(sysCreds)
+
+	jwtFile := createConfFile(t, []byte(sysJwt))
+	defer os.Remove(jwtFile)
+	// The resolver directory starts out empty.
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		system_account: %s
+		system_account_jwt: %q
+		resolver: {
+			type: full
+			dir: %s
+		}
+	`, ojwt, syspub, jwtFile, dir)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sys := s.SystemAccount()
+	require_True(t, sys != nil && sys.Name == syspub)
+	sys.mu.RLock()
+	claimJWT := sys.claimJWT
+	sys.mu.RUnlock()
+	require_True(t, claimJWT == sysJwt)
+	stored, err := ioutil.ReadFile(filepath.Join(dir, syspub+".jwt"))
+	require_NoError(t, err)
+	require_True(t, string(stored) == sysJwt)
+
+	// System account users can connect and use system services right away.
+	nc := natsConnect(t, s.ClientURL(), nats.UserCredentials(sysCreds))
+	defer nc.Close()
+	if _, err := nc.Request(serverStatsPingReqSubj, nil, time.Second); err != nil {
+		t.Fatalf("Expected a response from the system account, got %v", err)
+	}
+
+	// A JWT for another account is rejected.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	badFile := createConfFile(t, []byte(ajwt))
+	defer os.Remove(badFile)
+	opts := s.getOpts().Clone()
+	opts.SystemAccountJWT = badFile
+	opts.TrustedKeys = nil
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "system account jwt") {
+		t.Fatalf("Expected a system account jwt error, got %v", err)
+	}
+}
+
+func TestJWTAuthErrorTemplate(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	require_NoError(t, err)
+
+	// Connects with a signature from the wrong key and returns the error line.
+	connectErr := func() string {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		defer c.close()
+		var info nonceInfo
+		json.Unmarshal([]byte(l[5:]), &info)
+		sig, _ := akp.Sign([]byte(info.Nonce))
+		c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n",
+			ujwt, base64.RawURLEncoding.EncodeToString(sig)))
+		l, _ = cr.ReadString('\n')
+		return l
+	}
+
+	if l := connectErr(); l != "-ERR 'Authorization Violation'\r\n" {
+		t.Fatalf("Expected the default error, got %q", l)
+	}
+
+	opts := s.getOpts().Clone()
+	opts.AuthErrorTemplate = "{message} ({reason}) - account {account}, ref corr-{cid}"
+	s.setOpts(opts)
+
+	l := connectErr()
+	if !strings.HasPrefix(l, "-ERR 'Authorization Violation (Authentication Failure) - account "+apub+", ref corr-") {
+		t.Fatalf("Expected the templated error, got %q", l)
+	}
+
+	opts = opts.Clone()
+	opts.AuthErrorTemplate = "bad\r\ntemplate"
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected a template with line breaks to be rejected")
+	}
+}
+
+func TestJWTAccountActivationTypeMismatch(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	l := &captureErrorLogger{errCh: make(chan string, 10)}
+	s.SetLogger(l, false, false)
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Exports.Add(&jwt.Export{Subject: "private", Type: jwt.Stream, TokenReq: true})
+	fooJWT, err := fooAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+
+	// The activation is for a service, but is used for a stream import.
+	activation := jwt.NewActivationClaims(barPub)
+	activation.ImportSubject = "private"
+	activation.ImportType = jwt.Service
+	actJWT, err := activation.Encode(fooKP)
+	require_NoError(t, err)
+
+	barAC := jwt.NewAccountClaims(barPub)
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "private", Token: actJWT, Type: jwt.Stream})
+	barJWT, err := barAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	acc, _ := s.LookupAccount(barPub)
+	require_True(t, acc != nil)
+	if les := len(acc.imports.streams); les != 0 {
+		t.Fatalf("Expected imports streams len of 0, got %d", les)
+	}
+	// The import is rejected, not left pending.
+	require_True(t, len(acc.PendingImports()) == 0)
+	select {
+	case e := <-l.errCh:
+		if !strings.Contains(e, ErrActivationTypeMismatch.Error()) {
+			t.Fatalf("Expected an activation type mismatch error, got %q", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the import to be rejected")
+	}
+
+	// A direct import with the claim is rejected as well.
+	imp := &jwt.Import{Account: fooPub, Subject: "private", Token: actJWT, Type: jwt.Stream}
+	foo, _ := s.LookupAccount(fooPub)
+	if err := acc.AddStreamImportWithClaim(foo, "private", _EMPTY_, imp); err == nil {
+		t.Fatal("Expected the stream import to fail")
+	}
+}
+
+// decodeUnverifiedClaims decodes account and user JWTs without checking
+// their signature, and rejects claims named "rejected".
+func decodeUnverifiedClaims(token string) (jwt.Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var generic jwt.GenericClaims
+	if err := json.Unmarshal(payload, &generic); err != nil {
+		return nil, err
+	}
+	if generic.Name == "rejected" {
+		return nil, fmt.Errorf("rejected by verifier")
+	}
+	var claims jwt.Claims
+	switch generic.ClaimType() {
+	case jwt.AccountClaim:
+		claims = &jwt.AccountClaims{}
+	case jwt.UserClaim:
+		claims = &jwt.UserClaims{}
+	default:
+		return nil, fmt.Errorf("unexpected claim type %q", generic.ClaimType())
 	}
+	return claims, json.Unmarshal(payload, claims)
 }
 
-func TestJWTJetStreamLimits(t *testing.T) {
-	updateJwt := func(url string, creds string, pubKey string, jwt string) {
-		t.Helper()
-		c := natsConnect(t, url, nats.UserCredentials(creds))
-		defer c.Close()
-		if msg, err := c.Request(fmt.Sprintf(accUpdateEventSubjNew, pubKey), []byte(jwt), time.Second); err != nil {
-			t.Fatal("error not expected in this test", err)
-		} else {
-			content := make(map[string]interface{})
-			if err := json.Unmarshal(msg.Data, &content); err != nil {
-				t.Fatalf("%v", err)
-			} else if _, ok := content["data"]; !ok {
-				t.Fatalf("did not get an ok response got: %v", content)
-			}
+// tamperJWT invalidates the signature of the JWT, the built-in
+// verification rejects it.
+func tamperJWT(token string) string {
+	return token[:strings.LastIndex(token, ".")+1] + "bad-signature"
+}
+
+func TestJWTCustomVerifier(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	var calls int32
+	s.SetJWTVerifier(func(token string, trustedKeys []string) (jwt.Claims, error) {
+		atomic.AddInt32(&calls, 1)
+		if len(trustedKeys) == 0 {
+			return nil, fmt.Errorf("no trusted keys")
 		}
+		// The verifier is not called with the server locked.
+		s.NumClients()
+		return decodeUnverifiedClaims(token)
+	})
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, apub, tamperJWT(ajwt))
+	if acc, err := s.LookupAccount(apub); err != nil || acc == nil {
+		t.Fatalf("Expected the verifier to accept the account, got %v", err)
 	}
-	require_IdenticalLimits := func(infoLim JetStreamAccountLimits, lim jwt.JetStreamLimits) {
-		t.Helper()
-		if int64(infoLim.MaxConsumers) != lim.Consumer || int64(infoLim.MaxStreams) != lim.Streams ||
-			infoLim.MaxMemory != lim.MemoryStorage || infoLim.MaxStore != lim.DiskStorage {
-			t.Fatalf("limits do not match %v != %v", infoLim, lim)
-		}
+
+	rkp, _ := nkeys.CreateAccount()
+	rpub, _ := rkp.PublicKey()
+	rac := jwt.NewAccountClaims(rpub)
+	rac.Name = "rejected"
+	rjwt, err := rac.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, rpub, rjwt)
+	if _, err := s.LookupAccount(rpub); err == nil {
+		t.Fatal("Expected the verifier to reject the account")
 	}
-	expect_JSDisabledForAccount := func(c *nats.Conn) {
+
+	connect := func(name string) string {
 		t.Helper()
-		if _, err := c.Request("$JS.API.INFO", nil, time.Second); err != nats.ErrTimeout {
-			t.Fatalf("Unexpected error: %v", err)
-		}
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		uc.Name = name
+		ujwt, err := uc.Encode(akp)
+		require_NoError(t, err)
+		c, cr, l := newClientForServer(s)
+		defer c.close()
+		var info nonceInfo
+		json.Unmarshal([]byte(l[5:]), &info)
+		sig, _ := ukp.Sign([]byte(info.Nonce))
+		c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n",
+			tamperJWT(ujwt), base64.RawURLEncoding.EncodeToString(sig)))
+		l, _ = cr.ReadString('\n')
+		return l
 	}
-	expect_InfoError := func(c *nats.Conn) {
-		t.Helper()
-		var info JSApiAccountInfoResponse
-		if resp, err := c.Request("$JS.API.INFO", nil, time.Second); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		} else if err = json.Unmarshal(resp.Data, &info); err != nil {
-			t.Fatalf("response1 %v got error %v", string(resp.Data), err)
-		} else if info.Error == nil {
-			t.Fatalf("expected error")
-		}
+	if l := connect("accepted"); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected the verifier to accept the user, got %q", l)
 	}
-	validate_limits := func(c *nats.Conn, expectedLimits jwt.JetStreamLimits) {
-		t.Helper()
-		var info JSApiAccountInfoResponse
-		if resp, err := c.Request("$JS.API.INFO", nil, time.Second); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		} else if err = json.Unmarshal(resp.Data, &info); err != nil {
-			t.Fatalf("response1 %v got error %v", string(resp.Data), err)
-		} else {
-			require_IdenticalLimits(info.Limits, expectedLimits)
-		}
+	if l := connect("rejected"); !strings.Contains(l, "Authorization Violation") {
+		t.Fatalf("Expected the verifier to reject the user, got %q", l)
 	}
-	// create system account
-	sysKp, _ := nkeys.CreateAccount()
-	sysPub, _ := sysKp.PublicKey()
-	claim := jwt.NewAccountClaims(sysPub)
-	sysJwt, err := claim.Encode(oKp)
-	require_NoError(t, err)
-	sysUKp, _ := nkeys.CreateUser()
-	sysUSeed, _ := sysUKp.Seed()
-	uclaim := newJWTTestUserClaims()
-	uclaim.Subject, _ = sysUKp.PublicKey()
-	sysUserJwt, err := uclaim.Encode(sysKp)
-	require_NoError(t, err)
-	sysKp.Seed()
-	sysCreds := genCredsFile(t, sysUserJwt, sysUSeed)
-	// limits to apply and check
-	limits1 := jwt.JetStreamLimits{MemoryStorage: 1024 * 1024, DiskStorage: 2048 * 1024, Streams: 1, Consumer: 2}
-	// has valid limits that would fail when incorrectly applied twice
-	limits2 := jwt.JetStreamLimits{MemoryStorage: 4096 * 1024, DiskStorage: 8192 * 1024, Streams: 3, Consumer: 4}
-	// limits exceeding actual configured value of DiskStorage
-	limitsExceeded := jwt.JetStreamLimits{MemoryStorage: 8192 * 1024, DiskStorage: 16384 * 1024, Streams: 5, Consumer: 6}
-	// create account using jetstream with both limits
+	if n := atomic.LoadInt32(&calls); n < 4 {
+		t.Fatalf("Expected the verifier to be used for all JWTs, got %d calls", n)
+	}
+
+	// Without the verifier, tampered JWTs are rejected again.
+	s.SetJWTVerifier(nil)
+	if l := connect("accepted"); !strings.Contains(l, "Authorization Violation") {
+		t.Fatalf("Expected the built-in verification to reject the user, got %q", l)
+	}
+}
+
+func TestJWTCustomVerifierUserClaimsApplied(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	s.SetJWTVerifier(func(token string, trustedKeys []string) (jwt.Claims, error) {
+		return decodeUnverifiedClaims(token)
+	})
+
 	akp, _ := nkeys.CreateAccount()
-	aPub, _ := akp.PublicKey()
-	claim = jwt.NewAccountClaims(aPub)
-	claim.Limits.JetStreamLimits = limits1
-	aJwt1, err := claim.Encode(oKp)
-	require_NoError(t, err)
-	claim.Limits.JetStreamLimits = limits2
-	aJwt2, err := claim.Encode(oKp)
-	require_NoError(t, err)
-	claim.Limits.JetStreamLimits = limitsExceeded
-	aJwtLimitsExceeded, err := claim.Encode(oKp)
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
 	require_NoError(t, err)
-	claim.Limits.JetStreamLimits = jwt.JetStreamLimits{} // disabled
-	aJwt4, err := claim.Encode(oKp)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	// The built-in verification would reject this user.
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	uc := jwt.NewUserClaims(upub)
+	uc.Limits.Subs = 1
+	ujwt, err := uc.Encode(akp)
 	require_NoError(t, err)
-	// account user
-	uKp, _ := nkeys.CreateUser()
-	uSeed, _ := uKp.Seed()
-	uclaim = newJWTTestUserClaims()
-	uclaim.Subject, _ = uKp.PublicKey()
-	userJwt, err := uclaim.Encode(akp)
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	sig, _ := ukp.Sign([]byte(info.Nonce))
+	c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n",
+		tamperJWT(ujwt), base64.RawURLEncoding.EncodeToString(sig)))
+	expectPong(t, cr)
+
+	// The user limits and account apply.
+	c.mu.Lock()
+	msubs := c.msubs
+	account := c.authAccountName()
+	c.mu.Unlock()
+	if msubs != 1 {
+		t.Fatalf("Expected the user subscription limit to apply, got %d", msubs)
+	}
+	if account != apub {
+		t.Fatalf("Expected account %q, got %q", apub, account)
+	}
+
+	// And so do revocations.
+	acc, err := s.LookupAccount(apub)
 	require_NoError(t, err)
-	userCreds := genCredsFile(t, userJwt, uSeed)
-	dir, err := ioutil.TempDir("", "srv")
+	s.revMu.Lock()
+	s.revoked = map[string]int64{upub: time.Now().Unix()}
+	s.revMu.Unlock()
+	go io.Copy(ioutil.Discard, cr)
+	if n := acc.closeRevokedClients(); n != 1 {
+		t.Fatalf("Expected the revoked user to be disconnected, got %d", n)
+	}
+}
+
+func TestJWTCustomVerifierPushedAccount(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
 	require_NoError(t, err)
+
+	dir := createDir(t, "srv")
 	defer os.RemoveAll(dir)
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
-		jetstream: {max_mem_store: 10Mb, max_file_store: 10Mb}
 		operator: %s
+		system_account: %s
 		resolver: {
 			type: full
 			dir: %s
 		}
-		system_account: %s
-    `, ojwt, dir, sysPub)))
+		resolver_preload: {
+			%s: %s
+		}
+	`, ojwt, syspub, dir, syspub, sysjwt)))
 	defer os.Remove(conf)
-	s, opts := RunServerWithConfig(conf)
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	port := opts.Port
-	updateJwt(s.ClientURL(), sysCreds, sysPub, sysJwt)
-	sys := natsConnect(t, s.ClientURL(), nats.UserCredentials(sysCreds))
-	expect_InfoError(sys)
-	sys.Close()
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt1)
-	c := natsConnect(t, s.ClientURL(), nats.UserCredentials(userCreds), nats.ReconnectWait(200*time.Millisecond))
-	defer c.Close()
-	validate_limits(c, limits1)
-	// keep using the same connection
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
-	validate_limits(c, limits2)
-	// keep using the same connection but do NOT CHANGE anything.
-	// This tests if the jwt is applied a second time (would fail)
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
-	validate_limits(c, limits2)
-	// keep using the same connection. This update EXCEEDS LIMITS
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
-	validate_limits(c, limits2)
-	// disable test after failure
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt4)
-	expect_InfoError(c)
-	// re enable, again testing with a value that can't be applied twice
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
-	validate_limits(c, limits2)
-	// disable test no prior failure
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt4)
-	expect_InfoError(c)
-	// Wrong limits form start
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
-	expect_JSDisabledForAccount(c)
-	// enable js but exceed limits. Followed by fix via restart
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
-	validate_limits(c, limits2)
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwtLimitsExceeded)
-	validate_limits(c, limits2)
-	s.Shutdown()
-	conf = createConfFile(t, []byte(fmt.Sprintf(`
-		listen: %d
-		jetstream: {max_mem_store: 20Mb, max_file_store: 20Mb}
+
+	s.SetJWTVerifier(func(token string, trustedKeys []string) (jwt.Claims, error) {
+		return decodeUnverifiedClaims(token)
+	})
+
+	sysc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, syskp))
+	defer sysc.Close()
+
+	push := func(pub, token string) string {
+		t.Helper()
+		resp, err := sysc.Request(fmt.Sprintf(accUpdateEventSubjNew, pub), []byte(token), time.Second)
+		require_NoError(t, err)
+		return string(resp.Data)
+	}
+
+	// The built-in verification would reject this one.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+	if resp := push(apub, tamperJWT(ajwt)); !strings.Contains(resp, "jwt updated") {
+		t.Fatalf("Expected the verifier to accept the account, got %s", resp)
+	}
+	require_JWTPresent(t, dir, apub)
+
+	rkp, _ := nkeys.CreateAccount()
+	rpub, _ := rkp.PublicKey()
+	rac := jwt.NewAccountClaims(rpub)
+	rac.Name = "rejected"
+	rjwt, err := rac.Encode(oKp)
+	require_NoError(t, err)
+	if resp := push(rpub, rjwt); !strings.Contains(resp, "rejected by verifier") {
+		t.Fatalf("Expected the verifier to reject the account, got %s", resp)
+	}
+	require_JWTAbsent(t, dir, rpub)
+}
+
+func TestJWTAccountShadowSubscriptionEvents(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	events := make(chan ShadowSubscriptionEvent, 10)
+	s.SetShadowSubscriptionHandler(func(e ShadowSubscriptionEvent) { events <- e })
+
+	fooKP, _ := nkeys.CreateAccount()
+	fooPub, _ := fooKP.PublicKey()
+	fooAC := jwt.NewAccountClaims(fooPub)
+	fooAC.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	fooJWT, err := fooAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, fooPub, fooJWT)
+
+	barKP, _ := nkeys.CreateAccount()
+	barPub, _ := barKP.PublicKey()
+	barAC := jwt.NewAccountClaims(barPub)
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "foo", To: "import", Type: jwt.Stream})
+	barJWT, err := barAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, barPub, barJWT)
+
+	c, cr, cs := createClient(t, s, barKP)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+
+	expectEvent := func(created bool) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Created != created || e.Account != fooPub || e.Importer != barPub ||
+				e.Subject != "foo" || e.Client != c.cid {
+				t.Fatalf("Unexpected shadow subscription event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a shadow subscription event (created=%v)", created)
+		}
+	}
+
+	c.parseAsync("SUB import.foo 1\r\nPING\r\n")
+	expectPong(t, cr)
+	expectEvent(true)
+
+	// Removing the import removes the shadow subscription.
+	barAC = jwt.NewAccountClaims(barPub)
+	barJWT, _ = barAC.Encode(oKp)
+	addAccountToMemResolver(s, barPub, barJWT)
+	acc, _ := s.LookupAccount(barPub)
+	s.UpdateAccountClaims(acc, barAC)
+	expectEvent(false)
+
+	// Adding it back creates it again.
+	barAC.Imports.Add(&jwt.Import{Account: fooPub, Subject: "foo", To: "import", Type: jwt.Stream})
+	barJWT, _ = barAC.Encode(oKp)
+	addAccountToMemResolver(s, barPub, barJWT)
+	s.UpdateAccountClaims(acc, barAC)
+	expectEvent(true)
+
+	// As does unsubscribing.
+	c.parseAsync("UNSUB 1\r\nPING\r\n")
+	expectPong(t, cr)
+	expectEvent(false)
+
+	select {
+	case e := <-events:
+		t.Fatalf("Unexpected shadow subscription event: %+v", e)
+	default:
+	}
+}
+
+func TestJWTAccountDefaultResponsePermission(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt := encodeClaimsWithExt(t, jwt.NewAccountClaims(apub), oKp, map[string]interface{}{
+		"default_resp": map[string]interface{}{"max": 5, "ttl": int64(time.Minute)},
+	})
+	addAccountToMemResolver(s, apub, ajwt)
+
+	connect := func(pubAllow string, resp *jwt.ResponsePermission) (*testAsyncClient, *bufio.Reader) {
+		t.Helper()
+		ukp, _ := nkeys.CreateUser()
+		upub, _ := ukp.PublicKey()
+		uc := jwt.NewUserClaims(upub)
+		uc.Permissions.Sub.Allow.Add("requests")
+		if pubAllow != _EMPTY_ {
+			uc.Permissions.Pub.Allow.Add(pubAllow)
+		}
+		uc.Permissions.Resp = resp
+		ujwt, err := uc.Encode(akp)
+		require_NoError(t, err)
+		c, cr, l := newClientForServer(s)
+		var info nonceInfo
+		json.Unmarshal([]byte(l[5:]), &info)
+		sig, _ := ukp.Sign([]byte(info.Nonce))
+		c.parseAsync(fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\"}\r\nPING\r\n",
+			ujwt, base64.RawURLEncoding.EncodeToString(sig)))
+		expectPong(t, cr)
+		return c, cr
+	}
+	perms := func(c *testAsyncClient) (*ResponsePermission, *Sublist) {
+		t.Helper()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.perms.resp, c.perms.pub.allow
+	}
+
+	// A responder restricted to allowed subjects without its own response
+	// permission gets the account's.
+	c, _ := connect("foo", nil)
+	defer c.close()
+	resp, pubAllow := perms(c)
+	if resp == nil || resp.MaxMsgs != 5 || resp.Expires != time.Minute {
+		t.Fatalf("Expected the account default response permission, got %+v", resp)
+	}
+	if pubAllow == nil || pubAllow.Count() != 1 {
+		t.Fatal("Expected publishing to be limited to the allowed subject and replies")
+	}
+
+	// Users that are not restricted get it too, but can still publish anywhere.
+	c2, cr2 := connect(_EMPTY_, nil)
+	defer c2.close()
+	resp, pubAllow = perms(c2)
+	if resp == nil || resp.MaxMsgs != 5 || resp.Expires != time.Minute {
+		t.Fatalf("Expected the account default response permission, got %+v", resp)
+	}
+	if pubAllow != nil {
+		t.Fatal("Expected publishing not to be limited")
+	}
+	c2.parseAsync("SUB requests 1\r\nPUB requests 2\r\nok\r\nPING\r\n")
+	if l, err := cr2.ReadString('\n'); err != nil || !strings.HasPrefix(l, "MSG requests 1 2") {
+		t.Fatalf("Expected the message to be delivered, got %q (%v)", l, err)
+	}
+
+	// Its own response permission takes precedence.
+	c3, _ := connect(_EMPTY_, &jwt.ResponsePermission{MaxMsgs: 22, Expires: time.Second})
+	defer c3.close()
+	resp, _ = perms(c3)
+	if resp == nil || resp.MaxMsgs != 22 || resp.Expires != time.Second {
+		t.Fatalf("Expected the user response permission, got %+v", resp)
+	}
+}
+
+func TestAccountNATSResolverCacheWarmUp(t *testing.T) {
+	newAccount := func() (string, string, nats.Option) {
+		t.Helper()
+		kp, _ := nkeys.CreateAccount()
+		pub, _ := kp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(pub).Encode(oKp)
+		require_NoError(t, err)
+		return pub, ajwt, createUserCreds(t, nil, kp)
+	}
+	syspub, sysjwt, _ := newAccount()
+	apub, ajwt, aCreds := newAccount()
+	bpub, bjwt, bCreds := newAccount()
+	cpub, cjwt, _ := newAccount()
+
+	dirA := createDir(t, "srv-a")
+	defer os.RemoveAll(dirA)
+	dirC := createDir(t, "srv-c")
+	defer os.RemoveAll(dirC)
+	writeJWT(t, dirA, syspub, sysjwt)
+	writeJWT(t, dirA, apub, ajwt)
+	writeJWT(t, dirA, bpub, bjwt)
+	writeJWT(t, dirA, cpub, cjwt)
+
+	confA := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-A
 		operator: %s
+		system_account: %s
 		resolver: {
 			type: full
 			dir: %s
 		}
+		cluster {
+			name: clust
+			listen: -1
+			no_advertise: true
+		}
+	`, ojwt, syspub, dirA)))
+	defer os.Remove(confA)
+	sA, _ := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+
+	// Accounts a and b are in use on A, c is only stored there.
+	for _, creds := range []nats.Option{aCreds, bCreds} {
+		nc := natsConnect(t, sA.ClientURL(), creds)
+		nc.Close()
+	}
+
+	confC := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		server_name: srv-C
+		operator: %s
 		system_account: %s
-    `, port, ojwt, dir, sysPub)))
-	defer os.Remove(conf)
-	s, _ = RunServerWithConfig(conf)
-	defer s.Shutdown()
-	c.Flush() // force client to discover the disconnect
-	checkClientsCount(t, s, 1)
-	validate_limits(c, limitsExceeded)
-	s.Shutdown()
-	// disable jetstream test
-	conf = createConfFile(t, []byte(fmt.Sprintf(`
-		listen: %d
+		resolver: {
+			type: cache
+			dir: %s
+			ttl: "10s"
+			warm: true
+		}
+		cluster {
+			name: clust
+			listen: -1
+			no_advertise: true
+			routes [
+				nats-route://localhost:%d
+			]
+		}
+	`, ojwt, syspub, dirC, sA.opts.Cluster.Port)))
+	defer os.Remove(confC)
+	sC, _ := RunServerWithConfig(confC)
+	defer sC.Shutdown()
+
+	// The cache is populated without any connection to C.
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		for _, pub := range []string{apub, bpub} {
+			if _, err := os.Stat(filepath.Join(dirC, pub+".jwt")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require_JWTAbsent(t, dirC, cpub)
+
+	nc := natsConnect(t, sC.ClientURL(), aCreds)
+	nc.Close()
+}
+
+func TestAccountNATSResolverSyncJitter(t *testing.T) {
+	syskp, _ := nkeys.CreateAccount()
+	syspub, _ := syskp.PublicKey()
+	sysjwt, err := jwt.NewAccountClaims(syspub).Encode(oKp)
+	require_NoError(t, err)
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
+	writeJWT(t, dir, syspub, sysjwt)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
 		operator: %s
+		system_account: %s
 		resolver: {
 			type: full
 			dir: %s
+			interval: "100ms"
+			jitter: 1
 		}
-		system_account: %s
-    `, port, ojwt, dir, sysPub)))
+	`, ojwt, syspub, dir)))
 	defer os.Remove(conf)
-	s, _ = RunServerWithConfig(conf)
+	s, opts := RunServerWithConfig(conf)
 	defer s.Shutdown()
-	c.Flush() // force client to discover the disconnect
-	checkClientsCount(t, s, 1)
-	expect_JSDisabledForAccount(c)
-	// test that it stays disabled
-	updateJwt(s.ClientURL(), sysCreds, aPub, aJwt2)
-	expect_JSDisabledForAccount(c)
-	c.Close()
-}
-
-func TestJWTUserRevocation(t *testing.T) {
-	createAccountAndUser := func(done chan struct{}, pubKey, jwt1, jwt2, creds1, creds2 *string) {
-		t.Helper()
-		kp, _ := nkeys.CreateAccount()
-		*pubKey, _ = kp.PublicKey()
-		claim := jwt.NewAccountClaims(*pubKey)
-		var err error
-		*jwt1, err = claim.Encode(oKp)
-		require_NoError(t, err)
+	if cfg := opts.AccountResolverConfig(); cfg.Jitter != 1 {
+		t.Fatalf("Expected jitter of 1, got %v", cfg.Jitter)
+	}
 
-		ukp, _ := nkeys.CreateUser()
-		seed, _ := ukp.Seed()
-		upub, _ := ukp.PublicKey()
-		uclaim := newJWTTestUserClaims()
-		uclaim.Subject = upub
+	// Record when the server sends its sync requests.
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, syskp))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, accPackReqSubj)
+	natsFlush(t, nc)
+	natsNexMsg(t, sub, time.Second)
+	last := time.Now()
+	minGap, maxGap := time.Hour, time.Duration(0)
+	for i := 0; i < 10; i++ {
+		natsNexMsg(t, sub, time.Second)
+		now := time.Now()
+		gap := now.Sub(last)
+		last = now
+		if gap < minGap {
+			minGap = gap
+		}
+		if gap > maxGap {
+			maxGap = gap
+		}
+	}
+	// Waits are between the interval and twice of it, and not all the same.
+	if minGap < 80*time.Millisecond || maxGap > 300*time.Millisecond {
+		t.Fatalf("Expected waits between syncs of 100ms to 200ms, got %v to %v", minGap, maxGap)
+	}
+	if maxGap-minGap < 30*time.Millisecond {
+		t.Fatalf("Expected waits between syncs to be spread, got %v to %v", minGap, maxGap)
+	}
 
-		ujwt1, err := uclaim.Encode(kp)
-		require_NoError(t, err)
-		*creds1 = genCredsFile(t, ujwt1, seed)
+	// Jitter is rejected out of range, when not a number and for cache resolvers.
+	for _, resolver := range []string{
+		fmt.Sprintf(`{type: full, dir: %q, jitter: 1.5}`, dir),
+		fmt.Sprintf(`{type: cache, dir: %q, jitter: 0.5}`, dir),
+		fmt.Sprintf(`{type: full, dir: %q, jitter: "10%%"}`, dir),
+		fmt.Sprintf(`{type: full, dir: %q, jitter: true}`, dir),
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf(`
+			operator: %s
+			system_account: %s
+			resolver: %s
+		`, ojwt, syspub, resolver)))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "jitter") {
+			t.Fatalf("Expected a jitter error for %s, got %v", resolver, err)
+		}
+	}
+}
 
-		// create updated claim need to assure that issue time differs
-		claim.Revoke(upub) // revokes all jwt from now on
-		time.Sleep(time.Millisecond * 1100)
-		*jwt2, err = claim.Encode(oKp)
-		require_NoError(t, err)
+func TestJWTAccountJetStreamAPIDeny(t *testing.T) {
+	sysKp, _ := nkeys.CreateAccount()
+	sysPub, _ := sysKp.PublicKey()
+	sysJwt, err := jwt.NewAccountClaims(sysPub).Encode(oKp)
+	require_NoError(t, err)
 
-		ujwt2, err := uclaim.Encode(kp)
-		require_NoError(t, err)
-		*creds2 = genCredsFile(t, ujwt2, seed)
+	akp, _ := nkeys.CreateAccount()
+	aPub, _ := akp.PublicKey()
+	claim := jwt.NewAccountClaims(aPub)
+	claim.Limits.JetStreamLimits = jwt.JetStreamLimits{MemoryStorage: 1024 * 1024, DiskStorage: 1024 * 1024, Streams: 2, Consumer: 2}
+	aJwt := encodeClaimsWithExt(t, claim, oKp, map[string]interface{}{
+		"js_api_deny": []string{"stream_delete", "bogus"},
+	})
 
-		done <- struct{}{}
-	}
-	// Create Accounts and corresponding revoked and non revoked user creds. Do so concurrently to speed up the test
-	doneChan := make(chan struct{}, 2)
-	defer close(doneChan)
-	var syspub, sysjwt, dummy1, sysCreds, dummyCreds string
-	go createAccountAndUser(doneChan, &syspub, &sysjwt, &dummy1, &sysCreds, &dummyCreds)
-	var apub, ajwt1, ajwt2, aCreds1, aCreds2 string
-	go createAccountAndUser(doneChan, &apub, &ajwt1, &ajwt2, &aCreds1, &aCreds2)
-	for i := 0; i < cap(doneChan); i++ {
-		<-doneChan
-	}
-	defer os.Remove(sysCreds)
-	defer os.Remove(dummyCreds)
-	defer os.Remove(aCreds1)
-	defer os.Remove(aCreds2)
-	dirSrv := createDir(t, "srv")
-	defer os.RemoveAll(dirSrv)
+	dir := createDir(t, "srv")
+	defer os.RemoveAll(dir)
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: -1
+		jetstream: {max_mem_store: 10Mb, max_file_store: 10Mb, store_dir: %q}
 		operator: %s
-		system_account: %s
-		resolver: {
-			type: full
-			dir: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
 		}
-    `, ojwt, syspub, dirSrv)))
+		system_account: %s
+	`, dir, ojwt, sysPub, sysJwt, aPub, aJwt, sysPub)))
 	defer os.Remove(conf)
-	srv, _ := RunServerWithConfig(conf)
-	defer srv.Shutdown()
-	updateJwt(t, srv.ClientURL(), sysCreds, syspub, sysjwt, 1) // update system account jwt
-	updateJwt(t, srv.ClientURL(), sysCreds, apub, ajwt1, 1)    // set account jwt without revocation
-	// use credentials that will be revoked ans assure that the connection will be disconnected
-	nc := natsConnect(t, srv.ClientURL(), nats.UserCredentials(aCreds1),
-		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
-			if lErr := conn.LastError(); lErr != nil && strings.Contains(lErr.Error(), "Authentication Revoked") {
-				doneChan <- struct{}{}
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 1)
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			select {
+			case errCh <- err:
+			default:
 			}
 		}))
 	defer nc.Close()
-	// update account jwt to contain revocation
-	if passCnt := updateJwt(t, srv.ClientURL(), sysCreds, apub, ajwt2, 1); passCnt != 1 {
-		t.Fatalf("Expected jwt update to pass")
+
+	// Other operations are permitted.
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "foo"),
+		[]byte(`{"name":"foo","subjects":["foo"],"storage":"memory"}`), time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error creating stream: %+v", scResp.Error)
+	}
+
+	if _, err := nc.Request(fmt.Sprintf(JSApiStreamDeleteT, "foo"), nil, 250*time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected the stream delete request to time out, got %v", err)
 	}
-	// assure that nc got disconnected due to the revocation
 	select {
-	case <-doneChan:
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Expected a permissions violation, got %v", err)
+		}
 	case <-time.After(time.Second):
-		t.Fatalf("Expected connection to have failed")
+		t.Fatal("Expected a permissions violation")
 	}
-	// try again with old credentials. Expected to fail
-	if nc1, err := nats.Connect(srv.ClientURL(), nats.UserCredentials(aCreds1)); err == nil {
-		nc1.Close()
-		t.Fatalf("Expected revoked credentials to fail")
+
+	// The stream is still there.
+	resp, err = nc.Request(fmt.Sprintf(JSApiStreamInfoT, "foo"), nil, time.Second)
+	require_NoError(t, err)
+	var siResp JSApiStreamInfoResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &siResp))
+	if siResp.Error != nil {
+		t.Fatalf("Expected the stream to still exist, got %+v", siResp.Error)
+	}
+}
+
+func TestJWTAccountStreamImportFilter(t *testing.T) {
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	expKP, _ := nkeys.CreateAccount()
+	expPub, _ := expKP.PublicKey()
+	impKP, _ := nkeys.CreateAccount()
+	impPub, _ := impKP.PublicKey()
+
+	expAC := jwt.NewAccountClaims(expPub)
+	expAC.Exports.Add(&jwt.Export{Subject: "foo.>", Type: jwt.Stream})
+	expJWT, err := expAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, expPub, expJWT)
+
+	impAC := jwt.NewAccountClaims(impPub)
+	impAC.Imports.Add(&jwt.Import{Account: expPub, Subject: "foo.>", To: "imp", Type: jwt.Stream})
+	encodeImp := func(filter string) string {
+		t.Helper()
+		return encodeClaimsWithExt(t, impAC, oKp, map[string]interface{}{
+			"imports": []map[string]interface{}{
+				{"account": expPub, "subject": "foo.>", "to": "imp", "type": "stream", "filter": filter},
+			},
+		})
+	}
+	addAccountToMemResolver(s, impPub, encodeImp("foo.bar.*"))
+
+	c, cr, cs := createClient(t, s, impKP)
+	defer c.close()
+	c.parseAsync(cs)
+	expectPong(t, cr)
+	c.parseAsync("SUB imp.> 1\r\nPING\r\n")
+	expectPong(t, cr)
+
+	checkShadow := func(expected string) {
+		t.Helper()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		shadow := c.subs["1"].shadow
+		if len(shadow) != 1 || string(shadow[0].subject) != expected {
+			t.Fatalf("Expected a shadow subscription on %q, got %+v", expected, shadow)
+		}
+	}
+	checkShadow("foo.bar.*")
+
+	pc, pr, ps := createClient(t, s, expKP)
+	defer pc.close()
+	pc.parseAsync(ps)
+	expectPong(t, pr)
+
+	received := func() []string {
+		t.Helper()
+		pc.parseAsync("PUB foo.bar.1 2\r\nok\r\nPUB foo.baz 2\r\nok\r\nPUB foo.bar.1.2 2\r\nok\r\nPING\r\n")
+		expectPong(t, pr)
+		c.parseAsync("PING\r\n")
+		var subjects []string
+		for {
+			l, err := cr.ReadString('\n')
+			require_NoError(t, err)
+			if strings.HasPrefix(l, "PONG") {
+				return subjects
+			}
+			if strings.HasPrefix(l, "MSG ") {
+				subjects = append(subjects, strings.Fields(l)[1])
+				// Skip the payload.
+				if _, err := cr.ReadString('\n'); err != nil {
+					t.Fatalf("Error reading payload: %v", err)
+				}
+			}
+		}
+	}
+	// Only the subjects matching the filter are delivered.
+	if subjects := received(); len(subjects) != 1 || subjects[0] != "imp.foo.bar.1" {
+		t.Fatalf("Expected only %q, got %v", "imp.foo.bar.1", subjects)
+	}
+
+	// Removing the filter delivers the full stream to existing subscriptions.
+	impJWT, err := impAC.Encode(oKp)
+	require_NoError(t, err)
+	addAccountToMemResolver(s, impPub, impJWT)
+	impAcc, err := s.LookupAccount(impPub)
+	require_NoError(t, err)
+	require_NoError(t, s.updateAccountWithClaimJWT(impAcc, impJWT))
+	checkShadow("foo.>")
+	if subjects := received(); len(subjects) != 3 {
+		t.Fatalf("Expected all 3 messages, got %v", subjects)
+	}
+
+	// A filter outside of the imported subject is rejected.
+	expAcc, err := s.LookupAccount(expPub)
+	require_NoError(t, err)
+	if err := impAcc.SetStreamImportFilter(expAcc, "foo.>", "bar.*"); err != ErrStreamImportBadFilter {
+		t.Fatalf("Expected %v, got %v", ErrStreamImportBadFilter, err)
+	}
+	if err := impAcc.SetStreamImportFilter(expAcc, "baz", "baz"); err != ErrMissingStreamImport {
+		t.Fatalf("Expected %v, got %v", ErrMissingStreamImport, err)
 	}
-	// Assure new creds pass
-	nc2 := natsConnect(t, srv.ClientURL(), nats.UserCredentials(aCreds2))
-	defer nc2.Close()
 }
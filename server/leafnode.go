@@ -603,13 +603,13 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	}
 	c.mu.Unlock()
 
-	var nonce [nonceLen]byte
+	nonce := make([]byte, s.nonceLen())
 
 	// Grab server variables
 	s.mu.Lock()
 	info := s.copyLeafNodeInfo()
 	if !solicited {
-		s.generateNonce(nonce[:])
+		s.generateNonce(nonce)
 	}
 	clusterName := s.info.Cluster
 	s.mu.Unlock()
@@ -724,8 +724,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	} else {
 		// Send our info to the other side.
 		// Remember the nonce we sent here for signatures, etc.
-		c.nonce = make([]byte, nonceLen)
-		copy(c.nonce, nonce[:])
+		c.nonce = nonce
 		info.Nonce = string(c.nonce)
 		info.CID = c.cid
 		b, _ := json.Marshal(info)
@@ -1760,6 +1759,11 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 		return
 	}
 
+	// Bring back service imports torn down for being idle that this message is for.
+	if atomic.LoadInt32(&acc.siIdle) > 0 {
+		acc.reinstateIdleServiceImports(string(c.pa.subject))
+	}
+
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
 	var r *SublistResult
@@ -1802,3 +1802,76 @@ func TestLeafNodeLoopDetectedDueToReconnect(t *testing.T) {
 	checkLeafNodeConnected(t, s)
 	checkLeafNodeConnected(t, sl)
 }
+
+func TestLeafNodeServiceImportIdleTimeout(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		service_import_idle_timeout: "100ms"
+		leafnodes {
+			listen: 127.0.0.1:-1
+		}
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				exports: [{service: "svc"}]
+			}
+			B {
+				users: [{user: b, password: b}]
+				imports: [{service: {account: A, subject: "svc"}}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	hub, hopts := RunServerWithConfig(conf)
+	defer hub.Shutdown()
+
+	lconf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		leafnodes {
+			remotes [ { url: "nats://b:b@127.0.0.1:%d" } ]
+		}
+	`, hopts.LeafNode.Port)))
+	defer os.Remove(lconf)
+	leaf, _ := RunServerWithConfig(lconf)
+	defer leaf.Shutdown()
+
+	checkLeafNodeConnected(t, hub)
+	checkLeafNodeConnected(t, leaf)
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:a@%s:%d", hopts.Host, hopts.Port))
+	defer nca.Close()
+	natsSub(t, nca, "svc", func(m *nats.Msg) {
+		m.Respond([]byte("ok"))
+	})
+	natsFlush(t, nca)
+
+	nc := natsConnect(t, leaf.ClientURL())
+	defer nc.Close()
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		_, err := nc.Request("svc", nil, 250*time.Millisecond)
+		return err
+	})
+
+	accB, err := hub.LookupAccount("B")
+	require_NoError(t, err)
+	waitIdle := func() {
+		t.Helper()
+		checkFor(t, time.Second, 20*time.Millisecond, func() error {
+			accB.mu.RLock()
+			defer accB.mu.RUnlock()
+			if accB.imports.services["svc"].sid != nil {
+				return fmt.Errorf("Service import subscription still present")
+			}
+			return nil
+		})
+	}
+
+	// Requests from the leafnode keep reaching the hub while the import is
+	// idle, and set it up again, for as many times as it gets idle.
+	for i := 0; i < 2; i++ {
+		waitIdle()
+		if _, err := nc.Request("svc", nil, time.Second); err != nil {
+			t.Fatalf("Error on request after idle: %v", err)
+		}
+	}
+}
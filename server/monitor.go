@@ -109,6 +109,7 @@ type ConnInfo struct {
 	LastActivity   time.Time   `json:"last_activity"`
 	Stop           *time.Time  `json:"stop,omitempty"`
 	Reason         string      `json:"reason,omitempty"`
+	AuthError      string      `json:"auth_error,omitempty"`
 	RTT            string      `json:"rtt,omitempty"`
 	Uptime         string      `json:"uptime"`
 	Idle           string      `json:"idle"`
@@ -1033,6 +1034,8 @@ type Varz struct {
 	InBytes           int64             `json:"in_bytes"`
 	OutBytes          int64             `json:"out_bytes"`
 	SlowConsumers     int64             `json:"slow_consumers"`
+	AuthTimers        int64             `json:"auth_timers"`
+	AuthExpirations   int64             `json:"auth_expirations"`
 	Subscriptions     uint32            `json:"subscriptions"`
 	HTTPReqStats      map[string]uint64 `json:"http_req_stats"`
 	ConfigLoadTime    time.Time         `json:"config_load_time"`
@@ -1334,6 +1337,8 @@ func (s *Server) updateVarzRuntimeFields(v *Varz, forceUpdate bool, pcpu float64
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.AuthTimers = atomic.LoadInt64(&s.authTimers)
+	v.AuthExpirations = atomic.LoadInt64(&s.authExpirations)
 	// FIXME(dlc) - make this multi-account aware.
 	v.Subscriptions = s.gacc.sl.Count()
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
@@ -1913,11 +1918,62 @@ func (reason ClosedState) String() string {
 		return "No Responders Requires Headers"
 	case ClusterNameConflict:
 		return "Cluster Name Conflict"
+	case MaxUserConnectionsExceeded:
+		return "Maximum User Connections Exceeded"
+	case AccountDrained:
+		return "Account Drained"
+	case AccountAuthenticationExpired:
+		return "Account Authentication Expired"
+	case Kicked:
+		return "Kicked"
+	case AccountInMaintenance:
+		return "Account In Maintenance"
+	case AccountRequiresTLS:
+		return "Account Requires TLS"
 	}
 
 	return "Unknown State"
 }
 
+// Err returns the error matching the reason a connection was closed, or
+// nil if there is none. Unlike the string returned by String(), or the
+// error sent to the client, these errors can be compared against.
+func (reason ClosedState) Err() error {
+	switch reason {
+	case AuthenticationTimeout:
+		return ErrAuthTimeout
+	case AuthenticationViolation:
+		return ErrAuthentication
+	case AuthenticationExpired:
+		return ErrJWTExpired
+	case AccountAuthenticationExpired:
+		return ErrJWTAccountExpired
+	case Revocation:
+		return ErrJWTRevoked
+	case MaxConnectionsExceeded:
+		return ErrTooManyConnections
+	case MaxAccountConnectionsExceeded:
+		return ErrTooManyAccountConnections
+	case MaxUserConnectionsExceeded:
+		return ErrTooManyUserConnections
+	case MaxSubscriptionsExceeded:
+		return ErrTooManySubs
+	case MaxPayloadExceeded:
+		return ErrMaxPayload
+	case MaxControlLineExceeded:
+		return ErrMaxControlLine
+	case MissingAccount:
+		return ErrMissingAccount
+	case AccountDrained:
+		return ErrAccountDraining
+	case AccountInMaintenance:
+		return ErrAccountInMaintenance
+	case AccountRequiresTLS:
+		return ErrAccountRequiresTLS
+	}
+	return nil
+}
+
 // LeafzOptions are options passed to Leafz
 type AccountzOptions struct {
 	// Account indicates that Accountz will return details for the account
@@ -1926,27 +1982,32 @@ type AccountzOptions struct {
 
 type ExtImport struct {
 	jwt.Import
-	Invalid bool `json:"invalid"`
+	Invalid    bool   `json:"invalid"`
+	Deprecated string `json:"deprecated,omitempty"`
 }
 
 type ExtExport struct {
 	jwt.Export
 	ApprovedAccounts []string `json:"approved_accounts,omitempty"`
+	Deprecated       string   `json:"deprecated,omitempty"`
 }
 
 type AccountInfo struct {
-	AccountName string             `json:"account_name"`
-	LastUpdate  time.Time          `json:"update_time,omitempty"`
-	Expired     bool               `json:"expired"`
-	Complete    bool               `json:"complete"`
-	JetStream   bool               `json:"jetstream_enabled"`
-	LeafCnt     int                `json:"leafnode_connections"`
-	ClientCnt   int                `json:"client_connections"`
-	SubCnt      uint32             `json:"subscriptions"`
-	Exports     []ExtExport        `json:"exports"`
-	Imports     []ExtImport        `json:"imports"`
-	Jwt         string             `json:"jwt,omitempty"`
-	Claim       *jwt.AccountClaims `json:"decoded_jwt,omitempty"`
+	AccountName string              `json:"account_name"`
+	NameTag     string              `json:"name_tag,omitempty"`
+	Tags        jwt.TagList         `json:"tags,omitempty"`
+	LastUpdate  time.Time           `json:"update_time,omitempty"`
+	Expired     bool                `json:"expired"`
+	Complete    bool                `json:"complete"`
+	JetStream   bool                `json:"jetstream_enabled"`
+	LeafCnt     int                 `json:"leafnode_connections"`
+	ClientCnt   int                 `json:"client_connections"`
+	SubCnt      uint32              `json:"subscriptions"`
+	Traffic     AccountTrafficStats `json:"traffic"`
+	Exports     []ExtExport         `json:"exports"`
+	Imports     []ExtImport         `json:"imports"`
+	Jwt         string              `json:"jwt,omitempty"`
+	Claim       *jwt.AccountClaims  `json:"decoded_jwt,omitempty"`
 }
 
 type Accountz struct {
@@ -1993,6 +2054,51 @@ func (s *Server) Accountz(optz *AccountzOptions) (*Accountz, error) {
 	}
 }
 
+// ListAccounts returns a page of account public keys, in sorted order, as well
+// as the total number of accounts. Accounts are the ones loaded by this server
+// and the ones stored by a directory based account resolver.
+// A limit of 0 returns all accounts starting at offset.
+func (s *Server) ListAccounts(offset, limit int) ([]string, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("invalid offset %d or limit %d", offset, limit)
+	}
+	known := make(map[string]struct{})
+	s.accounts.Range(func(key, value interface{}) bool {
+		known[key.(string)] = struct{}{}
+		return true
+	})
+	var store *DirJWTStore
+	switch ar := s.AccountResolver().(type) {
+	case *DirAccResolver:
+		store = ar.DirJWTStore
+	case *CacheDirAccResolver:
+		store = ar.DirJWTStore
+	}
+	if store != nil {
+		keys, err := store.keys()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, k := range keys {
+			known[k] = struct{}{}
+		}
+	}
+	accounts := make([]string, 0, len(known))
+	for k := range known {
+		accounts = append(accounts, k)
+	}
+	sort.Strings(accounts)
+	total := len(accounts)
+	if offset >= total {
+		return []string{}, total, nil
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return accounts[offset:end], total, nil
+}
+
 func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 	var a *Account
 	if v, ok := s.accounts.Load(accName); !ok {
@@ -2001,10 +2107,12 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 		a = v.(*Account)
 	}
 	a.mu.RLock()
-	defer a.mu.RUnlock()
 	claim, _ := jwt.DecodeAccountClaims(a.claimJWT) // ignore error
 	exports := []ExtExport{}
 	for k, v := range a.exports.services {
+		if v.hidden {
+			continue
+		}
 		e := ExtExport{
 			Export: jwt.Export{
 				Subject:      jwt.Subject(k),
@@ -2013,6 +2121,7 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 				ResponseType: jwt.ResponseType(v.respType.String()),
 			},
 			ApprovedAccounts: []string{},
+			Deprecated:       v.deprecated,
 		}
 		for name := range v.approved {
 			e.ApprovedAccounts = append(e.ApprovedAccounts, name)
@@ -2020,6 +2129,12 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 		exports = append(exports, e)
 	}
 	for k, v := range a.exports.streams {
+		// Public stream exports may not have an entry.
+		if v == nil {
+			v = &streamExport{}
+		} else if v.hidden {
+			continue
+		}
 		e := ExtExport{
 			Export: jwt.Export{
 				Subject:  jwt.Subject(k),
@@ -2027,6 +2142,7 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 				TokenReq: v.tokenReq,
 			},
 			ApprovedAccounts: []string{},
+			Deprecated:       v.deprecated,
 		}
 		for name := range v.approved {
 			e.ApprovedAccounts = append(e.ApprovedAccounts, name)
@@ -2034,6 +2150,8 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 		exports = append(exports, e)
 	}
 	imports := []ExtImport{}
+	// Exporting accounts are looked up once the lock is released.
+	exporters := []*Account{}
 	for _, v := range a.imports.streams {
 		to := ""
 		if v.prefix != "" {
@@ -2048,6 +2166,7 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 			},
 			Invalid: v.invalid,
 		})
+		exporters = append(exporters, v.acc)
 	}
 	for _, v := range a.imports.services {
 		imports = append(imports, ExtImport{
@@ -2059,9 +2178,16 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 			},
 			Invalid: v.invalid,
 		})
+		exporters = append(exporters, v.acc)
 	}
-	return &AccountInfo{
+	var tags jwt.TagList
+	if len(a.tags) > 0 {
+		tags = append(tags, a.tags...)
+	}
+	info := &AccountInfo{
 		accName,
+		a.nameTag,
+		tags,
 		a.updated,
 		a.expired,
 		!a.incomplete,
@@ -2069,9 +2195,21 @@ func (s *Server) accountInfo(accName string) (*AccountInfo, error) {
 		a.numLocalLeafNodes(),
 		a.numLocalConnections(),
 		a.sl.Count(),
+		a.TrafficStats(),
 		exports,
 		imports,
 		a.claimJWT,
 		claim,
-	}, nil
+	}
+	a.mu.RUnlock()
+
+	for i, acc := range exporters {
+		im := &imports[i].Import
+		subject := string(im.Subject)
+		if im.Type == jwt.Service {
+			subject = string(im.To)
+		}
+		imports[i].Deprecated = acc.exportDeprecation(subject, im.Type)
+	}
+	return info, nil
 }
@@ -3683,7 +3683,94 @@ func TestMonitorAccountz(t *testing.T) {
 		t.Fatalf("Body missing value. Contains: %s", body)
 	} else if !strings.Contains(body, `"account_name": "$SYS",`) {
 		t.Fatalf("Body missing value. Contains: %s", body)
-	} else if !strings.Contains(body, `"subscriptions": 32,`) {
+	} else if !strings.Contains(body, `"subscriptions": 36,`) {
 		t.Fatalf("Body missing value. Contains: %s", body)
 	}
 }
+
+func TestMonitorListAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srv-list-accounts")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The last account doubles as the system account the full resolver requires.
+	preloads := make([]string, 0, 6)
+	stored := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		akp, _ := nkeys.CreateAccount()
+		apub, _ := akp.PublicKey()
+		ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+		if err != nil {
+			t.Fatalf("Error generating account JWT: %v", err)
+		}
+		preloads = append(preloads, fmt.Sprintf("%s: %s", apub, ajwt))
+		stored = append(stored, apub)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		operator: %s
+		system_account: %s
+		resolver: {
+			type: full
+			dir: %s
+		}
+		resolver_preload: {
+			%s
+		}
+	`, ojwt, stored[5], dir, strings.Join(preloads, "\n"))))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Load one of the accounts, it should not be listed twice.
+	if _, err := s.LookupAccount(stored[0]); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	all, total, err := s.ListAccounts(0, 0)
+	if err != nil {
+		t.Fatalf("Error listing accounts: %v", err)
+	}
+	if total != len(all) {
+		t.Fatalf("Expected total of %d, got %d", len(all), total)
+	}
+	if !sort.StringsAreSorted(all) {
+		t.Fatalf("Expected accounts to be sorted: %v", all)
+	}
+	for _, apub := range stored {
+		found := false
+		for _, acc := range all {
+			found = found || acc == apub
+		}
+		if !found {
+			t.Fatalf("Expected account %q to be listed in %v", apub, all)
+		}
+	}
+
+	var paged []string
+	for offset := 0; ; offset += 2 {
+		page, ptotal, err := s.ListAccounts(offset, 2)
+		if err != nil {
+			t.Fatalf("Error listing accounts: %v", err)
+		}
+		if ptotal != total {
+			t.Fatalf("Expected total of %d, got %d", total, ptotal)
+		}
+		if len(page) == 0 {
+			break
+		}
+		if len(page) > 2 {
+			t.Fatalf("Expected at most 2 accounts, got %d", len(page))
+		}
+		paged = append(paged, page...)
+	}
+	if !reflect.DeepEqual(all, paged) {
+		t.Fatalf("Expected pages to add up to %v, got %v", all, paged)
+	}
+
+	if _, _, err := s.ListAccounts(-1, 2); err == nil {
+		t.Fatalf("Expected an error for a negative offset")
+	}
+}
@@ -15,6 +15,7 @@ package server
 
 import (
 	"encoding/base64"
+	"fmt"
 )
 
 // Raw length of the nonce challenge
@@ -23,6 +24,9 @@ const (
 	nonceLen    = 15 // base64.RawURLEncoding.EncodedLen(nonceRawLen)
 )
 
+// Minimum raw length of the nonce challenge that can be configured.
+const minNonceRawLen = nonceRawLen
+
 // NonceRequired tells us if we should send a nonce.
 func (s *Server) NonceRequired() bool {
 	s.mu.Lock()
@@ -36,11 +40,29 @@ func (s *Server) nonceRequired() bool {
 	return len(s.nkeys) > 0 || len(s.trustedKeys) > 0
 }
 
+// nonceLen returns the length of the encoded nonce challenge, based
+// on the configured raw length of the nonce.
+func (s *Server) nonceLen() int {
+	if n := s.getOpts().NonceLength; n > 0 {
+		return base64.RawURLEncoding.EncodedLen(n)
+	}
+	return nonceLen
+}
+
 // Generate a nonce for INFO challenge.
+// The length of n is the one returned by nonceLen().
 // Assumes server lock is held
 func (s *Server) generateNonce(n []byte) {
-	var raw [nonceRawLen]byte
-	data := raw[:]
+	data := make([]byte, base64.RawURLEncoding.DecodedLen(len(n)))
 	s.prand.Read(data)
 	base64.RawURLEncoding.Encode(n, data)
 }
+
+// validateNonceLength checks that the configured raw length of the nonce
+// challenge is not below the minimum.
+func validateNonceLength(o *Options) error {
+	if o.NonceLength != 0 && o.NonceLength < minNonceRawLen {
+		return fmt.Errorf("nonce length of %d bytes is below the minimum of %d bytes", o.NonceLength, minNonceRawLen)
+	}
+	return nil
+}
@@ -166,6 +166,46 @@ func TestNkeyClientConnect(t *testing.T) {
 	}
 }
 
+func TestNkeyClientConnectNonceLength(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: string(pubKey)}}
+	opts.NonceLength = 32
+	_, c, cr, l := rawSetup(opts)
+	defer c.close()
+
+	var info nonceInfo
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Could not parse INFO json: %v\n", err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(info.Nonce)
+	if err != nil {
+		t.Fatalf("Could not decode nonce: %v", err)
+	}
+	if len(raw) != 32 {
+		t.Fatalf("Expected a nonce of 32 bytes, got %d", len(raw))
+	}
+	sigraw, err := kp.Sign([]byte(info.Nonce))
+	if err != nil {
+		t.Fatalf("Failed signing nonce: %v", err)
+	}
+	sig := base64.RawURLEncoding.EncodeToString(sigraw)
+	cs := fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":\"%s\",\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", pubKey, sig)
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected an OK, got: %v", l)
+	}
+
+	// Lengths below the minimum are rejected.
+	bad := DefaultOptions()
+	bad.NonceLength = minNonceRawLen - 1
+	if _, err := NewServer(bad); err == nil || !strings.Contains(err.Error(), "nonce length") {
+		t.Fatalf("Expected an error about the nonce length, got %v", err)
+	}
+}
+
 func TestMixedClientConnect(t *testing.T) {
 	s, c, cr, _ := mixedSetup()
 	defer c.close()
@@ -228,6 +228,137 @@ type Options struct {
 	AccountResolverTLSConfig *tls.Config           `json:"-"`
 	resolverPreloads         map[string]string
 
+	// AccountResolverHeaders are static HTTP headers, such as Authorization,
+	// that the URL resolver attaches to every fetch.
+	AccountResolverHeaders map[string]string `json:"-"`
+
+	// ResolverPreloadDir is a directory of account JWT files, with a .jwt
+	// extension, that are loaded into the MEM resolver at startup.
+	ResolverPreloadDir string `json:"-"`
+
+	// TraceResolverFetches will log each account resolver fetch at debug
+	// level, including the resolver type, origin and elapsed time.
+	TraceResolverFetches bool `json:"-"`
+
+	// ResolverNegativeCacheTTL is how long a failed account lookup is
+	// remembered, during which further lookups of that account are rejected
+	// without asking the resolver. A negative value disables the cache.
+	ResolverNegativeCacheTTL time.Duration `json:"-"`
+
+	// AccountUpdateMinInterval is the minimum time between two resolver
+	// fetches of an account's claims, requests made sooner are ignored.
+	// A negative value disables this protection.
+	AccountUpdateMinInterval time.Duration `json:"-"`
+
+	// AccountExpiryGrace, if set, is how long the clients of an account that
+	// expires stay connected. During that time their publishes and new
+	// subscriptions are rejected, and an update renewing the account restores
+	// them. Clients still connected afterwards are disconnected.
+	AccountExpiryGrace time.Duration `json:"-"`
+
+	// AccountUpdateSubjects are additional subjects, on the system account,
+	// on which account claim updates are accepted. Each subject must have a
+	// single "*" token standing for the account public key.
+	AccountUpdateSubjects []string `json:"-"`
+
+	// AuthExpirationExemptConnectionTypes lists the connection types, such as
+	// LEAFNODE or WEBSOCKET, that are not disconnected when their user JWT
+	// expires while connected. Expired JWTs are still rejected on connect.
+	AuthExpirationExemptConnectionTypes map[string]struct{} `json:"-"`
+
+	// RequireJetStreamLimits rejects account JWTs, other than the system
+	// account, that do not declare JetStream limits, even if set to zero.
+	RequireJetStreamLimits bool `json:"-"`
+
+	// RejectUsersIssuedBefore will reject any user JWT, regardless of the
+	// account, that was issued before this time.
+	RejectUsersIssuedBefore time.Time `json:"-"`
+
+	// NonceLength is the number of random bytes of the nonce challenge sent
+	// to connections that must sign it. Zero means the default, lower values
+	// than the default are rejected.
+	NonceLength int `json:"-"`
+
+	// MaxResolverFetches bounds the number of account resolver fetches that
+	// can be in flight at once. Further lookups wait for a fetch to complete
+	// and fail if none does in time. Zero means unlimited.
+	MaxResolverFetches int `json:"-"`
+
+	// MaxUserTimeRanges is the maximum number of connect time ranges a user
+	// JWT may declare. Users with more are rejected. Zero means unlimited.
+	MaxUserTimeRanges int `json:"-"`
+
+	// MaxSubjectLength is the maximum length of the subject of client
+	// subscriptions. Longer subjects are rejected as a permissions
+	// violation. Accounts can set a lower limit. Zero means unlimited.
+	MaxSubjectLength int `json:"-"`
+
+	// RevocationsURL is polled for a revocation list applied to the users
+	// of all accounts, on top of the revocations of their account. The list
+	// is a JSON object mapping user public keys to a unix time, user JWTs
+	// issued at or before that time are revoked.
+	RevocationsURL string `json:"-"`
+
+	// RevocationsPollInterval is the time between two polls of RevocationsURL.
+	RevocationsPollInterval time.Duration `json:"-"`
+
+	// ServiceImportIdleTimeout, if set, tears down the subscription of a
+	// service import that has not seen a request for that long, reclaiming
+	// its resources. It is set up again on the next request from a client.
+	ServiceImportIdleTimeout time.Duration `json:"-"`
+
+	// SystemAccountJWT is the path to a file with the JWT of the system
+	// account. It is loaded when the server is created, before the account
+	// resolver is asked for the system account.
+	SystemAccountJWT string `json:"-"`
+
+	// AuthErrorTemplate formats the -ERR line sent to clients disconnected
+	// for authentication failures. The placeholders {message}, {reason},
+	// {account} and {cid} are replaced with the default error text, the
+	// closed state, the account name when known and the client id. When
+	// empty, the default error text is sent.
+	AuthErrorTemplate string `json:"-"`
+
+	// AuthRejectionEvents sends a system account event, with a reason code,
+	// for every client connection rejected because it failed to authenticate.
+	AuthRejectionEvents bool `json:"-"`
+
+	// MaxAccounts caps the number of accounts held in memory. When reached,
+	// the least recently used account without connections is evicted to
+	// make room for a new one. The global, system and configured accounts
+	// are never evicted. Zero means unlimited.
+	MaxAccounts int `json:"-"`
+
+	// RejectUnknownClaimFields rejects account and user JWTs with fields this
+	// server does not understand, for instance ones added by a newer version
+	// of the jwt library, instead of ignoring those fields.
+	RejectUnknownClaimFields bool `json:"-"`
+
+	// RejectExpiredOperators fails startup, and configuration reloads, when
+	// a trusted operator JWT has expired. Otherwise a warning is logged and
+	// the keys of the operator are still trusted.
+	RejectExpiredOperators bool `json:"-"`
+
+	// LenientSubscriptionLimits keeps the subscriptions of clients when their
+	// subscription limit is lowered below their current usage, instead of
+	// disconnecting them. New subscriptions are rejected, and clients that
+	// keep subscribing after a rejection are disconnected.
+	LenientSubscriptionLimits bool `json:"-"`
+
+	// ProxyProtocol requires client connections to start with a PROXY
+	// protocol v1 header. The source address it carries is then used as the
+	// client's address, including for user JWT source network limits.
+	// Websocket connections are not affected.
+	ProxyProtocol bool `json:"-"`
+
+	// UserTagPermissions maps a (lower case) user JWT tag to permissions
+	// that are merged with the permissions of users carrying that tag.
+	UserTagPermissions map[string]*Permissions `json:"-"`
+
+	// MaxResponsePermissionExpiration caps the expiration of any user's
+	// response permissions. Zero means no cap.
+	MaxResponsePermissionExpiration time.Duration `json:"-"`
+
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
 
@@ -823,7 +954,16 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			o.AccountResolver = nil
 			memResolverRe := regexp.MustCompile(`(?i)(MEM|MEMORY)\s*`)
 			resolverRe := regexp.MustCompile(`(?i)(?:URL){1}(?:\({1}\s*"?([^\s"]*)"?\s*\){1})?\s*`)
-			if memResolverRe.MatchString(v) {
+			unixResolverRe := regexp.MustCompile(`(?i)^\s*UNIX\(\s*"?([^\s"]*)"?\s*\)\s*$`)
+			// Check first since a socket path may contain any of the other keywords.
+			if items := unixResolverRe.FindStringSubmatch(v); len(items) == 2 {
+				if ur, err := NewUnixAccResolver(items[1]); err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					return
+				} else {
+					o.AccountResolver = ur
+				}
+			} else if memResolverRe.MatchString(v) {
 				o.AccountResolver = &MemAccResolver{}
 			} else if items := resolverRe.FindStringSubmatch(v); len(items) == 2 {
 				url := items[1]
@@ -846,6 +986,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			limit := int64(0)
 			ttl := time.Duration(0)
 			sync := time.Duration(0)
+			jitter := float64(0)
+			warm := false
 			var err error
 			if v, ok := v["dir"]; ok {
 				_, v := unwrapValue(v, &lt)
@@ -867,6 +1009,26 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 				_, v := unwrapValue(v, &lt)
 				sync, err = time.ParseDuration(v.(string))
 			}
+			if v, ok := v["jitter"]; ok {
+				_, v := unwrapValue(v, &lt)
+				switch j := v.(type) {
+				case float64:
+					jitter = j
+				case int64:
+					jitter = float64(j)
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("jitter needs to be a number, got %T", v)})
+					return
+				}
+				if jitter < 0 || jitter > 1 {
+					*errors = append(*errors, &configErr{tk, "jitter needs to be between 0 and 1"})
+					return
+				}
+			}
+			if v, ok := v["warm"]; ok {
+				_, v := unwrapValue(v, &lt)
+				warm = v.(bool)
+			}
 			if err != nil {
 				*errors = append(*errors, &configErr{tk, err.Error()})
 				return
@@ -884,12 +1046,26 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 				if sync != 0 {
 					*errors = append(*errors, &configErr{tk, "CACHE does not accept sync"})
 				}
-				res, err = NewCacheDirAccResolver(dir, limit, ttl)
+				if jitter != 0 {
+					*errors = append(*errors, &configErr{tk, "CACHE does not accept jitter"})
+				}
+				var cr *CacheDirAccResolver
+				if cr, err = NewCacheDirAccResolver(dir, limit, ttl); err == nil {
+					cr.warm = warm
+					res = cr
+				}
 			case "FULL":
 				if ttl != 0 {
 					*errors = append(*errors, &configErr{tk, "FULL does not accept ttl"})
 				}
-				res, err = NewDirAccResolver(dir, limit, sync)
+				if warm {
+					*errors = append(*errors, &configErr{tk, "FULL does not accept warm"})
+				}
+				var dr *DirAccResolver
+				if dr, err = NewDirAccResolver(dir, limit, sync); err == nil {
+					dr.syncJitter = jitter
+					res = dr
+				}
 			}
 			if err != nil {
 				*errors = append(*errors, &configErr{tk, err.Error()})
@@ -902,8 +1078,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			return
 		}
 		if o.AccountResolver == nil {
-			err := &configErr{tk, "error parsing account resolver, should be MEM or " +
-				" URL(\"url\") or a map containing dir and type state=[FULL|CACHE])"}
+			err := &configErr{tk, "error parsing account resolver, should be MEM, " +
+				" URL(\"url\"), UNIX(\"path\") or a map containing dir and type state=[FULL|CACHE])"}
 			*errors = append(*errors, err)
 		}
 	case "resolver_tls":
@@ -917,6 +1093,120 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			*errors = append(*errors, err)
 			return
 		}
+		// If ca_file is defined, GenTLSConfig() sets TLSConfig.ClientCAs.
+		// Set RootCAs since this tls.Config is used by the URL resolver
+		// when connecting to the account server (therefore behaves as a client).
+		o.AccountResolverTLSConfig.RootCAs = o.AccountResolverTLSConfig.ClientCAs
+	case "resolver_headers":
+		mp, ok := v.(map[string]interface{})
+		if !ok {
+			err := &configErr{tk, "resolver headers should be a map of header name to value"}
+			*errors = append(*errors, err)
+			return
+		}
+		o.AccountResolverHeaders = make(map[string]string, len(mp))
+		for name, hv := range mp {
+			tk, hv = unwrapValue(hv, &lt)
+			value, ok := hv.(string)
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("resolver header %q value should be a string", name)}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.AccountResolverHeaders[name] = value
+		}
+	case "resolver_negative_cache_ttl":
+		o.ResolverNegativeCacheTTL = parseDuration("resolver_negative_cache_ttl", tk, v, errors, warnings)
+	case "auth_expiration_exempt_connection_types":
+		o.AuthExpirationExemptConnectionTypes = parseAllowedConnectionTypes(tk, &lt, v, errors, warnings)
+	case "require_jetstream_limits":
+		o.RequireJetStreamLimits = v.(bool)
+	case "lenient_subscription_limits":
+		o.LenientSubscriptionLimits = v.(bool)
+	case "proxy_protocol":
+		o.ProxyProtocol = v.(bool)
+	case "nonce_length":
+		o.NonceLength = int(v.(int64))
+	case "max_resolver_fetches":
+		o.MaxResolverFetches = int(v.(int64))
+	case "max_user_time_ranges":
+		o.MaxUserTimeRanges = int(v.(int64))
+	case "max_subject_length":
+		o.MaxSubjectLength = int(v.(int64))
+	case "revocations_url":
+		o.RevocationsURL = v.(string)
+	case "revocations_poll_interval":
+		o.RevocationsPollInterval = parseDuration("revocations_poll_interval", tk, v, errors, warnings)
+	case "service_import_idle_timeout":
+		o.ServiceImportIdleTimeout = parseDuration("service_import_idle_timeout", tk, v, errors, warnings)
+	case "system_account_jwt":
+		o.SystemAccountJWT = v.(string)
+	case "auth_error_template":
+		o.AuthErrorTemplate = v.(string)
+	case "auth_rejection_events":
+		o.AuthRejectionEvents = v.(bool)
+	case "max_accounts":
+		o.MaxAccounts = int(v.(int64))
+	case "reject_unknown_claim_fields":
+		o.RejectUnknownClaimFields = v.(bool)
+	case "reject_expired_operators":
+		o.RejectExpiredOperators = v.(bool)
+	case "account_update_min_interval":
+		o.AccountUpdateMinInterval = parseDuration("account_update_min_interval", tk, v, errors, warnings)
+	case "account_expiry_grace":
+		o.AccountExpiryGrace = parseDuration("account_expiry_grace", tk, v, errors, warnings)
+	case "account_update_subjects":
+		switch v := v.(type) {
+		case string:
+			o.AccountUpdateSubjects = []string{v}
+		case []interface{}:
+			for _, sv := range v {
+				tk, sv := unwrapValue(sv, &lt)
+				subj, ok := sv.(string)
+				if !ok {
+					err := &configErr{tk, fmt.Sprintf("error parsing account update subject, unsupported type %T", sv)}
+					*errors = append(*errors, err)
+					continue
+				}
+				o.AccountUpdateSubjects = append(o.AccountUpdateSubjects, subj)
+			}
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing account update subjects, unsupported type %T", v)}
+			*errors = append(*errors, err)
+		}
+	case "resolver_trace_fetches":
+		o.TraceResolverFetches = v.(bool)
+	case "max_response_permission_expiration":
+		o.MaxResponsePermissionExpiration = parseDuration("max_response_permission_expiration", tk, v, errors, warnings)
+	case "reject_users_issued_before":
+		switch v := v.(type) {
+		case time.Time:
+			o.RejectUsersIssuedBefore = v
+		case int64:
+			o.RejectUsersIssuedBefore = time.Unix(v, 0)
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing reject_users_issued_before, unsupported type %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+	case "user_tag_permissions":
+		mp, ok := v.(map[string]interface{})
+		if !ok {
+			err := &configErr{tk, "user tag permissions should be a map of tag to permissions"}
+			*errors = append(*errors, err)
+			return
+		}
+		o.UserTagPermissions = make(map[string]*Permissions, len(mp))
+		for tag, mv := range mp {
+			perms, err := parseUserPermissions(mv, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.UserTagPermissions[strings.ToLower(tag)] = perms
+		}
+	case "resolver_preload_dir":
+		o.ResolverPreloadDir = v.(string)
 	case "resolver_preload":
 		mp, ok := v.(map[string]interface{})
 		if !ok {
@@ -3615,6 +3905,15 @@ func setBaselineOptions(opts *Options) {
 	if opts.LameDuckGracePeriod == 0 {
 		opts.LameDuckGracePeriod = DEFAULT_LAME_DUCK_GRACE_PERIOD
 	}
+	if opts.ResolverNegativeCacheTTL == 0 {
+		opts.ResolverNegativeCacheTTL = DEFAULT_RESOLVER_NEGATIVE_CACHE_TTL
+	}
+	if opts.AccountUpdateMinInterval == 0 {
+		opts.AccountUpdateMinInterval = DEFAULT_ACCOUNT_UPDATE_MIN_INTERVAL
+	}
+	if opts.RevocationsURL != _EMPTY_ && opts.RevocationsPollInterval == 0 {
+		opts.RevocationsPollInterval = DEFAULT_REVOCATIONS_POLL_INTERVAL
+	}
 	if opts.Gateway.Port != 0 {
 		if opts.Gateway.Host == "" {
 			opts.Gateway.Host = DEFAULT_HOST
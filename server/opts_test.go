@@ -65,11 +65,13 @@ func TestDefaultOptions(t *testing.T) {
 		LeafNode: LeafNodeOpts{
 			ReconnectInterval: DEFAULT_LEAF_NODE_RECONNECT,
 		},
-		ConnectErrorReports:   DEFAULT_CONNECT_ERROR_REPORTS,
-		ReconnectErrorReports: DEFAULT_RECONNECT_ERROR_REPORTS,
-		MaxTracedMsgLen:       0,
-		JetStreamMaxMemory:    -1,
-		JetStreamMaxStore:     -1,
+		ConnectErrorReports:      DEFAULT_CONNECT_ERROR_REPORTS,
+		ReconnectErrorReports:    DEFAULT_RECONNECT_ERROR_REPORTS,
+		MaxTracedMsgLen:          0,
+		JetStreamMaxMemory:       -1,
+		JetStreamMaxStore:        -1,
+		ResolverNegativeCacheTTL: DEFAULT_RESOLVER_NEGATIVE_CACHE_TTL,
+		AccountUpdateMinInterval: DEFAULT_ACCOUNT_UPDATE_MIN_INTERVAL,
 	}
 
 	opts := &Options{}
@@ -0,0 +1,103 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum length of a PROXY protocol v1 header, including CRLF.
+	proxyProtoV1MaxLen = 107
+	// How long we wait for the PROXY protocol header after accepting.
+	proxyProtoHeaderTimeout = 2 * time.Second
+)
+
+var errProxyProtoHeader = errors.New("invalid proxy protocol header")
+
+// proxyProtoConn is a connection accepted through a proxy that reports
+// the address of the original client as its remote address.
+type proxyProtoConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address of the client as reported by the proxy.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyProtoHeader reads a PROXY protocol v1 header from conn and returns
+// a connection whose remote address is the source address it carries. For
+// an UNKNOWN protocol, conn is returned as is. The header is read one byte at
+// a time so that nothing following it is consumed.
+func readProxyProtoHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf [proxyProtoV1MaxLen]byte
+	var b [1]byte
+	n := 0
+	for {
+		if _, err := conn.Read(b[:]); err != nil {
+			return nil, err
+		}
+		if n == len(buf) {
+			return nil, errProxyProtoHeader
+		}
+		buf[n] = b[0]
+		n++
+		if n >= 2 && buf[n-2] == '\r' && buf[n-1] == '\n' {
+			break
+		}
+	}
+	remote, err := parseProxyProtoHeader(buf[:n-2])
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, remote: remote}, nil
+}
+
+// parseProxyProtoHeader parses a PROXY protocol v1 header without its
+// trailing CRLF, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 4222".
+// Returns a nil address for the UNKNOWN protocol.
+func parseProxyProtoHeader(hdr []byte) (net.Addr, error) {
+	if !bytes.HasPrefix(hdr, []byte("PROXY ")) {
+		return nil, errProxyProtoHeader
+	}
+	fields := strings.Split(string(hdr), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtoHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyProtoHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyProtoHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestParseProxyProtoHeader(t *testing.T) {
+	for _, test := range []struct {
+		hdr  string
+		addr string
+		err  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 4222", "192.0.2.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 4222", "[2001:db8::1]:56324", false},
+		{"PROXY UNKNOWN", "", false},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 4222", "", false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 4222", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 99999 4222", "", true},
+		{"PROXY TCP4 192.0.2.1", "", true},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 4222", "", true},
+		{"CONNECT {}", "", true},
+	} {
+		t.Run(test.hdr, func(t *testing.T) {
+			addr, err := parseProxyProtoHeader([]byte(test.hdr))
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if test.addr == "" {
+				if addr != nil {
+					t.Fatalf("Expected no address, got %v", addr)
+				}
+			} else if addr == nil || addr.String() != test.addr {
+				t.Fatalf("Expected address %q, got %v", test.addr, addr)
+			}
+		})
+	}
+}
@@ -544,6 +544,52 @@ func (a *accountsOption) Apply(s *Server) {
 	s.Noticef("Reloaded: accounts")
 }
 
+// trustedOperatorsOption implements the option interface for the `operator`
+// setting. Only the signing keys of the configured operators can change.
+type trustedOperatorsOption struct {
+	noopOption
+	newValue []*jwt.OperatorClaims
+}
+
+// Apply replaces the trusted keys with the operators' identity and signing
+// keys, and invalidates loaded accounts whose issuer is no longer trusted.
+func (t *trustedOperatorsOption) Apply(s *Server) {
+	keys := make([]string, 0, 4)
+	for _, opc := range t.newValue {
+		keys = append(keys, opc.Issuer)
+		keys = append(keys, opc.SigningKeys...)
+	}
+	s.mu.Lock()
+	s.trustedKeys = keys
+	s.mu.Unlock()
+
+	var untrusted []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		issuer := acc.Issuer
+		acc.mu.RUnlock()
+		if issuer != _EMPTY_ && !s.isTrustedIssuer(issuer) {
+			untrusted = append(untrusted, acc)
+		}
+		return true
+	})
+	for _, acc := range untrusted {
+		s.Warnf("Account %q issuer %q is no longer trusted", acc.Name, acc.Issuer)
+		acc.mu.Lock()
+		acc.expired = true
+		clients := make([]*client, 0, len(acc.clients))
+		for c := range acc.clients {
+			clients = append(clients, c)
+		}
+		acc.mu.Unlock()
+		for _, c := range clients {
+			c.closeConnection(AuthenticationViolation)
+		}
+	}
+	s.Noticef("Reloaded: operator signing keys")
+}
+
 // For changes to a server's config.
 type jetStreamOption struct {
 	noopOption
@@ -596,6 +642,240 @@ func (m *maxTracedMsgLenOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_traced_msg_len = %d", m.newValue)
 }
 
+// resolverNegativeCacheTTLOption implements the option interface for the
+// `resolver_negative_cache_ttl` setting.
+type resolverNegativeCacheTTLOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the TTL is read from the options when a failed
+// lookup is cached.
+func (r *resolverNegativeCacheTTLOption) Apply(s *Server) {
+	s.Noticef("Reloaded: resolver_negative_cache_ttl = %v", r.newValue)
+}
+
+// accountUpdateMinIntervalOption implements the option interface for the
+// `account_update_min_interval` setting.
+type accountUpdateMinIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the interval is read from the options on each
+// account update.
+func (a *accountUpdateMinIntervalOption) Apply(s *Server) {
+	s.Noticef("Reloaded: account_update_min_interval = %v", a.newValue)
+}
+
+// accountExpiryGraceOption implements the option interface for the
+// `account_expiry_grace` setting.
+type accountExpiryGraceOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the grace period is read from the options when
+// an account expires.
+func (a *accountExpiryGraceOption) Apply(s *Server) {
+	s.Noticef("Reloaded: account_expiry_grace = %v", a.newValue)
+}
+
+// authExpirationExemptOption implements the option interface for the
+// `auth_expiration_exempt_connection_types` setting.
+type authExpirationExemptOption struct {
+	noopOption
+}
+
+// Apply is a no-op because the setting is checked when a client
+// authenticates. Existing connections keep their expiration timers.
+func (a *authExpirationExemptOption) Apply(s *Server) {
+	s.Noticef("Reloaded: auth_expiration_exempt_connection_types")
+}
+
+// requireJetStreamLimitsOption implements the option interface for the
+// `require_jetstream_limits` setting.
+type requireJetStreamLimitsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is checked when account claims are
+// verified. Accounts already loaded are not checked again.
+func (r *requireJetStreamLimitsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: require_jetstream_limits = %v", r.newValue)
+}
+
+// maxUserTimeRangesOption implements the option interface for the
+// `max_user_time_ranges` setting.
+type maxUserTimeRangesOption struct {
+	authOption
+	newValue int
+}
+
+// Apply is a no-op. Connected users will be checked in reloadAuthorization.
+func (m *maxUserTimeRangesOption) Apply(s *Server) {
+	s.Noticef("Reloaded: max_user_time_ranges = %v", m.newValue)
+}
+
+// maxSubjectLengthOption implements the option interface for the
+// `max_subject_length` setting.
+type maxSubjectLengthOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the setting by re-applying the limits of each client. Existing
+// subscriptions are not affected.
+func (m *maxSubjectLengthOption) Apply(s *Server) {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		acc := c.acc
+		c.mu.Unlock()
+		msublen := int32(jwt.NoLimit)
+		if acc != nil {
+			msublen = acc.maxSubjectLength()
+		}
+		if m.newValue > 0 {
+			minLimit(&msublen, int32(m.newValue))
+		}
+		c.mu.Lock()
+		c.msublen = msublen
+		c.mu.Unlock()
+	}
+	s.Noticef("Reloaded: max_subject_length = %v", m.newValue)
+}
+
+// maxAccountsOption implements the option interface for the `max_accounts`
+// setting.
+type maxAccountsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the limit is checked when an account is
+// registered.
+func (m *maxAccountsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: max_accounts = %v", m.newValue)
+}
+
+// authErrorTemplateOption implements the option interface for the
+// `auth_error_template` setting.
+type authErrorTemplateOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op because the template is applied when errors are sent.
+func (a *authErrorTemplateOption) Apply(s *Server) {
+	s.Noticef("Reloaded: auth_error_template = %q", a.newValue)
+}
+
+// authRejectionEventsOption implements the option interface for the
+// `auth_rejection_events` setting.
+type authRejectionEventsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the option is checked when clients are rejected.
+func (a *authRejectionEventsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: auth_rejection_events = %v", a.newValue)
+}
+
+// rejectUnknownClaimFieldsOption implements the option interface for the
+// `reject_unknown_claim_fields` setting.
+type rejectUnknownClaimFieldsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the fields are checked when JWTs are verified.
+func (r *rejectUnknownClaimFieldsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: reject_unknown_claim_fields = %v", r.newValue)
+}
+
+// rejectExpiredOperatorsOption implements the option interface for the
+// `reject_expired_operators` setting.
+type rejectExpiredOperatorsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the operators are checked when the new options
+// are validated.
+func (r *rejectExpiredOperatorsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: reject_expired_operators = %v", r.newValue)
+}
+
+// lenientSubscriptionLimitsOption implements the option interface for the
+// `lenient_subscription_limits` setting.
+type lenientSubscriptionLimitsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is checked when account limits are
+// applied to clients.
+func (l *lenientSubscriptionLimitsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: lenient_subscription_limits = %v", l.newValue)
+}
+
+// nonceLengthOption implements the option interface for the
+// `nonce_length` setting.
+type nonceLengthOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the nonce is generated when connections are
+// accepted. Existing connections are not affected.
+func (n *nonceLengthOption) Apply(s *Server) {
+	s.Noticef("Reloaded: nonce_length = %v", n.newValue)
+}
+
+// proxyProtocolOption implements the option interface for the
+// `proxy_protocol` setting.
+type proxyProtocolOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is checked when client connections
+// are accepted. Existing connections are not affected.
+func (p *proxyProtocolOption) Apply(s *Server) {
+	s.Noticef("Reloaded: proxy_protocol = %v", p.newValue)
+}
+
+// rejectUsersIssuedBeforeOption implements the option interface for the
+// `reject_users_issued_before` setting.
+type rejectUsersIssuedBeforeOption struct {
+	authOption
+	newValue time.Time
+}
+
+// Apply is a no-op. Connected users will be checked in reloadAuthorization.
+func (r *rejectUsersIssuedBeforeOption) Apply(s *Server) {
+	s.Noticef("Reloaded: reject_users_issued_before = %v", r.newValue)
+}
+
+// userTagPermissionsOption implements the option interface for the
+// `user_tag_permissions` setting.
+type userTagPermissionsOption struct {
+	authOption
+}
+
+// Apply is a no-op. Connected users will be checked in reloadAuthorization.
+func (u *userTagPermissionsOption) Apply(s *Server) {
+	s.Noticef("Reloaded: user_tag_permissions")
+}
+
 // Reload reads the current configuration file and applies any supported
 // changes. This returns an error if the server was not started with a config
 // file or an option which doesn't support hot-swapping was changed.
@@ -765,8 +1045,9 @@ func imposeOrder(value interface{}) error {
 		})
 	case WebsocketOpts:
 		sort.Strings(value.AllowedOrigins)
-	case string, bool, int, int32, int64, time.Duration, float64, nil,
-		LeafNodeOpts, ClusterOpts, *tls.Config, *URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication:
+	case string, bool, int, int32, int64, time.Duration, time.Time, float64, nil,
+		LeafNodeOpts, ClusterOpts, *tls.Config, *URLAccResolver, *UnixAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication,
+		map[string]string, map[string]*Permissions, map[string]struct{}:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -881,7 +1162,7 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload does not support moving to or from an account resolver")
 			}
 			diffOpts = append(diffOpts, &accountsOption{})
-		case "accountresolvertlsconfig":
+		case "accountresolvertlsconfig", "accountresolverheaders", "resolverpreloaddir":
 			diffOpts = append(diffOpts, &accountsOption{})
 		case "gateway":
 			// Not supported for now, but report warning if configuration of gateway
@@ -986,6 +1267,52 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			continue
 		case "maxtracedmsglen":
 			diffOpts = append(diffOpts, &maxTracedMsgLenOption{newValue: newValue.(int)})
+		case "resolvernegativecachettl":
+			diffOpts = append(diffOpts, &resolverNegativeCacheTTLOption{newValue: newValue.(time.Duration)})
+		case "accountupdatemininterval":
+			diffOpts = append(diffOpts, &accountUpdateMinIntervalOption{newValue: newValue.(time.Duration)})
+		case "accountexpirygrace":
+			diffOpts = append(diffOpts, &accountExpiryGraceOption{newValue: newValue.(time.Duration)})
+		case "authexpirationexemptconnectiontypes":
+			diffOpts = append(diffOpts, &authExpirationExemptOption{})
+		case "requirejetstreamlimits":
+			diffOpts = append(diffOpts, &requireJetStreamLimitsOption{newValue: newValue.(bool)})
+		case "lenientsubscriptionlimits":
+			diffOpts = append(diffOpts, &lenientSubscriptionLimitsOption{newValue: newValue.(bool)})
+		case "noncelength":
+			diffOpts = append(diffOpts, &nonceLengthOption{newValue: newValue.(int)})
+		case "proxyprotocol":
+			diffOpts = append(diffOpts, &proxyProtocolOption{newValue: newValue.(bool)})
+		case "maxusertimeranges":
+			diffOpts = append(diffOpts, &maxUserTimeRangesOption{newValue: newValue.(int)})
+		case "maxsubjectlength":
+			diffOpts = append(diffOpts, &maxSubjectLengthOption{newValue: newValue.(int)})
+		case "maxaccounts":
+			diffOpts = append(diffOpts, &maxAccountsOption{newValue: newValue.(int)})
+		case "autherrortemplate":
+			diffOpts = append(diffOpts, &authErrorTemplateOption{newValue: newValue.(string)})
+		case "authrejectionevents":
+			diffOpts = append(diffOpts, &authRejectionEventsOption{newValue: newValue.(bool)})
+		case "rejectunknownclaimfields":
+			diffOpts = append(diffOpts, &rejectUnknownClaimFieldsOption{newValue: newValue.(bool)})
+		case "rejectexpiredoperators":
+			diffOpts = append(diffOpts, &rejectExpiredOperatorsOption{newValue: newValue.(bool)})
+		case "rejectusersissuedbefore":
+			diffOpts = append(diffOpts, &rejectUsersIssuedBeforeOption{newValue: newValue.(time.Time)})
+		case "usertagpermissions":
+			diffOpts = append(diffOpts, &userTagPermissionsOption{})
+		case "trustedoperators":
+			oldOps, newOps := oldValue.([]*jwt.OperatorClaims), newValue.([]*jwt.OperatorClaims)
+			// Operators can not be added or removed, only their signing keys can change.
+			sameOps := len(oldOps) == len(newOps) && len(newOps) > 0
+			for i := 0; sameOps && i < len(newOps); i++ {
+				sameOps = oldOps[i].Subject == newOps[i].Subject
+			}
+			if !sameOps {
+				return nil, fmt.Errorf("config reload not supported for %s: only operator signing keys can change",
+					field.Name)
+			}
+			diffOpts = append(diffOpts, &trustedOperatorsOption{newValue: newOps})
 		case "port":
 			// check to see if newValue == 0 and continue if so.
 			if newValue == 0 {
@@ -1104,9 +1431,13 @@ func (s *Server) reloadAuthorization() {
 	// import configuration changed.
 	awcsti := make(map[string]struct{})
 	checkJetStream := false
+	// Preloaded account JWTs stored by the resolver, reported once the
+	// server lock is released.
+	var preloaded map[string]string
 	s.mu.Lock()
 
-	// This can not be changed for now so ok to check server's trustedKeys unlocked.
+	// Reload can only change the keys of configured operators, it never
+	// enables or disables trusted mode.
 	// If plain configured accounts, process here.
 	if s.trustedKeys == nil {
 		// We need to drain the old accounts here since we have something
@@ -1174,10 +1505,11 @@ func (s *Server) reloadAuthorization() {
 		// Double check any JetStream configs.
 		checkJetStream = true
 	} else if s.opts.AccountResolver != nil {
-		s.configureResolver()
+		preloaded, _ = s.configureResolver()
 		if _, ok := s.accResolver.(*MemAccResolver); ok {
 			// Check preloads so we can issue warnings etc if needed.
 			s.checkResolvePreloads()
+			s.loadResolverPreloadDir()
 			// With a memory resolver we want to do something similar to configured accounts.
 			// We will walk the accounts and delete them if they are no longer present via fetch.
 			// If they are present we will force a claim update to process changes.
@@ -1235,6 +1567,10 @@ func (s *Server) reloadAuthorization() {
 	}
 	s.mu.Unlock()
 
+	for k, v := range preloaded {
+		s.resolverStored(k, v, ResolverStorePreload)
+	}
+
 	if resetCh != nil {
 		resetCh <- struct{}{}
 	}
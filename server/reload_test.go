@@ -4488,3 +4488,74 @@ func TestConfigReloadDefaultSystemAccount(t *testing.T) {
 	}
 	testInAccounts()
 }
+
+func TestConfigReloadOperatorSigningKeys(t *testing.T) {
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	skp, _ := nkeys.CreateOperator()
+	spub, _ := skp.PublicKey()
+	operatorJWT := func(signingKeys ...string) string {
+		t.Helper()
+		oc := jwt.NewOperatorClaims(opub)
+		oc.SigningKeys.Add(signingKeys...)
+		ojwt, err := oc.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error generating operator JWT: %v", err)
+		}
+		return ojwt
+	}
+	// The account is signed by the operator signing key.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(skp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	confTemplate := `
+		listen: "127.0.0.1:-1"
+		operator: %s
+		resolver: MEM
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, operatorJWT())))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	s.AccountResolver().Store(apub, ajwt)
+	if _, err := s.LookupAccount(apub); err == nil {
+		t.Fatal("Expected account signed by unknown signing key to fail")
+	}
+
+	// Add the signing key to the operator and reload.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(confTemplate, operatorJWT(spub)))
+	s.AccountResolver().Store(apub, ajwt)
+	if _, err := s.LookupAccount(apub); err != nil {
+		t.Fatalf("Expected account to load after reload, got %v", err)
+	}
+	disconnected := make(chan struct{}, 1)
+	nc := natsConnect(t, s.ClientURL(), createUserCreds(t, nil, akp),
+		nats.NoReconnect(), nats.ClosedHandler(func(_ *nats.Conn) { disconnected <- struct{}{} }))
+	defer nc.Close()
+
+	// Removing the signing key invalidates the account and its clients.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(confTemplate, operatorJWT()))
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected client of untrusted account to be disconnected")
+	}
+
+	// A different operator can not be reloaded.
+	okp2, _ := nkeys.CreateOperator()
+	opub2, _ := okp2.PublicKey()
+	ojwt2, err := jwt.NewOperatorClaims(opub2).Encode(okp2)
+	if err != nil {
+		t.Fatalf("Error generating operator JWT: %v", err)
+	}
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(confTemplate, ojwt2)), 0666); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "only operator signing keys can change") {
+		t.Fatalf("Expected reload of a different operator to fail, got %v", err)
+	}
+}
@@ -1285,8 +1285,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Grab server variables
 	s.mu.Lock()
 	// New proto wants a nonce (although not used in routes, that is, not signed in CONNECT)
-	var raw [nonceLen]byte
-	nonce := raw[:]
+	nonce := make([]byte, s.nonceLen())
 	s.generateNonce(nonce)
 	s.routeInfo.Nonce = string(nonce)
 	s.generateRouteInfoJSON()
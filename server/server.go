@@ -33,6 +33,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -103,6 +104,10 @@ type Info struct {
 type Server struct {
 	gcid uint64
 	stats
+	// Client auth and JWT expiration timers currently set, and clients
+	// disconnected because their authentication expired.
+	authTimers       int64
+	authExpirations  int64
 	mu               sync.Mutex
 	kp               nkeys.KeyPair
 	prand            *rand.Rand
@@ -118,9 +123,22 @@ type Server struct {
 	sys              *internal
 	js               *jetStream
 	accounts         sync.Map
-	tmpAccounts      sync.Map // Temporarily stores accounts that are being built
+	tmpAccounts      sync.Map      // Temporarily stores accounts that are being built
+	accNegCache      sync.Map      // Account lookups that recently failed, to their expiration
+	accFetchSem      chan struct{} // Bounds in flight resolver fetches, if configured
+	accFetchMu       sync.Mutex
+	accFetches       map[string]*accFetchCall // In flight resolver fetches, by account
 	activeAccounts   int32
 	accResolver      AccountResolver
+	accResolverMu    sync.Mutex // Serializes account resolver swaps
+	accAdmission     AccountAdmissionHandler
+	accExpiry        AccountExpiryHandler
+	accUpdates       chan AccountUpdate
+	resolverStore    ResolverStoreHandler
+	jwtVerifier      JWTVerifier
+	shadowHandler    atomic.Value // ShadowSubscriptionHandler, read on subscription changes
+	revMu            sync.RWMutex
+	revoked          map[string]int64 // Revocations polled from RevocationsURL
 	clients          map[uint64]*client
 	routes           map[uint64]*client
 	routesByHash     sync.Map
@@ -322,6 +340,10 @@ func NewServer(opts *Options) (*Server, error) {
 		s.routeResolver = net.DefaultResolver
 	}
 
+	if opts.MaxResolverFetches > 0 {
+		s.accFetchSem = make(chan struct{}, opts.MaxResolverFetches)
+	}
+
 	// Used internally for quick look-ups.
 	s.clientConnectURLsMap = make(refCountedUrlSet)
 	s.websocket.connectURLsMap = make(refCountedUrlSet)
@@ -373,21 +395,36 @@ func NewServer(opts *Options) (*Server, error) {
 	s.shutdownComplete = make(chan struct{})
 
 	// Check for configured account resolvers.
-	if err := s.configureResolver(); err != nil {
+	// No resolver store handler can be set yet, so the preloads stored
+	// here are not reported.
+	if _, err := s.configureResolver(); err != nil {
 		return nil, err
 	}
-	// If there is an URL account resolver, do basic test to see if anyone is home.
-	if ar := opts.AccountResolver; ar != nil {
-		if ur, ok := ar.(*URLAccResolver); ok {
-			if _, err := ur.Fetch(""); err != nil {
-				return nil, err
-			}
+	// If there is an URL or UNIX account resolver, do basic test to see if anyone is home.
+	switch ar := opts.AccountResolver.(type) {
+	case *URLAccResolver:
+		if _, err := ar.Fetch(""); err != nil {
+			return nil, err
+		}
+	case *UnixAccResolver:
+		if _, err := ar.Fetch(""); err != nil {
+			return nil, err
+		}
+	}
+	// Load the system account from file, if configured, so that it does not
+	// have to be fetched first.
+	if opts.SystemAccountJWT != _EMPTY_ {
+		s.mu.Unlock()
+		err := s.loadSystemAccountJWT(opts.SystemAccountJWT)
+		s.mu.Lock()
+		if err != nil {
+			return nil, fmt.Errorf("system account jwt error: %v", err)
 		}
 	}
 	// For other resolver:
 	// In operator mode, when the account resolver depends on an external system and
 	// the system account can't fetched, inject a temporary one.
-	if ar := s.accResolver; len(opts.TrustedOperators) == 1 && ar != nil &&
+	if ar := s.accResolver; len(opts.TrustedOperators) == 1 && ar != nil && opts.SystemAccountJWT == _EMPTY_ &&
 		opts.SystemAccount != _EMPTY_ && opts.SystemAccount != DEFAULT_SYSTEM_ACCOUNT {
 		if _, ok := ar.(*MemAccResolver); !ok {
 			s.mu.Unlock()
@@ -548,6 +585,15 @@ func validateOptions(o *Options) error {
 	if err := validateClusterName(o); err != nil {
 		return err
 	}
+	if err := validateAccountUpdateSubjects(o); err != nil {
+		return err
+	}
+	if err := validateNonceLength(o); err != nil {
+		return err
+	}
+	if err := validateAuthErrorTemplate(o); err != nil {
+		return err
+	}
 	// Finally check websocket options.
 	return validateWebsocketOptions(o)
 }
@@ -668,10 +714,19 @@ func (s *Server) configureAccounts() error {
 }
 
 // Setup the account resolver. For memory resolver, make sure the JWTs are
-// properly formed but do not enforce expiration etc.
-func (s *Server) configureResolver() error {
+// properly formed but do not enforce expiration etc. Returns the preloaded
+// JWTs that were stored, so that they can be reported to the resolver store
+// handler once the server lock is released.
+// Lock should be held.
+func (s *Server) configureResolver() (map[string]string, error) {
+	var stored map[string]string
 	opts := s.getOpts()
 	s.accResolver = opts.AccountResolver
+	// The resolver may have changed, so forget about failed lookups.
+	s.accNegCache.Range(func(k, _ interface{}) bool {
+		s.accNegCache.Delete(k)
+		return true
+	})
 	if opts.AccountResolver != nil {
 		// For URL resolver, set the TLSConfig if specified.
 		if opts.AccountResolverTLSConfig != nil {
@@ -682,20 +737,41 @@ func (s *Server) configureResolver() error {
 				}
 			}
 		}
+		// For URL and UNIX resolvers, set the headers attached to every fetch.
+		switch ar := opts.AccountResolver.(type) {
+		case *URLAccResolver:
+			ar.setHeaders(opts.AccountResolverHeaders)
+		case *UnixAccResolver:
+			ar.setHeaders(opts.AccountResolverHeaders)
+		default:
+			if len(opts.AccountResolverHeaders) > 0 {
+				return nil, fmt.Errorf("resolver headers only available for resolver types URL and UNIX")
+			}
+		}
+		if opts.ResolverPreloadDir != _EMPTY_ {
+			if _, ok := s.accResolver.(*MemAccResolver); !ok {
+				return nil, fmt.Errorf("resolver preload directory only available for resolver type MEM")
+			}
+		}
 		if len(opts.resolverPreloads) > 0 {
 			if s.accResolver.IsReadOnly() {
-				return fmt.Errorf("resolver preloads only available for writeable resolver types MEM/DIR/CACHE_DIR")
+				return nil, fmt.Errorf("resolver preloads only available for writeable resolver types MEM/DIR/CACHE_DIR")
 			}
 			for k, v := range opts.resolverPreloads {
 				_, err := jwt.DecodeAccountClaims(v)
 				if err != nil {
-					return fmt.Errorf("preload account error for %q: %v", k, err)
+					return nil, fmt.Errorf("preload account error for %q: %v", k, err)
+				}
+				if err := s.accResolver.Store(k, v); err == nil {
+					if stored == nil {
+						stored = make(map[string]string)
+					}
+					stored[k] = v
 				}
-				s.accResolver.Store(k, v)
 			}
 		}
 	}
-	return nil
+	return stored, nil
 }
 
 // This will check preloads for validation issues.
@@ -720,6 +796,60 @@ func (s *Server) checkResolvePreloads() {
 	}
 }
 
+// This will store all valid account JWTs found in the preload directory with
+// the memory resolver. Invalid files are logged and skipped.
+func (s *Server) loadResolverPreloadDir() {
+	opts := s.getOpts()
+	// As with checkResolvePreloads, only use the read-only opts here since
+	// the server lock may be held.
+	mr, ok := opts.AccountResolver.(*MemAccResolver)
+	if !ok || opts.ResolverPreloadDir == _EMPTY_ {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(opts.ResolverPreloadDir, "*.jwt"))
+	if err != nil {
+		s.Errorf("Error reading resolver preload directory %q: %v", opts.ResolverPreloadDir, err)
+		return
+	}
+	loaded := 0
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			s.Errorf("Preloaded account file %q could not be read: %v", file, err)
+			continue
+		}
+		theJWT := strings.TrimSpace(string(contents))
+		claims, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil {
+			s.Errorf("Preloaded account file %q not valid: %v", file, err)
+			continue
+		}
+		trusted := false
+		for _, tk := range opts.TrustedKeys {
+			if tk == claims.Issuer {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			s.Errorf("Preloaded account file %q has untrusted issuer %q", file, claims.Issuer)
+			continue
+		}
+		vr := jwt.CreateValidationResults()
+		claims.Validate(vr)
+		if vr.IsBlocking(true) {
+			s.Errorf("Preloaded account file %q has validation issues:", file)
+			for _, v := range vr.Issues {
+				s.Errorf("  - %s", v.Description)
+			}
+			continue
+		}
+		mr.Store(claims.Subject, theJWT)
+		loaded++
+	}
+	s.Noticef("Preloaded %d account(s) from %q", loaded, opts.ResolverPreloadDir)
+}
+
 func (s *Server) generateRouteInfoJSON() {
 	b, _ := json.Marshal(s.routeInfo)
 	pcs := [][]byte{[]byte("INFO"), b, []byte(CR_LF)}
@@ -772,6 +902,19 @@ func (s *Server) isTrustedIssuer(issuer string) bool {
 	return false
 }
 
+// TrustedKeys returns a copy of the operator public keys, including their
+// signing keys, that the server currently trusts as issuers.
+func (s *Server) TrustedKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.trustedKeys) == 0 {
+		return nil
+	}
+	keys := make([]string, len(s.trustedKeys))
+	copy(keys, s.trustedKeys)
+	return keys
+}
+
 // processTrustedKeys will process binary stamped and
 // options-based trusted nkeys. Returns success.
 func (s *Server) processTrustedKeys() bool {
@@ -949,8 +1092,10 @@ func (s *Server) SetSystemAccount(accName string) error {
 	if err != nil {
 		return err
 	}
-	acc := s.buildInternalAccount(ac)
-	acc.claimJWT = jwt
+	acc, err := s.buildInternalAccount(ac, jwt)
+	if err != nil {
+		return err
+	}
 	// Due to race, we need to make sure that we are not
 	// registering twice.
 	if racc := s.registerAccount(acc); racc != nil {
@@ -1159,21 +1304,113 @@ func (s *Server) registerAccountNoLock(acc *Account) *Account {
 	acc.srv = s
 	acc.updated = time.Now()
 	acc.mu.Unlock()
+	atomic.StoreInt64(&acc.used, acc.updated.UnixNano())
+	if s.opts != nil && s.opts.MaxAccounts > 0 {
+		s.makeRoomForAccount(acc.Name, s.opts.MaxAccounts)
+	}
 	s.accounts.Store(acc.Name, acc)
 	s.tmpAccounts.Delete(acc.Name)
 	s.enableAccountTracking(acc)
 	return nil
 }
 
+// makeRoomForAccount evicts the least recently used idle accounts until
+// there is room for one more below max. Accounts with connections or
+// JetStream enabled are not idle, and the global, system and configured
+// accounts are never evicted. Neither are accounts imported from, since
+// the imports would be left bound to an account that is no longer known.
+// Lock should be held on entry.
+func (s *Server) makeRoomForAccount(name string, max int) {
+	for {
+		var lru *Account
+		var lruUsed int64
+		count := 0
+		imported := s.importedAccounts()
+		s.accounts.Range(func(_, v interface{}) bool {
+			count++
+			acc := v.(*Account)
+			if _, ok := imported[acc.Name]; ok || s.isPinnedAccount(acc) {
+				return true
+			}
+			acc.mu.RLock()
+			idle := len(acc.clients) == 0 && acc.js == nil
+			acc.mu.RUnlock()
+			if used := atomic.LoadInt64(&acc.used); idle && (lru == nil || used < lruUsed) {
+				lru, lruUsed = acc, used
+			}
+			return true
+		})
+		if count < max {
+			return
+		}
+		if lru == nil {
+			s.Warnf("Maximum of %d accounts reached, no idle account to evict for [%s]", max, name)
+			return
+		}
+		s.accounts.Delete(lru.Name)
+		// Stop its timers, which would otherwise act on an unknown account.
+		lru.clearEventing()
+		s.Debugf("Evicted idle account [%s] to make room for [%s]", lru.Name, name)
+	}
+}
+
+// importedAccounts returns the names of the accounts that the loaded accounts
+// import from.
+func (s *Server) importedAccounts() map[string]struct{} {
+	imported := make(map[string]struct{})
+	s.accounts.Range(func(_, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		for _, im := range acc.imports.streams {
+			if im.acc != nil && im.acc != acc {
+				imported[im.acc.Name] = struct{}{}
+			}
+		}
+		for _, si := range acc.imports.services {
+			if si.acc != nil && si.acc != acc {
+				imported[si.acc.Name] = struct{}{}
+			}
+		}
+		acc.mu.RUnlock()
+		return true
+	})
+	return imported
+}
+
+// isPinnedAccount returns true if the account can not be evicted.
+// Lock should be held on entry.
+func (s *Server) isPinnedAccount(acc *Account) bool {
+	if acc == s.gacc || (s.sys != nil && acc == s.sys.account) || acc.Name == DEFAULT_SYSTEM_ACCOUNT {
+		return true
+	}
+	for _, a := range s.opts.Accounts {
+		if a.Name == acc.Name {
+			return true
+		}
+	}
+	return false
+}
+
 // lookupAccount is a function to return the account structure
 // associated with an account name.
 // Lock MUST NOT be held upon entry.
 func (s *Server) lookupAccount(name string) (*Account, error) {
+	return s.lookupAccountWithImports(name, true)
+}
+
+// lookupAccountWithImports is like lookupAccount. If resolveImports is false,
+// an account that needs to be fetched is registered without resolving its
+// imports, these are resolved when the account is first looked up with
+// resolveImports set. Exporters are looked up this way while resolving
+// imports, so that loading an account fetches its direct exporters only.
+// Lock MUST NOT be held upon entry.
+func (s *Server) lookupAccountWithImports(name string, resolveImports bool) (*Account, error) {
 	var acc *Account
 	if v, ok := s.accounts.Load(name); ok {
 		acc = v.(*Account)
 	}
 	if acc != nil {
+		atomic.StoreInt64(&acc.used, time.Now().UnixNano())
 		// If we are expired and we have a resolver, then
 		// return the latest information from the resolver.
 		if acc.IsExpired() {
@@ -1187,13 +1424,36 @@ func (s *Server) lookupAccount(name string) (*Account, error) {
 				return nil, ErrAccountExpired
 			}
 		}
+		if resolveImports {
+			s.resolveDeferredImports(acc)
+		}
 		return acc, nil
 	}
 	// If we have a resolver see if it can fetch the account.
 	if s.AccountResolver() == nil {
 		return nil, ErrMissingAccount
 	}
-	return s.fetchAccount(name)
+	return s.fetchAccountWithImports(name, resolveImports)
+}
+
+// resolveDeferredImports applies the claims of an account registered
+// without resolving its imports, now including those.
+// Lock MUST NOT be held upon entry.
+func (s *Server) resolveDeferredImports(acc *Account) {
+	acc.mu.Lock()
+	if !acc.deferred {
+		acc.mu.Unlock()
+		return
+	}
+	acc.deferred = false
+	claimJWT := acc.claimJWT
+	acc.mu.Unlock()
+	s.Debugf("Resolving deferred imports of account [%s]", acc.Name)
+	if accClaims, _, err := s.verifyAccountClaims(claimJWT); err != nil {
+		s.Errorf("Error resolving deferred imports of account [%s]: %v", acc.Name, err)
+	} else if err := s.updateAccountClaimsWithRefresh(acc, accClaims, false); err != nil {
+		s.Errorf("Error resolving deferred imports of account [%s]: %v", acc.Name, err)
+	}
 }
 
 // LookupAccount is a public function to return the account structure
@@ -1205,8 +1465,7 @@ func (s *Server) LookupAccount(name string) (*Account, error) {
 // This will fetch new claims and if found update the account with new claims.
 // Lock MUST NOT be held upon entry.
 func (s *Server) updateAccount(acc *Account) error {
-	// TODO(dlc) - Make configurable
-	if !acc.incomplete && time.Since(acc.updated) < time.Second {
+	if min := s.getOpts().AccountUpdateMinInterval; min > 0 && !acc.incomplete && time.Since(acc.updated) < min {
 		s.Debugf("Requested account update for [%s] ignored, too soon", acc.Name)
 		return ErrAccountResolverUpdateTooSoon
 	}
@@ -1228,6 +1487,10 @@ func (s *Server) updateAccountWithClaimJWT(acc *Account, claimJWT string) error
 		return ErrAccountResolverSameClaims
 	}
 	accClaims, _, err := s.verifyAccountClaims(claimJWT)
+	if err == nil && accClaims != nil && accClaims.Subject != acc.Name {
+		s.Warnf("Account [%s] update rejected, JWT is for account %q", acc.Name, accClaims.Subject)
+		return ErrAccountClaimsSubjectMismatch
+	}
 	if err == nil && accClaims != nil {
 		acc.mu.Lock()
 		if acc.Issuer == "" {
@@ -1236,30 +1499,123 @@ func (s *Server) updateAccountWithClaimJWT(acc *Account, claimJWT string) error
 			acc.mu.Unlock()
 			return ErrAccountValidation
 		}
+		// Updates scheduled for later are held back, the current claims
+		// stay in effect until then. Without claims in place there is
+		// nothing to keep, so those are rejected until then. Incomplete
+		// claims are replaced right away.
+		if applyAt := claimsApplyAt(claimJWT, accClaims.ID); !applyAt.IsZero() {
+			if acc.claimJWT == _EMPTY_ {
+				acc.mu.Unlock()
+				s.Debugf("Account update for [%s] rejected, claims only apply at %v", acc.Name, applyAt)
+				return ErrAccountClaimsNotApplied
+			} else if !acc.incomplete {
+				acc.schedulePendingClaims(s, claimJWT, time.Until(applyAt))
+				acc.mu.Unlock()
+				s.Debugf("Account update for [%s] scheduled for %v", acc.Name, applyAt)
+				return nil
+			}
+		}
+		// Any pending update is superseded by this one.
+		clearTimer(&acc.atmr)
+		acc.pendingJWT = _EMPTY_
+		prevJWT := acc.claimJWT
 		acc.claimJWT = claimJWT
 		acc.mu.Unlock()
-		s.UpdateAccountClaims(acc, accClaims)
+		if err := s.updateAccountClaimsWithRefresh(acc, accClaims, true); err != nil {
+			// The claims were rejected, keep the ones currently applied.
+			acc.mu.Lock()
+			acc.claimJWT = prevJWT
+			acc.mu.Unlock()
+			return err
+		}
 		return nil
 	}
 	return err
 }
 
+// FetchAccountJWT returns the account JWT for pub exactly as served by the
+// account resolver. Unlike LookupAccount, the account is not loaded or
+// updated as a result.
+func (s *Server) FetchAccountJWT(pub string) (string, error) {
+	return s.fetchRawAccountClaims(pub)
+}
+
 // fetchRawAccountClaims will grab raw account claims iff we have a resolver.
 // Lock is NOT held upon entry.
 func (s *Server) fetchRawAccountClaims(name string) (string, error) {
+	// Share the result of a fetch of the same account already in flight.
+	s.accFetchMu.Lock()
+	if call, ok := s.accFetches[name]; ok {
+		s.accFetchMu.Unlock()
+		call.wg.Wait()
+		return call.claimJWT, call.err
+	}
+	call := &accFetchCall{}
+	call.wg.Add(1)
+	if s.accFetches == nil {
+		s.accFetches = make(map[string]*accFetchCall)
+	}
+	s.accFetches[name] = call
+	s.accFetchMu.Unlock()
+
+	call.claimJWT, call.err = s.resolverFetch(name)
+
+	s.accFetchMu.Lock()
+	delete(s.accFetches, name)
+	s.accFetchMu.Unlock()
+	call.wg.Done()
+	return call.claimJWT, call.err
+}
+
+// accFetchCall is a resolver fetch in flight, waited on by any concurrent
+// fetch of the same account.
+type accFetchCall struct {
+	wg       sync.WaitGroup
+	claimJWT string
+	err      error
+}
+
+// resolverFetch does the actual fetch of the account's claims from the resolver.
+func (s *Server) resolverFetch(name string) (string, error) {
 	accResolver := s.AccountResolver()
 	if accResolver == nil {
 		return "", ErrNoAccountResolver
 	}
+	// Wait for a slot if the number of fetches in flight is bounded.
+	if sem := s.accFetchSem; sem != nil {
+		tmr := time.NewTimer(fetchTimeout)
+		select {
+		case sem <- struct{}{}:
+			tmr.Stop()
+		case <-tmr.C:
+			s.Warnf("Account [%s] fetch not attempted, too many fetches in flight", name)
+			return "", ErrTooManyResolverFetches
+		}
+		defer func() { <-sem }()
+	}
 	// Need to do actual Fetch
+	var claimJWT, origin string
+	var err error
 	start := time.Now()
-	claimJWT, err := accResolver.Fetch(name)
+	trace := s.getOpts().TraceResolverFetches
+	if fr, ok := accResolver.(fetchOriginResolver); ok && trace {
+		claimJWT, origin, err = fr.fetchWithOrigin(name)
+	} else {
+		claimJWT, err = accResolver.Fetch(name)
+	}
 	fetchTime := time.Since(start)
 	if fetchTime > time.Second {
 		s.Warnf("Account [%s] fetch took %v", name, fetchTime)
-	} else {
+	} else if !trace {
 		s.Debugf("Account [%s] fetch took %v", name, fetchTime)
 	}
+	if trace {
+		if origin == _EMPTY_ {
+			origin = "n/a"
+		}
+		s.Debugf("Account [%s] fetch from %s resolver (%s) took %v",
+			name, accResolverType(accResolver), origin, fetchTime)
+	}
 	if err != nil {
 		s.Warnf("Account fetch failed: %v", err)
 		return "", err
@@ -1274,39 +1630,193 @@ func (s *Server) fetchAccountClaims(name string) (*jwt.AccountClaims, string, er
 	if err != nil {
 		return nil, _EMPTY_, err
 	}
-	return s.verifyAccountClaims(claimJWT)
+	accClaims, claimJWT, err := s.verifyAccountClaims(claimJWT)
+	if err != nil {
+		return nil, _EMPTY_, err
+	}
+	// A resolver, or a cache in front of it, may hand out the JWT of another
+	// account. Never load it under the requested name.
+	if accClaims.Subject != name {
+		s.Warnf("Account [%s] fetch returned a JWT for account %q, rejecting", name, accClaims.Subject)
+		return nil, _EMPTY_, ErrAccountClaimsSubjectMismatch
+	}
+	return accClaims, claimJWT, nil
+}
+
+// fetchAppliedAccountClaims returns the account claims kept by the resolver
+// while the ones it has stored only apply later, nil if there are none.
+func (s *Server) fetchAppliedAccountClaims(name string) (*jwt.AccountClaims, string) {
+	ar, ok := s.AccountResolver().(appliedClaimsResolver)
+	if !ok {
+		return nil, _EMPTY_
+	}
+	claimJWT, err := ar.fetchApplied(name)
+	if err != nil {
+		return nil, _EMPTY_
+	}
+	accClaims, claimJWT, err := s.verifyAccountClaims(claimJWT)
+	if err != nil || accClaims.Subject != name {
+		return nil, _EMPTY_
+	}
+	return accClaims, claimJWT
 }
 
 // verifyAccountClaims will decode and validate any account claims.
 func (s *Server) verifyAccountClaims(claimJWT string) (*jwt.AccountClaims, string, error) {
-	accClaims, err := jwt.DecodeAccountClaims(claimJWT)
+	accClaims, err := s.decodeAccountClaims(claimJWT)
 	if err != nil {
 		return nil, _EMPTY_, err
 	}
 	if !s.isTrustedIssuer(accClaims.Issuer) {
 		return nil, _EMPTY_, ErrAccountValidation
 	}
+	// Duplicate exports fail validation too, but with a less helpful error.
+	if err := checkDuplicateExports(accClaims); err != nil {
+		s.Warnf("Account %q rejected: %v", accClaims.Subject, err)
+		return nil, _EMPTY_, err
+	}
 	vr := jwt.CreateValidationResults()
 	accClaims.Validate(vr)
 	if vr.IsBlocking(true) {
 		return nil, _EMPTY_, ErrAccountValidation
 	}
+	if s.getOpts().RejectUnknownClaimFields {
+		if unknown := unknownClaimFields(claimJWT, accountClaimFields); len(unknown) > 0 {
+			s.Warnf("Account %q rejected, unknown claim fields %v", accClaims.Subject, unknown)
+			return nil, _EMPTY_, ErrClaimsUnknownFields
+		}
+	}
+	if opts := s.getOpts(); opts.RequireJetStreamLimits && accClaims.Subject != opts.SystemAccount &&
+		!declaresJetStreamLimits(claimJWT, accClaims.ID) {
+		s.Warnf("Account %q rejected, JetStream limits are required but not declared", accClaims.Subject)
+		return nil, _EMPTY_, ErrAccountJetStreamLimitsRequired
+	}
+	s.Debugf("Account %q validated by %s %q", accClaims.Subject, s.trustedKeyKind(accClaims.Issuer), accClaims.Issuer)
 	return accClaims, claimJWT, nil
 }
 
+// trustedKeyKind describes which kind of trusted key the issuer is, which is
+// useful when tracing operator signing key rotations.
+func (s *Server) trustedKeyKind(issuer string) string {
+	for _, opc := range s.getOpts().TrustedOperators {
+		if opc.Subject == issuer {
+			return "operator key"
+		}
+		if opc.SigningKeys.Contains(issuer) {
+			return "operator signing key"
+		}
+	}
+	return "trusted key"
+}
+
+// isNegativelyCached returns true if a lookup of the named account failed
+// recently and should not be retried yet.
+func (s *Server) isNegativelyCached(name string) bool {
+	v, ok := s.accNegCache.Load(name)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(v.(time.Time)) {
+		return true
+	}
+	s.accNegCache.Delete(name)
+	return false
+}
+
+// cacheNegativeLookup remembers that the named account was not found.
+// Other fetch errors may be transient and are not cached.
+func (s *Server) cacheNegativeLookup(name string, err error) {
+	if _, ok := err.(*accountNotFoundErr); !ok {
+		return
+	}
+	if ttl := s.getOpts().ResolverNegativeCacheTTL; ttl > 0 {
+		s.accNegCache.Store(name, time.Now().Add(ttl))
+	}
+}
+
+// clearNegativeLookup is invoked when claims for the named account are
+// stored or pushed, so that the next lookup goes to the resolver again.
+func (s *Server) clearNegativeLookup(name string) {
+	s.accNegCache.Delete(name)
+}
+
+// negativeLookups returns the accounts that are negatively cached, sorted by
+// name. If clear is true, they are removed from the cache.
+func (s *Server) negativeLookups(clear bool) []NegativeCacheEntry {
+	now := time.Now()
+	entries := []NegativeCacheEntry{}
+	s.accNegCache.Range(func(k, v interface{}) bool {
+		if clear || !now.Before(v.(time.Time)) {
+			s.accNegCache.Delete(k)
+		}
+		if now.Before(v.(time.Time)) {
+			entries = append(entries, NegativeCacheEntry{Account: k.(string), Expires: v.(time.Time).UTC()})
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Account < entries[j].Account })
+	return entries
+}
+
 // This will fetch an account from a resolver if defined.
 // Lock is NOT held upon entry.
 func (s *Server) fetchAccount(name string) (*Account, error) {
+	return s.fetchAccountWithImports(name, true)
+}
+
+// fetchAccountWithImports is like fetchAccount. If resolveImports is false the
+// account is registered without its imports, see lookupAccountWithImports.
+// Lock MUST NOT be held upon entry.
+func (s *Server) fetchAccountWithImports(name string, resolveImports bool) (*Account, error) {
+	if s.isNegativelyCached(name) {
+		s.Debugf("Account [%s] lookup failed recently, not fetching", name)
+		return nil, ErrMissingAccount
+	}
 	accClaims, claimJWT, err := s.fetchAccountClaims(name)
 	if accClaims == nil {
+		s.cacheNegativeLookup(name, err)
 		return nil, err
 	}
-	acc := s.buildInternalAccount(accClaims)
-	acc.claimJWT = claimJWT
+	// Claims that apply later are loaded with the claims in effect until
+	// then, as kept by the resolver. Without those the account is not
+	// loaded before then.
+	appliedClaims, appliedJWT := accClaims, claimJWT
+	applyAt := claimsApplyAt(claimJWT, accClaims.ID)
+	if !applyAt.IsZero() {
+		if appliedClaims, appliedJWT = s.fetchAppliedAccountClaims(name); appliedClaims == nil {
+			s.Debugf("Account [%s] not loaded, its claims only apply at %v", name, applyAt)
+			return nil, ErrAccountClaimsNotApplied
+		}
+	}
+	buildClaims := appliedClaims
+	if !resolveImports && len(appliedClaims.Imports) > 0 {
+		deferred := *appliedClaims
+		deferred.Imports = nil
+		buildClaims = &deferred
+	}
+	acc, err := s.buildInternalAccount(buildClaims, appliedJWT)
+	if err != nil {
+		return nil, err
+	}
+	if buildClaims != appliedClaims || !applyAt.IsZero() {
+		acc.mu.Lock()
+		if buildClaims != appliedClaims {
+			// Still incomplete, so the same claims are applied again later.
+			acc.deferred = true
+			acc.incomplete = true
+		}
+		if !applyAt.IsZero() {
+			acc.schedulePendingClaims(s, claimJWT, time.Until(applyAt))
+		}
+		acc.mu.Unlock()
+	}
 	// Due to possible race, if registerAccount() returns a non
 	// nil account, it means the same account was already
 	// registered and we should use this one.
 	if racc := s.registerAccount(acc); racc != nil {
+		if !resolveImports {
+			return racc, nil
+		}
 		// Update with the new claims in case they are new.
 		// Following call will ignore ErrAccountResolverSameClaims
 		// if claims are the same.
@@ -1317,15 +1827,55 @@ func (s *Server) fetchAccount(name string) (*Account, error) {
 		return racc, nil
 	}
 	// The sub imports may have been setup but will not have had their
-	// subscriptions properly setup. Do that here.
-	if len(acc.imports.services) > 0 && acc.ic == nil {
-		acc.ic = s.createInternalAccountClient()
-		acc.ic.acc = acc
+	// subscriptions properly setup. Do that here. The internal client may
+	// already exist, e.g. for jetstream imports added once the account
+	// was bound to this server, so do not skip the others in that case.
+	if len(acc.imports.services) > 0 {
+		if acc.ic == nil {
+			acc.ic = s.createInternalAccountClient()
+			acc.ic.acc = acc
+		}
 		acc.addAllServiceImportSubs()
 	}
 	return acc, nil
 }
 
+// loadSystemAccountJWT registers the system account from the JWT in file.
+// The JWT is also stored with account resolvers that can be written to.
+// Lock MUST NOT be held upon entry.
+func (s *Server) loadSystemAccountJWT(file string) error {
+	sys := s.getOpts().SystemAccount
+	if sys == _EMPTY_ {
+		return fmt.Errorf("system account not configured")
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	claimJWT, err := jwt.ParseDecoratedJWT(contents)
+	if err != nil {
+		return err
+	}
+	accClaims, _, err := s.verifyAccountClaims(claimJWT)
+	if err != nil {
+		return err
+	}
+	if accClaims.Subject != sys {
+		return fmt.Errorf("jwt is for account %q, not the system account %q", accClaims.Subject, sys)
+	}
+	if ar := s.AccountResolver(); ar != nil && !ar.IsReadOnly() {
+		if err := ar.Store(sys, claimJWT); err != nil {
+			return err
+		}
+	}
+	acc, err := s.buildInternalAccount(accClaims, claimJWT)
+	if err != nil {
+		return err
+	}
+	s.registerAccount(acc)
+	return nil
+}
+
 // Start up the server, this will block.
 // Start via a Go routine if needed.
 func (s *Server) Start() {
@@ -1365,6 +1915,9 @@ func (s *Server) Start() {
 		s.Noticef("  Operator: %q", opc.Name)
 		s.Noticef("  Issued  : %v", time.Unix(opc.IssuedAt, 0))
 		s.Noticef("  Expires : %v", time.Unix(opc.Expires, 0))
+		if operatorExpired(opc) {
+			s.Warnf("Operator %q JWT has EXPIRED, its keys are still trusted", opc.Name)
+		}
 	}
 	if hasOperators && opts.SystemAccount == _EMPTY_ {
 		s.Warnf("Trusted Operators should utilize a System Account")
@@ -1375,6 +1928,9 @@ func (s *Server) Start() {
 	if hasOperators && len(opts.resolverPreloads) > 0 {
 		s.checkResolvePreloads()
 	}
+	if hasOperators {
+		s.loadResolverPreloadDir()
+	}
 
 	// Log the pid to a file
 	if opts.PidFile != _EMPTY_ {
@@ -1431,6 +1987,16 @@ func (s *Server) Start() {
 		}
 	}
 
+	// Reclaim idle service imports, if configured.
+	if opts.ServiceImportIdleTimeout > 0 {
+		s.startServiceImportReclaimer(opts.ServiceImportIdleTimeout)
+	}
+
+	// Poll the external revocation list, if configured.
+	if opts.RevocationsURL != _EMPTY_ {
+		s.startRevocationsPoller(opts.RevocationsURL, opts.RevocationsPollInterval)
+	}
+
 	// Start expiration of mapped GW replies, regardless if
 	// this server is configured with gateway or not.
 	s.startGWReplyMapExpiration()
@@ -2073,6 +2639,17 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	// When behind a proxy, get the address of the actual client first.
+	if ws == nil && opts.ProxyProtocol {
+		pconn, err := readProxyProtoHeader(conn)
+		if err != nil {
+			s.Debugf("Error reading proxy protocol header from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		conn = pconn
+	}
+
 	maxPay := int32(opts.MaxPayload)
 	maxSubs := int32(opts.MaxSubs)
 	// For system, maxSubs of 0 means unlimited, so re-adjust here.
@@ -2096,8 +2673,7 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	}
 	if s.nonceRequired() {
 		// Nonce handling
-		var raw [nonceLen]byte
-		nonce := raw[:]
+		nonce := make([]byte, s.nonceLen())
 		s.generateNonce(nonce)
 		info.Nonce = string(nonce)
 	}
@@ -2274,6 +2850,9 @@ func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 	cc.fill(c, nc, now)
 	cc.Stop = &now
 	cc.Reason = reason.String()
+	if c.authErr != nil {
+		cc.AuthError = c.authErr.Error()
+	}
 
 	// Do subs, do not place by default in main ConnInfo
 	if len(c.subs) > 0 {
@@ -2522,6 +3101,18 @@ func (s *Server) NumSlowConsumers() int64 {
 	return atomic.LoadInt64(&s.slowConsumers)
 }
 
+// NumAuthTimers will report the number of client auth and JWT expiration
+// timers currently set.
+func (s *Server) NumAuthTimers() int64 {
+	return atomic.LoadInt64(&s.authTimers)
+}
+
+// NumAuthExpirations will report the number of clients disconnected because
+// their user or account authentication expired.
+func (s *Server) NumAuthExpirations() int64 {
+	return atomic.LoadInt64(&s.authExpirations)
+}
+
 // ConfigTime will report the last time the server configuration was loaded.
 func (s *Server) ConfigTime() time.Time {
 	s.mu.Lock()
@@ -462,7 +462,8 @@ func (c *client) wsEnqueueCloseMessage(reason ClosedState) {
 		status = wsCloseStatusNormalClosure
 	case AuthenticationTimeout, AuthenticationViolation, SlowConsumerPendingBytes, SlowConsumerWriteDeadline,
 		MaxAccountConnectionsExceeded, MaxConnectionsExceeded, MaxControlLineExceeded, MaxSubscriptionsExceeded,
-		MissingAccount, AuthenticationExpired, Revocation:
+		MissingAccount, AuthenticationExpired, Revocation, MaxUserConnectionsExceeded,
+		AccountAuthenticationExpired, AccountRequiresTLS:
 		status = wsCloseStatusPolicyViolation
 	case TLSHandshakeError:
 		status = wsCloseStatusTLSHandshake
@@ -470,7 +471,7 @@ func (c *client) wsEnqueueCloseMessage(reason ClosedState) {
 		status = wsCloseStatusProtocolError
 	case MaxPayloadExceeded:
 		status = wsCloseStatusMessageTooBig
-	case ServerShutdown:
+	case ServerShutdown, AccountDrained, Kicked, AccountInMaintenance:
 		status = wsCloseStatusGoingAway
 	case WriteError, ReadError, StaleConnection:
 		status = wsCloseStatusAbnormalClosure
@@ -37,6 +37,7 @@ import (
 	"time"
 
 	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
 
@@ -884,6 +885,7 @@ func TestWSEnqueueCloseMsg(t *testing.T) {
 		{MissingAccount, wsCloseStatusPolicyViolation},
 		{AuthenticationExpired, wsCloseStatusPolicyViolation},
 		{Revocation, wsCloseStatusPolicyViolation},
+		{AccountAuthenticationExpired, wsCloseStatusPolicyViolation},
 		{TLSHandshakeError, wsCloseStatusTLSHandshake},
 		{ParseError, wsCloseStatusProtocolError},
 		{ProtocolViolation, wsCloseStatusProtocolError},
@@ -3922,3 +3924,125 @@ func Benchmark_WS_Subx5_CY_32768b(b *testing.B) {
 	s := sizedStringForCompression(32768)
 	wsBenchSub(b, 5, true, s)
 }
+
+func TestWSJWTExpirationExemptConnectionTypes(t *testing.T) {
+	o := testWSOptions()
+	setupAddTrusted(o)
+	o.AuthExpirationExemptConnectionTypes = testCreateAllowedConnectionTypes([]string{jwt.ConnectionTypeWebsocket})
+	s := RunServer(o)
+	buildMemAccResolver(s)
+	defer s.Shutdown()
+
+	expires := time.Now().Add(2 * time.Second).Unix()
+	nuc := newJWTTestUserClaims()
+	nuc.Expires = expires
+	akp, wsc, wsr, _ := testWSWithClaims(t, s, testWSClientOptions{host: o.Websocket.Host, port: o.Websocket.Port},
+		testClaimsOptions{nuc: nuc, expectAnswer: "+OK"})
+	defer wsc.Close()
+
+	// A standard client with the same expiration is still disconnected.
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	uc := jwt.NewUserClaims(upub)
+	uc.Expires = expires
+	ujwt, err := uc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+	closed := make(chan struct{}, 1)
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", o.Host, o.Port),
+		nats.UserJWT(func() (string, error) { return ujwt, nil }, func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }),
+		nats.NoReconnect(), nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+	defer nc.Close()
+	select {
+	case <-closed:
+	case <-time.After(4 * time.Second):
+		t.Fatal("Expected standard client to be disconnected on expiration")
+	}
+
+	// The websocket client is exempt and still connected.
+	wsc.Write(testWSCreateClientMsg(wsBinaryMessage, 1, true, false, []byte("PING\r\n")))
+	if msg := testWSReadFrame(t, wsr); !bytes.HasPrefix(msg, []byte("PONG\r\n")) {
+		t.Fatalf("Expected PONG, got %s", msg)
+	}
+}
+
+func TestWSJWTAccountConnectionTypeLimits(t *testing.T) {
+	o := testWSOptions()
+	setupAddTrusted(o)
+	s := RunServer(o)
+	buildMemAccResolver(s)
+	defer s.Shutdown()
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.Limits.Conn = 10
+	ajwt := encodeClaimsWithExt(t, nac, okp, map[string]interface{}{
+		"conn_type_limits": map[string]int64{
+			jwt.ConnectionTypeWebsocket: 1,
+			jwt.ConnectionTypeLeafnode:  0,
+		},
+	})
+	addAccountToMemResolver(s, apub, ajwt)
+
+	wsConnect := func(expected string) net.Conn {
+		t.Helper()
+		nkp, _ := nkeys.CreateUser()
+		upub, _ := nkp.PublicKey()
+		ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		c, cr, l := testNewWSClient(t, testWSClientOptions{host: o.Websocket.Host, port: o.Websocket.Port})
+		var info nonceInfo
+		if err := json.Unmarshal(l[5:], &info); err != nil {
+			t.Fatal(err)
+		}
+		sigraw, _ := nkp.Sign([]byte(info.Nonce))
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":\"%s\",\"verbose\":true}\r\nPING\r\n", ujwt, sig)
+		c.Write(testWSCreateClientMsg(wsBinaryMessage, 1, true, false, []byte(cs)))
+		if l := testWSReadFrame(t, cr); !strings.HasPrefix(string(l), expected) {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+		return c
+	}
+
+	ws := wsConnect("+OK")
+	defer ws.Close()
+	// The websocket cap is reached.
+	wsConnect("-ERR").Close()
+
+	// Standard connections are not affected.
+	creds := createUserCreds(t, s, akp)
+	for i := 0; i < 3; i++ {
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port), creds)
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.maxConnectionTypeReached(jwt.ConnectionTypeStandard) {
+		t.Fatalf("Standard connections should not be limited")
+	}
+	if !acc.maxConnectionTypeReached(jwt.ConnectionTypeLeafnode) {
+		t.Fatalf("Leafnode connections should be limited")
+	}
+
+	// Once the websocket connection is gone, a new one can connect.
+	ws.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if acc.maxConnectionTypeReached(jwt.ConnectionTypeWebsocket) {
+			return fmt.Errorf("websocket limit still reached")
+		}
+		return nil
+	})
+	wsConnect("+OK").Close()
+}